@@ -22,13 +22,42 @@ func main() {
 	// fmt.Println(DB)
 
 	// connection_pooling_diff.LearningConnectionPooling(router)
+	// connection_pooling_diff.CompareCustomPool(100, 5000)
+	// connection_pooling_diff.StartPoolBenchmark()
+	// connection_pooling_diff.StartAdmissionControlDemo(router)
+	// connection_pooling_diff.StartPoolMonitorDemo(router)
+	// connection_pooling_diff.StartLeakDetectionDemo()
 	// transaction_isolation_levels.StartTransactionIsolationLevels(DB)
+	// transaction_isolation_levels.StartAnomalyCatalog()
+	// transaction_isolation_levels.StartMVCCAnomalyCatalog()
+	// transaction_isolation_levels.StartIncrementHistoryCheck(DB)
+	// transaction_isolation_levels.StartBalanceStrategies(DB)
 	// transaction_deadlocks.StartTransactionDeadlock()
+	// transaction_deadlocks.StartTransferHistoryCheck(true)
+	// transaction_deadlocks.StartDeadlockDetectorDemo(lock_manager.LeastWork, false)
+	// transaction_deadlocks.StartTransferWorkload()
+	// transaction_deadlocks.StartJobQueueDemo()
 	// query_profiling.StartQueryProfiling()
 	//db_replication.StartDBReplication(router)
+	//db_replication.StartDBReplicationDrill(router, "internal/chaos/scenarios/replication-lag.json")
+	//transaction_isolation_levels.StartIsolationDrill("internal/chaos/scenarios/flaky-db.json")
+	//transaction_deadlocks.StartTransactionDeadlockDrill("internal/chaos/scenarios/flaky-db.json", false)
+	// stopRedis, _ := caching_strategies.UseInProcessRedis() // No docker needed for the caching experiments
+	// defer stopRedis()
 	//caching_strategies.StartCachingStrategies()
 	//caching_strategies.StartCachingStrategiesHandler(router)
+	//caching_strategies.StartOutboxDemo()
 	//caching_strategies.StartRedisVsInMemory(router)
+	//caching_strategies.StartLoadBalancerComparison()
+	//caching_strategies.StartAffinityDemo()
+	//caching_strategies.StartNearCacheDemo()
+	//caching_strategies.StartCodecComparison()
+	//caching_strategies.StartPenetrationDemo()
+	//caching_strategies.StartHTTPCacheDemo()
+	//caching_strategies.StartStaleWhileRevalidateDemo()
+	//caching_strategies.StartCacheWarmingDemo()
+	//caching_strategies.StartSessionRevocationDemo()
+	// caching_strategies.OutboxRelay = true
 	caching_strategies.StartCacheStampedeDemo(router)
 
 	http.ListenAndServe(":8080", router)
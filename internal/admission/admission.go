@@ -0,0 +1,320 @@
+package admission
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Admission control in front of a connection pool.
+// Without it every request gets a goroutine that sits in database/sql's wait queue, unbounded, until it gets a connection or the client gives up.
+// With it, requests beyond the pool size wait in a small queue we control - and once that's full we answer 503 straight away,
+// which is a lot cheaper than answering 200 after 30 seconds
+
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+// clamp maps anything outside the known priorities to the nearest one, the queues are indexed by it
+func (p Priority) clamp() Priority {
+	return min(max(p, PriorityLow), PriorityHigh)
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+type Config struct {
+	Pool         func() sql.DBStats // Usually DB.Stats, gives us InUse and MaxOpenConnections
+	MaxQueue     int                // Requests allowed to wait for a slot, beyond this we shed
+	QueueTimeout time.Duration      // Max time a request waits in the queue before it's shed, defaults to a second
+	RetryAfter   time.Duration      // Sent to the client with the 503
+
+	// Classify decides the priority of a request, defaults to everything being normal
+	Classify func(r *http.Request) Priority
+	// LowPriorityShare is the part of the queue low priority requests may fill, so there's always room left for the important ones
+	LowPriorityShare float64
+}
+
+type Controller struct {
+	cfg Config
+
+	mu       sync.Mutex
+	inFlight int
+	queues   [3][]*ticket // Index by priority, FIFO within each
+	metrics  Metrics
+}
+
+type ticket struct {
+	priority Priority
+	admitted chan struct{}
+}
+
+type Metrics struct {
+	InFlight      int            `json:"in_flight"`
+	QueueDepth    int            `json:"queue_depth"`
+	QueueByClass  map[string]int `json:"queue_by_class"`
+	MaxQueueDepth int            `json:"max_queue_depth"`
+	PoolInUse     int            `json:"pool_in_use"`
+	PoolMaxOpen   int            `json:"pool_max_open"`
+
+	Admitted      int           `json:"admitted"`
+	Queued        int           `json:"queued"`
+	ShedQueueFull int           `json:"shed_queue_full"`
+	ShedTimeout   int           `json:"shed_timeout"`
+	Evicted       int           `json:"evicted"` // Low priority waiters pushed out by higher priority requests
+	TotalQueued   time.Duration `json:"total_queued_ns"`
+}
+
+func New(cfg Config) *Controller {
+	if cfg.Classify == nil {
+		cfg.Classify = func(r *http.Request) Priority { return PriorityNormal }
+	}
+
+	if cfg.QueueTimeout <= 0 { // A zero timer fires straight away, every queued request would be shed
+		cfg.QueueTimeout = time.Second
+	}
+
+	if cfg.RetryAfter == 0 {
+		cfg.RetryAfter = time.Second
+	}
+
+	if cfg.LowPriorityShare == 0 {
+		cfg.LowPriorityShare = 0.5
+	}
+
+	return &Controller{cfg: cfg}
+}
+
+// Middleware for chi - r.Use(controller.Middleware) or r.With(controller.Middleware).Get(...)
+func (c *Controller) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		priority := c.cfg.Classify(r).clamp() // A classifier returning Priority(7) shouldn't take the handler down
+
+		t, admitted := c.admit(priority)
+		if !admitted {
+			if t == nil { // No room in the queue at all
+				c.shed(w)
+				return
+			}
+
+			if !c.wait(r, t) {
+				c.shed(w)
+				return
+			}
+		}
+
+		defer c.release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *Controller) Metrics() Metrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := c.metrics
+	m.InFlight = c.inFlight
+	m.QueueDepth = c.queueLen()
+	m.QueueByClass = make(map[string]int)
+	for p, q := range c.queues {
+		m.QueueByClass[Priority(p).String()] = len(q)
+	}
+
+	if c.cfg.Pool != nil {
+		stats := c.cfg.Pool()
+		m.PoolInUse = stats.InUse
+		m.PoolMaxOpen = stats.MaxOpenConnections
+	}
+
+	return m
+}
+
+func (c *Controller) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Metrics())
+}
+
+// admit either lets the request straight through, queues it (returns a ticket), or rejects it (nil ticket)
+func (c *Controller) admit(priority Priority) (*ticket, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.queueLen() == 0 && c.hasCapacity() {
+		c.inFlight++
+		c.metrics.Admitted++
+		return nil, true
+	}
+
+	if !c.queueHasRoom(priority) && !c.evictLowerThan(priority) {
+		c.metrics.ShedQueueFull++
+		return nil, false
+	}
+
+	// Buffered, so dispatch never blocks on a waiter that is busy giving up
+	t := &ticket{priority: priority, admitted: make(chan struct{}, 1)}
+	c.queues[priority] = append(c.queues[priority], t)
+	c.metrics.Queued++
+	c.metrics.MaxQueueDepth = max(c.metrics.MaxQueueDepth, c.queueLen())
+	return t, false
+}
+
+func (c *Controller) wait(r *http.Request, t *ticket) bool {
+	start := time.Now()
+	timeout := time.NewTimer(c.cfg.QueueTimeout)
+	defer timeout.Stop()
+
+	// Slots normally free up in release, but the pool can also be busy with work that doesn't go through us - poll for that
+	poll := time.NewTicker(10 * time.Millisecond)
+	defer poll.Stop()
+
+waiting:
+	for {
+		select {
+		case _, ok := <-t.admitted:
+			c.mu.Lock()
+			c.metrics.TotalQueued += time.Since(start)
+			c.mu.Unlock()
+			return ok // Closed without admission means we got evicted
+		case <-poll.C:
+			c.mu.Lock()
+			c.dispatch()
+			c.mu.Unlock()
+		case <-timeout.C:
+			break waiting
+		case <-r.Context().Done():
+			break waiting
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics.TotalQueued += time.Since(start)
+
+	if !c.removeTicket(t) {
+		// Admitted or evicted right as we gave up, if admitted the slot has to be handed on
+		select {
+		case _, ok := <-t.admitted:
+			if ok {
+				c.inFlight--
+				c.dispatch()
+			}
+		default:
+		}
+	}
+
+	c.metrics.ShedTimeout++
+	return false
+}
+
+func (c *Controller) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inFlight--
+	c.dispatch()
+}
+
+// dispatch hands free slots to waiters, highest priority first. Must be called with mu held
+func (c *Controller) dispatch() {
+	for c.hasCapacity() {
+		t := c.popHighest()
+		if t == nil {
+			return
+		}
+
+		c.inFlight++
+		c.metrics.Admitted++
+		t.admitted <- struct{}{}
+	}
+}
+
+// Must be called with mu held
+func (c *Controller) hasCapacity() bool {
+	if c.cfg.Pool == nil {
+		return true
+	}
+
+	stats := c.cfg.Pool()
+	if stats.MaxOpenConnections == 0 {
+		return true // Unlimited pool, nothing to protect
+	}
+
+	// Our own in flight count covers requests that haven't grabbed a connection yet,
+	// the pool's InUse covers everything else using the pool (background jobs etc)
+	return c.inFlight < stats.MaxOpenConnections && stats.InUse < stats.MaxOpenConnections
+}
+
+func (c *Controller) queueHasRoom(priority Priority) bool {
+	depth := c.queueLen()
+	if priority == PriorityLow {
+		return depth < int(float64(c.cfg.MaxQueue)*c.cfg.LowPriorityShare)
+	}
+
+	return depth < c.cfg.MaxQueue
+}
+
+// Make room for an important request by dropping the newest waiter of a lower class
+func (c *Controller) evictLowerThan(priority Priority) bool {
+	for p := PriorityLow; p < priority; p++ {
+		q := c.queues[p]
+		if len(q) == 0 {
+			continue
+		}
+
+		victim := q[len(q)-1]
+		c.queues[p] = q[:len(q)-1]
+		close(victim.admitted)
+		c.metrics.Evicted++
+		return true
+	}
+
+	return false
+}
+
+func (c *Controller) popHighest() *ticket {
+	for p := PriorityHigh; p >= PriorityLow; p-- {
+		if len(c.queues[p]) > 0 {
+			t := c.queues[p][0]
+			c.queues[p] = c.queues[p][1:]
+			return t
+		}
+	}
+
+	return nil
+}
+
+func (c *Controller) removeTicket(t *ticket) bool {
+	q := c.queues[t.priority]
+	for i, other := range q {
+		if other == t {
+			c.queues[t.priority] = append(q[:i], q[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Controller) queueLen() int {
+	return len(c.queues[PriorityLow]) + len(c.queues[PriorityNormal]) + len(c.queues[PriorityHigh])
+}
+
+func (c *Controller) shed(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(c.cfg.RetryAfter.Seconds()+0.999)))
+	http.Error(w, "server busy, try again later", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,88 @@
+package bloom_filter
+
+import (
+	"hash/fnv"
+	"math"
+	"sync/atomic"
+)
+
+// A Bloom filter answers "have I seen this key?" with either "definitely not" or "probably". It never forgets a key it was given,
+// so a "no" can be trusted and the lookup can be rejected before it touches redis or the database. A "probably" is wrong
+// about as often as the false positive rate it was sized for - those lookups just go the normal way.
+// There's no delete: a removed key stays "probably there" until the filter is rebuilt
+
+type Filter struct {
+	k    int    // Hashes per key
+	m    uint64 // Bits
+	bits []atomic.Uint64
+
+	count atomic.Int64
+}
+
+// New sizes the filter for the expected number of keys and the false positive rate we can live with.
+// Going over expected keeps working, the false positive rate just climbs
+func New(expected int, falsePositiveRate float64) *Filter {
+	expected = max(expected, 1)
+	falsePositiveRate = min(max(falsePositiveRate, 1e-9), 0.5)
+
+	// The textbook optimum: m = -n ln p / (ln 2)^2 bits and k = m/n ln 2 hashes
+	m := uint64(math.Ceil(-float64(expected) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	m = max(m, 64)
+	k := max(int(math.Round(float64(m)/float64(expected)*math.Ln2)), 1)
+
+	return &Filter{k: k, m: m, bits: make([]atomic.Uint64, (m+63)/64)}
+}
+
+func (f *Filter) Add(key string) {
+	h1, h2 := hashes(key)
+	for i := range f.k {
+		bit := (h1 + uint64(i)*h2) % f.m
+		f.bits[bit/64].Or(1 << (bit % 64))
+	}
+
+	f.count.Add(1)
+}
+
+// MayContain is false only for keys that were never added
+func (f *Filter) MayContain(key string) bool {
+	h1, h2 := hashes(key)
+	for i := range f.k {
+		bit := (h1 + uint64(i)*h2) % f.m
+		if f.bits[bit/64].Load()&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Count is how many adds there were, adding the same key twice counts twice
+func (f *Filter) Count() int {
+	return int(f.count.Load())
+}
+
+// FalsePositiveRate estimates the current rate from how many keys went in: (1 - e^(-kn/m))^k
+func (f *Filter) FalsePositiveRate() float64 {
+	n := float64(f.Count())
+	return math.Pow(1-math.Exp(-float64(f.k)*n/float64(f.m)), float64(f.k))
+}
+
+func (f *Filter) SizeBytes() int {
+	return len(f.bits) * 8
+}
+
+// Two hashes are enough to fake k of them, h1 + i*h2 (Kirsch and Mitzenmacher). Both come from one 64 bit fnv,
+// pushed through the murmur3 finalizer so short keys like "1", "2" don't land on neighbouring bits
+func hashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x & 0xffffffff, x>>32 | 1 // An odd step never cycles back onto the same bits early
+}
@@ -0,0 +1,199 @@
+package cache_codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// How a cached value turns into bytes. JSON is what everything used so far - readable in redis-cli, but big and slow-ish.
+// gob and the msgpack-style binary codec are smaller and faster, compression trades cpu for bytes on the wire and in memory.
+// Whatever the codec, a value written by one version of the code will one day be read by another (during a deploy both run at once),
+// so Versioned puts a small header in front and a reader that doesn't recognise it gets ErrIncompatible instead of garbage
+
+type Codec interface {
+	Name() string
+	Tag() byte // Identifies the format in the versioned header
+	Encode(v any) ([]byte, error)
+	Decode(data []byte, v any) error
+}
+
+var ErrIncompatible = errors.New("cached value was written in another format or schema version")
+
+type jsonCodec struct{}
+
+func JSON() Codec {
+	return jsonCodec{}
+}
+
+func (jsonCodec) Name() string { return "json" }
+func (jsonCodec) Tag() byte    { return 1 }
+
+func (jsonCodec) Encode(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Decode(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+// Gob sends the type description along with every value - fine for a stream, heavy for one small cached value
+func Gob() Codec {
+	return gobCodec{}
+}
+
+func (gobCodec) Name() string { return "gob" }
+func (gobCodec) Tag() byte    { return 2 }
+
+func (gobCodec) Encode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Decode(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type compressed struct {
+	inner   Codec
+	gzip    bool
+	level   int
+	minSize int
+}
+
+// Gzip compresses the inner codec's output, values under minSize aren't worth it and are stored as they are
+func Gzip(inner Codec, minSize int) Codec {
+	return compressed{inner: inner, gzip: true, level: gzip.DefaultCompression, minSize: minSize}
+}
+
+// Fast is the snappy-like option: deflate at its fastest level, most of the size win for a fraction of the cpu
+func Fast(inner Codec, minSize int) Codec {
+	return compressed{inner: inner, level: flate.BestSpeed, minSize: minSize}
+}
+
+func (c compressed) Name() string {
+	if c.gzip {
+		return c.inner.Name() + "+gzip"
+	}
+	return c.inner.Name() + "+fast"
+}
+
+func (c compressed) Tag() byte {
+	if c.gzip {
+		return c.inner.Tag() | 0x80
+	}
+	return c.inner.Tag() | 0x40
+}
+
+// First byte says whether the rest is compressed
+func (c compressed) Encode(v any) ([]byte, error) {
+	raw, err := c.inner.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < c.minSize {
+		return append([]byte{0}, raw...), nil
+	}
+
+	buf := bytes.NewBuffer([]byte{1})
+	var w io.WriteCloser
+	if c.gzip {
+		w, err = gzip.NewWriterLevel(buf, c.level)
+	} else {
+		w, err = flate.NewWriter(buf, c.level)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c compressed) Decode(data []byte, v any) error {
+	if len(data) == 0 {
+		return fmt.Errorf("%w: empty value", ErrIncompatible)
+	}
+	if data[0] == 0 {
+		return c.inner.Decode(data[1:], v)
+	}
+
+	var r io.ReadCloser
+	var err error
+	if c.gzip {
+		r, err = gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return err
+		}
+	} else {
+		r = flate.NewReader(bytes.NewReader(data[1:]))
+	}
+	defer r.Close()
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed decompressing: %w", err)
+	}
+
+	return c.inner.Decode(raw, v)
+}
+
+const magic = 0xCA
+
+type versioned struct {
+	Codec
+	schema uint16
+}
+
+// Versioned prefixes every value with magic, codec tag and schema version - 4 bytes. Bump the schema version whenever the cached
+// type changes in a way old readers can't handle, readers of the old version then see ErrIncompatible and treat it as a miss
+func Versioned(schema uint16, codec Codec) Codec {
+	return versioned{Codec: codec, schema: schema}
+}
+
+func (c versioned) Name() string {
+	return fmt.Sprintf("%s v%d", c.Codec.Name(), c.schema)
+}
+
+func (c versioned) Encode(v any) ([]byte, error) {
+	data, err := c.Codec.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	header := []byte{magic, c.Codec.Tag(), 0, 0}
+	binary.BigEndian.PutUint16(header[2:], c.schema)
+
+	return append(header, data...), nil
+}
+
+func (c versioned) Decode(data []byte, v any) error {
+	if len(data) < 4 || data[0] != magic {
+		return fmt.Errorf("%w: no header, probably written before values were versioned", ErrIncompatible)
+	}
+	if data[1] != c.Codec.Tag() {
+		return fmt.Errorf("%w: codec tag %d, we read %d (%s)", ErrIncompatible, data[1], c.Codec.Tag(), c.Codec.Name())
+	}
+	if schema := binary.BigEndian.Uint16(data[2:4]); schema != c.schema {
+		return fmt.Errorf("%w: schema v%d, we read v%d", ErrIncompatible, schema, c.schema)
+	}
+
+	return c.Codec.Decode(data[4:], v)
+}
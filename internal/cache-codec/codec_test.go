@@ -0,0 +1,87 @@
+package cache_codec_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	cache_codec "andreashoj/deeper-learnings/internal/cache-codec"
+	caching_strategies "andreashoj/deeper-learnings/internal/caching-strategies"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	user := caching_strategies.UserRes{UserID: 1, Username: "anz", Permissions: []int{1, 2, 999}}
+
+	for _, codec := range []cache_codec.Codec{
+		cache_codec.JSON(),
+		cache_codec.Gob(),
+		cache_codec.MsgPack(),
+		cache_codec.Gzip(cache_codec.MsgPack(), 0),
+		cache_codec.Fast(cache_codec.MsgPack(), 0),
+		cache_codec.Gzip(cache_codec.JSON(), 1<<20), // Under minSize, stored as it is
+		cache_codec.Versioned(1, cache_codec.MsgPack()),
+		cache_codec.Versioned(1, cache_codec.Fast(cache_codec.MsgPack(), 0)),
+	} {
+		if got := roundTrip(t, codec, user); !reflect.DeepEqual(got, user) {
+			t.Fatalf("%s: want %+v, got %+v", codec.Name(), user, got)
+		}
+	}
+}
+
+func TestVersionedRejectsOtherFormats(t *testing.T) {
+	user := caching_strategies.UserRes{UserID: 1, Username: "anz", Permissions: []int{999}}
+	v1 := cache_codec.Versioned(1, cache_codec.MsgPack())
+
+	legacy, err := cache_codec.JSON().Encode(user) // What was cached before values were versioned
+	if err != nil {
+		t.Fatalf("failed encoding: %s", err)
+	}
+
+	cases := []struct {
+		name  string
+		codec cache_codec.Codec
+	}{
+		{"newer schema", cache_codec.Versioned(2, cache_codec.MsgPack())},
+		{"other codec", cache_codec.Versioned(1, cache_codec.Gob())},
+		{"compressed", cache_codec.Versioned(1, cache_codec.Gzip(cache_codec.MsgPack(), 0))},
+		{"fast instead of gzip", cache_codec.Versioned(1, cache_codec.Fast(cache_codec.MsgPack(), 0))},
+	}
+	for _, c := range cases {
+		data, err := c.codec.Encode(user)
+		if err != nil {
+			t.Fatalf("%s: failed encoding: %s", c.name, err)
+		}
+		var out caching_strategies.UserRes
+		if err = v1.Decode(data, &out); !errors.Is(err, cache_codec.ErrIncompatible) {
+			t.Fatalf("%s: want ErrIncompatible, got %v", c.name, err)
+		}
+	}
+
+	var out caching_strategies.UserRes
+	if err = v1.Decode(legacy, &out); !errors.Is(err, cache_codec.ErrIncompatible) {
+		t.Fatalf("unversioned json: want ErrIncompatible, got %v", err)
+	}
+	if err = cache_codec.Gzip(cache_codec.MsgPack(), 0).Decode(nil, &out); !errors.Is(err, cache_codec.ErrIncompatible) {
+		t.Fatalf("empty compressed value: want ErrIncompatible, got %v", err)
+	}
+}
+
+func TestCompressedRejectsTruncatedInput(t *testing.T) {
+	user := caching_strategies.UserRes{UserID: 1, Username: "anz", Permissions: []int{1, 2, 999}}
+
+	for _, codec := range []cache_codec.Codec{
+		cache_codec.Versioned(1, cache_codec.Gzip(cache_codec.MsgPack(), 0)),
+		cache_codec.Versioned(1, cache_codec.Fast(cache_codec.MsgPack(), 0)),
+	} {
+		data, err := codec.Encode(user)
+		if err != nil {
+			t.Fatalf("%s: failed encoding: %s", codec.Name(), err)
+		}
+		for n := range len(data) {
+			var out caching_strategies.UserRes
+			if err = codec.Decode(data[:n], &out); err == nil {
+				t.Fatalf("%s: decoding the first %d of %d bytes didn't fail", codec.Name(), n, len(data))
+			}
+		}
+	}
+}
@@ -0,0 +1,627 @@
+package cache_codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// A MessagePack subset, enough for the structs we cache: nil, bools, ints, floats, strings, []byte, slices, arrays, maps with string keys,
+// structs (as maps keyed by field name, so adding or removing a field doesn't break older values) and time.Time as the
+// timestamp extension. Small numbers and short strings fit in a single type byte, which is where most of the size win over JSON comes from
+
+type msgpackCodec struct{}
+
+func MsgPack() Codec {
+	return msgpackCodec{}
+}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+func (msgpackCodec) Tag() byte    { return 3 }
+
+func (msgpackCodec) Encode(v any) ([]byte, error) {
+	return appendValue(nil, reflect.ValueOf(v))
+}
+
+func (msgpackCodec) Decode(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("msgpack: decode needs a non-nil pointer")
+	}
+
+	d := &decoder{data: data}
+	if err := d.value(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(d.data)-d.pos)
+	}
+
+	return nil
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+func appendValue(b []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(b, 0xc0), nil
+	}
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		b = append(b, 0xc7, 12, 0xff) // ext 8, 12 bytes, type -1: nanoseconds then seconds
+		b = binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+		return binary.BigEndian.AppendUint64(b, uint64(t.Unix())), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		return appendValue(b, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendInt(b, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := v.Uint()
+		if u <= math.MaxInt64 {
+			return appendInt(b, int64(u)), nil
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), u), nil
+	case reflect.Float32, reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return appendString(b, v.String()), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return appendBytes(b, v.Bytes()), nil
+		}
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		b = appendHeader(b, v.Len(), 0x90, 0xdc, 0xdd, 16)
+		var err error
+		for i := range v.Len() {
+			if b, err = appendValue(b, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("msgpack: only string map keys, got %s", v.Type().Key())
+		}
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		b = appendHeader(b, v.Len(), 0x80, 0xde, 0xdf, 16)
+		var err error
+		iter := v.MapRange()
+		for iter.Next() {
+			b = appendString(b, iter.Key().String())
+			if b, err = appendValue(b, iter.Value()); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Struct:
+		fields := structFields(v.Type())
+		b = appendHeader(b, len(fields), 0x80, 0xde, 0xdf, 16)
+		var err error
+		for _, f := range fields {
+			b = appendString(b, f.name)
+			if b, err = appendValue(b, v.Field(f.index)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("msgpack: can't encode %s", v.Type())
+}
+
+func appendInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(b, byte(n)) // Positive fixint
+	case n < 0 && n >= -32:
+		return append(b, byte(n)) // Negative fixint, 0xe0-0xff
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+}
+
+func appendString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+
+	return append(b, s...)
+}
+
+func appendBytes(b []byte, p []byte) []byte {
+	switch n := len(p); {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc5), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(n))
+	}
+
+	return append(b, p...)
+}
+
+// Arrays and maps: a fix type when it fits, otherwise the 16 or 32 bit length
+func appendHeader(b []byte, n int, fix, len16, len32 byte, fixMax int) []byte {
+	switch {
+	case n < fixMax:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, len16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, len32), uint32(n))
+}
+
+type field struct {
+	name  string
+	index int
+}
+
+var fieldCache sync.Map // reflect.Type -> []field
+
+func structFields(t reflect.Type) []field {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.([]field)
+	}
+
+	var fields []field
+	for i := range t.NumField() {
+		if f := t.Field(i); f.IsExported() {
+			fields = append(fields, field{name: f.Name, index: i})
+		}
+	}
+	fieldCache.Store(t, fields)
+
+	return fields
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+var errShort = errors.New("msgpack: value cut short")
+
+func (d *decoder) take(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errShort
+	}
+	p := d.data[d.pos : d.pos+n]
+	d.pos += n
+
+	return p, nil
+}
+
+func (d *decoder) byte() (byte, error) {
+	p, err := d.take(1)
+	if err != nil {
+		return 0, err
+	}
+
+	return p[0], nil
+}
+
+func (d *decoder) uint(size int) (uint64, error) {
+	p, err := d.take(size)
+	if err != nil {
+		return 0, err
+	}
+
+	switch size {
+	case 1:
+		return uint64(p[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(p)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(p)), nil
+	}
+	return binary.BigEndian.Uint64(p), nil
+}
+
+// Reads any value into a generic form: nil, bool, int64, uint64, float64, string, []byte, []any, map[string]any, time.Time
+func (d *decoder) any() (any, error) {
+	t, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xe0 == 0xa0:
+		return d.str(int(t & 0x1f))
+	case t&0xf0 == 0x90:
+		return d.array(int(t & 0x0f))
+	case t&0xf0 == 0x80:
+		return d.mapOf(int(t & 0x0f))
+	}
+
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (t - 0xd0)
+		u, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, nil // Sign extend
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (t - 0xcc))
+	case 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (t - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		p, err := d.take(int(n))
+		return append([]byte(nil), p...), err
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(int(n))
+	case 0xc7:
+		return d.timestamp()
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%x", t)
+}
+
+func (d *decoder) str(n int) (string, error) {
+	p, err := d.take(n)
+	return string(p), err
+}
+
+// A struct field name, without allocating a string for it
+func (d *decoder) key() ([]byte, error) {
+	t, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	if t&0xe0 == 0xa0 {
+		return d.take(int(t & 0x1f))
+	}
+	if t == 0xd9 || t == 0xda || t == 0xdb {
+		n, err := d.uint(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.take(int(n))
+	}
+
+	return nil, fmt.Errorf("msgpack: expected a string key, got type byte 0x%x", t)
+}
+
+func (d *decoder) array(n int) ([]any, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errShort // Every element takes at least a byte, don't allocate for a bogus length
+	}
+	out := make([]any, n)
+	for i := range n {
+		v, err := d.any()
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+
+	return out, nil
+}
+
+func (d *decoder) mapOf(n int) (map[string]any, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errShort
+	}
+	out := make(map[string]any, n)
+	for range n {
+		k, err := d.any()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key is %T, not a string", k)
+		}
+		if out[key], err = d.any(); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+func (d *decoder) timestamp() (time.Time, error) {
+	p, err := d.take(2)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if p[0] != 12 || p[1] != 0xff {
+		return time.Time{}, fmt.Errorf("msgpack: unsupported extension %d of length %d", int8(p[1]), p[0])
+	}
+	nsec, err := d.uint(4)
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec, err := d.uint(8)
+
+	return time.Unix(int64(sec), int64(nsec)), err
+}
+
+// Decodes straight into v. Decoding into a generic value first and then converting would be simpler, but twice as slow
+func (d *decoder) value(v reflect.Value) error {
+	if d.pos >= len(d.data) {
+		return errShort
+	}
+	t := d.data[d.pos]
+
+	if t == 0xc0 {
+		d.pos++
+		v.SetZero()
+		return nil
+	}
+
+	if v.Type() == timeType {
+		d.pos++
+		if t != 0xc7 {
+			return fmt.Errorf("msgpack: expected a timestamp, got type byte 0x%x", t)
+		}
+		ts, err := d.timestamp()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(ts))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(v.Elem())
+	case reflect.Interface:
+		generic, err := d.any()
+		if err != nil {
+			return err
+		}
+		if generic != nil {
+			v.Set(reflect.ValueOf(generic))
+		}
+		return nil
+	case reflect.Struct:
+		n, err := d.containerLen(0x80, 0xde)
+		if err != nil {
+			return err
+		}
+		fields := structFields(v.Type())
+		for range n {
+			name, err := d.key()
+			if err != nil {
+				return err
+			}
+			target := -1
+			for _, f := range fields {
+				if f.name == string(name) { // Doesn't allocate
+					target = f.index
+					break
+				}
+			}
+			if target < 0 { // A field this version doesn't know about, skip it
+				if _, err = d.any(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err = d.value(v.Field(target)); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			generic, err := d.any()
+			if err != nil {
+				return err
+			}
+			p, ok := generic.([]byte)
+			if !ok {
+				return fmt.Errorf("msgpack: expected bin for %s, got %T", v.Type(), generic)
+			}
+			v.SetBytes(p)
+			return nil
+		}
+		n, err := d.containerLen(0x90, 0xdc)
+		if err != nil {
+			return err
+		}
+		if n > len(d.data)-d.pos {
+			return errShort
+		}
+		slice := reflect.MakeSlice(v.Type(), n, n)
+		for i := range n {
+			if err = d.value(slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	case reflect.Array:
+		n, err := d.containerLen(0x90, 0xdc)
+		if err != nil {
+			return err
+		}
+		if n != v.Len() {
+			return fmt.Errorf("msgpack: can't put %d elements in %s", n, v.Type())
+		}
+		for i := range n {
+			if err = d.value(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		n, err := d.containerLen(0x80, 0xde)
+		if err != nil {
+			return err
+		}
+		if n > len(d.data)-d.pos {
+			return errShort
+		}
+		m := reflect.MakeMapWithSize(v.Type(), n)
+		for range n {
+			k, err := d.any()
+			if err != nil {
+				return err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return fmt.Errorf("msgpack: map key is %T, not a string", k)
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err = d.value(elem); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+		v.Set(m)
+		return nil
+	}
+
+	generic, err := d.any()
+	if err != nil {
+		return err
+	}
+	return setScalar(v, generic)
+}
+
+// Reads a map or array header, fix form or the 16/32 bit one
+func (d *decoder) containerLen(fix, len16 byte) (int, error) {
+	t, err := d.byte()
+	if err != nil {
+		return 0, err
+	}
+	if t&0xf0 == fix {
+		return int(t & 0x0f), nil
+	}
+	if t == len16 || t == len16+1 {
+		n, err := d.uint(2 << (t - len16))
+		return int(n), err
+	}
+
+	return 0, fmt.Errorf("msgpack: expected map or array, got type byte 0x%x", t)
+}
+
+func setScalar(v reflect.Value, generic any) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, ok := generic.(bool)
+		if !ok {
+			return fmt.Errorf("msgpack: can't put %T in a bool", generic)
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch n := generic.(type) {
+		case int64:
+			if v.OverflowInt(n) {
+				return fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+			}
+			v.SetInt(n)
+			return nil
+		case uint64:
+			if n > math.MaxInt64 || v.OverflowInt(int64(n)) {
+				return fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+			}
+			v.SetInt(int64(n))
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		switch n := generic.(type) {
+		case int64:
+			if n < 0 || v.OverflowUint(uint64(n)) {
+				return fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+			}
+			v.SetUint(uint64(n))
+			return nil
+		case uint64:
+			if v.OverflowUint(n) {
+				return fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+			}
+			v.SetUint(n)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch n := generic.(type) {
+		case float64:
+			v.SetFloat(n)
+			return nil
+		case int64:
+			v.SetFloat(float64(n))
+			return nil
+		}
+	case reflect.String:
+		if s, ok := generic.(string); ok {
+			v.SetString(s)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("msgpack: can't put %T in %s", generic, v.Type())
+}
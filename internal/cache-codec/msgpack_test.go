@@ -0,0 +1,224 @@
+package cache_codec_test
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	cache_codec "andreashoj/deeper-learnings/internal/cache-codec"
+	caching_strategies "andreashoj/deeper-learnings/internal/caching-strategies"
+	query_profiling "andreashoj/deeper-learnings/internal/query-profiling"
+)
+
+// The real cached types, so a field change that the codec can't handle fails here and not in redis
+
+func roundTrip[T any](t *testing.T, codec cache_codec.Codec, in T) T {
+	t.Helper()
+
+	data, err := codec.Encode(in)
+	if err != nil {
+		t.Fatalf("failed encoding %T: %s", in, err)
+	}
+	var out T
+	if err = codec.Decode(data, &out); err != nil {
+		t.Fatalf("failed decoding %T: %s", in, err)
+	}
+
+	return out
+}
+
+func TestMsgPackRoundTripsCachedTypes(t *testing.T) {
+	codec := cache_codec.MsgPack()
+
+	posts := []query_profiling.Post{{Id: 1, Name: "first", UserID: 1}, {Id: 2, Name: strings.Repeat("long ", 100), UserID: 7}}
+	if got := roundTrip(t, codec, posts); !reflect.DeepEqual(got, posts) {
+		t.Fatalf("posts: want %+v, got %+v", posts, got)
+	}
+
+	user := query_profiling.User{Id: 3, Name: "Andreas", Username: "anz", Password: "tester12"}
+	if got := roundTrip(t, codec, user); got != user {
+		t.Fatalf("user: want %+v, got %+v", user, got)
+	}
+
+	res := caching_strategies.UserRes{UserID: 1, Username: "anz", Permissions: []int{1, 2, 999}}
+	if got := roundTrip(t, codec, res); !reflect.DeepEqual(got, res) {
+		t.Fatalf("user res: want %+v, got %+v", res, got)
+	}
+}
+
+func TestMsgPackRoundTripsNumbers(t *testing.T) {
+	type numbers struct {
+		Ints   []int64
+		Small  int8
+		Uint8  uint8
+		MaxU64 uint64
+		F32    float32
+		F64    float64
+	}
+
+	// Every boundary between the int encodings, on both sides
+	in := numbers{
+		Ints: []int64{0, 1, 127, 128, 255, 256, 65535, 65536, math.MaxInt32, math.MaxInt32 + 1, math.MaxInt64,
+			-1, -32, -33, -128, -129, -32768, -32769, math.MinInt32, math.MinInt32 - 1, math.MinInt64},
+		Small:  -100,
+		Uint8:  200,
+		MaxU64: math.MaxUint64,
+		F32:    1.5,
+		F64:    -math.Pi,
+	}
+	if got := roundTrip(t, cache_codec.MsgPack(), in); !reflect.DeepEqual(got, in) {
+		t.Fatalf("want %+v, got %+v", in, got)
+	}
+}
+
+func TestMsgPackRejectsOverflow(t *testing.T) {
+	data, err := cache_codec.MsgPack().Encode(struct{ N int64 }{N: 300})
+	if err != nil {
+		t.Fatalf("failed encoding: %s", err)
+	}
+	var out struct{ N int8 }
+	if err = cache_codec.MsgPack().Decode(data, &out); err == nil {
+		t.Fatalf("300 decoded into an int8 as %d", out.N)
+	}
+}
+
+func TestMsgPackRoundTripsTime(t *testing.T) {
+	type stamped struct {
+		At time.Time
+	}
+
+	for _, at := range []time.Time{
+		time.Now(),
+		time.Date(2024, 2, 29, 23, 59, 59, 999999999, time.UTC),
+		time.Date(1969, 7, 20, 20, 17, 0, 0, time.UTC), // Before the epoch, negative seconds
+		{},
+	} {
+		got := roundTrip(t, cache_codec.MsgPack(), stamped{At: at})
+		if !got.At.Equal(at) {
+			t.Fatalf("want %s, got %s", at, got.At)
+		}
+	}
+}
+
+func TestMsgPackKeepsNilAndEmptyApart(t *testing.T) {
+	type containers struct {
+		NilSlice   []int
+		EmptySlice []int
+		NilMap     map[string]int
+		EmptyMap   map[string]int
+		Map        map[string][]string
+		NilBytes   []byte
+		Bytes      []byte
+		Pointer    *query_profiling.Post
+		NilPointer *query_profiling.Post
+	}
+
+	in := containers{
+		EmptySlice: []int{},
+		EmptyMap:   map[string]int{},
+		Map:        map[string][]string{"a": {"x", "y"}, "b": nil},
+		Bytes:      []byte{0, 1, 2},
+		Pointer:    &query_profiling.Post{Id: 1},
+	}
+	got := roundTrip(t, cache_codec.MsgPack(), in)
+	if got.NilSlice != nil || got.EmptySlice == nil || len(got.EmptySlice) != 0 {
+		t.Fatalf("slices: want nil and empty, got %#v and %#v", got.NilSlice, got.EmptySlice)
+	}
+	if got.NilMap != nil || got.EmptyMap == nil || len(got.EmptyMap) != 0 {
+		t.Fatalf("maps: want nil and empty, got %#v and %#v", got.NilMap, got.EmptyMap)
+	}
+	if !reflect.DeepEqual(got.Map, in.Map) || !reflect.DeepEqual(got.Bytes, in.Bytes) || got.NilBytes != nil {
+		t.Fatalf("want %+v, got %+v", in, got)
+	}
+	if got.Pointer == nil || *got.Pointer != *in.Pointer || got.NilPointer != nil {
+		t.Fatalf("pointers: want %+v and nil, got %+v and %+v", in.Pointer, got.Pointer, got.NilPointer)
+	}
+}
+
+func TestMsgPackRoundTripsArrays(t *testing.T) {
+	type arrays struct {
+		Ints  [3]int
+		Names [2]string
+		Bytes [4]byte
+	}
+
+	in := arrays{Ints: [3]int{1, -2, 300}, Names: [2]string{"a", "b"}, Bytes: [4]byte{0xca, 0xfe, 0, 1}}
+	if got := roundTrip(t, cache_codec.MsgPack(), in); got != in {
+		t.Fatalf("want %+v, got %+v", in, got)
+	}
+
+	data, err := cache_codec.MsgPack().Encode([3]int{1, 2, 3})
+	if err != nil {
+		t.Fatalf("failed encoding: %s", err)
+	}
+	var short [2]int
+	if err = cache_codec.MsgPack().Decode(data, &short); err == nil {
+		t.Fatalf("3 elements decoded into a [2]int as %v", short)
+	}
+}
+
+func TestMsgPackSkipsUnknownFields(t *testing.T) {
+	// A newer version added a field, an older reader still reads the rest
+	data, err := cache_codec.MsgPack().Encode(struct {
+		Id    int
+		Added []string
+		Name  string
+	}{Id: 1, Added: []string{"x"}, Name: "post"})
+	if err != nil {
+		t.Fatalf("failed encoding: %s", err)
+	}
+
+	var post query_profiling.Post
+	if err = cache_codec.MsgPack().Decode(data, &post); err != nil {
+		t.Fatalf("failed decoding: %s", err)
+	}
+	if post.Id != 1 || post.Name != "post" {
+		t.Fatalf("want id 1 and name post, got %+v", post)
+	}
+}
+
+func TestMsgPackRejectsTruncatedInput(t *testing.T) {
+	type everything struct {
+		Post  query_profiling.Post
+		User  caching_strategies.UserRes
+		Big   uint64
+		Neg   int64
+		Float float64
+		At    time.Time
+		Bytes []byte
+		Map   map[string]any
+		Array [2]int
+		Long  string
+	}
+
+	data, err := cache_codec.MsgPack().Encode(everything{
+		Post:  query_profiling.Post{Id: 1, Name: "post", UserID: 2},
+		User:  caching_strategies.UserRes{UserID: 2, Username: "anz", Permissions: []int{1, 999}},
+		Big:   math.MaxUint64,
+		Neg:   -40000,
+		Float: 0.25,
+		At:    time.Now(),
+		Bytes: []byte("bytes"),
+		Map:   map[string]any{"n": 1, "s": "x", "l": []any{true, nil}},
+		Array: [2]int{1, 2},
+		Long:  strings.Repeat("x", 300),
+	})
+	if err != nil {
+		t.Fatalf("failed encoding: %s", err)
+	}
+
+	// Every cut must be an error, not a panic and not a half filled value passed off as whole
+	for n := range len(data) {
+		var out everything
+		if err = cache_codec.MsgPack().Decode(data[:n], &out); err == nil {
+			t.Fatalf("decoding the first %d of %d bytes didn't fail", n, len(data))
+		}
+	}
+
+	var out everything
+	if err = cache_codec.MsgPack().Decode(append(data, 0), &out); err == nil {
+		t.Fatalf("decoding with a trailing byte didn't fail")
+	}
+}
@@ -0,0 +1,328 @@
+package cache_warming
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// After a restart every key is cold and the first wave of traffic all misses at once - the stampede, just caused by us.
+// The warmer remembers which keys were hot: it counts reads while running and snapshots the counts to a file.
+// On startup it reads the snapshot and loads the top N keys before the instance takes traffic, throttled so warming
+// doesn't become its own stampede on the database. Until it's done the readiness endpoint says 503 and Gate turns requests away,
+// a load balancer health checking /readyz won't send anything our way in the meantime
+
+// Loads the key into whatever cache it belongs to
+type Loader func(ctx context.Context, key string) error
+
+type Config struct {
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+	TopN             int
+	Rate             int           // Loads per second at most
+	Concurrency      int           // Loads in flight at most
+	Timeout          time.Duration // For all of warming, an instance that can't warm still has to start at some point
+}
+
+func DefaultConfig(path string) Config {
+	return Config{SnapshotPath: path, SnapshotInterval: 30 * time.Second, TopN: 100, Rate: 50, Concurrency: 4, Timeout: 30 * time.Second}
+}
+
+type HotKey struct {
+	Key      string    `json:"key"`
+	Hits     int64     `json:"hits"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type Result struct {
+	Snapshot int           `json:"snapshot"` // Keys in the snapshot
+	Warmed   int           `json:"warmed"`
+	Failed   int           `json:"failed"`
+	Skipped  int           `json:"skipped"` // No loader for them
+	Took     time.Duration `json:"took"`
+}
+
+type Warmer struct {
+	cfg Config
+
+	mu      sync.Mutex
+	loaders map[string]Loader // Key prefix -> loader
+	hot     map[string]*HotKey
+	result  Result
+
+	ready chan struct{}
+	once  sync.Once
+}
+
+func New(cfg Config) *Warmer {
+	return &Warmer{cfg: cfg, loaders: make(map[string]Loader), hot: make(map[string]*HotKey), ready: make(chan struct{})}
+}
+
+// Register routes every key starting with prefix to loader, the longest matching prefix wins
+func (w *Warmer) Register(prefix string, loader Loader) {
+	w.mu.Lock()
+	w.loaders[prefix] = loader
+	w.mu.Unlock()
+}
+
+func (w *Warmer) loaderFor(key string) Loader {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var best string
+	var loader Loader
+	for prefix, l := range w.loaders {
+		if strings.HasPrefix(key, prefix) && len(prefix) >= len(best) {
+			best, loader = prefix, l
+		}
+	}
+
+	return loader
+}
+
+// Touch counts a read of the key
+func (w *Warmer) Touch(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	h, ok := w.hot[key]
+	if !ok {
+		h = &HotKey{Key: key}
+		w.hot[key] = h
+	}
+	h.Hits++
+	h.LastSeen = time.Now()
+}
+
+// Track counts a read of key for every request the handler serves
+func (w *Warmer) Track(key string, next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		w.Touch(key)
+		next(rw, r)
+	}
+}
+
+// Hot is every key seen, hottest first
+func (w *Warmer) Hot() []HotKey {
+	w.mu.Lock()
+	keys := make([]HotKey, 0, len(w.hot))
+	for _, h := range w.hot {
+		keys = append(keys, *h)
+	}
+	w.mu.Unlock()
+
+	slices.SortFunc(keys, func(a, b HotKey) int {
+		if c := cmp.Compare(b.Hits, a.Hits); c != 0 {
+			return c
+		}
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+
+	return keys
+}
+
+// Snapshot writes the hot keys to a temp file and renames it over the old snapshot, a crash mid write never leaves half a file behind
+func (w *Warmer) Snapshot() error {
+	data, err := json.MarshalIndent(w.Hot(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed encoding hot keys: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(w.cfg.SnapshotPath), filepath.Base(w.cfg.SnapshotPath)+".*")
+	if err != nil {
+		return fmt.Errorf("failed creating snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // Fails once renamed, which is fine
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed writing snapshot: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed writing snapshot: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), w.cfg.SnapshotPath); err != nil {
+		return fmt.Errorf("failed replacing snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// RunSnapshots snapshots every interval and a last time when ctx is done
+func (w *Warmer) RunSnapshots(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.SnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := w.Snapshot(); err != nil {
+				fmt.Printf("failed taking the last snapshot: %s\n", err)
+			}
+			return
+		case <-ticker.C:
+			if err := w.Snapshot(); err != nil {
+				fmt.Printf("failed taking snapshot: %s\n", err)
+			}
+		}
+	}
+}
+
+// Restore reads the snapshot and merges it into the counts, so the next snapshot doesn't forget what was hot before the restart
+func (w *Warmer) Restore() ([]HotKey, error) {
+	data, err := os.ReadFile(w.cfg.SnapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil // First start, nothing to warm
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading snapshot: %w", err)
+	}
+
+	var keys []HotKey
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed decoding snapshot: %w", err)
+	}
+
+	w.mu.Lock()
+	for _, k := range keys {
+		if h, ok := w.hot[k.Key]; ok {
+			h.Hits += k.Hits
+			continue
+		}
+		w.hot[k.Key] = &k
+	}
+	w.mu.Unlock()
+
+	return keys, nil
+}
+
+// Warm loads the top N keys from the snapshot and marks the warmer ready, also when it fails - a cold instance beats no instance
+func (w *Warmer) Warm(ctx context.Context) (Result, error) {
+	defer w.markReady()
+	start := time.Now()
+
+	keys, err := w.Restore()
+	if err != nil {
+		return Result{}, err
+	}
+	slices.SortFunc(keys, func(a, b HotKey) int { return cmp.Compare(b.Hits, a.Hits) })
+
+	res := Result{Snapshot: len(keys)}
+	type job struct {
+		key  string
+		load Loader
+	}
+	var jobs []job
+	for _, k := range keys {
+		if len(jobs) == w.cfg.TopN {
+			break
+		}
+		load := w.loaderFor(k.Key)
+		if load == nil {
+			res.Skipped++
+			continue
+		}
+		jobs = append(jobs, job{key: k.Key, load: load})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, w.cfg.Timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Second / time.Duration(max(w.cfg.Rate, 1)))
+	defer ticker.Stop()
+	slots := make(chan struct{}, max(w.cfg.Concurrency, 1))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		slots <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-slots }()
+			err := j.load(ctx, j.key)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fmt.Printf("failed warming %s: %s\n", j.key, err)
+				res.Failed++
+				return
+			}
+			res.Warmed++
+		})
+	}
+	wg.Wait()
+	res.Took = time.Since(start)
+
+	w.mu.Lock()
+	w.result = res
+	w.mu.Unlock()
+
+	if ctx.Err() != nil {
+		return res, fmt.Errorf("warming stopped after %d of %d keys: %w", res.Warmed, len(jobs), ctx.Err())
+	}
+
+	return res, nil
+}
+
+func (w *Warmer) markReady() {
+	w.once.Do(func() { close(w.ready) })
+}
+
+// Done is closed once warming is over
+func (w *Warmer) Done() <-chan struct{} {
+	return w.ready
+}
+
+func (w *Warmer) Ready() bool {
+	select {
+	case <-w.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadyHandler is the readiness endpoint: 503 while warming, 200 with what was warmed after
+func (w *Warmer) ReadyHandler(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	res := w.result
+	w.mu.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	if !w.Ready() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(rw).Encode(map[string]any{"ready": false})
+		return
+	}
+
+	json.NewEncoder(rw).Encode(map[string]any{"ready": true, "warming": res})
+}
+
+// Gate turns requests away with a 503 until warming is done, the readiness endpoint goes outside it
+func (w *Warmer) Gate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !w.Ready() {
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, "warming up", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
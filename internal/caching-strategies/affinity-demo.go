@@ -0,0 +1,182 @@
+package caching_strategies
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+
+	load_balancer "andreashoj/deeper-learnings/internal/load-balancer"
+	query_profiling "andreashoj/deeper-learnings/internal/query-profiling"
+)
+
+// An in-memory cache per server is only worth something if the same user keeps landing on the same server.
+// First the hash ring on its own: how evenly it spreads keys and how many move when a server joins or leaves,
+// next to plain hash % n. Then the real thing - the test servers behind the balancer, with a server added halfway
+func StartAffinityDemo() {
+	printRebalancing()
+
+	algorithms := []func() load_balancer.Algorithm{
+		load_balancer.RoundRobin,
+		func() load_balancer.Algorithm {
+			return load_balancer.StickyCookie("lb", load_balancer.RoundRobin())
+		},
+		func() load_balancer.Algorithm {
+			return load_balancer.StickyKey(load_balancer.ByLastPathSegment(), load_balancer.RoundRobin())
+		},
+		func() load_balancer.Algorithm {
+			return load_balancer.ConsistentHash(load_balancer.ByLastPathSegment(), 100)
+		},
+	}
+
+	fmt.Printf("\n%-16s %16s %16s\n", "routing", "hits, 3 servers", "hits, 4 servers")
+	for _, newAlgo := range algorithms {
+		algo := newAlgo()
+		before, after, err := runAffinity(algo)
+		if err != nil {
+			fmt.Printf("failed running %s: %s\n", algo.Name(), err)
+			return
+		}
+		fmt.Printf("%-16s %15.0f%% %15.0f%%\n", algo.Name(), 100*before, 100*after)
+	}
+}
+
+func printRebalancing() {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d", i)
+	}
+
+	fmt.Printf("%d keys on 3 servers, then a 4th is added, then server-1 is removed - ideal is 25%% moved both times, only the keys the new or removed server owns\n", len(keys))
+	fmt.Printf("%-18s %18s %10s %12s\n", "placement", "spread (min-max)", "add moved", "remove moved")
+
+	for _, replicas := range []int{1, 10, 100, 500} {
+		ring := load_balancer.NewRing(replicas)
+		for i := range 3 {
+			ring.Add(fmt.Sprintf("server-%d", i))
+		}
+		three := ring.Assign(keys)
+
+		ring.Add("server-3")
+		four := ring.Assign(keys)
+
+		ring.Remove("server-1")
+		removed := ring.Assign(keys)
+
+		fmt.Printf("%-18s %18s %9.0f%% %11.0f%%\n", fmt.Sprintf("ring, %d vnodes", replicas), spread(three, len(keys)),
+			percent(load_balancer.Moved(three, four), len(keys)), percent(load_balancer.Moved(four, removed), len(keys)))
+	}
+
+	// hash % n for comparison - perfectly even, but changing n moves almost everything
+	modulo := func(servers []string) map[string]string {
+		owners := make(map[string]string, len(keys))
+		for _, key := range keys {
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			owners[key] = servers[h.Sum32()%uint32(len(servers))]
+		}
+		return owners
+	}
+	three := modulo([]string{"server-0", "server-1", "server-2"})
+	four := modulo([]string{"server-0", "server-1", "server-2", "server-3"})
+	removed := modulo([]string{"server-0", "server-2", "server-3"})
+	fmt.Printf("%-18s %18s %9.0f%% %11.0f%%\n", "hash % n", spread(three, len(keys)),
+		percent(load_balancer.Moved(three, four), len(keys)), percent(load_balancer.Moved(four, removed), len(keys)))
+}
+
+func spread(owners map[string]string, keys int) string {
+	perNode := make(map[string]int)
+	for _, owner := range owners {
+		perNode[owner]++
+	}
+	counts := make([]int, 0, len(perNode))
+	for _, n := range perNode {
+		counts = append(counts, n)
+	}
+
+	return fmt.Sprintf("%.0f%%-%.0f%%", percent(slices.Min(counts), keys), percent(slices.Max(counts), keys))
+}
+
+func percent(n, total int) float64 {
+	return 100 * float64(n) / float64(total)
+}
+
+// Every client keeps asking for its own user with its own cookie jar. Returns the in-memory hit ratio before and after a 4th server joins
+func runAffinity(algo load_balancer.Algorithm) (float64, float64, error) {
+	servers := startTestServers(4)
+	defer func() {
+		for _, s := range servers {
+			s.server.Close()
+		}
+	}()
+
+	balancer, err := newTestBalancer(algo, servers[:3])
+	if err != nil {
+		return 0, 0, err
+	}
+	proxy := httptest.NewServer(balancer)
+	defer proxy.Close()
+
+	type client struct {
+		http   *http.Client
+		userID int
+	}
+	var clients []client
+	for range 30 {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed creating cookie jar: %w", err)
+		}
+		c := client{http: &http.Client{Jar: jar}}
+
+		res, err := c.http.Post(proxy.URL+"/user", "application/json", nil)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed creating user: %w", err)
+		}
+		var user query_profiling.User
+		err = decodeJSON(res, &user)
+		if err != nil {
+			return 0, 0, err
+		}
+		c.userID = user.Id
+		clients = append(clients, c)
+	}
+
+	phase := func(requests int) (float64, error) {
+		hits := 0
+		for range requests {
+			c := clients[rand.Intn(len(clients))]
+			res, err := c.http.Get(proxy.URL + "/user-mem/" + strconv.Itoa(c.userID))
+			if err != nil {
+				return 0, fmt.Errorf("failed getting user: %w", err)
+			}
+			res.Body.Close()
+			if res.Header.Get("X-Cache") == "hit" {
+				hits++
+			}
+		}
+		return float64(hits) / float64(requests), nil
+	}
+
+	before, err := phase(300)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	backend, err := load_balancer.NewBackend(servers[3].server.URL, 4)
+	if err != nil {
+		return 0, 0, err
+	}
+	balancer.Add(backend)
+
+	after, err := phase(300)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return before, after, nil
+}
@@ -1,13 +1,22 @@
 package caching_strategies
 
 import (
+	cache_codec "andreashoj/deeper-learnings/internal/cache-codec"
+	cache_warming "andreashoj/deeper-learnings/internal/cache-warming"
+	near_cache "andreashoj/deeper-learnings/internal/near-cache"
 	query_profiling "andreashoj/deeper-learnings/internal/query-profiling"
+	stale_cache "andreashoj/deeper-learnings/internal/stale-cache"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
@@ -23,42 +32,137 @@ var RDB = redis.NewClient(&redis.Options{
 
 var TTL = 5 * time.Minute
 
+// Set before StartCacheStampedeDemo to serve /api/dashboard/post-outbox and run the outbox relay next to it
+var OutboxRelay = false
+
+// Where the warmer snapshots the hot keys between restarts. Not the working directory, that's the repo root under go run ./cmd
+var WarmingSnapshot = filepath.Join(os.TempDir(), "cache-warming.json")
+
 func StartCacheStampedeDemo(r *chi.Mux) {
 	// Problem: /dashboard (api/post, api/user, api/stats) is being hit by 1000 requests concurrently, and the cache JUST expired!
 	// How do we handle this and how could it be prevented?
 
 	// Jitter TTL [X]
-	// Refresh cache in the background when endpoint sees exp is close [X]
+	// Refresh cache in the background when endpoint sees exp is close [X] => stale-while-revalidate, soft and hard TTL
+	// Serve stale when the DB or redis fails [X] => stale-if-error
 	// Refresh worker
 	// Mutex lock on cache [X]
 	// Event driven - when to update cache ?
+	// Restart with a cold cache [X] => warm the keys that were hot before the restart, before taking traffic
+
+	ctx := context.Background()
+	warmer := cache_warming.New(cache_warming.DefaultConfig(WarmingSnapshot))
+	r.Get("/readyz", warmer.ReadyHandler)
+	r.Group(func(r chi.Router) {
+		r.Use(warmer.Gate)
+		registerDashboardEndpoints(r, warmer)
+	})
+	go warmer.RunSnapshots(ctx)
+	go func() {
+		res, err := warmer.Warm(ctx)
+		if err != nil {
+			fmt.Printf("failed warming the cache, starting cold: %s\n", err)
+			return
+		}
+		fmt.Printf("warmed %d of %d keys from the snapshot in %v\n", res.Warmed, res.Snapshot, res.Took.Round(time.Millisecond))
+	}()
 
-	registerDashboardEndpoints(r)
 	ts := httptest.NewServer(r)
+	<-warmer.Done()
 	stampedeApiWithRequests(ts)
+	if err := warmer.Snapshot(); err != nil { // What the stampede made hot, for the next start
+		fmt.Printf("failed snapshotting hot keys: %s\n", err)
+	}
 }
 
-func registerDashboardEndpoints(r *chi.Mux) {
-	r.Get("/api/dashboard/post", getPosts)
-	r.Get("/api/dashboard/post-mutex", getPostsWithMutex)
+func registerDashboardEndpoints(r chi.Router, warmer *cache_warming.Warmer) {
+	postsCache := stale_cache.New(near_cache.NewRedisL2(RDB),
+		stale_cache.Config{SoftTTL: time.Minute, HardTTL: TTL, StaleIfError: time.Hour, LoadTimeout: 10 * time.Second}, loadPostsJSON)
+	warmer.Register("posts:swr", func(ctx context.Context, key string) error {
+		_, err := postsCache.Get(ctx, key) // A miss loads and stores it
+		return err
+	})
+	warmer.Register("posts", warmPosts)
+
+	r.Get("/api/dashboard/post", warmer.Track("posts:swr", stalePostsHandler(postsCache)))
+	r.Get("/api/dashboard/post-mutex", warmer.Track("posts", getPostsWithMutex))
 	r.Get("/api/dashboard/post-event-driven", getPostsWithEventDriven)
+	if OutboxRelay { // Recreates the outbox table and holds a LISTEN connection, so only when asked for
+		r.Get("/api/dashboard/post-outbox", getPostsWithOutbox)
+		go startPostsOutboxRelay(context.Background())
+	}
 
-	startCachingWorkerPosts(context.Background(), "posts")
-	r.Get("/api/dashboard/post-worker", getPostsWithWorker)
+	go startCachingWorkerPosts(context.Background(), "posts")
+	r.Get("/api/dashboard/post-worker", warmer.Track("posts", getPostsWithWorker))
+}
+
+// refreshPostsCache for the warmer, which needs to know when it failed
+func warmPosts(ctx context.Context, key string) error {
+	posts, err := query_profiling.GetPosts()
+	if err != nil {
+		return err
+	}
+	encoded, err := cacheCodec.Encode(posts)
+	if err != nil {
+		return fmt.Errorf("failed encoding posts: %w", err)
+	}
+
+	return RDB.Set(ctx, key, encoded, getJitteredTTL()).Err()
 }
 
 func stampedeApiWithRequests(server *httptest.Server) {
-	for i := 0; i < 1000; i++ {
-		endpoint := []string{"post", "user", "stats"}[rand.Intn(2)]
-		go func() {
-			_, err := http.Get(server.URL + fmt.Sprintf("/api/dashboard/%s", endpoint))
-			if err != nil {
-				fmt.Printf("failed getting endpoint: %s", err)
+	for _, endpoint := range []string{"post", "post-mutex", "post-worker"} {
+		res := runStampede(server.URL+fmt.Sprintf("/api/dashboard/%s", endpoint), 1000)
+		fmt.Printf("\n%-12s %s\n", endpoint, res)
+	}
+}
 
+type stampedeResult struct {
+	statuses  map[int]int
+	freshness map[string]int // X-Cache-Freshness, for the endpoints that set it
+	median    time.Duration
+	slowest   time.Duration
+}
+
+func (s stampedeResult) String() string {
+	return fmt.Sprintf("statuses %v, freshness %v, median %v, slowest %v", s.statuses, s.freshness,
+		s.median.Round(time.Microsecond), s.slowest.Round(time.Microsecond))
+}
+
+// Fires all the requests at once and waits for every one of them
+func runStampede(url string, requests int) stampedeResult {
+	res := stampedeResult{statuses: make(map[int]int), freshness: make(map[string]int)}
+	var mu sync.Mutex
+	var latencies []time.Duration
+
+	var wg sync.WaitGroup
+	for range requests {
+		wg.Go(func() {
+			start := time.Now()
+			resp, err := http.Get(url)
+			took := time.Since(start)
+
+			mu.Lock()
+			defer mu.Unlock()
+			latencies = append(latencies, took)
+			if err != nil {
+				res.statuses[0]++
 				return
 			}
-		}()
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			res.statuses[resp.StatusCode]++
+			if freshness := resp.Header.Get("X-Cache-Freshness"); freshness != "" {
+				res.freshness[freshness]++
+			}
+		})
 	}
+	wg.Wait()
+
+	slices.Sort(latencies)
+	res.median, res.slowest = latencies[len(latencies)/2], latencies[len(latencies)-1]
+
+	return res
 }
 
 // First issue here is that we have a set TTL of 5 minutes, which means that all our endpoints cache all runs out at the same time
@@ -69,23 +173,29 @@ func getJitteredTTL() time.Duration {
 	return TTL + randSecs
 }
 
-func getPosts(w http.ResponseWriter, r *http.Request) {
-	cacheKeyPosts := "posts"
-	_, err := RDB.Get(r.Context(), cacheKeyPosts).Result()
-	if err == nil { // Got cache
-		fmt.Printf("success! Got posts cache")
-
-		// We check here to see if the cache expiration is low, if so, we refresh the cache in the background
-		exp := RDB.TTL(r.Context(), cacheKeyPosts).Val()
-		if exp < (1 * time.Minute) {
-			go refreshPostsCache(r.Context(), cacheKeyPosts)
+// Read from Redis with a soft and a hard TTL. Past the soft TTL the posts are served stale while one background load refreshes them,
+// when that load fails the stale posts keep being served instead of an error. X-Cache-Freshness says which one the client got
+func stalePostsHandler(cache *stale_cache.Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := cache.Get(r.Context(), "posts:swr")
+		if err != nil { // Nothing cached that's young enough to cover for the error
+			http.Error(w, fmt.Sprintf("failed getting posts: %s", err), http.StatusServiceUnavailable)
+			return
 		}
 
-		return
+		cache.SetHeaders(w.Header(), res)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(res.Value)
+	}
+}
+
+func loadPostsJSON(ctx context.Context, key string) ([]byte, error) {
+	posts, err := query_profiling.GetPosts()
+	if err != nil {
+		return nil, err
 	}
 
-	fmt.Printf("No cache, queried posts from DB")
-	refreshPostsCache(r.Context(), cacheKeyPosts)
+	return json.Marshal(posts)
 }
 
 func refreshPostsCache(ctx context.Context, cacheKeyPosts string) {
@@ -95,13 +205,13 @@ func refreshPostsCache(ctx context.Context, cacheKeyPosts string) {
 		return
 	}
 
-	postsJSON, err := json.Marshal(posts)
+	encoded, err := cacheCodec.Encode(posts)
 	if err != nil {
-		fmt.Printf("failed decoding posts to json: %s", postsJSON)
+		fmt.Printf("failed encoding posts: %s", err)
 		return
 	}
 
-	RDB.Set(ctx, cacheKeyPosts, postsJSON, getJitteredTTL())
+	RDB.Set(ctx, cacheKeyPosts, encoded, getJitteredTTL())
 	fmt.Print("Updated posts cache")
 }
 
@@ -110,17 +220,19 @@ var mu sync.Mutex
 
 func getPostsWithMutex(w http.ResponseWriter, r *http.Request) {
 	cacheKey := "posts"
-	res, err := RDB.Get(r.Context(), cacheKey).Result()
+	res, err := RDB.Get(r.Context(), cacheKey).Bytes()
 	if err == nil { // Cache was found
 		var posts []query_profiling.Post
-		err = json.Unmarshal([]byte(res), &posts)
-		if err != nil {
+		err = cacheCodec.Decode(res, &posts)
+		if err == nil {
+			fmt.Printf("Got cached posts!")
+			return
+		}
+		if !errors.Is(err, cache_codec.ErrIncompatible) {
 			fmt.Printf("couldn't decode cached posts: %s", err)
 			return
 		}
-
-		fmt.Printf("Got cached posts!")
-		return
+		// Written by another version of the code, treat it like a miss and overwrite it below
 	}
 
 	mu.Lock()
@@ -134,10 +246,13 @@ func getPostsWithMutex(w http.ResponseWriter, r *http.Request) {
 	defer lock.Unlock()
 	// race condition the first try of getting the cache and this line, the cache may have been set from a
 	// concurrent running getPostsWithMutex function, so try again here - if that fails, it has not been set, and this function will then do it
-	_, err = RDB.Get(r.Context(), cacheKey).Result()
+	res, err = RDB.Get(r.Context(), cacheKey).Bytes()
 	if err == nil {
-		fmt.Printf("Got cached posts, after running the lock")
-		return
+		var posts []query_profiling.Post
+		if cacheCodec.Decode(res, &posts) == nil {
+			fmt.Printf("Got cached posts, after running the lock")
+			return
+		}
 	}
 
 	posts, err := query_profiling.GetPosts()
@@ -146,13 +261,13 @@ func getPostsWithMutex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	postsJSON, err := json.Marshal(posts)
+	encoded, err := cacheCodec.Encode(posts)
 	if err != nil {
-		fmt.Printf("failed decoding posts: %s", err)
+		fmt.Printf("failed encoding posts: %s", err)
 		return
 	}
 
-	RDB.Set(r.Context(), cacheKey, postsJSON, getJitteredTTL())
+	RDB.Set(r.Context(), cacheKey, encoded, getJitteredTTL())
 	fmt.Printf("Set posts cache")
 	return
 }
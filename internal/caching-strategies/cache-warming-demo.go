@@ -0,0 +1,139 @@
+package caching_strategies
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	cache_warming "andreashoj/deeper-learnings/internal/cache-warming"
+	near_cache "andreashoj/deeper-learnings/internal/near-cache"
+)
+
+// Two lives of the same instance. The first serves skewed traffic - a few users are read all the time - and snapshots what was hot.
+// Then it "restarts" with an empty cache, once cold and once warmed from the snapshot, and we count how many of the first
+// requests after the restart still had to go to the database. Everything in process, the database is a fake with a slow query
+func StartCacheWarmingDemo() {
+	ctx := context.Background()
+	dir, err := os.MkdirTemp("", "cache-warming")
+	if err != nil {
+		fmt.Printf("failed creating snapshot dir: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := cache_warming.DefaultConfig(filepath.Join(dir, "snapshot.json"))
+	cfg.TopN, cfg.Rate, cfg.Concurrency = 200, 500, 4
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.2, 1, 999)
+	nextKey := func() string { return fmt.Sprintf("users:%d", zipf.Uint64()+1) }
+
+	// First life
+	before := newWarmingInstance(cfg)
+	for range 5000 {
+		key := nextKey()
+		before.warmer.Touch(key)
+		before.get(ctx, key)
+	}
+	if err = before.warmer.Snapshot(); err != nil {
+		fmt.Printf("failed snapshotting: %s\n", err)
+		return
+	}
+	hot := before.warmer.Hot()
+	fmt.Printf("first life: %d distinct keys read, the hottest %s read %d times, snapshot taken\n\n", len(hot), hot[0].Key, hot[0].Hits)
+
+	fmt.Printf("%-8s %10s %14s %22s %22s\n", "restart", "warm time", "warm queries", "misses, first 500 req", "misses, first 5000 req")
+	for _, warm := range []bool{false, true} {
+		instance := newWarmingInstance(cfg)
+		server := httptest.NewServer(instance.router())
+
+		name, took := "cold", time.Duration(0)
+		if warm {
+			name = "warmed"
+			results := make(chan cache_warming.Result, 1)
+			go func() {
+				res, err := instance.warmer.Warm(ctx)
+				if err != nil {
+					fmt.Printf("failed warming: %s\n", err)
+				}
+				results <- res
+			}()
+			if status := readiness(server.URL); status != http.StatusServiceUnavailable {
+				fmt.Printf("readiness said %d while warming\n", status)
+			}
+			took = (<-results).Took
+			if status := readiness(server.URL); status != http.StatusOK {
+				fmt.Printf("readiness said %d after warming\n", status)
+			}
+		}
+		warmQueries := instance.queries.Load()
+
+		var missesEarly int64
+		for i := range 5000 {
+			if i == 500 {
+				missesEarly = instance.queries.Load() - warmQueries
+			}
+			key := nextKey()
+			instance.warmer.Touch(key)
+			instance.get(ctx, key)
+		}
+		server.Close()
+
+		fmt.Printf("%-8s %10v %14d %22d %22d\n", name, took.Round(time.Millisecond), warmQueries, missesEarly, instance.queries.Load()-warmQueries)
+	}
+}
+
+type warmingInstance struct {
+	warmer  *cache_warming.Warmer
+	cache   near_cache.L2
+	queries atomic.Int64
+}
+
+func newWarmingInstance(cfg cache_warming.Config) *warmingInstance {
+	i := &warmingInstance{warmer: cache_warming.New(cfg), cache: near_cache.NewMemoryL2(0)}
+	i.warmer.Register("users:", func(ctx context.Context, key string) error {
+		_, err := i.load(ctx, key)
+		return err
+	})
+
+	return i
+}
+
+func (i *warmingInstance) get(ctx context.Context, key string) ([]byte, error) {
+	value, err := i.cache.Get(ctx, key)
+	if errors.Is(err, near_cache.ErrMiss) {
+		return i.load(ctx, key)
+	}
+
+	return value, err
+}
+
+func (i *warmingInstance) load(ctx context.Context, key string) ([]byte, error) {
+	i.queries.Add(1)
+	time.Sleep(2 * time.Millisecond)
+	value := fmt.Appendf(nil, `{"key":%q}`, key)
+
+	return value, i.cache.Set(ctx, key, value, time.Minute)
+}
+
+func (i *warmingInstance) router() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", i.warmer.ReadyHandler)
+
+	return mux
+}
+
+func readiness(url string) int {
+	res, err := http.Get(url + "/readyz")
+	if err != nil {
+		return 0
+	}
+	res.Body.Close()
+
+	return res.StatusCode
+}
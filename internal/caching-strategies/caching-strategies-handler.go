@@ -1,18 +1,21 @@
 package caching_strategies
 
 import (
+	cache_codec "andreashoj/deeper-learnings/internal/cache-codec"
 	"andreashoj/deeper-learnings/internal/db"
+	http_cache "andreashoj/deeper-learnings/internal/http-cache"
 	query_profiling "andreashoj/deeper-learnings/internal/query-profiling"
-	"bytes"
+	"andreashoj/deeper-learnings/internal/session"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"net/http/httptest"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/lib/pq"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -22,6 +25,9 @@ var rdb = redis.NewClient(&redis.Options{
 	DB:       0,
 })
 
+// In front of the redis cached routes, a hit never reaches the handler. Purged whenever users change
+var responseCache = http_cache.NewCache(100)
+
 // Could be abstracted into it's own package with accessors - "cache" => GetUserKey, GetUsersKey?
 const (
 	CacheKeyUsers = "users"
@@ -31,10 +37,18 @@ const (
 func StartCachingStrategiesHandler(r *chi.Mux) {
 	query_profiling.InsertUsersAndPosts() // Seed DB with users and posts
 
-	r.Get("/api/cache/hit", handlerAnalyzer(getUsers))
+	// The redis cached routes also get ETags and 304s, and sit behind the shared response cache.
+	// Users are a strong ETag, the byte for byte same list. The posts and users are weak, the same content is all we promise there
+	r.With(responseCache.Middleware, http_cache.Conditional(http_cache.Policy{MaxAge: 10 * time.Second, Vary: []string{"Accept-Encoding"}})).
+		Get("/api/cache/hit", handlerAnalyzer(getUsers))
 	r.Get("/api/no-cache/hit", handlerAnalyzer(getUsersNoCache))
-	r.Get("/api/cache/posts", handlerAnalyzer(getUsersAndPosts))
+	r.With(responseCache.Middleware, http_cache.Conditional(http_cache.Policy{MaxAge: 30 * time.Second, SMaxAge: 10 * time.Second, WeakETag: true, Vary: []string{"Accept-Encoding"}})).
+		Get("/api/cache/posts", handlerAnalyzer(getUsersAndPosts))
 	r.Get("/api/no-cache/posts", handlerAnalyzer(getUsersAndPostsNoCache))
+	r.Get("/api/http-cache/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(http_cache.GetStats())
+	})
 
 	r.Post("/api/user-invalidate", handlerAnalyzer(createUserManualCacheInvalidation))
 	r.Post("/api/user-update", handlerAnalyzer(createUserCacheUpdate))
@@ -55,17 +69,15 @@ func handlerAnalyzer(handler http.HandlerFunc) http.HandlerFunc {
 }
 
 func updateUserRole(r *chi.Mux) {
-	// Register routes
-	// Log user in - cache user
-	// Update user role - admin updates the user
-	// Make "unauthorized" request from user - that will succeed wrongfully
+	// Log user in - gets a session
+	// Update user role - admin takes admin away from the user, which revokes their sessions
+	// Make "unauthorized" request from user - used to succeed with the permissions cached at login, now a 401
 
 	userID := 1
 	userAdminRole := 999
 
-	r.Post("/api/login", login)
-	r.Post("/api/user", updateUserPermissions)
-	r.Get("/api/secret-data", getUserDetails)
+	sessions := newSessions(postgresPermissions{})
+	registerSessionRoutes(r, sessions, postgresPermissions{}, getUserDetails)
 
 	testServer := httptest.NewServer(r)
 	defer testServer.Close()
@@ -76,59 +88,17 @@ func updateUserRole(r *chi.Mux) {
 		fmt.Printf("failed inserting the user / permission role into the users_permissions table: %s", err)
 		return
 	}
-
-	// Simulate bad path here
-	// Login req - caches user
-	loginRes, err := http.Post(
-		testServer.URL+"/api/login",
-		"application/json",
-		bytes.NewBufferString(`{"username": "anz", "password": "tester12"}`),
-	)
-
-	if err != nil {
-		fmt.Printf("failed logging in..: %s", err)
-		return
-	}
-
-	defer loginRes.Body.Close()
-
-	body, err := io.ReadAll(loginRes.Body)
-	if err != nil {
-		fmt.Printf("failed reading login response body: %s", err)
-		return
-	}
-
-	fmt.Println(string(body)) // User!
-
-	// Update user permission
-	updateUserPermissionResp, err := http.Post(
-		testServer.URL+"/api/user",
-		"application/json",
-		bytes.NewBufferString(`{ "id": 1, "permissions": [1, 2]}`),
-	)
-
-	if err != nil {
-		fmt.Printf("failed updating user permissions: %s", err)
-		return
-	}
-
-	defer updateUserPermissionResp.Body.Close()
-
-	// Make request that requires ADMIN - (999)
-	getUsersRes, err := http.Get(testServer.URL + "/api/secret-data")
-
-	if err != nil {
-		fmt.Printf("failed logging in..: %s", err)
+	// The insert above changed the permissions too, so it has to revoke like any other change
+	if _, err = sessions.Revoke(context.Background(), userID); err != nil {
+		fmt.Printf("failed revoking sessions: %s", err)
 		return
 	}
 
-	defer loginRes.Body.Close()
-
-	body, err = io.ReadAll(getUsersRes.Body)
-	if err != nil {
-		fmt.Printf("failed getting user res body: %s", err)
+	if err = checkRevocation(testServer.URL); err != nil {
+		fmt.Printf("\nrevocation check failed: %s\n", err)
 		return
 	}
+	fmt.Println("\nrevocation check passed: demoted user got a 401 with their old session")
 }
 
 type UserRes struct {
@@ -137,153 +107,207 @@ type UserRes struct {
 	Permissions []int  `json:"permissions,omitempty"`
 }
 
-func login(w http.ResponseWriter, r *http.Request) {
-	userID := 1
-	// Authorize user
-	var req struct {
-		Username string `json:"username,omitempty"`
-		Password string `json:"password,omitempty"`
-	}
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		fmt.Printf("failed decoding user: %s", err)
-		return
+type LoginRes struct {
+	UserRes
+	Token string `json:"token"`
+}
+
+func login(sessions *session.Manager, users permissionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := 1
+		// Authorize user
+		var req struct {
+			Username string `json:"username,omitempty"`
+			Password string `json:"password,omitempty"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			fmt.Printf("failed decoding user: %s", err)
+			w.WriteHeader(400)
+			return
+		}
+
+		res, err := users.load(r.Context(), userID)
+		if err != nil {
+			fmt.Printf("failed getting user: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+
+		// Nothing about the user is cached here anymore. The permissions in the response are for display,
+		// authorization reads them through the session, cached per generation
+		token, _, err := sessions.Issue(r.Context(), res.UserID)
+		if err != nil {
+			fmt.Printf("failed creating session: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+
+		response, err := json.Marshal(LoginRes{UserRes: res, Token: token})
+		if err != nil {
+			fmt.Printf("failed decoding user: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+
+		sessions.SetCookie(w, token)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(response)
 	}
+}
 
-	var res UserRes
-	res.UserID = userID
+// The user with their permissions, errNotFound when the user doesn't exist
+func loadUserRes(ctx context.Context, userID int) (UserRes, error) {
+	res := UserRes{UserID: userID}
 
-	rows, err := db.DB.Query(`SELECT users.name, permission_id FROM users LEFT JOIN users_permissions ON users.id = users_permissions.user_id WHERE id = $1 `, userID)
+	rows, err := db.DB.QueryContext(ctx, `SELECT users.name, permission_id FROM users LEFT JOIN users_permissions ON users.id = users_permissions.user_id WHERE id = $1 `, userID)
 	if err != nil {
-		fmt.Printf("failed getting user: %s", err)
-		return
+		return res, fmt.Errorf("failed getting user: %w", err)
 	}
+	defer rows.Close()
 
-	var permissions []int
+	found := false
 	for rows.Next() {
-		var permission int
+		var permission sql.NullInt64 // NULL for a user without permissions
 		err = rows.Scan(&res.Username, &permission)
 		if err != nil {
-			fmt.Printf("failed mapping username/permissions: %s", err)
-			return
+			return res, fmt.Errorf("failed mapping username/permissions: %w", err)
 		}
 
-		permissions = append(permissions, permission)
+		found = true
+		if permission.Valid {
+			res.Permissions = append(res.Permissions, int(permission.Int64))
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return res, fmt.Errorf("failed getting user: %w", err)
+	}
+	if !found {
+		return res, fmt.Errorf("user %d: %w", userID, errNotFound)
 	}
 
-	res.Permissions = permissions
+	return res, nil
+}
 
-	response, err := json.Marshal(res)
-	if err != nil {
-		fmt.Printf("failed decoding user: %s", err)
-		return
-	}
+func updateUserPermissions(sessions *session.Manager, users permissionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Id          int   `json:"id,omitempty"`
+			Permissions []int `json:"permissions,omitempty"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			fmt.Printf("failed decoding user: %s", err)
+			w.WriteHeader(400)
+			return
+		}
 
-	// Cache user
-	rdb.Set(r.Context(), fmt.Sprintf(CacheKeyUser, res.UserID), response, 5*time.Minute)
+		if err = users.replace(r.Context(), req.Id, req.Permissions); err != nil {
+			fmt.Printf("failed updating permissions: %s", err)
+			w.WriteHeader(500)
+			return
+		}
 
-	w.WriteHeader(200)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(response)
-}
+		// Only after the commit: a request that sees the new generation must also see the new permissions.
+		// If this fails the old sessions live on with the old permissions, so the caller has to know
+		gen, err := sessions.Revoke(r.Context(), req.Id)
+		if err != nil {
+			fmt.Printf("failed revoking sessions of user %d: %s", req.Id, err)
+			w.WriteHeader(500)
+			return
+		}
 
-func updateUserPermissions(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Id          int   `json:"id,omitempty"`
-		Permissions []int `json:"permissions,omitempty"`
-	}
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		fmt.Printf("failed decoding user: %s", err)
-		return
-	}
+		// Not for authorization anymore, but getUserDetails reads the user through this key
+		if err = rdb.Del(r.Context(), fmt.Sprintf(CacheKeyUser, req.Id)).Err(); err != nil {
+			fmt.Printf("failed deleting cached user %d: %s", req.Id, err)
+		}
 
-	// Start transaction..
-	tx, err := db.DB.BeginTx(r.Context(), nil)
-	if err != nil {
-		fmt.Printf("failed starting transaction: %s", err)
-		return
+		fmt.Printf("updated user the user to have permissions: %v, now at generation %d\n", req.Permissions, gen)
+		w.WriteHeader(201)
 	}
-	defer tx.Rollback()
+}
 
-	// Delete
-	_, err = tx.ExecContext(r.Context(), `DELETE FROM users_permissions WHERE user_id = $1`, req.Id)
-	if err != nil {
-		fmt.Printf("failed deleting user permission: %s", err)
+// Only reached through session.Require, which checked the admin permission against the user's current permissions
+func getUserDetails(w http.ResponseWriter, r *http.Request) {
+	current, ok := session.FromContext(r.Context())
+	if !ok {
+		w.WriteHeader(401)
 		return
 	}
 
-	// Create new
-	_, err = tx.Exec("INSERT INTO users_permissions (user_id, permission_id) SELECT $1 ja, unnest($2::int[])", req.Id, pq.Array(req.Permissions))
-	if err != nil {
-		fmt.Printf("failed inserting users and permissions")
-		return
+	// Read through: a miss loads the user from postgres, a user that doesn't exist is caught by the bloom filter or the negative cache
+	users := &guardedCache{
+		redis:       rdb,
+		keyFormat:   CacheKeyUser,
+		ttl:         5 * time.Minute,
+		negativeTTL: NegativeTTL,
+		known:       knownUserFilter(),
+		load: func(ctx context.Context, id int) ([]byte, error) {
+			res, err := loadUserRes(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			return cacheCodec.Encode(res)
+		},
 	}
-
-	// NOT updating the cached user here.
-	err = tx.Commit()
-	if err != nil {
-		fmt.Printf("failed commiting transaction: %s", err)
+	cachedUserWithPermissions, result, err := users.get(r.Context(), current.UserID)
+	w.Header().Set("X-Cache", result)
+	if errors.Is(err, errNotFound) { // A valid session of a deleted user
+		w.WriteHeader(404)
 		return
 	}
-
-	fmt.Printf("updated user the user to have permissions: %v", req.Permissions)
-	w.WriteHeader(201)
-}
-
-func getUserDetails(w http.ResponseWriter, r *http.Request) {
-	// Usually the id retrieval and authorization would happen through a guard and cookie etc, we don't need that for testing though! So the id is just the same as in the previous endpoints
-	userID := 1
-	adminID := 999
-	cachedUserWithPermissions, err := rdb.Get(r.Context(), fmt.Sprintf(CacheKeyUser, userID)).Result()
 	if err != nil {
-		fmt.Printf("couldn't find cached user: %s", err)
+		fmt.Printf("couldn't get user: %s", err)
+		w.WriteHeader(500)
 		return
 	}
 
 	var user UserRes
-	err = json.Unmarshal([]byte(cachedUserWithPermissions), &user)
+	err = cacheCodec.Decode(cachedUserWithPermissions, &user)
+	if errors.Is(err, cache_codec.ErrIncompatible) { // Cached by an older version, drop it and read through again
+		rdb.Del(r.Context(), fmt.Sprintf(CacheKeyUser, current.UserID))
+		if cachedUserWithPermissions, _, err = users.get(r.Context(), current.UserID); err == nil {
+			err = cacheCodec.Decode(cachedUserWithPermissions, &user)
+		}
+	}
 	if err != nil {
 		fmt.Printf("failed decoding cached user: %s", err)
+		w.WriteHeader(500)
 		return
 	}
 
-	// At this point the user does NOT have admin privileges, it was removed in the previous request
-	hasAdmin := false
-	for _, permission := range user.Permissions {
-		if permission == adminID { // This becomes true because the user.Permissions is from the cache which is STALE and did not get updated in the previous request
-			hasAdmin = true
-			break
-		}
+	// Get details of all users
+	var details []query_profiling.User
+	rows, err := db.DB.QueryContext(r.Context(), `SELECT id, name, username FROM users`)
+	if err != nil {
+		fmt.Printf("failed getting users: %s", err)
+		w.WriteHeader(500)
+		return
 	}
+	defer rows.Close()
 
-	if hasAdmin {
-		// Get details of all users
-		var users []query_profiling.User
-		rows, err := db.DB.Query(`SELECT id, name, username FROM users`)
+	for rows.Next() {
+		var detail query_profiling.User
+		err = rows.Scan(&detail.Id, &detail.Name, &detail.Username)
 		if err != nil {
-			fmt.Printf("failed getting users: %s", err)
+			fmt.Printf("failed mapping user: %s", err)
+			w.WriteHeader(500)
 			return
 		}
-		for rows.Next() {
-			var user query_profiling.User
-			err = rows.Scan(&user.Id, &user.Name, &user.Username)
-			if err != nil {
-				fmt.Printf("failed mapping user: %s", err)
-				return
-			}
-
-			users = append(users, user)
-		}
 
-		fmt.Println("here")
-		w.WriteHeader(200)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(users)
+		details = append(details, detail)
+	}
+	if err = rows.Err(); err != nil {
+		fmt.Printf("failed reading users: %s", err)
+		w.WriteHeader(500)
 		return
 	}
 
-	w.WriteHeader(401)
+	fmt.Printf("user %s read the details of %d users\n", user.Username, len(details))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(details)
 }
 
 func createUserManualCacheInvalidation(w http.ResponseWriter, r *http.Request) {
@@ -328,6 +352,7 @@ func createUserCacheUpdate(w http.ResponseWriter, r *http.Request) {
 			fmt.Printf("failed getting users: %s", err)
 			return
 		}
+		defer rows.Close()
 
 		var users []query_profiling.User
 		for rows.Next() {
@@ -395,6 +420,7 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 			fmt.Printf("failed converting json to users slice: %s", err)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(200)
 		json.NewEncoder(w).Encode(users)
 		return
@@ -415,8 +441,8 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 	// store cache
 	rdb.Set(r.Context(), CacheKeyUsers, usersJSON, 5*time.Minute)
 
-	w.WriteHeader(200)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
 	w.Write(usersJSON)
 }
 
@@ -443,8 +469,10 @@ func getUsersAndPosts(w http.ResponseWriter, r *http.Request) {
 
 	result, err := rdb.Get(r.Context(), cacheKey).Result()
 	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(200)
 		w.Write([]byte(result))
+		return
 	}
 
 	posts, users, err := query_profiling.GetPostsAndUsersNPlus()
@@ -468,7 +496,6 @@ func getUsersAndPosts(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(responseJSON)
-	w.WriteHeader(200)
 }
 
 func getUsersAndPostsNoCache(w http.ResponseWriter, r *http.Request) {
@@ -507,6 +534,9 @@ func repoCreateUser(r *http.Request) (*query_profiling.User, error) {
 		fmt.Printf("failed inserting user: %s", err)
 		return nil, err
 	}
+	rememberUser(r.Context(), user.Id)
+	responseCache.Purge("/api/cache/hit")
+	responseCache.Purge("/api/cache/posts")
 
 	return &user, nil
 }
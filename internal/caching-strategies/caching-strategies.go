@@ -52,7 +52,7 @@ func getUser(rdb *redisClient) {
 
 func startRedisClient() *redisClient {
 	client := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6380",
+		Addr:     rdb.Options().Addr, // Follows UseInProcessRedis
 		Password: "",
 		DB:       0,
 	})
@@ -0,0 +1,90 @@
+import {useQuery} from "@tanstack/react-query";
+
+interface PoolSample {
+    saturation: number;
+    waits_per_sec: number;
+    mean_wait_ms: number;
+    requests_per_sec: number;
+    stats: {
+        MaxOpenConnections: number;
+        InUse: number;
+        Idle: number;
+    };
+}
+
+interface PoolReport {
+    name: string;
+    leaking: boolean;
+    latest: PoolSample | null;
+}
+
+interface PoolEvent {
+    time: string;
+    pool: string;
+    level: string;
+    kind: string;
+    message: string;
+}
+
+interface PoolHealthResponse {
+    pools: PoolReport[];
+    events: PoolEvent[] | null;
+}
+
+function PoolHealth() {
+    // /api/pool/health only exists while StartPoolMonitorDemo runs, a 404 means there's nothing to show and we stop polling
+    const {data, isError} = useQuery({
+        queryKey: ["pool-health"],
+        queryFn: async (): Promise<PoolHealthResponse | null> => {
+            const res = await fetch("http://localhost:8080/api/pool/health")
+            if (res.status === 404) {
+                return null
+            }
+            return res.json()
+        },
+        refetchInterval: (query) => (query.state.data === null ? false : 1000),
+    })
+
+    if (isError || !data) {
+        return null
+    }
+
+    return (
+        <div className="bg-gray-800 text-white rounded-lg p-4 mb-8 text-left">
+            {data.pools.map((pool) => (
+                <ul key={pool.name} className="w-full mb-2">
+                    <li className="flex">
+                        <span className="w-40">Pool:</span>
+                        {pool.name} {pool.leaking ? <span className="text-red-400 ml-2">leak suspected</span> : null}
+                    </li>
+                    {pool.latest ? (
+                        <>
+                            <li className="flex">
+                                <span className="w-40">In use:</span>
+                                {pool.latest.stats.InUse}/{pool.latest.stats.MaxOpenConnections || "∞"} ({(pool.latest.saturation * 100).toFixed(0)}%)
+                            </li>
+                            <li className="flex">
+                                <span className="w-40">Waits:</span>
+                                {pool.latest.waits_per_sec.toFixed(1)}/s, mean {pool.latest.mean_wait_ms.toFixed(1)}ms
+                            </li>
+                            <li className="flex">
+                                <span className="w-40">Throughput:</span>
+                                {pool.latest.requests_per_sec.toFixed(1)} req/s
+                            </li>
+                        </>
+                    ) : null}
+                </ul>
+            ))}
+
+            <div className="bg-gray-700 rounded p-4 mt-2 font-serif">
+                {(data.events ?? []).slice(-5).map((event) => (
+                    <div key={event.time + event.kind}>
+                        [{event.level}] {event.pool}: {event.message}
+                    </div>
+                ))}
+            </div>
+        </div>
+    )
+}
+
+export default PoolHealth
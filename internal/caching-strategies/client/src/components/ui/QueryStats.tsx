@@ -1,39 +1,66 @@
 import Button from "./Button.tsx";
 import {useMutation} from "@tanstack/react-query";
-import {useState} from "react";
+import {useRef, useState} from "react";
 
 export interface QueryStatsProps {
     method: string;
     url: string;
     headers?: Record<string, string>;
     body?: any;
+    conditional?: boolean; // Sends the last ETag back as If-None-Match
 }
 
-function QueryStats({ method, url, body, headers }: QueryStatsProps ) {
+interface Transfer {
+    status: number;
+    bytes: number;
+    cache: string | null;
+}
+
+function QueryStats({ method, url, body, headers, conditional }: QueryStatsProps ) {
     const [duration, setDuration] = useState<string | null>(null)
+    const [transfer, setTransfer] = useState<Transfer | null>(null)
+    // The last full response, what a 304 saved is measured against
+    const [full, setFull] = useState<{ bytes: number, duration: number } | null>(null)
+    const etag = useRef<string | null>(null)
+
     const {mutate} = useMutation({
         mutationFn: async () => {
+            const requestHeaders: Record<string, string> = {...headers}
+            if (conditional && etag.current) {
+                requestHeaders["If-None-Match"] = etag.current
+            }
+
             const start = performance.now()
             const res = await fetch("http://localhost:8080" + url, {
                 method: method,
-                headers: headers,
-                body: body
+                headers: requestHeaders,
+                body: body,
+                cache: "no-store", // Otherwise the browser revalidates on its own and hands us the 200 from its cache
             })
-
+            const text = await res.text()
             const end = performance.now()
+
+            const bytes = new TextEncoder().encode(text).length
             setDuration(((end - start) / 1000).toFixed(4))
-            return res.json()
+            setTransfer({status: res.status, bytes: bytes, cache: res.headers.get("X-Cache")})
+            if (res.status === 200) {
+                etag.current = res.headers.get("ETag")
+                setFull({bytes: bytes, duration: (end - start) / 1000})
+            }
+
+            return text ? JSON.parse(text) : null
         },
     })
 
     return (
         <>
             <div className="bg-gray-800 text-white rounded-lg p-4 mb-2 text-left">
-                <QueryStatsDetails method={method} url={url} headers={headers} body={body} duration={duration}/>
+                <QueryStatsDetails method={method} url={url} headers={headers} body={body} duration={duration}
+                                   transfer={transfer} full={full} conditional={conditional}/>
 
                 <div className="bg-gray-700 rounded p-4 mt-2 font-serif">
                     Headers:
-                    { "  {  }" }
+                    { conditional && etag.current ? `  { If-None-Match: ${etag.current} }` : "  {  }" }
                     <span className="my-4 block"/>
 
                     Payload:
@@ -49,7 +76,17 @@ function QueryStats({ method, url, body, headers }: QueryStatsProps ) {
     )
 }
 
-function QueryStatsDetails({method, url, duration}: QueryStatsProps & { duration: string | null }) {
+interface QueryStatsDetailsProps extends QueryStatsProps {
+    duration: string | null;
+    transfer: Transfer | null;
+    full: { bytes: number, duration: number } | null;
+}
+
+function QueryStatsDetails({method, url, duration, transfer, full, conditional}: QueryStatsDetailsProps) {
+    const saved = transfer?.status === 304 && full && duration
+        ? `${full.bytes - transfer.bytes} bytes, ${(full.duration - Number(duration)).toFixed(4)}s`
+        : null
+
     return (
         <ul className="w-full">
             <li className="flex">
@@ -62,7 +99,7 @@ function QueryStatsDetails({method, url, duration}: QueryStatsProps & { duration
                 <span className="w-20">
                     Request:
                 </span>
-                { url }
+                { url }{ conditional ? " (conditional)" : null }
             </li>
             <li className="flex">
                 <span className="w-20">
@@ -70,8 +107,24 @@ function QueryStatsDetails({method, url, duration}: QueryStatsProps & { duration
                 </span>
                 { duration }{ duration ? "s" : null}
             </li>
+            { transfer ? (
+                <li className="flex">
+                    <span className="w-20">
+                        Status:
+                    </span>
+                    { transfer.status } - { transfer.bytes } bytes{ transfer.cache ? `, shared cache ${transfer.cache}` : null }
+                </li>
+            ) : null }
+            { saved ? (
+                <li className="flex">
+                    <span className="w-20">
+                        Saved:
+                    </span>
+                    { saved }
+                </li>
+            ) : null }
         </ul>
     )
 }
 
-export default QueryStats
\ No newline at end of file
+export default QueryStats
@@ -1,14 +1,16 @@
 import QueryStats from "../components/ui/QueryStats.tsx";
+import PoolHealth from "../components/ui/PoolHealth.tsx";
 
 function Dashboard() {
     return (
         <div className="flex flex-col overflow-hidden">
+            <PoolHealth />
             <QueryStats method="GET" url="/api/cache/hit" />
             <QueryStats method="GET" url="/api/no-cache/hit" />
             <QueryStats method="GET" url="/api/no-cache/posts" />
             <QueryStats method="GET" url="/api/cache/posts" />
-            <QueryStats method="GET" url="/api/cache/hit" />
-            <QueryStats method="GET" url="/api/cache/hit" />
+            <QueryStats method="GET" url="/api/cache/hit" conditional />
+            <QueryStats method="GET" url="/api/cache/posts" conditional />
         </div>
     )
 }
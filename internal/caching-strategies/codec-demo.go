@@ -0,0 +1,172 @@
+package caching_strategies
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	cache_codec "andreashoj/deeper-learnings/internal/cache-codec"
+	query_profiling "andreashoj/deeper-learnings/internal/query-profiling"
+)
+
+// What the posts and login user caches are written with. Bump the schema version when Post or UserRes change shape,
+// values from the old version then read as a miss instead of a half filled struct
+var cacheCodec = cache_codec.Versioned(1, cache_codec.MsgPack())
+
+var codecs = []cache_codec.Codec{
+	cache_codec.JSON(),
+	cache_codec.Gob(),
+	cache_codec.MsgPack(),
+	cache_codec.Gzip(cache_codec.JSON(), 256),
+	cache_codec.Fast(cache_codec.JSON(), 256),
+	cache_codec.Gzip(cache_codec.MsgPack(), 256),
+	cache_codec.Fast(cache_codec.MsgPack(), 256),
+}
+
+type codecPayload struct {
+	name  string
+	value any
+	into  func() any // A fresh pointer to decode into
+}
+
+// Every codec against the payloads we actually cache: bytes stored, encode and decode time, and the full round trip
+// of encode, SET, GET and decode through redis. Uses the posts and users in the DB when it's up, otherwise the same shape as the seed
+func StartCodecComparison() {
+	ctx := context.Background()
+	payloads := codecPayloads()
+
+	fmt.Printf("\n%-22s %-14s %10s %12s %12s %14s\n", "payload", "codec", "bytes", "encode", "decode", "redis round")
+	redisUp := rdb.Ping(ctx).Err() == nil
+	for _, payload := range payloads {
+		iterations := 2000
+		if _, isList := payload.value.([]query_profiling.Post); isList {
+			iterations = 200
+		}
+
+		for _, codec := range codecs {
+			res, err := measureCodec(ctx, codec, payload, iterations, redisUp)
+			if err != nil {
+				fmt.Printf("failed measuring %s on %s: %s\n", codec.Name(), payload.name, err)
+				return
+			}
+			round := "-"
+			if redisUp {
+				round = res.round.Round(time.Microsecond).String()
+			}
+			fmt.Printf("%-22s %-14s %10d %12v %12v %14s\n", payload.name, codec.Name(), res.size,
+				res.encode.Round(100*time.Nanosecond), res.decode.Round(100*time.Nanosecond), round)
+		}
+		fmt.Println()
+	}
+	if !redisUp {
+		fmt.Println("redis not reachable, skipped the round trips - UseInProcessRedis runs them without docker")
+	}
+
+	showSchemaVersioning()
+}
+
+func codecPayloads() []codecPayload {
+	posts, err := query_profiling.GetPosts()
+	if err != nil || len(posts) == 0 {
+		posts = make([]query_profiling.Post, 1000)
+		for i := range posts {
+			posts[i] = query_profiling.Post{Id: i + 1, Name: strconv.Itoa(i + 1), UserID: i + 1}
+		}
+	}
+
+	users := make([]query_profiling.User, 1000)
+	for i := range users {
+		users[i] = query_profiling.User{Id: i + 1, Name: strconv.Itoa(i + 1), Username: "anz", Password: "tester123"}
+	}
+
+	return []codecPayload{
+		{"login user", UserRes{UserID: 1, Username: "1", Permissions: []int{1, 999}}, func() any { return &UserRes{} }},
+		{"user", users[0], func() any { return &query_profiling.User{} }},
+		{fmt.Sprintf("posts (%d)", len(posts)), posts, func() any { return &[]query_profiling.Post{} }},
+		{fmt.Sprintf("users (%d)", len(users)), users, func() any { return &[]query_profiling.User{} }},
+	}
+}
+
+type codecResult struct {
+	size                  int
+	encode, decode, round time.Duration
+}
+
+func measureCodec(ctx context.Context, codec cache_codec.Codec, payload codecPayload, iterations int, redisUp bool) (codecResult, error) {
+	var res codecResult
+
+	var data []byte
+	var err error
+	start := time.Now()
+	for range iterations {
+		if data, err = codec.Encode(payload.value); err != nil {
+			return res, fmt.Errorf("failed encoding: %w", err)
+		}
+	}
+	res.encode = time.Since(start) / time.Duration(iterations)
+	res.size = len(data)
+
+	start = time.Now()
+	for range iterations {
+		if err = codec.Decode(data, payload.into()); err != nil {
+			return res, fmt.Errorf("failed decoding: %w", err)
+		}
+	}
+	res.decode = time.Since(start) / time.Duration(iterations)
+
+	if !redisUp {
+		return res, nil
+	}
+
+	key := "codec-comparison:" + codec.Name()
+	rounds := iterations / 10
+	start = time.Now()
+	for range rounds {
+		encoded, err := codec.Encode(payload.value)
+		if err != nil {
+			return res, fmt.Errorf("failed encoding: %w", err)
+		}
+		if err = rdb.Set(ctx, key, encoded, time.Minute).Err(); err != nil {
+			return res, fmt.Errorf("failed setting %s: %w", key, err)
+		}
+		cached, err := rdb.Get(ctx, key).Bytes()
+		if err != nil {
+			return res, fmt.Errorf("failed getting %s: %w", key, err)
+		}
+		if err = codec.Decode(cached, payload.into()); err != nil {
+			return res, fmt.Errorf("failed decoding: %w", err)
+		}
+	}
+	res.round = time.Since(start) / time.Duration(rounds)
+	rdb.Del(ctx, key)
+
+	return res, nil
+}
+
+// A deploy changes the cached type, old and new instances run side by side for a while.
+// Without the header the new code would decode the old value "fine" with fields missing, with it both sides see a miss
+func showSchemaVersioning() {
+	user := UserRes{UserID: 1, Username: "1", Permissions: []int{1, 999}}
+	v1 := cache_codec.Versioned(1, cache_codec.MsgPack())
+	v2 := cache_codec.Versioned(2, cache_codec.MsgPack())
+
+	written, err := v1.Encode(user)
+	if err != nil {
+		fmt.Printf("failed encoding: %s\n", err)
+		return
+	}
+
+	var decoded UserRes
+	err = v2.Decode(written, &decoded)
+	fmt.Printf("v1 value read by v2:            miss=%t (%v)\n", errors.Is(err, cache_codec.ErrIncompatible), err)
+
+	legacy, _ := cache_codec.JSON().Encode(user) // What login wrote before the codecs
+	err = v1.Decode(legacy, &decoded)
+	fmt.Printf("unversioned json read by v1:    miss=%t (%v)\n", errors.Is(err, cache_codec.ErrIncompatible), err)
+
+	gzipped, _ := cache_codec.Versioned(1, cache_codec.Gzip(cache_codec.MsgPack(), 0)).Encode(user)
+	err = v1.Decode(gzipped, &decoded)
+	fmt.Printf("gzip value read by plain codec: miss=%t (%v)\n", errors.Is(err, cache_codec.ErrIncompatible), err)
+}
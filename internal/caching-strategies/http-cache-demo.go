@@ -0,0 +1,113 @@
+package caching_strategies
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	http_cache "andreashoj/deeper-learnings/internal/http-cache"
+	query_profiling "andreashoj/deeper-learnings/internal/query-profiling"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The ETag and 304 flow and the shared cache without postgres or redis: a users list that only changes when we say so,
+// a greeting that varies on Accept-Language, and a private profile a shared cache must never keep
+func StartHTTPCacheDemo() {
+	var handlerRuns atomic.Int64
+	users := make([]query_profiling.User, 1000)
+	for i := range users {
+		users[i] = query_profiling.User{Id: i + 1, Name: strconv.Itoa(i + 1)}
+	}
+
+	shared := http_cache.NewCache(100)
+	r := chi.NewRouter()
+	r.With(shared.Middleware, http_cache.Conditional(http_cache.Policy{MaxAge: 10 * time.Second})).
+		Get("/users", func(w http.ResponseWriter, r *http.Request) {
+			handlerRuns.Add(1)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(users)
+		})
+	r.With(shared.Middleware, http_cache.Conditional(http_cache.Policy{MaxAge: time.Minute, Vary: []string{"Accept-Language"}})).
+		Get("/greeting", func(w http.ResponseWriter, r *http.Request) {
+			handlerRuns.Add(1)
+			if r.Header.Get("Accept-Language") == "da" {
+				w.Write([]byte("hej"))
+				return
+			}
+			w.Write([]byte("hello"))
+		})
+	r.With(shared.Middleware, http_cache.Conditional(http_cache.Policy{MaxAge: time.Minute, Private: true})).
+		Get("/me", func(w http.ResponseWriter, r *http.Request) {
+			handlerRuns.Add(1)
+			w.Write([]byte(`{"id":1,"permissions":[999]}`))
+		})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	var etag, lastModified string
+	steps := []struct {
+		name    string
+		path    string
+		headers func() map[string]string
+		before  func()
+	}{
+		{"first request", "/users", nil, nil},
+		{"again, shared cache is fresh", "/users", nil, nil},
+		{"If-None-Match", "/users", func() map[string]string { return map[string]string{"If-None-Match": etag} }, nil},
+		{"If-Modified-Since", "/users", func() map[string]string { return map[string]string{"If-Modified-Since": lastModified} }, nil},
+		{"client forces revalidation", "/users", func() map[string]string {
+			return map[string]string{"If-None-Match": etag, "Cache-Control": "no-cache"}
+		}, nil},
+		{"a user is added, cache purged", "/users", func() map[string]string { return map[string]string{"If-None-Match": etag} }, func() {
+			users = append(users, query_profiling.User{Id: len(users) + 1, Name: "new"})
+			shared.Purge("/users")
+		}},
+		{"greeting in english", "/greeting", func() map[string]string { return map[string]string{"Accept-Language": "en"} }, nil},
+		{"greeting in danish", "/greeting", func() map[string]string { return map[string]string{"Accept-Language": "da"} }, nil},
+		{"english again", "/greeting", func() map[string]string { return map[string]string{"Accept-Language": "en"} }, nil},
+		{"private profile", "/me", nil, nil},
+		{"private profile again", "/me", nil, nil},
+	}
+
+	fmt.Printf("%-32s %-10s %6s %8s %-6s %s\n", "request", "path", "status", "bytes", "cache", "handler ran")
+	for _, step := range steps {
+		if step.before != nil {
+			step.before()
+		}
+		req, err := http.NewRequest(http.MethodGet, server.URL+step.path, nil)
+		if err != nil {
+			fmt.Printf("failed creating request: %s\n", err)
+			return
+		}
+		if step.headers != nil {
+			for name, value := range step.headers() {
+				req.Header.Set(name, value)
+			}
+		}
+
+		runsBefore := handlerRuns.Load()
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Printf("failed requesting %s: %s\n", step.path, err)
+			return
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode == http.StatusOK && step.path == "/users" {
+			etag, lastModified = res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+		}
+		fmt.Printf("%-32s %-10s %6d %8d %-6s %t\n", step.name, step.path, res.StatusCode, len(body), res.Header.Get("X-Cache"),
+			handlerRuns.Load() > runsBefore)
+	}
+
+	stats := http_cache.GetStats()
+	fmt.Printf("\n%d requests, %d answered with 304, %d bytes sent, %d bytes saved, shared cache %d hits / %d misses\n",
+		stats.Requests, stats.NotModified, stats.BytesSent, stats.BytesSaved, stats.SharedHits, stats.SharedMisses)
+}
@@ -0,0 +1,30 @@
+package caching_strategies
+
+import (
+	"fmt"
+
+	redis_server "andreashoj/deeper-learnings/internal/redis-server"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// UseInProcessRedis points every redis client in this package at an in-process server on a free port,
+// so the experiments run without the docker compose redis. Call it before starting an experiment, stop puts the old clients back
+func UseInProcessRedis() (stop func(), err error) {
+	server, err := redis_server.Start("127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed starting in-process redis: %w", err)
+	}
+
+	oldRDB, oldrdb := RDB, rdb
+	RDB = redis.NewClient(&redis.Options{Addr: server.Addr()})
+	rdb = redis.NewClient(&redis.Options{Addr: server.Addr()})
+	fmt.Printf("in-process redis listening on %s\n", server.Addr())
+
+	return func() {
+		RDB.Close()
+		rdb.Close()
+		RDB, rdb = oldRDB, oldrdb
+		server.Close()
+	}, nil
+}
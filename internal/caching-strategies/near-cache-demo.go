@@ -0,0 +1,195 @@
+package caching_strategies
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	near_cache "andreashoj/deeper-learnings/internal/near-cache"
+)
+
+// Three instances reading and now and then writing the same keys, with every combination of tiers.
+// Reads tell us the latency, a read returning something other than what the "database" holds right now is a stale read.
+// Background readers keep loads running while the writes land, that's when a load can put the value from before a write back.
+// Redis is used when it's up, otherwise the in-process L2 and bus stand in for it
+func StartNearCacheDemo() {
+	ctx := context.Background()
+
+	l2, bus := near_cache.NewMemoryL2(300*time.Microsecond), near_cache.NewLocalBus()
+	l2Name := "in-process L2"
+	if err := rdb.Ping(ctx).Err(); err == nil {
+		l2, bus = near_cache.NewRedisL2(rdb), near_cache.NewRedisBus(rdb, "near-cache-invalidation")
+		l2Name = "redis"
+	} else {
+		fmt.Printf("redis not reachable, using the in-process L2 and bus: %s\n", err)
+	}
+
+	l1TTL := time.Second
+	setups := []struct {
+		name  string
+		l1TTL time.Duration
+		l2    near_cache.L2
+		bus   near_cache.Bus
+	}{
+		{"db only", 0, nil, nil},
+		{"L1 only", l1TTL, nil, bus},
+		{"L2 only (" + l2Name + ")", 0, l2, nil},
+		{"L1 + L2", l1TTL, l2, bus},
+		{"L1 + L2, no bus", l1TTL, l2, nil},
+	}
+
+	fmt.Printf("\n%-28s %12s %8s %8s %8s %8s %8s %16s\n", "tiers", "avg read", "L1 hits", "L2 hits", "loads", "dropped", "stale", "stale window")
+	for n, setup := range setups {
+		source := newFakeSource(2 * time.Millisecond)
+		runCtx, stop := context.WithCancel(ctx)
+
+		var instances []*near_cache.Cache
+		for i := range 3 {
+			cache, err := near_cache.New(runCtx, fmt.Sprintf("setup-%d-instance-%d", n, i),
+				near_cache.Config{L1TTL: setup.l1TTL, L2TTL: time.Minute}, setup.l2, setup.bus, source.load)
+			if err != nil {
+				fmt.Printf("failed creating cache: %s\n", err)
+				stop()
+				return
+			}
+			instances = append(instances, cache)
+		}
+
+		reads, stale, took, err := runNearCacheWorkload(ctx, source, instances)
+		if err != nil {
+			fmt.Printf("failed running %s: %s\n", setup.name, err)
+			stop()
+			return
+		}
+		window, err := measureStaleWindow(ctx, source, instances[0], instances[1], 3*l1TTL)
+		stop()
+		if err != nil {
+			fmt.Printf("failed measuring stale window: %s\n", err)
+			return
+		}
+
+		var total near_cache.Stats
+		for _, c := range instances {
+			s := c.Stats()
+			total.L1Hits += s.L1Hits
+			total.L2Hits += s.L2Hits
+			total.Loads += s.Loads
+			total.DroppedLoads += s.DroppedLoads
+		}
+		fmt.Printf("%-28s %12v %8d %8d %8d %8d %8d %16v\n", setup.name, (took / time.Duration(reads)).Round(time.Microsecond),
+			total.L1Hits, total.L2Hits, total.Loads, total.DroppedLoads, stale, window.Round(time.Millisecond))
+	}
+
+	fmt.Println("\nstale window: how long instance 1 keeps serving the old value after instance 0 wrote a new one")
+}
+
+// Plays the database: a map with a delay on every read, and a version per key so we can tell a stale read
+type fakeSource struct {
+	delay time.Duration
+
+	mu       sync.Mutex
+	versions map[string]int
+}
+
+func newFakeSource(delay time.Duration) *fakeSource {
+	return &fakeSource{delay: delay, versions: make(map[string]int)}
+}
+
+// Returns what the key held when the query ran, by the time it arrives a write may have landed
+func (s *fakeSource) load(ctx context.Context, key string) ([]byte, error) {
+	version := s.current(key)
+	time.Sleep(s.delay)
+	return []byte(strconv.Itoa(version)), nil
+}
+
+func (s *fakeSource) current(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.versions[key]
+}
+
+func (s *fakeSource) write(key string) int {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.versions[key]++
+	return s.versions[key]
+}
+
+func runNearCacheWorkload(ctx context.Context, source *fakeSource, instances []*near_cache.Cache) (int, int, time.Duration, error) {
+	prefix := strconv.FormatInt(time.Now().UnixNano(), 36) // Fresh keys, the L2 may still hold the last setup's
+	reads, stale := 0, 0
+	var took time.Duration
+
+	readersCtx, stopReaders := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer stopReaders()
+	for range 4 {
+		wg.Go(func() {
+			for readersCtx.Err() == nil {
+				key := fmt.Sprintf("near:%s:%d", prefix, rand.Intn(50))
+				instances[rand.Intn(len(instances))].Get(readersCtx, key)
+			}
+		})
+	}
+
+	for range 3000 {
+		key := fmt.Sprintf("near:%s:%d", prefix, rand.Intn(50))
+		c := instances[rand.Intn(len(instances))]
+
+		if rand.Intn(100) < 5 {
+			source.write(key)
+			if err := c.Invalidate(ctx, key); err != nil {
+				return 0, 0, 0, err
+			}
+			continue
+		}
+
+		start := time.Now()
+		value, err := c.Get(ctx, key)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		took += time.Since(start)
+		reads++
+
+		if string(value) != strconv.Itoa(source.current(key)) {
+			stale++
+		}
+	}
+
+	return reads, stale, took, nil
+}
+
+// Warms the key on reader, writes through writer and polls reader until it sees the new value
+func measureStaleWindow(ctx context.Context, source *fakeSource, writer, reader *near_cache.Cache, limit time.Duration) (time.Duration, error) {
+	key := fmt.Sprintf("near:window:%d", time.Now().UnixNano())
+	if _, err := reader.Get(ctx, key); err != nil {
+		return 0, err
+	}
+
+	want := strconv.Itoa(source.write(key))
+	if err := writer.Invalidate(ctx, key); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	for time.Since(start) < limit {
+		value, err := reader.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if string(value) == want {
+			return time.Since(start), nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	return limit, nil
+}
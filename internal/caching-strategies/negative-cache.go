@@ -0,0 +1,130 @@
+package caching_strategies
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bloom_filter "andreashoj/deeper-learnings/internal/bloom-filter"
+	query_profiling "andreashoj/deeper-learnings/internal/query-profiling"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Cache penetration: lookups for keys that don't exist are never cached, so every one of them goes all the way to the database.
+// Someone asking for random user ids gets a free path straight to postgres. Two defences, used together:
+// - negative caching: remember "not found" for a short while, repeated lookups for the same missing id stop at redis
+// - a Bloom filter of every id that exists: a "definitely not" is rejected before redis or postgres are asked at all.
+// Negative caching does nothing against random ids (each one is new), the filter does nothing against an id that exists,
+// so the filter catches the random ids and negative caching catches its false positives and deleted ids
+
+var errNotFound = errors.New("not found")
+
+// Stored instead of the value, no encoded value starts with a zero byte followed by this
+const negativeMarker = "\x00not-found"
+
+var NegativeTTL = 30 * time.Second
+
+// Returns errNotFound when the id doesn't exist, anything else is a real failure and isn't cached
+type idLoader func(ctx context.Context, id int) ([]byte, error)
+
+type guardedCache struct {
+	redis       *redis.Client
+	keyFormat   string
+	ttl         time.Duration
+	negativeTTL time.Duration        // 0 turns negative caching off
+	known       *bloom_filter.Filter // nil turns the filter off
+	load        idLoader
+
+	hits, negativeHits, rejected, loads atomic.Int64
+}
+
+// The X-Cache values
+const (
+	cacheHit         = "hit"
+	cacheMiss        = "miss"
+	cacheNegativeHit = "negative-hit"
+	cacheRejected    = "bloom-reject"
+)
+
+func (g *guardedCache) get(ctx context.Context, id int) ([]byte, string, error) {
+	if g.known != nil && !g.known.MayContain(fmt.Sprint(id)) {
+		g.rejected.Add(1)
+		return nil, cacheRejected, errNotFound
+	}
+
+	key := fmt.Sprintf(g.keyFormat, id)
+	cached, err := g.redis.Get(ctx, key).Bytes()
+	if err == nil {
+		if string(cached) == negativeMarker {
+			g.negativeHits.Add(1)
+			return nil, cacheNegativeHit, errNotFound
+		}
+		g.hits.Add(1)
+		return cached, cacheHit, nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		fmt.Printf("failed reading %s from redis, going to the database: %s\n", key, err)
+	}
+
+	g.loads.Add(1)
+	value, err := g.load(ctx, id)
+	if errors.Is(err, errNotFound) {
+		if g.negativeTTL > 0 {
+			g.redis.Set(ctx, key, negativeMarker, g.negativeTTL)
+		}
+		return nil, cacheMiss, errNotFound
+	}
+	if err != nil {
+		return nil, cacheMiss, err
+	}
+	g.redis.Set(ctx, key, value, g.ttl)
+
+	return value, cacheMiss, nil
+}
+
+// Call it for every new id. It overwrites a negative entry left by someone probing the id before it existed,
+// and the filter has to learn the id or it'd be rejected forever
+func (g *guardedCache) set(ctx context.Context, id int, value []byte) {
+	if g.known != nil {
+		g.known.Add(fmt.Sprint(id))
+	}
+	g.redis.Set(ctx, fmt.Sprintf(g.keyFormat, id), value, g.ttl)
+}
+
+var knownUsersOnce sync.Once
+var knownUsers *bloom_filter.Filter
+
+// One filter of every user id for the whole process, built from the database the first time it's needed.
+// Nil when that fails - an empty filter would reject every user
+func knownUserFilter() *bloom_filter.Filter {
+	knownUsersOnce.Do(func() {
+		ids, err := query_profiling.GetUserIDs()
+		if err != nil {
+			fmt.Printf("failed loading user ids, running without a bloom filter: %s\n", err)
+			return
+		}
+
+		filter := bloom_filter.New(max(2*len(ids), 10_000), 0.01) // Room to grow before the false positive rate suffers
+		for _, id := range ids {
+			filter.Add(fmt.Sprint(id))
+		}
+		knownUsers = filter
+	})
+
+	return knownUsers
+}
+
+// Inserts into users that don't end in guardedCache.set have to call this, or the filter rejects the new user
+// and a "not found" cached by someone probing the id before it existed keeps answering 404 for NegativeTTL
+func rememberUser(ctx context.Context, id int) {
+	if filter := knownUserFilter(); filter != nil {
+		filter.Add(fmt.Sprint(id))
+	}
+	if err := rdb.Del(ctx, fmt.Sprintf(CacheKeyUser, id)).Err(); err != nil {
+		fmt.Printf("failed dropping cached user %d: %s\n", id, err)
+	}
+}
@@ -0,0 +1,183 @@
+package caching_strategies
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"andreashoj/deeper-learnings/internal/db"
+	"andreashoj/deeper-learnings/internal/outbox"
+	query_profiling "andreashoj/deeper-learnings/internal/query-profiling"
+)
+
+// getPostsWithEventDriven creates the post and then refreshes the cache - two steps, and a crash between them leaves the cache
+// stale until the TTL runs out. getPostsWithOutbox commits the post.created event together with the post, and the relay invalidates the cache
+func getPostsWithOutbox(w http.ResponseWriter, r *http.Request) {
+	post, err := query_profiling.CreatePostWithOutbox(r.Context(), "my post", 1)
+	if err != nil {
+		fmt.Printf("failed creating post: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(post)
+}
+
+func postsCacheKeys(event outbox.Event) []string {
+	if event.Type == "post.created" {
+		return []string{"posts"}
+	}
+
+	return nil
+}
+
+func startPostsOutboxRelay(ctx context.Context) {
+	if err := outbox.Setup(ctx, db.DB); err != nil {
+		fmt.Printf("failed setting up outbox: %s", err)
+		return
+	}
+
+	cfg := outbox.DefaultRelayConfig()
+	cfg.ListenDSN = db.DSN
+	invalidator := outbox.CacheInvalidator(postsCacheKeys, func(ctx context.Context, key string) error {
+		return RDB.Del(ctx, key).Err()
+	})
+
+	relay := outbox.NewRelay(db.DB, cfg, outbox.Deduplicate(invalidator), outbox.Logger())
+	if err := relay.Run(ctx); err != nil {
+		fmt.Printf("outbox relay stopped: %s", err)
+	}
+}
+
+var errRelayCrashed = errors.New("relay crashed before marking the batch")
+
+// Plays both crashes against an in-memory cache so the only thing needed is postgres:
+// the writer dying between commit and publish, and the relay dying between publish and marking the events as published
+func StartOutboxDemo() {
+	ctx := context.Background()
+	query_profiling.InsertUsersAndPosts()
+	if err := outbox.Reset(ctx, db.DB); err != nil {
+		log.Fatalf("failed setting up outbox: %s", err)
+		return
+	}
+
+	var mu sync.Mutex
+	cache := map[string]int{} // key -> how many posts the cached value was built from
+	fill := func() {
+		posts, err := query_profiling.GetPosts()
+		if err != nil {
+			log.Fatalf("failed getting posts: %s", err)
+		}
+		mu.Lock()
+		cache["posts"] = len(posts)
+		mu.Unlock()
+	}
+	cached := func() (int, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		n, ok := cache["posts"]
+		return n, ok
+	}
+
+	// The old way: create, then refresh - and the process dies in between
+	fill()
+	if _, err := query_profiling.CreatePost("lost event", 1); err != nil {
+		log.Fatalf("failed creating post: %s", err)
+		return
+	}
+	posts, _ := query_profiling.GetPosts()
+	n, _ := cached()
+	fmt.Printf("without outbox: crashed after commit, cache says %d posts, db has %d - stale until the TTL runs out\n", n, len(posts))
+
+	// The outbox way: the writers commit and "die" before anything is published, no relay is running
+	fill()
+	for i := range 10 {
+		if _, err := query_profiling.CreatePostWithOutbox(ctx, fmt.Sprintf("outbox post %d", i), 1); err != nil {
+			log.Fatalf("failed creating post: %s", err)
+			return
+		}
+	}
+	counts, err := outbox.Count(ctx, db.DB)
+	if err != nil {
+		log.Fatalf("failed counting outbox: %s", err)
+		return
+	}
+	fmt.Printf("with outbox: 10 posts committed, nothing published yet - %d events waiting in the outbox\n", counts.Pending)
+
+	invalidator := outbox.Deduplicate(outbox.CacheInvalidator(postsCacheKeys, func(ctx context.Context, key string) error {
+		mu.Lock()
+		delete(cache, key)
+		mu.Unlock()
+		fill() // Refill right away, the next reader would do it otherwise
+		return nil
+	}))
+	bus := outbox.NewBus()
+	created := bus.Subscribe("post.created", 100)
+
+	// A relay comes up, publishes the first batch and dies before marking it
+	cfg := outbox.DefaultRelayConfig()
+	cfg.BatchSize = 4
+	crashes := 1
+	cfg.BeforeMark = func(delivered []outbox.Event) error {
+		if crashes > 0 {
+			crashes--
+			return errRelayCrashed
+		}
+		return nil
+	}
+	relay := outbox.NewRelay(db.DB, cfg, invalidator, bus)
+	if _, err = relay.RunOnce(ctx); !errors.Is(err, errRelayCrashed) {
+		log.Fatalf("expected the relay to crash, got: %v", err)
+		return
+	}
+	fmt.Printf("relay crashed after publishing %d events, they're still unpublished in the outbox\n", len(created))
+
+	// The next relay picks up from the outbox - the first batch goes out again
+	if err = relay.Drain(ctx); err != nil {
+		log.Fatalf("failed draining outbox: %s", err)
+		return
+	}
+	counts, err = outbox.Count(ctx, db.DB)
+	if err != nil {
+		log.Fatalf("failed counting outbox: %s", err)
+		return
+	}
+
+	received := 0
+	for len(created) > 0 {
+		<-created
+		received++
+	}
+	posts, _ = query_profiling.GetPosts()
+	n, _ = cached()
+	fmt.Printf("after restart: %d published, %d pending, bus subscriber got %d messages for 10 events (at-least-once)\n", counts.Published, counts.Pending, received)
+	fmt.Printf("cache invalidation skipped %d duplicates, cache says %d posts, db has %d\n", invalidator.Duplicates(), n, len(posts))
+
+	// And with LISTEN the relay doesn't wait for the next poll
+	listenCfg := outbox.DefaultRelayConfig()
+	listenCfg.ListenDSN = db.DSN
+	listenCfg.PollInterval = time.Minute
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go outbox.NewRelay(db.DB, listenCfg, bus).Run(runCtx)
+	time.Sleep(100 * time.Millisecond) // Let the listener connect
+
+	began := time.Now()
+	if _, err = query_profiling.CreatePostWithOutbox(ctx, "listened post", 1); err != nil {
+		log.Fatalf("failed creating post: %s", err)
+		return
+	}
+	select {
+	case event := <-created:
+		fmt.Printf("listening relay published event %d %v after commit\n", event.ID, time.Since(began).Round(time.Millisecond))
+	case <-time.After(5 * time.Second):
+		fmt.Println("listening relay didn't publish within 5s")
+	}
+}
@@ -0,0 +1,123 @@
+package caching_strategies
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	bloom_filter "andreashoj/deeper-learnings/internal/bloom-filter"
+	"andreashoj/deeper-learnings/internal/db"
+	query_profiling "andreashoj/deeper-learnings/internal/query-profiling"
+)
+
+// An attacker asking for users that don't exist, mixed in with normal traffic for users that do.
+// Once with the same handful of missing ids over and over, once with a fresh random id every time - negative caching only
+// helps against the first, the bloom filter against both. Uses postgres when it's up, otherwise a fake users table with the same ids
+func StartPenetrationDemo() {
+	ctx := context.Background()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		fmt.Printf("redis not reachable, start it or call UseInProcessRedis first: %s\n", err)
+		return
+	}
+
+	ids, load := penetrationSource()
+	fmt.Printf("%d users, loading one takes %v\n", len(ids), timeLoad(ctx, load, ids[0]))
+
+	filter := bloom_filter.New(2*len(ids), 0.01)
+	for _, id := range ids {
+		filter.Add(fmt.Sprint(id))
+	}
+	falsePositives := 0
+	for i := range 100_000 {
+		if filter.MayContain(fmt.Sprint(10_000_000 + i)) {
+			falsePositives++
+		}
+	}
+	fmt.Printf("bloom filter: %d KB, estimated false positive rate %.2f%%, measured %.2f%%\n",
+		filter.SizeBytes()/1024, 100*filter.FalsePositiveRate(), float64(falsePositives)/1000)
+
+	attacks := []struct {
+		name string
+		id   func() int
+	}{
+		{"50 missing ids on repeat", func() int { return 10_000_000 + rand.Intn(50) }},
+		{"random missing ids", func() int { return 10_000_000 + rand.Intn(1_000_000_000) }},
+	}
+	setups := []struct {
+		name        string
+		negativeTTL time.Duration
+		known       *bloom_filter.Filter
+	}{
+		{"no protection", 0, nil},
+		{"negative cache", NegativeTTL, nil},
+		{"bloom filter", 0, filter},
+		{"both", NegativeTTL, filter},
+	}
+
+	for n, attack := range attacks {
+		fmt.Printf("\n%s, 9 of every 10 requests are the attacker\n", attack.name)
+		fmt.Printf("%-16s %10s %10s %12s %10s %12s\n", "setup", "db queries", "rejected", "negative hits", "hits", "avg request")
+
+		for i, setup := range setups {
+			var queries int
+			cache := &guardedCache{
+				redis:       rdb,
+				keyFormat:   fmt.Sprintf("penetration:%d:%d:user:%%v", n, i),
+				ttl:         time.Minute,
+				negativeTTL: setup.negativeTTL,
+				known:       setup.known,
+				load: func(ctx context.Context, id int) ([]byte, error) {
+					queries++
+					return load(ctx, id)
+				},
+			}
+
+			requests := 2000
+			start := time.Now()
+			for r := range requests {
+				id := ids[rand.Intn(len(ids))]
+				if r%10 != 0 {
+					id = attack.id()
+				}
+				if _, _, err := cache.get(ctx, id); err != nil && !errors.Is(err, errNotFound) {
+					fmt.Printf("failed getting user %d: %s\n", id, err)
+					return
+				}
+			}
+			took := time.Since(start)
+
+			fmt.Printf("%-16s %10d %10d %12d %10d %12v\n", setup.name, queries, cache.rejected.Load(), cache.negativeHits.Load(),
+				cache.hits.Load(), (took / time.Duration(requests)).Round(time.Microsecond))
+		}
+	}
+}
+
+// The user ids that exist and a loader for them
+func penetrationSource() ([]int, idLoader) {
+	if db.DB != nil && db.DB.Ping() == nil {
+		if ids, err := query_profiling.GetUserIDs(); err == nil && len(ids) > 0 {
+			return ids, loadUserJSON
+		}
+	}
+
+	fmt.Println("postgres not reachable, using a fake users table")
+	ids := make([]int, 1000)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	return ids, func(ctx context.Context, id int) ([]byte, error) {
+		time.Sleep(time.Millisecond) // The query
+		if id < 1 || id > len(ids) {
+			return nil, fmt.Errorf("user %d: %w", id, errNotFound)
+		}
+		return fmt.Appendf(nil, `{"id":%d,"name":"%d"}`, id, id), nil
+	}
+}
+
+func timeLoad(ctx context.Context, load idLoader, id int) time.Duration {
+	start := time.Now()
+	load(ctx, id)
+	return time.Since(start).Round(10 * time.Microsecond)
+}
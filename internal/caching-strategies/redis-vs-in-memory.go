@@ -2,50 +2,136 @@ package caching_strategies
 
 import (
 	"andreashoj/deeper-learnings/internal/db"
+	load_balancer "andreashoj/deeper-learnings/internal/load-balancer"
 	query_profiling "andreashoj/deeper-learnings/internal/query-profiling"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/redis/go-redis/v9"
 )
 
+// Every testServer is its own http server with its own in-memory cache, and they sit behind a real load balancer.
+// The in-memory cache only hits when the balancer sends the request to the server that cached the user,
+// redis hits no matter where the request lands - but every hit costs a network round trip
 type testServer struct {
-	server     *httptest.Server
-	inMemCache map[string]interface{}
-}
+	server *httptest.Server
+	users  *guardedCache // Redis, with negative caching and the bloom filter in front
 
-type loadBalancer struct {
-	servers []*testServer
-	redis   *redis.Client
-	current int
-}
+	mu         sync.RWMutex
+	inMemCache map[string][]byte
 
-var lb loadBalancer
-var userID int
+	memHits, memMisses atomic.Int64
+}
 
 func StartRedisVsInMemory(r *chi.Mux) {
-	lb = loadBalancer{
-		redis: rdb,
+	servers := startTestServers(3)
+	balancer, err := newTestBalancer(load_balancer.RoundRobin(), servers)
+	if err != nil {
+		fmt.Printf("failed creating load balancer: %s", err)
+		return
 	}
+	go balancer.HealthCheck(context.Background(), load_balancer.HealthConfig{Path: "/healthz", Interval: 2 * time.Second, Timeout: time.Second})
 
-	r.Post("/api/rvm/user", logSpeed(lb.createRvmUser))
-	r.Get("/api/rvm/user-mem", logSpeed(lb.getRvmUserInMem)) // It will only work every when the load balancer uses the server where the data was stored in
-	// but it has a noticably big difference in query speed as it doesn't have to make any addiotnal network requests
-	r.Get("/api/rvm/user-redis", logSpeed(lb.getRvmUserInRedis)) // Will work every time as redis is running in its own process
-
-	servers := startTestServers(r)
-	lb.servers = servers
+	// The api only proxies, all the work happens on whichever test server the balancer picks
+	r.Handle("/api/rvm/*", logSpeed(http.StripPrefix("/api/rvm", balancer).ServeHTTP))
+	// POST /api/rvm/user
+	// GET /api/rvm/user-mem/{id} - only hits when it lands on the server that cached the user, but there's no extra network hop
+	// GET /api/rvm/user-redis/{id} - hits every time as redis runs in its own process
 
 	for _, s := range servers {
 		fmt.Printf("\nserver running on: %s", s.server.URL)
 	}
 }
 
+// Runs the same traffic through every algorithm and compares the in-memory hit ratio and latency with redis
+func StartLoadBalancerComparison() {
+	algorithms := []load_balancer.Algorithm{
+		load_balancer.RoundRobin(),
+		load_balancer.LeastConnections(),
+		load_balancer.Weighted(),
+		load_balancer.RandomTwoChoices(),
+		load_balancer.ConsistentHash(load_balancer.ByLastPathSegment(), 100),
+	}
+
+	fmt.Printf("%-20s %10s %12s %12s %s\n", "algorithm", "mem hits", "mem latency", "redis lat.", "requests per backend")
+	for _, algo := range algorithms {
+		servers := startTestServers(3)
+		balancer, err := newTestBalancer(algo, servers)
+		if err != nil {
+			fmt.Printf("failed creating load balancer: %s", err)
+			return
+		}
+		proxy := httptest.NewServer(balancer)
+
+		var ids []int
+		for range 20 {
+			user, err := postJSON[query_profiling.User](proxy.URL + "/user")
+			if err != nil {
+				fmt.Printf("failed creating user: %s", err)
+				return
+			}
+			ids = append(ids, user.Id)
+		}
+
+		var memTime, redisTime time.Duration
+		requests := 300
+		for range requests {
+			id := ids[rand.Intn(len(ids))]
+
+			start := time.Now()
+			if err = get(fmt.Sprintf("%s/user-mem/%d", proxy.URL, id)); err != nil {
+				fmt.Printf("failed getting user: %s", err)
+				return
+			}
+			memTime += time.Since(start)
+
+			start = time.Now()
+			if err = get(fmt.Sprintf("%s/user-redis/%d", proxy.URL, id)); err != nil {
+				fmt.Printf("failed getting user: %s", err)
+				return
+			}
+			redisTime += time.Since(start)
+		}
+
+		hits, total := 0, 0
+		perBackend := ""
+		for i, s := range servers {
+			hits += int(s.memHits.Load())
+			total += int(s.memHits.Load() + s.memMisses.Load())
+			perBackend += fmt.Sprintf("%d ", balancer.Backends()[i].Served())
+			s.server.Close()
+		}
+		proxy.Close()
+
+		fmt.Printf("%-20s %9.0f%% %12v %12v %s\n", algo.Name(), 100*float64(hits)/float64(total),
+			(memTime / time.Duration(requests)).Round(time.Microsecond), (redisTime / time.Duration(requests)).Round(time.Microsecond), perBackend)
+	}
+}
+
+func newTestBalancer(algo load_balancer.Algorithm, servers []*testServer) (*load_balancer.Balancer, error) {
+	balancer := load_balancer.New(algo)
+	for i, s := range servers {
+		backend, err := load_balancer.NewBackend(s.server.URL, i+1) // Weights 1, 2, 3... only the weighted algorithm cares
+		if err != nil {
+			return nil, err
+		}
+		balancer.Add(backend)
+	}
+
+	return balancer, nil
+}
+
 func logSpeed(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		start := time.Now()
@@ -54,72 +140,123 @@ func logSpeed(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func startTestServers(r *chi.Mux) []*testServer {
-	amount := 2
+func startTestServers(amount int) []*testServer {
 	var testServers []*testServer
 	for i := 0; i < amount; i++ {
-		server := testServer{
-			server:     httptest.NewServer(r),
-			inMemCache: make(map[string]interface{}),
+		server := &testServer{
+			users: &guardedCache{
+				redis:       rdb,
+				keyFormat:   "user:%v",
+				ttl:         time.Minute,
+				negativeTTL: NegativeTTL,
+				known:       knownUserFilter(),
+				load:        loadUserJSON,
+			},
+			inMemCache: make(map[string][]byte),
 		}
-		testServers = append(testServers, &server)
+
+		r := chi.NewRouter()
+		r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+		r.Post("/user", server.createRvmUser)
+		r.Get("/user-mem/{id}", server.getRvmUserInMem)
+		r.Get("/user-redis/{id}", server.getRvmUserInRedis)
+		server.server = httptest.NewServer(r)
+
+		testServers = append(testServers, server)
 	}
 
 	return testServers
 }
 
-func (lb *loadBalancer) createRvmUser(w http.ResponseWriter, r *http.Request) {
-	// Create user - cache user based off id in redis and lb server
+func (t *testServer) createRvmUser(w http.ResponseWriter, r *http.Request) {
+	// Create user - cache user based off id in redis and on this server
 	user := createUser()
-	lb.getServer().cacheUserInMemory(user)
-	lb.cacheUserInRedis(user, r.Context())
+	if user == nil {
+		http.Error(w, "failed creating user", http.StatusInternalServerError)
+		return
+	}
+
+	userJSON, err := json.Marshal(user)
+	if err != nil {
+		http.Error(w, "failed encoding user", http.StatusInternalServerError)
+		return
+	}
+	t.cacheUserInMemory(user.Id, userJSON)
+	t.users.set(r.Context(), user.Id, userJSON)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(userJSON)
 }
 
-func (lb *loadBalancer) getRvmUserInMem(w http.ResponseWriter, r *http.Request) {
-	// Get user
-	userJSON := lb.getServer().getCache(fmt.Sprintf("user:%v", userID))
-	if userJSON == nil {
-		fmt.Printf("didn't find user")
+func (t *testServer) getRvmUserInMem(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
 		return
 	}
 
-	var user query_profiling.User
-	err := json.Unmarshal(userJSON.([]byte), &user)
+	userJSON := t.getCache(fmt.Sprintf("user:%v", id))
+	if userJSON != nil {
+		t.memHits.Add(1)
+		w.Header().Set("X-Cache", "hit")
+		w.Write(userJSON)
+		return
+	}
+	t.memMisses.Add(1)
+
+	// Read through, the next request for this user is a hit - if it lands here
+	userJSON, err = loadUserJSON(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		fmt.Printf("failed decoding user")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	t.cacheUserInMemory(id, userJSON)
 
-	fmt.Println(user)
+	w.Header().Set("X-Cache", "miss")
+	w.Write(userJSON)
 }
 
-func (lb *loadBalancer) getRvmUserInRedis(w http.ResponseWriter, r *http.Request) {
-	// Get user
-	userJSON, err := rdb.Get(r.Context(), fmt.Sprintf("user:%v", userID)).Result()
+func (t *testServer) getRvmUserInRedis(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		fmt.Sprintf("failed getting user: %s", err)
+		http.Error(w, "invalid id", http.StatusBadRequest)
 		return
 	}
 
-	var user query_profiling.User
-	err = json.Unmarshal([]byte(userJSON), &user)
-
+	// Ids that don't exist are answered by the bloom filter or the negative cache, only the first miss per id reaches postgres
+	userJSON, result, err := t.users.get(r.Context(), id)
+	w.Header().Set("X-Cache", result)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		fmt.Printf("failed decoding user: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Printf("Got user: %s", user)
+	w.Write(userJSON)
 }
 
-func (lb *loadBalancer) getServer() *testServer {
-	server := lb.servers[lb.current%len(lb.servers)]
-	lb.current++
-	if lb.current > len(lb.servers) {
-		lb.current = 0
+func loadUserJSON(ctx context.Context, id int) ([]byte, error) {
+	user, err := query_profiling.GetUser(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("user %d: %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	userJSON, err := json.Marshal(user)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding user: %w", err)
 	}
 
-	return server
+	return userJSON, nil
 }
 
 func createUser() *query_profiling.User {
@@ -134,36 +271,57 @@ func createUser() *query_profiling.User {
 		return nil
 	}
 
-	userID = user.Id // just for reference
 	return &user
 }
 
-func (t *testServer) getCache(key string) interface{} {
-	val, ok := t.inMemCache[key]
-	if !ok {
-		fmt.Printf("couldn't find cached user")
-		return nil
-	}
+func (t *testServer) getCache(key string) []byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 
-	return val
+	return t.inMemCache[key]
 }
 
-func (t *testServer) cacheUserInMemory(user *query_profiling.User) {
-	userJSON, err := json.Marshal(user)
+func (t *testServer) cacheUserInMemory(id int, userJSON []byte) {
+	t.mu.Lock()
+	t.inMemCache[fmt.Sprintf("user:%v", id)] = userJSON
+	t.mu.Unlock()
+}
+
+func postJSON[T any](url string) (T, error) {
+	var v T
+	res, err := http.Post(url, "application/json", nil)
 	if err != nil {
-		fmt.Printf("failed saving user")
-		return
+		return v, err
 	}
-	fmt.Printf("saved as: %s", fmt.Sprintf("user:%v", user.Id))
-	t.inMemCache[fmt.Sprintf("user:%v", user.Id)] = userJSON
+
+	err = decodeJSON(res, &v)
+	return v, err
 }
 
-func (lb *loadBalancer) cacheUserInRedis(user *query_profiling.User, ctx context.Context) {
-	userJSON, err := json.Marshal(*user)
+func decodeJSON(res *http.Response, v any) error {
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %d", res.Request.Method, res.Request.URL, res.StatusCode)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed decoding response: %w", err)
+	}
+
+	return nil
+}
+
+func get(url string) error {
+	res, err := http.Get(url)
 	if err != nil {
-		fmt.Printf("failed saving user")
-		return
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", url, res.StatusCode)
 	}
-	fmt.Println(user)
-	lb.redis.Set(ctx, fmt.Sprintf("user:%v", user.Id), userJSON, 1*time.Minute)
+
+	return nil
 }
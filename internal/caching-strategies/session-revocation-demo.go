@@ -0,0 +1,30 @@
+package caching_strategies
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// updateUserRole without postgres: the same login, demote and access flow through the same handlers and middleware,
+// with the users in a map. Needs redis for the sessions, UseInProcessRedis will do
+func StartSessionRevocationDemo() {
+	users := &memoryPermissions{users: map[int]UserRes{1: {UserID: 1, Username: "anz", Permissions: []int{1, adminPermission}}}}
+	sessions := newSessions(users)
+
+	r := chi.NewRouter()
+	registerSessionRoutes(r, sessions, users, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"Id":1,"Name":"anz"}]`))
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	if err := checkRevocation(server.URL); err != nil {
+		fmt.Printf("\nrevocation check failed: %s\n", err)
+		return
+	}
+	fmt.Printf("\nrevocation check passed, %d permission loads from the database\n", users.loads)
+}
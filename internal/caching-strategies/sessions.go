@@ -0,0 +1,211 @@
+package caching_strategies
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"andreashoj/deeper-learnings/internal/db"
+	"andreashoj/deeper-learnings/internal/session"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// The fix for the stale permissions in updateUserRole. Login used to cache the user with their permissions and /api/secret-data
+// trusted that copy, so taking admin away changed nothing until the cache expired. Now login hands out a session,
+// changing permissions bumps the user's generation which revokes every session they have,
+// and session.Require checks /api/secret-data against permissions cached for the current generation only
+
+const adminPermission = 999
+
+// Where users and their permissions live, postgres for the handler and a map for the demo
+type permissionStore interface {
+	load(ctx context.Context, userID int) (UserRes, error)
+	replace(ctx context.Context, userID int, permissions []int) error
+}
+
+type postgresPermissions struct{}
+
+func (postgresPermissions) load(ctx context.Context, userID int) (UserRes, error) {
+	return loadUserRes(ctx, userID)
+}
+
+func (postgresPermissions) replace(ctx context.Context, userID int, permissions []int) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_permissions WHERE user_id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("failed deleting user permission: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO users_permissions (user_id, permission_id) SELECT $1, unnest($2::int[])", userID, pq.Array(permissions))
+	if err != nil {
+		return fmt.Errorf("failed inserting users and permissions: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed commiting transaction: %w", err)
+	}
+
+	return nil
+}
+
+type memoryPermissions struct {
+	mu    sync.Mutex
+	users map[int]UserRes
+	loads int
+}
+
+func (m *memoryPermissions) load(ctx context.Context, userID int) (UserRes, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.loads++
+	user, ok := m.users[userID]
+	if !ok {
+		return UserRes{}, fmt.Errorf("user %d: %w", userID, errNotFound)
+	}
+	user.Permissions = slices.Clone(user.Permissions)
+
+	return user, nil
+}
+
+func (m *memoryPermissions) replace(ctx context.Context, userID int, permissions []int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user := m.users[userID]
+	user.UserID, user.Permissions = userID, slices.Clone(permissions)
+	m.users[userID] = user
+
+	return nil
+}
+
+func newSessions(users permissionStore) *session.Manager {
+	return session.New(rdb, sessionSecret(), time.Hour, func(ctx context.Context, userID int) ([]int, error) {
+		user, err := users.load(ctx, userID)
+		return user.Permissions, err
+	})
+}
+
+// SESSION_SECRET when set, otherwise a random one - sessions don't survive a restart then, which is fine for the experiments
+func sessionSecret() []byte {
+	if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	return secret
+}
+
+func registerSessionRoutes(r chi.Router, sessions *session.Manager, users permissionStore, secretData http.HandlerFunc) {
+	r.Post("/api/login", login(sessions, users))
+	r.Post("/api/user", updateUserPermissions(sessions, users))
+	r.With(sessions.Require(adminPermission)).Get("/api/secret-data", secretData)
+}
+
+// The login, demote, access flow against a running server, for a user 1 who is admin going in.
+// Returns an error for every step that didn't answer what it should
+func checkRevocation(baseURL string) error {
+	token, err := loginToken(baseURL)
+	if err != nil {
+		return err
+	}
+
+	steps := []struct {
+		name   string
+		want   int
+		before func() error
+		token  func() string
+	}{
+		{"admin reads the secret data", http.StatusOK, nil, nil},
+		{"again, permissions from the cache", http.StatusOK, nil, nil},
+		{"demoted, same session", http.StatusUnauthorized, func() error {
+			res, err := http.Post(baseURL+"/api/user", "application/json", bytes.NewBufferString(`{"id": 1, "permissions": [1, 2]}`))
+			if err != nil {
+				return fmt.Errorf("failed updating user permissions: %w", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusCreated {
+				return fmt.Errorf("updating user permissions answered %d", res.StatusCode)
+			}
+			return nil
+		}, nil},
+		{"logged in again, no admin", http.StatusForbidden, func() (err error) {
+			token, err = loginToken(baseURL)
+			return err
+		}, nil},
+		{"no session at all", http.StatusUnauthorized, nil, func() string { return "" }},
+		{"forged session", http.StatusUnauthorized, nil, func() string { return "made-up.c2lnbmF0dXJl" }},
+	}
+
+	var failed []string
+	for _, step := range steps {
+		if step.before != nil {
+			if err = step.before(); err != nil {
+				return err
+			}
+		}
+		t := token
+		if step.token != nil {
+			t = step.token()
+		}
+
+		req, err := http.NewRequest(http.MethodGet, baseURL+"/api/secret-data", nil)
+		if err != nil {
+			return fmt.Errorf("failed creating request: %w", err)
+		}
+		if t != "" {
+			req.Header.Set("Authorization", "Bearer "+t)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed requesting the secret data: %w", err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		fmt.Printf("%-36s want %d, got %d %s\n", step.name, step.want, res.StatusCode, bytes.TrimSpace(body[:min(len(body), 40)]))
+		if res.StatusCode != step.want {
+			failed = append(failed, fmt.Sprintf("%s: want %d, got %d", step.name, step.want, res.StatusCode))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d steps failed: %v", len(failed), len(steps), failed)
+	}
+
+	return nil
+}
+
+func loginToken(baseURL string) (string, error) {
+	res, err := http.Post(baseURL+"/api/login", "application/json", bytes.NewBufferString(`{"username": "anz", "password": "tester12"}`))
+	if err != nil {
+		return "", fmt.Errorf("failed logging in: %w", err)
+	}
+	defer res.Body.Close()
+
+	var login LoginRes
+	if err = json.NewDecoder(res.Body).Decode(&login); err != nil {
+		return "", fmt.Errorf("failed decoding login response: %w", err)
+	}
+	if login.Token == "" {
+		return "", fmt.Errorf("login answered %d without a token", res.StatusCode)
+	}
+
+	return login.Token, nil
+}
@@ -0,0 +1,114 @@
+package caching_strategies
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The updateUserRole flow through the real handlers and middleware, with the users in a map and redis in-process
+func startSessionServer(t *testing.T) (*httptest.Server, *memoryPermissions) {
+	t.Helper()
+
+	stop, err := UseInProcessRedis()
+	if err != nil {
+		t.Fatalf("failed starting redis: %s", err)
+	}
+	t.Cleanup(stop)
+
+	users := &memoryPermissions{users: map[int]UserRes{1: {UserID: 1, Username: "anz", Permissions: []int{1, adminPermission}}}}
+	r := chi.NewRouter()
+	registerSessionRoutes(r, newSessions(users), users, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	return server, users
+}
+
+func loginForTest(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+
+	res, err := http.Post(server.URL+"/api/login", "application/json", bytes.NewBufferString(`{"username": "anz", "password": "tester12"}`))
+	if err != nil {
+		t.Fatalf("failed logging in: %s", err)
+	}
+	defer res.Body.Close()
+
+	var login LoginRes
+	if err = json.NewDecoder(res.Body).Decode(&login); err != nil {
+		t.Fatalf("failed decoding login response: %s", err)
+	}
+	if res.StatusCode != http.StatusOK || login.Token == "" {
+		t.Fatalf("want 200 with a token from login, got %d %+v", res.StatusCode, login)
+	}
+
+	return login.Token
+}
+
+func secretDataStatus(t *testing.T, server *httptest.Server, token string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/secret-data", nil)
+	if err != nil {
+		t.Fatalf("failed creating request: %s", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed requesting the secret data: %s", err)
+	}
+	res.Body.Close()
+
+	return res.StatusCode
+}
+
+func TestDemotionRevokesSessions(t *testing.T) {
+	server, users := startSessionServer(t)
+	token := loginForTest(t, server)
+
+	if status := secretDataStatus(t, server, token); status != http.StatusOK {
+		t.Fatalf("admin reading the secret data: want 200, got %d", status)
+	}
+	loads := users.loads
+	if status := secretDataStatus(t, server, token); status != http.StatusOK {
+		t.Fatalf("admin reading the secret data again: want 200, got %d", status)
+	}
+	if users.loads != loads {
+		t.Fatalf("second read loaded the permissions again, they should come from the cache")
+	}
+
+	res, err := http.Post(server.URL+"/api/user", "application/json", bytes.NewBufferString(`{"id": 1, "permissions": [1, 2]}`))
+	if err != nil {
+		t.Fatalf("failed demoting user: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("demoting user: want 201, got %d", res.StatusCode)
+	}
+
+	if status := secretDataStatus(t, server, token); status != http.StatusUnauthorized {
+		t.Fatalf("session from before the demotion: want 401, got %d", status)
+	}
+	if status := secretDataStatus(t, server, loginForTest(t, server)); status != http.StatusForbidden {
+		t.Fatalf("new session without admin: want 403, got %d", status)
+	}
+}
+
+func TestSecretDataRejectsMissingAndForgedTokens(t *testing.T) {
+	server, _ := startSessionServer(t)
+
+	if status := secretDataStatus(t, server, ""); status != http.StatusUnauthorized {
+		t.Fatalf("no session: want 401, got %d", status)
+	}
+	if status := secretDataStatus(t, server, "made-up.c2lnbmF0dXJl"); status != http.StatusUnauthorized {
+		t.Fatalf("forged session: want 401, got %d", status)
+	}
+}
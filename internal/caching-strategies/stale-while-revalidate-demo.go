@@ -0,0 +1,75 @@
+package caching_strategies
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	near_cache "andreashoj/deeper-learnings/internal/near-cache"
+	stale_cache "andreashoj/deeper-learnings/internal/stale-cache"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The posts endpoint through its whole life: cold, fresh, stale, the database going down and staying down.
+// Every phase is a stampede of concurrent requests. The TTLs are seconds instead of minutes so it runs in a few seconds,
+// and the database is a fake one we can switch off. Redis is used when it's up, otherwise the in-process L2
+func StartStaleWhileRevalidateDemo() {
+	ctx := context.Background()
+
+	var store near_cache.L2 = near_cache.NewMemoryL2(300 * time.Microsecond)
+	if err := RDB.Ping(ctx).Err(); err == nil {
+		store = near_cache.NewRedisL2(RDB)
+		RDB.Del(ctx, "posts:swr")
+	} else {
+		fmt.Printf("redis not reachable, using the in-process L2: %s\n", err)
+	}
+
+	var dbDown atomic.Bool
+	var queries atomic.Int64
+	load := func(ctx context.Context, key string) ([]byte, error) {
+		queries.Add(1)
+		time.Sleep(50 * time.Millisecond) // A slow query, the thing the cache is there to hide
+		if dbDown.Load() {
+			return nil, errors.New("connection refused")
+		}
+		return fmt.Appendf(nil, `[{"Id":1,"Name":"loaded at %s","UserID":1}]`, time.Now().Format(time.TimeOnly)), nil
+	}
+
+	cfg := stale_cache.Config{SoftTTL: time.Second, HardTTL: 2 * time.Second, StaleIfError: 2 * time.Second, LoadTimeout: time.Second, RetryBackoff: 500 * time.Millisecond}
+	cache := stale_cache.New(store, cfg, load)
+	r := chi.NewRouter()
+	r.Get("/posts", stalePostsHandler(cache))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	phases := []struct {
+		name   string
+		before func()
+	}{
+		{"cold cache", nil},
+		{"fresh", nil},
+		{"past the soft TTL", func() { time.Sleep(cfg.SoftTTL) }},
+		{"revalidated", func() { time.Sleep(100 * time.Millisecond) }},
+		{"db down, stale", func() { dbDown.Store(true); time.Sleep(cfg.SoftTTL) }},
+		{"db down, past the hard TTL", func() { time.Sleep(cfg.HardTTL - cfg.SoftTTL) }},
+		{"db down, past stale-if-error", func() { time.Sleep(cfg.StaleIfError) }},
+		{"db back", func() { dbDown.Store(false); time.Sleep(cfg.RetryBackoff) }}, // Until the backoff is over nobody asks the db
+	}
+
+	for _, phase := range phases {
+		if phase.before != nil {
+			phase.before()
+		}
+		queriesBefore := queries.Load()
+		res := runStampede(server.URL+"/posts", 500)
+		fmt.Printf("%-30s db queries %d, %s\n", phase.name, queries.Load()-queriesBefore, res)
+	}
+
+	s := cache.Stats()
+	fmt.Printf("\nfresh %d, stale %d, stale-if-error %d, misses %d, loads %d (%d failed), %d backed off\n",
+		s.Fresh, s.Stale, s.StaleIfError, s.Misses, s.Loads, s.LoadErrors, s.BackedOff)
+}
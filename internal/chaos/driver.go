@@ -0,0 +1,201 @@
+package chaos
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+)
+
+const TargetDB = "db"
+
+// Open gives a *sql.DB where every connection goes through the injector. The experiments don't know the difference,
+// they just get slower queries, dropped connections and serialization failures like they would from a bad day in production
+func Open(driverName, dsn string, inj *Injector) (*sql.DB, error) {
+	// sql.Open doesn't connect, it's just the easiest way to get hold of the registered driver
+	base, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed looking up driver %s: %w", driverName, err)
+	}
+	d := base.Driver()
+	base.Close()
+
+	if driverName == "sqlite3" {
+		inj.useSQLiteErrors()
+	}
+
+	DB := sql.OpenDB(&connector{driver: d, dsn: dsn, inj: inj})
+	if err = DB.Ping(); err != nil {
+		return nil, fmt.Errorf("failed pinging chaos db: %w", err)
+	}
+
+	return DB, nil
+}
+
+type connector struct {
+	driver driver.Driver
+	dsn    string
+	inj    *Injector
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	if c.inj.Partitioned(TargetDB) {
+		return nil, fmt.Errorf("%w: failed connecting to %s", ErrPartitioned, TargetDB)
+	}
+
+	raw, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{Conn: raw, inj: c.inj}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// The sql package checks for these optional interfaces, so the wrapper implements them and forwards to the real connection
+type conn struct {
+	driver.Conn
+	inj *Injector
+	bad bool // Set once we've "dropped" the connection, so the pool throws it away
+}
+
+func (c *conn) before() error {
+	err := c.inj.Before(TargetDB)
+	if errors.Is(err, driver.ErrBadConn) {
+		c.bad = true
+	}
+
+	return err
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := c.before(); err != nil {
+		return nil, err
+	}
+
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+
+	return c.Conn.Prepare(query)
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := c.before(); err != nil {
+		return nil, err
+	}
+
+	var raw driver.Tx
+	var err error
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		raw, err = b.BeginTx(ctx, opts)
+	} else {
+		raw, err = c.Conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &tx{Tx: raw, conn: c}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	if err := c.before(); err != nil {
+		return nil, err
+	}
+
+	return e.ExecContext(ctx, query, args)
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	if err := c.before(); err != nil {
+		return nil, err
+	}
+
+	return q.QueryContext(ctx, query, args)
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if c.inj.Partitioned(TargetDB) {
+		return driver.ErrBadConn
+	}
+
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+
+	return nil
+}
+
+func (c *conn) CheckNamedValue(v *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(v)
+	}
+
+	return driver.ErrSkip
+}
+
+func (c *conn) ResetSession(ctx context.Context) error {
+	if c.bad {
+		return driver.ErrBadConn
+	}
+
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+func (c *conn) IsValid() bool {
+	if c.bad {
+		return false
+	}
+
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+
+	return true
+}
+
+type tx struct {
+	driver.Tx
+	conn *conn
+}
+
+func (t *tx) Commit() error {
+	err := t.conn.inj.BeforeCommit(TargetDB)
+	if err != nil {
+		// The real transaction has to be cleaned up, otherwise the connection is stuck in a transaction
+		t.Tx.Rollback()
+		if errors.Is(err, driver.ErrBadConn) {
+			t.conn.bad = true
+		}
+		return err
+	}
+
+	return t.Tx.Commit()
+}
@@ -0,0 +1,227 @@
+package chaos
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+var ErrInjected = errors.New("chaos: injected failure")
+var ErrPartitioned = errors.New("chaos: network partition")
+
+// The injector owns the seeded random source, so every decision (sleep this long? fail this op?) is drawn from the same sequence
+type Injector struct {
+	scenario Scenario
+	started  time.Time
+
+	mu  sync.Mutex
+	rng *rand.Rand
+
+	// Driver specific serialization error, so the experiments see the same error they would get from the real db
+	serializationErr error
+
+	stats Stats
+}
+
+type Stats struct {
+	Operations     int
+	Delayed        int
+	TotalDelay     time.Duration
+	Dropped        int
+	Failed         int
+	Serialization  int
+	PartitionFails int
+}
+
+func NewInjector(scenario Scenario) *Injector {
+	return &Injector{
+		scenario:         scenario,
+		started:          time.Now(),
+		rng:              rand.New(rand.NewSource(scenario.Seed)),
+		serializationErr: &pq.Error{Code: "40001", Message: "could not serialize access due to concurrent update (injected)"},
+	}
+}
+
+func NewInjectorFromFile(path string) (*Injector, error) {
+	scenario, err := LoadScenario(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewInjector(*scenario), nil
+}
+
+// Before is called ahead of every operation against the target, it sleeps for the latency and decides if the operation should fail
+func (i *Injector) Before(target string) error {
+	if i == nil {
+		return nil
+	}
+
+	delay := i.sample(i.scenario.Latency)
+
+	i.mu.Lock()
+	i.stats.Operations++
+	if delay > 0 {
+		i.stats.Delayed++
+		i.stats.TotalDelay += delay
+	}
+	i.mu.Unlock()
+
+	time.Sleep(delay)
+
+	if i.Partitioned(target) {
+		i.count(func(s *Stats) { s.PartitionFails++ })
+		return fmt.Errorf("%w: %s unreachable", ErrPartitioned, target)
+	}
+
+	if i.roll(i.scenario.DropRate) {
+		i.count(func(s *Stats) { s.Dropped++ })
+		// ErrBadConn makes database/sql throw the connection away and retry on a new one - same as a real dropped connection
+		return driver.ErrBadConn
+	}
+
+	if i.roll(i.scenario.ErrorRate) {
+		i.count(func(s *Stats) { s.Failed++ })
+		return ErrInjected
+	}
+
+	return nil
+}
+
+// BeforeCommit also rolls for a serialization failure, which only makes sense at commit time
+func (i *Injector) BeforeCommit(target string) error {
+	if i == nil {
+		return nil
+	}
+
+	if err := i.Before(target); err != nil {
+		return err
+	}
+
+	if i.roll(i.scenario.SerializationRate) {
+		i.count(func(s *Stats) { s.Serialization++ })
+		return i.serializationErr
+	}
+
+	return nil
+}
+
+func (i *Injector) ReplicationLag() time.Duration {
+	if i == nil {
+		return 0
+	}
+
+	return i.sample(i.scenario.ReplicationLag)
+}
+
+func (i *Injector) Partitioned(target string) bool {
+	if i == nil {
+		return false
+	}
+
+	elapsed := time.Since(i.started)
+	for _, p := range i.scenario.Partitions {
+		if !slices.Contains(p.Targets, target) {
+			continue
+		}
+
+		if elapsed >= time.Duration(p.After) && elapsed < time.Duration(p.After+p.For) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Seed of the scenario, for experiments that draw their own random numbers and want the drill to stay reproducible
+func (i *Injector) Seed() int64 {
+	if i == nil {
+		return 0
+	}
+
+	return i.scenario.Seed
+}
+
+func (i *Injector) Stats() Stats {
+	if i == nil {
+		return Stats{}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.stats
+}
+
+func (i *Injector) Report() {
+	if i == nil {
+		fmt.Printf("\nNo chaos scenario, nothing injected\n")
+		return
+	}
+
+	s := i.Stats()
+	fmt.Printf("\nChaos scenario %q (seed %d):\n", i.scenario.Name, i.scenario.Seed)
+	fmt.Printf("  operations: %d\n", s.Operations)
+	fmt.Printf("  delayed: %d (total %v)\n", s.Delayed, s.TotalDelay)
+	fmt.Printf("  dropped connections: %d\n", s.Dropped)
+	fmt.Printf("  injected errors: %d\n", s.Failed)
+	fmt.Printf("  serialization failures: %d\n", s.Serialization)
+	fmt.Printf("  partitioned operations: %d\n", s.PartitionFails)
+}
+
+func (i *Injector) useSQLiteErrors() {
+	if i == nil {
+		return
+	}
+
+	i.serializationErr = sqlite3.Error{Code: sqlite3.ErrBusy, ExtendedCode: sqlite3.ErrBusySnapshot}
+}
+
+func (i *Injector) count(f func(s *Stats)) {
+	i.mu.Lock()
+	f(&i.stats)
+	i.mu.Unlock()
+}
+
+func (i *Injector) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rng.Float64() < rate
+}
+
+func (i *Injector) sample(l Latency) time.Duration {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var d float64
+	switch l.Distribution {
+	case "constant":
+		d = float64(l.Mean)
+	case "uniform":
+		d = float64(l.Min) + i.rng.Float64()*float64(l.Max-l.Min)
+	case "normal":
+		d = i.rng.NormFloat64()*float64(l.StdDev) + float64(l.Mean)
+	case "exponential": // Long tail - most ops are fast, a few are really slow
+		d = float64(l.Min) + i.rng.ExpFloat64()*float64(l.Mean)
+	default:
+		return 0
+	}
+
+	d = math.Max(d, float64(l.Min))
+	if l.Max > 0 {
+		d = math.Min(d, float64(l.Max))
+	}
+
+	return time.Duration(d)
+}
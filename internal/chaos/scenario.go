@@ -0,0 +1,95 @@
+package chaos
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// A scenario describes every fault we want to inject during an experiment. Same seed + same scenario = same drill,
+// which is the whole point - a failure we can replay instead of "it broke once on my machine"
+type Scenario struct {
+	Name              string      `json:"name"`
+	Seed              int64       `json:"seed"`
+	Latency           Latency     `json:"latency"`            // Added to every query/exec/commit
+	ReplicationLag    Latency     `json:"replication_lag"`    // Used by the db_replication fake pool instead of a constant sleep
+	DropRate          float64     `json:"drop_rate"`          // Chance a connection is dropped mid-operation (driver.ErrBadConn)
+	ErrorRate         float64     `json:"error_rate"`         // Chance an operation fails with a generic error (partial failures)
+	SerializationRate float64     `json:"serialization_rate"` // Chance a commit fails with a serialization failure
+	Partitions        []Partition `json:"partitions"`
+}
+
+// Distribution is one of: "constant", "uniform", "normal", "exponential". Empty means no latency
+type Latency struct {
+	Distribution string   `json:"distribution"`
+	Min          Duration `json:"min"`
+	Max          Duration `json:"max"`
+	Mean         Duration `json:"mean"`
+	StdDev       Duration `json:"stddev"`
+}
+
+// A partition cuts off the given targets (e.g. "db", "replica-0") from After until After+For, measured from when the injector was created
+type Partition struct {
+	Targets []string `json:"targets"`
+	After   Duration `json:"after"`
+	For     Duration `json:"for"`
+}
+
+// Duration lets the scenario files use "150ms" instead of nanoseconds
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"100ms\": %w", err)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("failed parsing duration %q: %w", s, err)
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func LoadScenario(path string) (*Scenario, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading scenario file: %w", err)
+	}
+
+	var scenario Scenario
+	if err = json.Unmarshal(file, &scenario); err != nil {
+		return nil, fmt.Errorf("failed decoding scenario file: %w", err)
+	}
+
+	if err = scenario.validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario %q: %w", scenario.Name, err)
+	}
+
+	return &scenario, nil
+}
+
+func (s *Scenario) validate() error {
+	for name, rate := range map[string]float64{"drop_rate": s.DropRate, "error_rate": s.ErrorRate, "serialization_rate": s.SerializationRate} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("%s must be between 0 and 1, got %v", name, rate)
+		}
+	}
+
+	for _, l := range []Latency{s.Latency, s.ReplicationLag} {
+		switch l.Distribution {
+		case "", "constant", "uniform", "normal", "exponential":
+		default:
+			return fmt.Errorf("unknown latency distribution %q", l.Distribution)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package connection_pooling_diff
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"time"
+
+	"andreashoj/deeper-learnings/internal/admission"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Overloads a small pool twice - once unprotected, once behind the admission controller.
+// Unprotected, every request eventually gets served but latency grows with the pile up.
+// Protected, the excess gets a fast 503 and the requests we do serve keep a bounded latency
+func StartAdmissionControlDemo(r *chi.Mux) {
+	openConns := 5
+	requestsToMake := 300
+
+	DB, err := StartDBWithPool(openConns)
+	if err != nil {
+		log.Fatalf("failed starting pool db: %s", err)
+		return
+	}
+
+	controller := admission.New(admission.Config{
+		Pool:         DB.Stats,
+		MaxQueue:     20,
+		QueueTimeout: 200 * time.Millisecond,
+		RetryAfter:   time.Second,
+		Classify: func(r *http.Request) admission.Priority {
+			switch r.Header.Get("X-Priority") {
+			case "high":
+				return admission.PriorityHigh
+			case "low":
+				return admission.PriorityLow
+			default:
+				return admission.PriorityNormal
+			}
+		},
+	})
+
+	r.Get("/api/pool/users-unprotected", slowUsersHandler(DB))
+	r.With(controller.Middleware).Get("/api/pool/users", slowUsersHandler(DB))
+	r.Get("/api/pool/admission", controller.MetricsHandler)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	fmt.Println("Unprotected:")
+	overload(ts.URL+"/api/pool/users-unprotected", requestsToMake)
+
+	fmt.Println("With admission control:")
+	overload(ts.URL+"/api/pool/users", requestsToMake)
+	fmt.Printf("  metrics: %+v\n", controller.Metrics())
+}
+
+// Holds on to a connection for a while, like a handler doing a slow query or some work mid transaction
+func slowUsersHandler(DB *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := DB.Conn(r.Context())
+		if err != nil {
+			http.Error(w, "failed getting connection", http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+
+		var count int
+		if err = conn.QueryRowContext(r.Context(), `SELECT COUNT(*) FROM users`).Scan(&count); err != nil {
+			http.Error(w, "failed counting users", http.StatusInternalServerError)
+			return
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(w, `{"users": %d}`, count)
+	}
+}
+
+func overload(url string, requests int) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	statuses := make(map[int]int)
+	var served []time.Duration
+	var shed []time.Duration
+
+	for i := range requests {
+		wg.Go(func() {
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			if i%10 == 0 {
+				req.Header.Set("X-Priority", "high")
+			}
+
+			start := time.Now()
+			res, err := http.DefaultClient.Do(req)
+			took := time.Since(start)
+			if err != nil {
+				fmt.Printf("request failed: %s\n", err)
+				return
+			}
+			res.Body.Close()
+
+			mu.Lock()
+			defer mu.Unlock()
+			statuses[res.StatusCode]++
+			if res.StatusCode == http.StatusOK {
+				served = append(served, took)
+			} else {
+				shed = append(shed, took)
+			}
+		})
+	}
+	wg.Wait()
+
+	slices.Sort(served)
+	slices.Sort(shed)
+	fmt.Printf("  statuses: %v\n", statuses)
+	fmt.Printf("  served: p50 %v, p99 %v, max %v\n", percentile(served, 0.5), percentile(served, 0.99), percentile(served, 1))
+	fmt.Printf("  shed: p50 %v, max %v\n", percentile(shed, 0.5), percentile(shed, 1))
+}
@@ -0,0 +1,132 @@
+package connection_pooling_diff
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func WriteReports(outDir string, results []BenchmarkResult) error {
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return fmt.Errorf("failed creating report dir: %w", err)
+	}
+
+	if err := writeCSV(filepath.Join(outDir, "results.csv"), results); err != nil {
+		return err
+	}
+
+	if err := writeJSON(filepath.Join(outDir, "results.json"), results); err != nil {
+		return err
+	}
+
+	err := os.WriteFile(filepath.Join(outDir, "chart.txt"), []byte(RenderChart(results)), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed writing chart: %w", err)
+	}
+
+	return nil
+}
+
+func writeCSV(path string, results []BenchmarkResult) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed creating csv file: %w", err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write([]string{
+		"driver", "max_open", "max_idle", "concurrency", "mix", "requests", "errors", "duration_ms", "throughput_rps",
+		"p50_ms", "p90_ms", "p99_ms", "max_ms", "open_connections", "wait_count", "wait_duration_ms", "max_idle_closed",
+	})
+
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	for _, r := range results {
+		w.Write([]string{
+			r.Driver, strconv.Itoa(r.MaxOpen), strconv.Itoa(r.MaxIdle), strconv.Itoa(r.Concurrency), r.Mix,
+			strconv.Itoa(r.Requests), strconv.Itoa(r.Errors), f(r.DurationMs), f(r.Throughput),
+			f(r.P50Ms), f(r.P90Ms), f(r.P99Ms), f(r.MaxMs), strconv.Itoa(r.OpenConnections),
+			strconv.FormatInt(r.WaitCount, 10), f(r.WaitDurationMs), strconv.FormatInt(r.MaxIdleClosed, 10),
+		})
+	}
+
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return fmt.Errorf("failed writing csv: %w", err)
+	}
+
+	return nil
+}
+
+func writeJSON(path string, results []BenchmarkResult) error {
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed encoding results: %w", err)
+	}
+
+	if err = os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed writing json: %w", err)
+	}
+
+	return nil
+}
+
+// One bar chart of throughput per workload (driver + mix + concurrency), with the winning pool settings marked
+func RenderChart(results []BenchmarkResult) string {
+	const barWidth = 50
+
+	var order []string
+	groups := make(map[string][]BenchmarkResult)
+	for _, r := range results {
+		key := fmt.Sprintf("%s / %s / concurrency %d", r.Driver, r.Mix, r.Concurrency)
+		if _, exists := groups[key]; !exists {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], r)
+	}
+
+	var sb strings.Builder
+	for _, key := range order {
+		group := groups[key]
+
+		best := group[0]
+		for _, r := range group {
+			if r.Errors < best.Errors || (r.Errors == best.Errors && r.Throughput > best.Throughput) {
+				best = r
+			}
+		}
+
+		fmt.Fprintf(&sb, "\n%s\n", key)
+		for _, r := range group {
+			bar := 0
+			if best.Throughput > 0 { // Every run failed outright, nothing to compare against
+				bar = int(r.Throughput / best.Throughput * barWidth)
+			}
+			if r.Throughput > best.Throughput {
+				bar = barWidth // A run with errors can be "faster", cap it so the chart stays readable
+			}
+
+			marker := ""
+			if r == best {
+				marker = " <- best"
+			}
+
+			fmt.Fprintf(&sb, "  open=%-4s idle=%-3d |%-*s| %7.0f req/s p99 %6.2fms waits %d%s\n",
+				maxOpenLabel(r.MaxOpen), r.MaxIdle, barWidth, strings.Repeat("#", bar), r.Throughput, r.P99Ms, r.WaitCount, marker)
+		}
+	}
+
+	return sb.String()
+}
+
+func maxOpenLabel(maxOpen int) string {
+	if maxOpen == 0 {
+		return "inf"
+	}
+
+	return strconv.Itoa(maxOpen)
+}
@@ -0,0 +1,348 @@
+package connection_pooling_diff
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"andreashoj/deeper-learnings/internal/db"
+)
+
+// Sweeps pool settings against a workload, so "what pool size should I use" gets answered with numbers instead of a guess.
+// Every combination of driver x max open x max idle x concurrency x query mix is one run
+
+type BenchmarkConfig struct {
+	Drivers     []string // "sqlite3" and/or "postgres"
+	MaxOpen     []int    // 0 = unlimited, like sql.DB
+	MaxIdle     []int
+	Concurrency []int
+	Mixes       []QueryMix
+	Requests    int // Per run
+	Rows        int // Rows seeded into the bench table
+	SQLitePath  string
+	OutDir      string
+}
+
+// Weights are relative, {Read: 8, Write: 2} means 80% point reads and 20% writes
+type QueryMix struct {
+	Name  string `json:"name"`
+	Read  int    `json:"read"`  // Point lookup by id
+	List  int    `json:"list"`  // Full table scan, holds the connection longer
+	Write int    `json:"write"` // Update, on sqlite this serializes on the db lock
+}
+
+type BenchmarkResult struct {
+	Driver      string  `json:"driver"`
+	MaxOpen     int     `json:"max_open"`
+	MaxIdle     int     `json:"max_idle"`
+	Concurrency int     `json:"concurrency"`
+	Mix         string  `json:"mix"`
+	Requests    int     `json:"requests"`
+	Errors      int     `json:"errors"`
+	DurationMs  float64 `json:"duration_ms"`
+	Throughput  float64 `json:"throughput_rps"`
+	P50Ms       float64 `json:"p50_ms"`
+	P90Ms       float64 `json:"p90_ms"`
+	P99Ms       float64 `json:"p99_ms"`
+	MaxMs       float64 `json:"max_ms"`
+
+	// From sql.DBStats after the run
+	OpenConnections int     `json:"open_connections"`
+	WaitCount       int64   `json:"wait_count"`
+	WaitDurationMs  float64 `json:"wait_duration_ms"`
+	MaxIdleClosed   int64   `json:"max_idle_closed"`
+}
+
+func DefaultBenchmarkConfig() BenchmarkConfig {
+	return BenchmarkConfig{
+		Drivers:     []string{"sqlite3", "postgres"},
+		MaxOpen:     []int{1, 5, 10, 25, 50, 0},
+		MaxIdle:     []int{2, 10},
+		Concurrency: []int{10, 100},
+		Mixes: []QueryMix{
+			{Name: "read-heavy", Read: 9, List: 1},
+			{Name: "mixed", Read: 6, List: 1, Write: 3},
+			{Name: "write-heavy", Read: 2, Write: 8},
+		},
+		Requests:   2000,
+		Rows:       1000,
+		SQLitePath: filepath.Join(os.TempDir(), "pool-bench.db"),
+		OutDir:     "internal/connection-pooling-diff/bench-results",
+	}
+}
+
+func StartPoolBenchmark() {
+	cfg := DefaultBenchmarkConfig()
+	results, err := RunBenchmark(context.Background(), cfg)
+	if err != nil {
+		fmt.Printf("benchmark failed: %s\n", err)
+	}
+
+	if len(results) == 0 {
+		return
+	}
+
+	if err = WriteReports(cfg.OutDir, results); err != nil {
+		fmt.Printf("failed writing reports: %s\n", err)
+		return
+	}
+
+	fmt.Print(RenderChart(results))
+}
+
+func RunBenchmark(ctx context.Context, cfg BenchmarkConfig) ([]BenchmarkResult, error) {
+	for _, mix := range cfg.Mixes {
+		if err := mix.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	var results []BenchmarkResult
+
+	for _, driverName := range cfg.Drivers {
+		dsn := benchmarkDSN(driverName, cfg)
+		if err := seedBenchmark(driverName, dsn, cfg.Rows); err != nil {
+			// Postgres might not be running, still report whatever driver worked
+			fmt.Printf("skipping %s: %s\n", driverName, err)
+			continue
+		}
+
+		for _, mix := range cfg.Mixes {
+			for _, concurrency := range cfg.Concurrency {
+				for _, maxOpen := range cfg.MaxOpen {
+					seen := make(map[int]bool)
+					for _, maxIdle := range cfg.MaxIdle {
+						if maxOpen > 0 {
+							maxIdle = min(maxIdle, maxOpen) // sql.DB silently lowers it anyway, so report what's actually used
+						}
+						if seen[maxIdle] {
+							continue
+						}
+						seen[maxIdle] = true
+
+						result, err := runBenchmarkCase(ctx, driverName, dsn, cfg, mix, concurrency, maxOpen, maxIdle)
+						if err != nil {
+							return results, fmt.Errorf("failed running %s/%s: %w", driverName, mix.Name, err)
+						}
+
+						fmt.Printf("%s %s c=%d open=%d idle=%d: %.0f req/s p99=%.2fms waits=%d errors=%d\n",
+							driverName, mix.Name, concurrency, maxOpen, maxIdle, result.Throughput, result.P99Ms, result.WaitCount, result.Errors)
+						results = append(results, result)
+					}
+				}
+			}
+		}
+	}
+
+	return results, nil
+}
+
+func runBenchmarkCase(ctx context.Context, driverName, dsn string, cfg BenchmarkConfig, mix QueryMix, concurrency, maxOpen, maxIdle int) (BenchmarkResult, error) {
+	DB, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return BenchmarkResult{}, fmt.Errorf("failed opening db: %w", err)
+	}
+	defer DB.Close()
+
+	DB.SetMaxOpenConns(maxOpen)
+	DB.SetMaxIdleConns(maxIdle)
+
+	queries := benchmarkQueries(driverName)
+	var next atomic.Int64
+	var errCount atomic.Int64
+	latencies := make([][]time.Duration, concurrency)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for worker := range concurrency {
+		wg.Go(func() {
+			rng := rand.New(rand.NewSource(int64(worker))) // Seeded per worker, so the mix is the same every run
+			for next.Add(1) <= int64(cfg.Requests) {
+				id := rng.Intn(cfg.Rows) + 1
+				queryStart := time.Now()
+				if err := queries.run(ctx, DB, mix.pick(rng), id); err != nil {
+					errCount.Add(1)
+				}
+				latencies[worker] = append(latencies[worker], time.Since(queryStart))
+			}
+		})
+	}
+	wg.Wait()
+	duration := time.Since(start)
+
+	all := slices.Concat(latencies...)
+	slices.Sort(all)
+	stats := DB.Stats()
+
+	return BenchmarkResult{
+		Driver:          driverName,
+		MaxOpen:         maxOpen,
+		MaxIdle:         maxIdle,
+		Concurrency:     concurrency,
+		Mix:             mix.Name,
+		Requests:        cfg.Requests,
+		Errors:          int(errCount.Load()),
+		DurationMs:      ms(duration),
+		Throughput:      float64(cfg.Requests) / duration.Seconds(),
+		P50Ms:           ms(percentile(all, 0.50)),
+		P90Ms:           ms(percentile(all, 0.90)),
+		P99Ms:           ms(percentile(all, 0.99)),
+		MaxMs:           ms(percentile(all, 1)),
+		OpenConnections: stats.OpenConnections,
+		WaitCount:       stats.WaitCount,
+		WaitDurationMs:  ms(stats.WaitDuration),
+		MaxIdleClosed:   stats.MaxIdleClosed,
+	}, nil
+}
+
+const (
+	queryRead = iota
+	queryList
+	queryWrite
+)
+
+// A mix needs at least one query kind to pick from, and no negative weights
+func (m QueryMix) validate() error {
+	if m.Read < 0 || m.List < 0 || m.Write < 0 {
+		return fmt.Errorf("query mix %q has a negative weight", m.Name)
+	}
+	if m.Read+m.List+m.Write == 0 {
+		return fmt.Errorf("query mix %q has no weights", m.Name)
+	}
+
+	return nil
+}
+
+func (m QueryMix) pick(rng *rand.Rand) int {
+	n := rng.Intn(m.Read + m.List + m.Write)
+	switch {
+	case n < m.Read:
+		return queryRead
+	case n < m.Read+m.List:
+		return queryList
+	default:
+		return queryWrite
+	}
+}
+
+// sqlite and postgres don't agree on placeholders, so each driver gets its own set
+type benchQueries struct {
+	read  string
+	list  string
+	write string
+}
+
+func benchmarkQueries(driverName string) benchQueries {
+	if driverName == "postgres" {
+		return benchQueries{
+			read:  `SELECT id, name FROM bench_users WHERE id = $1`,
+			list:  `SELECT id, name FROM bench_users`,
+			write: `UPDATE bench_users SET updated_at = CURRENT_TIMESTAMP WHERE id = $1`,
+		}
+	}
+
+	return benchQueries{
+		read:  `SELECT id, name FROM bench_users WHERE id = ?`,
+		list:  `SELECT id, name FROM bench_users`,
+		write: `UPDATE bench_users SET updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+	}
+}
+
+func (q benchQueries) run(ctx context.Context, DB *sql.DB, kind int, id int) error {
+	switch kind {
+	case queryWrite:
+		_, err := DB.ExecContext(ctx, q.write, id)
+		return err
+	case queryList:
+		rows, err := DB.QueryContext(ctx, q.list)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var rowID int
+			var name string
+			if err = rows.Scan(&rowID, &name); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	default:
+		var rowID int
+		var name string
+		return DB.QueryRowContext(ctx, q.read, id).Scan(&rowID, &name)
+	}
+}
+
+func benchmarkDSN(driverName string, cfg BenchmarkConfig) string {
+	if driverName == "postgres" {
+		return db.DSN
+	}
+
+	// WAL + busy timeout, otherwise concurrent writers just get "database is locked" instead of waiting
+	return fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000", cfg.SQLitePath)
+}
+
+func seedBenchmark(driverName, dsn string, rows int) error {
+	DB, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return fmt.Errorf("failed opening db: %w", err)
+	}
+	defer DB.Close()
+
+	idColumn := "id INTEGER PRIMARY KEY AUTOINCREMENT"
+	insert := `INSERT INTO bench_users (name) VALUES (?)`
+	if driverName == "postgres" {
+		idColumn = "id SERIAL PRIMARY KEY"
+		insert = `INSERT INTO bench_users (name) VALUES ($1)`
+	}
+
+	_, err = DB.Exec(`DROP TABLE IF EXISTS bench_users`)
+	if err != nil {
+		return fmt.Errorf("failed dropping bench table: %w", err)
+	}
+
+	_, err = DB.Exec(fmt.Sprintf(`CREATE TABLE bench_users (%s, name VARCHAR(255) NOT NULL, updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`, idColumn))
+	if err != nil {
+		return fmt.Errorf("failed creating bench table: %w", err)
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed starting seed transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for i := 1; i <= rows; i++ {
+		if _, err = tx.Exec(insert, fmt.Sprintf("user-%d", i)); err != nil {
+			return fmt.Errorf("failed seeding bench row: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed committing seed: %w", err)
+	}
+
+	return nil
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	index := int(float64(len(sorted)-1) * p)
+	return sorted[index]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
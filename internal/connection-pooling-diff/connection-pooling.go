@@ -1,11 +1,12 @@
 package connection_pooling_diff
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
-	"sync"
-	"time"
+
+	pool_monitor "andreashoj/deeper-learnings/internal/pool-monitor"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -26,42 +27,30 @@ func LearningConnectionPooling(r *chi.Mux) {
 		return
 	}
 
-	var wgPool sync.WaitGroup
-	var wgNoPool sync.WaitGroup
-
-	startPool := time.Now()
-	for i := 0; i < requestsToMake; i++ {
-		wgPool.Add(1)
-		go func() {
-			defer wgPool.Done()
-			_, err = GetUsers(DBPool)
-			if err != nil {
-				log.Fatalf("faileding getting users from pool db: %s", err)
-				return
-			}
-
-			// Could be used to track pool usage!
-			//poolHealth(DBPool.Stats(), openConns)
-		}()
-	}
-	wgPool.Wait()
-	poolDuration := time.Since(startPool)
-
-	startNoPool := time.Now()
-	for i := 0; i < requestsToMake; i++ {
-		wgNoPool.Add(1)
-		go func() {
-			defer wgNoPool.Done()
-			_, err = GetUsers(DBNoPool)
-			if err != nil {
-				log.Fatalf("faileding getting users from no pool db: %s", err)
-				return
-			}
-
-		}()
+	// Track pool usage while the benchmark runs, warnings are logged as they happen
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	monitor := pool_monitor.New(pool_monitor.DefaultConfig(), pool_monitor.LogSink{})
+	monitor.Register("pool", DBPool.Stats)
+	monitor.Register("no-pool", DBNoPool.Stats)
+	monitor.Start(ctx)
+
+	// Errors are counted instead of log.Fatalf'ing from inside the goroutines, which would kill the process mid benchmark
+	poolDuration, poolErrs := runConcurrently(requestsToMake, func() error {
+		_, err := GetUsers(DBPool)
+		monitor.RecordRequest("pool")
+		return err
+	})
+
+	noPoolDuration, noPoolErrs := runConcurrently(requestsToMake, func() error {
+		_, err := GetUsers(DBNoPool)
+		monitor.RecordRequest("no-pool")
+		return err
+	})
+
+	if poolErrs > 0 || noPoolErrs > 0 {
+		fmt.Printf("failed getting users: %d errors with pool, %d without\n", poolErrs, noPoolErrs)
 	}
-	wgNoPool.Wait()
-	noPoolDuration := time.Since(startNoPool)
 
 	poolMs := float64(poolDuration.Milliseconds())
 	noPoolMs := float64(noPoolDuration.Milliseconds())
@@ -78,6 +67,8 @@ func GetUsers(db *sql.DB) ([]User, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed getting users: %w", err)
 	}
+	defer rows.Close()
+
 	var users []User
 	for rows.Next() {
 		var user User
@@ -92,16 +83,7 @@ func GetUsers(db *sql.DB) ([]User, error) {
 	return users, nil
 }
 
-func poolHealth(stats sql.DBStats, poolSize int) {
-	if stats.WaitCount > 10000 {
-		log.Println("WARNING: High wait count in pool!")
-	}
-
-	if stats.InUse == poolSize {
-		log.Println("WARNING: Pool fully in use!")
-	}
-}
-
 // Other strategies for ensuring a healthy connection pool and performance
 // Short circut request if all connections are being used and then retry after n seconds
 // Semaphore pattern to create queue with a max limit - and avoid starting unnecessary amounts of background jobs when there is no conn available anyways
+// Both are implemented in internal/admission, see StartAdmissionControlDemo
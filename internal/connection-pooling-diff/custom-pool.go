@@ -0,0 +1,128 @@
+package connection_pooling_diff
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"andreashoj/deeper-learnings/internal/pool"
+)
+
+const dbPath = "internal/connection-pooling-diff/pool.db"
+
+// The "no pool" db in LearningConnectionPooling is still pooled by database/sql, just without a limit.
+// This compares three honest modes instead:
+// - unpooled: open a brand new connection for every query, and close it after
+// - sql.DB: database/sql's built in pool
+// - custom: our own pool.Pool, handing out single connection handles
+func CompareCustomPool(openConns int, requestsToMake int) {
+	ctx := context.Background()
+
+	sqlPool, err := StartDBWithPool(openConns)
+	if err != nil {
+		log.Fatalf("failed starting sql.DB pool: %s", err)
+		return
+	}
+	defer sqlPool.Close()
+
+	customPool, err := StartCustomPool(openConns)
+	if err != nil {
+		log.Fatalf("failed starting custom pool: %s", err)
+		return
+	}
+	defer customPool.Close()
+
+	unpooledDuration, unpooledErrs := runConcurrently(requestsToMake, func() error {
+		conn, err := openSingleConn(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		_, err = GetUsers(conn)
+		return err
+	})
+
+	sqlDuration, sqlErrs := runConcurrently(requestsToMake, func() error {
+		_, err := GetUsers(sqlPool)
+		return err
+	})
+
+	customDuration, customErrs := runConcurrently(requestsToMake, func() error {
+		res, err := customPool.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer res.Release()
+
+		_, err = GetUsers(res.Value())
+		if err != nil {
+			res.Discard() // Don't hand a possibly broken connection to the next caller
+		}
+		return err
+	})
+
+	fmt.Printf("Unpooled (open per query): %v, %d errors\n", unpooledDuration, unpooledErrs)
+	fmt.Printf("sql.DB (max %d): %v, %d errors\n", openConns, sqlDuration, sqlErrs)
+	fmt.Printf("  stats: %+v\n", sqlPool.Stats())
+	fmt.Printf("Custom pool (max %d): %v, %d errors\n", openConns, customDuration, customErrs)
+	fmt.Printf("  stats: %s\n", customPool.Stats())
+}
+
+func StartCustomPool(openConns int) (*pool.Pool[*sql.DB], error) {
+	return pool.New(pool.Config[*sql.DB]{
+		MaxOpen:     openConns,
+		MinIdle:     min(5, openConns),
+		MaxLifetime: 5 * time.Minute,
+		IdleTimeout: 2 * time.Minute,
+		New:         openSingleConn,
+		Close: func(conn *sql.DB) error {
+			return conn.Close()
+		},
+		Check: func(ctx context.Context, conn *sql.DB) error {
+			return conn.PingContext(ctx)
+		},
+	})
+}
+
+// A *sql.DB capped at exactly one connection is the closest we get to a raw connection while still being able to use Scan
+func openSingleConn(ctx context.Context) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening connection: %w", err)
+	}
+
+	conn.SetMaxOpenConns(1)
+	conn.SetMaxIdleConns(1)
+
+	// sql.Open is lazy, ping to actually pay the cost of connecting here
+	if err = conn.PingContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed pinging connection: %w", err)
+	}
+
+	return conn, nil
+}
+
+func runConcurrently(requests int, query func() error) (time.Duration, int) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	errCount := 0
+
+	start := time.Now()
+	for range requests {
+		wg.Go(func() {
+			if err := query(); err != nil {
+				mu.Lock()
+				errCount++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	return time.Since(start), errCount
+}
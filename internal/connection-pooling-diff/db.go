@@ -24,7 +24,7 @@ func SeedDBS(pool *sql.DB) error {
 }
 
 func StartDBWithoutPool() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "internal/connection-pooling-diff/pool.db")
+	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed starting no pool db: %w", err)
 	}
@@ -40,7 +40,7 @@ func StartDBWithoutPool() (*sql.DB, error) {
 }
 
 func StartDBWithPool(openConns int) (*sql.DB, error) {
-	DB, err := sql.Open("sqlite3", "internal/connection-pooling-diff/pool.db")
+	DB, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed starting no pool db: %w", err)
 	}
@@ -0,0 +1,79 @@
+package connection_pooling_diff
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"time"
+
+	leak_check "andreashoj/deeper-learnings/internal/leak-check"
+)
+
+// Runs the leaky patterns that used to be all over the codebase against a db wrapped by the leak detector,
+// so we can see what the report looks like and where it points
+func StartLeakDetectionDemo() {
+	detector := leak_check.NewDetector(200 * time.Millisecond)
+	DB, err := leak_check.Open("sqlite3", dbPath, detector)
+	if err != nil {
+		log.Fatalf("failed opening leak checked db: %s", err)
+		return
+	}
+	defer DB.Close()
+	DB.SetMaxOpenConns(5)
+
+	// Fixed version, this should never show up in the report
+	if _, err = GetUsers(DB); err != nil {
+		fmt.Printf("failed getting users: %s\n", err)
+	}
+
+	// Rows are never closed - the connection stays checked out until the Rows are garbage collected
+	leakyGetUsers := func() {
+		rows, err := DB.Query(`SELECT id, username FROM users`)
+		if err != nil {
+			fmt.Printf("failed getting users: %s\n", err)
+			return
+		}
+
+		rows.Next() // Bailing out after the first row, without rows.Close()
+	}
+	leakyGetUsers()
+
+	// Transaction that is never committed or rolled back
+	tx, err := DB.BeginTx(context.Background(), nil)
+	if err != nil {
+		fmt.Printf("failed starting transaction: %s\n", err)
+		return
+	}
+	tx.Exec(`UPDATE users SET updated_at = CURRENT_TIMESTAMP WHERE id = 1`)
+
+	// Connection taken out of the pool and never given back
+	conn, err := DB.Conn(context.Background())
+	if err != nil {
+		fmt.Printf("failed getting connection: %s\n", err)
+		return
+	}
+	conn.PingContext(context.Background())
+
+	time.Sleep(300 * time.Millisecond)
+	runtime.GC() // The leaky Rows are unreachable now, the cleanup reports them as collected while open
+
+	for _, leak := range detector.Check() {
+		fmt.Printf("LEAK: %s\n", leak)
+	}
+
+	// In a test this is: defer detector.VerifyNone(t), see detector_test.go
+	detector.VerifyNone(printingT{})
+
+	// Clean up after ourselves, otherwise the open transaction keeps pool.db locked
+	tx.Rollback()
+	conn.Close()
+}
+
+type printingT struct{}
+
+func (printingT) Helper() {}
+
+func (printingT) Errorf(format string, args ...any) {
+	fmt.Printf("FAIL: "+format+"\n", args...)
+}
@@ -0,0 +1,74 @@
+package connection_pooling_diff
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	pool_monitor "andreashoj/deeper-learnings/internal/pool-monitor"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Runs healthy traffic against a small pool for a while, then starts leaking connections (taken, never closed).
+// The monitor should go from "busy" to "leak suspected" on its own, poll /api/pool/health to watch it happen
+func StartPoolMonitorDemo(r *chi.Mux) {
+	openConns := 5
+
+	DB, err := StartDBWithPool(openConns)
+	if err != nil {
+		log.Fatalf("failed starting pool db: %s", err)
+		return
+	}
+
+	cfg := pool_monitor.DefaultConfig()
+	cfg.Interval = 500 * time.Millisecond
+	cfg.LeakWindow = 4
+
+	events := pool_monitor.NewMemorySink(100)
+	monitor := pool_monitor.New(cfg, pool_monitor.LogSink{}, events)
+	monitor.Register("users-db", DB.Stats)
+	monitor.Start(context.Background())
+
+	r.Get("/api/pool/health", monitor.Handler(events))
+	r.With(monitor.Middleware("users-db")).Get("/api/pool/users-monitored", func(w http.ResponseWriter, r *http.Request) {
+		users, err := GetUsers(DB)
+		if err != nil {
+			http.Error(w, "failed getting users", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(users)
+	})
+
+	go func() {
+		healthyUntil := time.Now().Add(5 * time.Second)
+		for range 20 { // Workers hammering the pool
+			go func() {
+				for {
+					ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+					conn, err := DB.Conn(ctx)
+					cancel()
+					if err != nil {
+						continue // Timed out waiting, the pool is exhausted
+					}
+
+					var count int
+					conn.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM users`).Scan(&count)
+					time.Sleep(5 * time.Millisecond)
+					monitor.RecordRequest("users-db")
+
+					if time.Now().After(healthyUntil) {
+						fmt.Println("leaking a connection")
+						return // The bug: returning without conn.Close(), the connection is never given back
+					}
+
+					conn.Close()
+				}
+			}()
+		}
+	}()
+}
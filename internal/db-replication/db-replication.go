@@ -3,9 +3,12 @@ package db_replication
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
+	"andreashoj/deeper-learnings/internal/chaos"
+
 	"github.com/go-chi/chi/v5"
 )
 
@@ -16,6 +19,21 @@ func StartDBReplication(r *chi.Mux) {
 	RegisterEndpoints(r, pool)
 }
 
+// Same endpoints, but replication lag and replica partitions come from a seeded scenario file (internal/chaos/scenarios)
+// So "the replica was behind" becomes something we can replay, instead of a fixed 100ms sleep
+func StartDBReplicationDrill(r *chi.Mux, scenarioPath string) {
+	faults, err := chaos.NewInjectorFromFile(scenarioPath)
+	if err != nil {
+		log.Fatalf("failed loading chaos scenario: %s", err)
+		return
+	}
+
+	pool := StartDatabasePool()
+	pool.Faults = faults
+
+	RegisterEndpoints(r, pool)
+}
+
 func RegisterEndpoints(r *chi.Mux, pool *Pool) {
 	// Writes
 	r.Post("/api/user", func(w http.ResponseWriter, r *http.Request) {
@@ -32,7 +50,7 @@ func RegisterEndpoints(r *chi.Mux, pool *Pool) {
 
 		time.Sleep(101 * time.Millisecond) // Wait for replicas to update
 		updatedUser = pool.GetUser(user.Id)
-		fmt.Printf("waited for replica to update: %s", updatedUser)
+		fmt.Printf("waited for replica to update: %v", updatedUser)
 	})
 
 	// Reads
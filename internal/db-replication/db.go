@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"math/rand"
 	"time"
+
+	"andreashoj/deeper-learnings/internal/chaos"
 )
 
 // Faking a pool of db's here, with a main / replica setup
 type Pool struct {
 	Main     SqlDB
 	Replicas []SqlDB
+	Faults   *chaos.Injector // Optional - when set, replication lag and partitions come from the chaos scenario instead of the fixed delay
 }
 
 type SqlDB struct {
@@ -57,7 +60,23 @@ func (p *Pool) Write() *SqlDB {
 func (p *Pool) Read() *SqlDB {
 	// Randomize the selection of replicas to distribute db load
 	replicaIndex := rand.Intn(len(p.Replicas))
-	return &p.Replicas[replicaIndex]
+	if !p.Faults.Partitioned(replicaName(replicaIndex)) {
+		return &p.Replicas[replicaIndex]
+	}
+
+	// Picked replica is cut off, try the others before falling back to main
+	for i := range p.Replicas {
+		if !p.Faults.Partitioned(replicaName(i)) {
+			return &p.Replicas[i]
+		}
+	}
+
+	fmt.Println("all replicas partitioned, reading from main")
+	return &p.Main
+}
+
+func replicaName(index int) string {
+	return fmt.Sprintf("replica-%d", index)
 }
 
 func (p *Pool) GetUser(id int) *User {
@@ -85,6 +104,11 @@ func (DB *SqlDB) AddUser(user User) User {
 }
 
 func (p *Pool) UpdateReplicas() {
+	if p.Faults != nil {
+		p.updateReplicasWithFaults()
+		return
+	}
+
 	go func() {
 		time.Sleep(100 * time.Millisecond) // Emulate replication delay from main to replicas
 		for i := range p.Replicas {
@@ -93,3 +117,23 @@ func (p *Pool) UpdateReplicas() {
 		}
 	}()
 }
+
+// Each replica gets its own lag from the scenario, so replicas can disagree with each other - like they would for real
+func (p *Pool) updateReplicasWithFaults() {
+	snapshot := make([]User, len(p.Main.Values))
+	copy(snapshot, p.Main.Values)
+
+	for i := range p.Replicas {
+		lag := p.Faults.ReplicationLag()
+		go func() {
+			time.Sleep(lag)
+			if p.Faults.Partitioned(replicaName(i)) {
+				fmt.Printf("%s is partitioned, dropped replication of %d rows\n", replicaName(i), len(snapshot))
+				return
+			}
+
+			p.Replicas[i].Values = snapshot
+			fmt.Printf("%s caught up after %v\n", replicaName(i), lag)
+		}()
+	}
+}
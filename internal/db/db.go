@@ -10,10 +10,11 @@ import (
 
 var DB *sql.DB
 
+const DSN = "user=postgres host=localhost port=5432 dbname=test sslmode=disable"
+
 func CreateDB() error {
-	connString := "user=postgres host=localhost port=5432 dbname=test sslmode=disable"
 	var err error
-	DB, err = sql.Open("postgres", connString)
+	DB, err = sql.Open("postgres", DSN)
 
 	if err != nil {
 		return fmt.Errorf("failed creating database connection: %w", err)
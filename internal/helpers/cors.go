@@ -9,8 +9,8 @@ func NewCors(r *chi.Mux) {
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://localhost:*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "If-None-Match", "If-Modified-Since", "Cache-Control"},
+		ExposedHeaders:   []string{"Link", "ETag", "Last-Modified", "Cache-Control", "Age", "X-Cache", "Content-Length"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
@@ -0,0 +1,478 @@
+package history
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// The checker works like Elle on a register history: a read of value v on key k must come from the one transaction that wrote v to k.
+// From "who read from whom" we get write-read dependencies, the version order of each key (a transaction that read k and then wrote it
+// comes right after the writer it read from) and anti-dependencies (reading a version someone else overwrote).
+// Any cycle in that graph means there's no serial order that explains what the transactions saw - not serializable.
+// Values have to be unique per key for the reads-from to be exact, reads that match more than one writer are counted as ambiguous and skipped
+
+type AnomalyKind string
+
+const (
+	AnomalyLostUpdate       AnomalyKind = "lost update"          // Two committed txns read the same version and both overwrote it
+	AnomalyCycle            AnomalyKind = "serialization cycle"  // Dependency cycle between committed txns
+	AnomalyAbortedRead      AnomalyKind = "aborted read"         // Read a value only a failed txn wrote
+	AnomalyGarbageRead      AnomalyKind = "garbage read"         // Read a value nobody wrote
+	AnomalyInconsistentRead AnomalyKind = "inconsistent read"    // Saw a total that doesn't add up, with ConstantTotal
+	AnomalyBrokenTotal      AnomalyKind = "broken invariant"     // Final total changed, with ConstantTotal
+	AnomalyFinalMismatch    AnomalyKind = "final state mismatch" // Final value doesn't match what the committed txns did
+)
+
+type CheckOptions struct {
+	Initial       map[int]int // Value per key before the run
+	Final         map[int]int // Value per key after the run, nil skips the final state checks
+	ConstantTotal bool        // The sum across keys must never change, like money moving between accounts
+}
+
+type TxnInfo struct {
+	ID      int
+	Process int
+	Name    string
+	Type    EventType
+	Ops     []MicroOp
+}
+
+func (t TxnInfo) String() string {
+	ops := make([]string, len(t.Ops))
+	for i, op := range t.Ops {
+		ops[i] = op.String()
+	}
+
+	return fmt.Sprintf("T%d (process %d, %s) %s", t.ID, t.Process, t.Name, strings.Join(ops, " "))
+}
+
+type Anomaly struct {
+	Kind   AnomalyKind
+	Txns   []TxnInfo
+	Detail string
+}
+
+type Report struct {
+	Committed     int
+	Failed        int
+	Indeterminate int
+	Ambiguous     int // Reads we couldn't tie to a single writer
+	Anomalies     []Anomaly
+}
+
+func (r Report) Valid() bool {
+	return len(r.Anomalies) == 0
+}
+
+func (r Report) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d committed, %d failed, %d indeterminate, %d ambiguous reads\n", r.Committed, r.Failed, r.Indeterminate, r.Ambiguous)
+	if r.Valid() {
+		sb.WriteString("no anomalies found\n")
+		return sb.String()
+	}
+
+	for _, a := range r.Anomalies {
+		fmt.Fprintf(&sb, "%s: %s\n", strings.ToUpper(string(a.Kind)), a.Detail)
+		for _, t := range a.Txns {
+			fmt.Fprintf(&sb, "    %s\n", t)
+		}
+	}
+
+	return sb.String()
+}
+
+const initialTxn = 0 // Stands in for whoever wrote the initial values
+
+type edge struct {
+	to   int
+	kind string // wr, ww or rw
+	key  int
+}
+
+type checker struct {
+	opts    CheckOptions
+	txns    map[int]*TxnInfo
+	report  Report
+	writers map[int]map[int][]int // key -> value -> ok/info txns whose final write to key was value
+	failed  map[int]map[int][]int // Same, for failed txns
+	reads   map[int]map[int]int   // txn -> key -> writer it read from
+	edges   map[int][]edge
+}
+
+func Check(events []Event, opts CheckOptions) Report {
+	c := &checker{
+		opts:    opts,
+		txns:    make(map[int]*TxnInfo),
+		writers: make(map[int]map[int][]int),
+		failed:  make(map[int]map[int][]int),
+		reads:   make(map[int]map[int]int),
+		edges:   make(map[int][]edge),
+	}
+
+	c.collect(events)
+	c.resolveReads()
+	c.checkLostUpdates()
+	c.buildEdges()
+	c.checkCycles()
+	c.checkInvariants()
+
+	return c.report
+}
+
+func (c *checker) collect(events []Event) {
+	for _, e := range events {
+		switch e.Type {
+		case EventInvoke:
+			// Without a completion we don't know what happened, that's the same as info
+			c.txns[e.Txn] = &TxnInfo{ID: e.Txn, Process: e.Process, Name: e.Name, Type: EventInfo}
+		default:
+			t, ok := c.txns[e.Txn]
+			if !ok {
+				t = &TxnInfo{ID: e.Txn, Process: e.Process, Name: e.Name}
+				c.txns[e.Txn] = t
+			}
+			t.Type = e.Type
+			t.Ops = e.Ops
+		}
+	}
+
+	for k, v := range c.opts.Initial {
+		addWriter(c.writers, k, v, initialTxn)
+	}
+
+	for _, id := range c.ids() {
+		t := c.txns[id]
+		switch t.Type {
+		case EventOk:
+			c.report.Committed++
+		case EventFail:
+			c.report.Failed++
+		default:
+			c.report.Indeterminate++
+		}
+
+		index := c.writers
+		if t.Type == EventFail {
+			index = c.failed
+		}
+		for k, v := range finalWrites(t.Ops) {
+			addWriter(index, k, v, id)
+		}
+	}
+}
+
+// Ties every external read of a committed txn to the writer it read from
+func (c *checker) resolveReads() {
+	for _, id := range c.ids() {
+		t := c.txns[id]
+		if t.Type != EventOk {
+			continue
+		}
+
+		c.reads[id] = make(map[int]int)
+		for k, v := range externalReads(t.Ops) {
+			candidates := slices.DeleteFunc(slices.Clone(c.writers[k][v]), func(w int) bool { return w == id })
+			switch len(candidates) {
+			case 1:
+				c.reads[id][k] = candidates[0]
+			case 0:
+				if aborted := c.failed[k][v]; len(aborted) > 0 {
+					c.add(AnomalyAbortedRead, fmt.Sprintf("T%d read %d from key %d, only written by failed transactions", id, v, k), append([]int{id}, aborted...)...)
+				} else {
+					c.add(AnomalyGarbageRead, fmt.Sprintf("T%d read %d from key %d, which no transaction wrote", id, v, k), id)
+				}
+			default:
+				c.report.Ambiguous++
+			}
+		}
+	}
+}
+
+func (c *checker) checkLostUpdates() {
+	// key -> version read -> committed txns that read that version and then wrote the key
+	overwrites := make(map[int]map[int][]int)
+	for _, id := range c.ids() {
+		writes := finalWrites(c.txns[id].Ops)
+		for k, w := range c.reads[id] {
+			if _, ok := writes[k]; ok {
+				addWriter(overwrites, k, w, id)
+			}
+		}
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(overwrites)) {
+		for _, w := range slices.Sorted(maps.Keys(overwrites[k])) {
+			txns := overwrites[k][w]
+			if len(txns) < 2 {
+				continue
+			}
+
+			writer := fmt.Sprintf("T%d", w)
+			if w == initialTxn {
+				writer = "the initial state"
+			}
+			c.add(AnomalyLostUpdate, fmt.Sprintf("%d transactions read key %d as written by %s and all overwrote it, only the last write survived", len(txns), k, writer), txns...)
+		}
+	}
+}
+
+func (c *checker) buildEdges() {
+	// key -> writer -> txns that read from it, and the ones among them that wrote the key after reading
+	readers := make(map[int]map[int][]int)
+	successors := make(map[int]map[int][]int)
+	for _, id := range c.ids() {
+		writes := finalWrites(c.txns[id].Ops)
+		for k, w := range c.reads[id] {
+			addWriter(readers, k, w, id)
+			if _, ok := writes[k]; ok {
+				addWriter(successors, k, w, id)
+			}
+		}
+	}
+
+	for _, id := range c.ids() {
+		for k, w := range c.reads[id] {
+			if w != initialTxn {
+				c.edges[w] = append(c.edges[w], edge{to: id, kind: "wr", key: k})
+			}
+		}
+	}
+
+	for k, byWriter := range successors {
+		for w, next := range byWriter {
+			for _, n := range next {
+				if w != initialTxn {
+					c.edges[w] = append(c.edges[w], edge{to: n, kind: "ww", key: k})
+				}
+				// Everyone who read the version n overwrote has to come before n
+				for _, r := range readers[k][w] {
+					if r != n {
+						c.edges[r] = append(c.edges[r], edge{to: n, kind: "rw", key: k})
+					}
+				}
+			}
+		}
+	}
+}
+
+// Tarjan's strongly connected components, every component with more than one txn contains a cycle
+func (c *checker) checkCycles() {
+	index := 0
+	indices := make(map[int]int)
+	lowlink := make(map[int]int)
+	onStack := make(map[int]bool)
+	var stack []int
+	var components [][]int
+
+	var connect func(v int)
+	connect = func(v int) {
+		indices[v] = index
+		lowlink[v] = index
+		index++
+		stack = append(stack, v)
+		onStack[v] = true
+
+		for _, e := range c.edges[v] {
+			if _, seen := indices[e.to]; !seen {
+				connect(e.to)
+				lowlink[v] = min(lowlink[v], lowlink[e.to])
+			} else if onStack[e.to] {
+				lowlink[v] = min(lowlink[v], indices[e.to])
+			}
+		}
+
+		if lowlink[v] == indices[v] {
+			var component []int
+			for {
+				w := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[w] = false
+				component = append(component, w)
+				if w == v {
+					break
+				}
+			}
+			if len(component) > 1 {
+				components = append(components, component)
+			}
+		}
+	}
+
+	for _, id := range c.ids() {
+		if _, seen := indices[id]; !seen {
+			connect(id)
+		}
+	}
+
+	for _, component := range components {
+		slices.Sort(component)
+		cycle := c.findCycle(component)
+		c.add(AnomalyCycle, fmt.Sprintf("%d transactions depend on each other in a cycle: %s", len(component), cycle), component...)
+	}
+}
+
+// Shortest cycle through the first txn of the component, printed as T1 -rw(2)-> T4 -wr(1)-> T1
+func (c *checker) findCycle(component []int) string {
+	inComponent := make(map[int]bool)
+	for _, id := range component {
+		inComponent[id] = true
+	}
+
+	start := component[0]
+	type step struct {
+		prev int
+		edge edge
+	}
+	visited := make(map[int]step)
+	queue := []int{start}
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+
+		for _, e := range c.edges[v] {
+			if !inComponent[e.to] {
+				continue
+			}
+
+			if e.to == start {
+				path := []string{fmt.Sprintf("-%s(%d)-> T%d", e.kind, e.key, start)}
+				for at := v; at != start; at = visited[at].prev {
+					s := visited[at]
+					path = append([]string{fmt.Sprintf("-%s(%d)-> T%d", s.edge.kind, s.edge.key, at)}, path...)
+				}
+				return fmt.Sprintf("T%d %s", start, strings.Join(path, " "))
+			}
+
+			if _, seen := visited[e.to]; !seen {
+				visited[e.to] = step{prev: v, edge: e}
+				queue = append(queue, e.to)
+			}
+		}
+	}
+
+	return "unknown"
+}
+
+func (c *checker) checkInvariants() {
+	initialTotal := 0
+	for _, v := range c.opts.Initial {
+		initialTotal += v
+	}
+
+	if c.opts.ConstantTotal {
+		for _, id := range c.ids() {
+			t := c.txns[id]
+			reads := externalReads(t.Ops)
+			if t.Type != EventOk || len(reads) != len(c.opts.Initial) {
+				continue // Only txns that saw every key can be checked
+			}
+
+			total := 0
+			for _, v := range reads {
+				total += v
+			}
+			if total != initialTotal {
+				c.add(AnomalyInconsistentRead, fmt.Sprintf("T%d saw a total of %d, the total is always %d", id, total, initialTotal), id)
+			}
+		}
+	}
+
+	if c.opts.Final == nil {
+		return
+	}
+
+	finalTotal := 0
+	for _, v := range c.opts.Final {
+		finalTotal += v
+	}
+	if c.opts.ConstantTotal && finalTotal != initialTotal {
+		c.add(AnomalyBrokenTotal, fmt.Sprintf("total went from %d to %d", initialTotal, finalTotal))
+	}
+
+	// Every committed txn moved its keys by (what it wrote - what it read), those deltas have to add up to the final state
+	expected := maps.Clone(c.opts.Initial)
+	uncertain := make(map[int]bool)
+	contributors := make(map[int][]int)
+	for _, id := range c.ids() {
+		t := c.txns[id]
+		reads := externalReads(t.Ops)
+		for k, w := range finalWrites(t.Ops) {
+			switch {
+			case t.Type == EventInfo:
+				uncertain[k] = true
+			case t.Type == EventOk:
+				r, ok := reads[k]
+				if !ok {
+					uncertain[k] = true // Blind write, no delta to add up
+					continue
+				}
+				expected[k] += w - r
+				contributors[k] = append(contributors[k], id)
+			}
+		}
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(c.opts.Final)) {
+		if uncertain[k] || c.opts.Final[k] == expected[k] {
+			continue
+		}
+
+		c.add(AnomalyFinalMismatch, fmt.Sprintf("key %d is %d, but the %d committed transactions that changed it add up to %d (%+d missing)",
+			k, c.opts.Final[k], len(contributors[k]), expected[k], expected[k]-c.opts.Final[k]))
+	}
+}
+
+func (c *checker) add(kind AnomalyKind, detail string, txns ...int) {
+	a := Anomaly{Kind: kind, Detail: detail}
+	for _, id := range txns {
+		if t, ok := c.txns[id]; ok {
+			a.Txns = append(a.Txns, *t)
+		}
+	}
+
+	c.report.Anomalies = append(c.report.Anomalies, a)
+}
+
+func (c *checker) ids() []int {
+	return slices.Sorted(maps.Keys(c.txns))
+}
+
+func addWriter(index map[int]map[int][]int, key, value, txn int) {
+	if index[key] == nil {
+		index[key] = make(map[int][]int)
+	}
+	index[key][value] = append(index[key][value], txn)
+}
+
+// The last value a txn wrote to each key, the intermediate ones were never visible to anyone else
+func finalWrites(ops []MicroOp) map[int]int {
+	writes := make(map[int]int)
+	for _, op := range ops {
+		if op.Write {
+			writes[op.Key] = op.Value
+		}
+	}
+
+	return writes
+}
+
+// Reads that happened before the txn wrote the key itself, those are the ones that say something about other txns
+func externalReads(ops []MicroOp) map[int]int {
+	reads := make(map[int]int)
+	written := make(map[int]bool)
+	for _, op := range ops {
+		switch {
+		case op.Write:
+			written[op.Key] = true
+		case !written[op.Key]:
+			if _, seen := reads[op.Key]; !seen {
+				reads[op.Key] = op.Value
+			}
+		}
+	}
+
+	return reads
+}
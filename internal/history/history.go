@@ -0,0 +1,164 @@
+package history
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Jepsen style history recording. Every transaction attempt gets an invoke event when it starts and a completion event
+// (ok, fail or info) when we know how it ended, together with every value it read and wrote.
+// Printing balances at the end only tells us something went wrong, the history lets the checker say which transactions did it
+
+type EventType string
+
+const (
+	EventInvoke EventType = "invoke"
+	EventOk     EventType = "ok"
+	EventFail   EventType = "fail"
+	EventInfo   EventType = "info" // Unknown outcome, e.g. the connection died during commit - it may or may not have committed
+)
+
+type MicroOp struct {
+	Write bool `json:"write"`
+	Key   int  `json:"key"`
+	Value int  `json:"value"`
+}
+
+func (m MicroOp) String() string {
+	if m.Write {
+		return fmt.Sprintf("w(%d,%d)", m.Key, m.Value)
+	}
+
+	return fmt.Sprintf("r(%d,%d)", m.Key, m.Value)
+}
+
+type Event struct {
+	Index   int       `json:"index"`
+	Type    EventType `json:"type"`
+	Txn     int       `json:"txn"` // Links the invoke to its completion
+	Process int       `json:"process"`
+	Name    string    `json:"name"`
+	Ops     []MicroOp `json:"ops,omitempty"` // Only on the completion, that's when we know everything the txn did
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+type Recorder struct {
+	mu     sync.Mutex
+	events []Event
+	nextID int
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Txn collects the reads and writes of one attempt. The methods are nil safe, so the experiment code can take a *Txn
+// and callers that don't record anything just pass nil
+type Txn struct {
+	recorder *Recorder
+	id       int
+	process  int
+	name     string
+
+	mu   sync.Mutex
+	ops  []MicroOp
+	done bool
+}
+
+func (r *Recorder) Invoke(process int, name string) *Txn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	t := &Txn{recorder: r, id: r.nextID, process: process, name: name}
+	r.events = append(r.events, Event{Index: len(r.events), Type: EventInvoke, Txn: t.id, Process: process, Name: name, Time: time.Now()})
+	return t
+}
+
+func (t *Txn) Read(key, value int) {
+	t.add(MicroOp{Key: key, Value: value})
+}
+
+func (t *Txn) Write(key, value int) {
+	t.add(MicroOp{Write: true, Key: key, Value: value})
+}
+
+func (t *Txn) add(op MicroOp) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ops = append(t.ops, op)
+}
+
+// Complete records how the attempt ended. A commit that failed because the connection broke is indeterminate,
+// anything else that returned an error definitely didn't commit
+func (t *Txn) Complete(err error) {
+	if t == nil {
+		return
+	}
+
+	typ := EventOk
+	switch {
+	case err == nil:
+	case errors.Is(err, driver.ErrBadConn):
+		typ = EventInfo
+	default:
+		typ = EventFail
+	}
+
+	t.complete(typ, err)
+}
+
+func (t *Txn) complete(typ EventType, err error) {
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return
+	}
+	t.done = true
+	ops := append([]MicroOp(nil), t.ops...)
+	t.mu.Unlock()
+
+	e := Event{Type: typ, Txn: t.id, Process: t.process, Name: t.name, Ops: ops, Time: time.Now()}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	t.recorder.mu.Lock()
+	defer t.recorder.mu.Unlock()
+	e.Index = len(t.recorder.events)
+	t.recorder.events = append(t.recorder.events, e)
+}
+
+var errRetried = errors.New("attempt failed, retried")
+
+// Run records one transaction per attempt for code that retries, like tx_retry.RunInTx. Call attempt at the start of every attempt,
+// the previous attempt must have failed or we wouldn't be retrying, and the last one ends the way run ends
+func (r *Recorder) Run(process int, name string, run func(attempt func() *Txn) error) error {
+	var current *Txn
+	attempt := func() *Txn {
+		if current != nil {
+			current.complete(EventFail, errRetried)
+		}
+		current = r.Invoke(process, name)
+		return current
+	}
+
+	err := run(attempt)
+	current.Complete(err)
+	return err
+}
+
+func (r *Recorder) History() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Event(nil), r.events...)
+}
@@ -0,0 +1,232 @@
+package http_cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Caching one level up from redis: the client keeps the response and asks "has it changed?" with the ETag or Last-Modified it got.
+// The server still runs the handler (the body is needed to hash it), but a 304 has no body, so what's saved is the bandwidth
+// and the client's decode. Cache-Control tells the client and any shared cache in between how long they may reuse it without asking
+
+type Policy struct {
+	MaxAge   time.Duration // How long any cache, the browser included, may reuse the response without asking
+	SMaxAge  time.Duration // Overrides MaxAge for shared caches, 0 means same as MaxAge
+	Private  bool          // Only the browser may keep it, never a shared cache
+	NoCache  bool          // May be kept, but has to be revalidated every time
+	NoStore  bool          // Never kept anywhere
+	WeakETag bool          // W/"..." - the same content, not necessarily the same bytes
+	Vary     []string      // Request headers that change the response
+}
+
+func (p Policy) CacheControl() string {
+	if p.NoStore {
+		return "no-store"
+	}
+
+	var parts []string
+	if p.Private {
+		parts = append(parts, "private")
+	} else {
+		parts = append(parts, "public")
+	}
+	if p.NoCache {
+		parts = append(parts, "no-cache")
+	}
+	parts = append(parts, fmt.Sprintf("max-age=%d", int(p.MaxAge.Seconds())))
+	if p.SMaxAge > 0 && !p.Private {
+		parts = append(parts, fmt.Sprintf("s-maxage=%d", int(p.SMaxAge.Seconds())))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+type Stats struct {
+	Requests     int64 `json:"requests"`
+	NotModified  int64 `json:"not_modified"`
+	BytesSent    int64 `json:"bytes_sent"`
+	BytesSaved   int64 `json:"bytes_saved"` // Bodies a 304 didn't have to send
+	SharedHits   int64 `json:"shared_hits"`
+	SharedMisses int64 `json:"shared_misses"`
+}
+
+var requests, notModified, bytesSent, bytesSaved atomic.Int64
+
+// Conditional sets ETag, Last-Modified, Cache-Control and Vary on successful GETs and answers If-None-Match
+// and If-Modified-Since with a 304. A handler that knows when its data last changed can set Last-Modified itself,
+// otherwise it's the first time this URL returned this ETag
+func Conditional(policy Policy) func(http.Handler) http.Handler {
+	// One entry per URL (and Vary variant) holding its current ETag, a new ETag replaces the old one instead of piling up
+	type version struct {
+		etag  string
+		since time.Time
+	}
+	var mu sync.Mutex
+	modified := make(map[string]version)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rec := newRecorder()
+			next.ServeHTTP(rec, r)
+			counted := !fromSharedCache(r) // The shared cache in front counts what reaches the client
+			if counted {
+				requests.Add(1)
+			}
+
+			if rec.status != http.StatusOK {
+				rec.flush(w, r.Method != http.MethodHead)
+				if counted {
+					bytesSent.Add(int64(rec.body.Len()))
+				}
+				return
+			}
+
+			header := rec.Header()
+			if header.Get("ETag") == "" {
+				header.Set("ETag", computeETag(rec.body.Bytes(), policy.WeakETag))
+			}
+			if header.Get("Last-Modified") == "" {
+				key := r.URL.String()
+				for _, v := range policy.Vary {
+					key += "\x00" + r.Header.Get(v)
+				}
+				etag := header.Get("ETag")
+
+				mu.Lock()
+				current, ok := modified[key]
+				if !ok || current.etag != etag {
+					current = version{etag: etag, since: time.Now().UTC().Truncate(time.Second)}
+					modified[key] = current
+				}
+				mu.Unlock()
+				header.Set("Last-Modified", current.since.Format(http.TimeFormat))
+			}
+			header.Set("Cache-Control", policy.CacheControl())
+			for _, v := range policy.Vary {
+				header.Add("Vary", v)
+			}
+			header.Set("Content-Length", strconv.Itoa(rec.body.Len()))
+
+			if notModifiedFor(r, header) {
+				if counted {
+					notModified.Add(1)
+					bytesSaved.Add(int64(rec.body.Len()))
+				}
+				writeNotModified(w, header)
+				return
+			}
+
+			rec.flush(w, r.Method != http.MethodHead)
+			if counted {
+				bytesSent.Add(int64(rec.body.Len()))
+			}
+		})
+	}
+}
+
+func computeETag(body []byte, weak bool) string {
+	sum := sha256.Sum256(body)
+	tag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+	if weak {
+		return "W/" + tag
+	}
+
+	return tag
+}
+
+// RFC 9110: If-None-Match wins over If-Modified-Since, and uses the weak comparison - W/"x" matches "x"
+func notModifiedFor(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		for candidate := range strings.SplitSeq(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return !lastModified.After(ims)
+}
+
+// A 304 carries the validators and caching headers, never the body or its length
+func writeNotModified(w http.ResponseWriter, header http.Header) {
+	for _, name := range []string{"ETag", "Last-Modified", "Cache-Control", "Vary", "Age", "X-Cache", "Expires"} {
+		if values := header.Values(name); len(values) > 0 {
+			w.Header()[name] = values
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+func GetStats() Stats {
+	return Stats{
+		Requests:     requests.Load(),
+		NotModified:  notModified.Load(),
+		BytesSent:    bytesSent.Load(),
+		BytesSaved:   bytesSaved.Load(),
+		SharedHits:   sharedHits.Load(),
+		SharedMisses: sharedMisses.Load(),
+	}
+}
+
+// Holds on to the whole response, headers can't be changed once the body is on its way
+type recorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func newRecorder() *recorder {
+	return &recorder{header: make(http.Header), status: http.StatusOK}
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+// Only the first call counts, like on a real ResponseWriter
+func (r *recorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.body.Write(p)
+}
+
+func (r *recorder) flush(w http.ResponseWriter, withBody bool) {
+	for name, values := range r.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(r.status)
+	if withBody {
+		w.Write(r.body.Bytes())
+	}
+}
@@ -0,0 +1,230 @@
+package http_cache
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A shared cache like a CDN or nginx proxy_cache, in process: while a response is fresh the handler doesn't run at all.
+// Vary is what keeps it correct - a response that depends on Accept-Language is stored once per language,
+// and a response with Vary: * or Cache-Control private/no-store/no-cache is never stored.
+// Put it in front of Conditional: r.With(cache.Middleware, http_cache.Conditional(policy))
+
+var sharedHits, sharedMisses atomic.Int64
+
+type Cache struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*resource // Method + URL
+	order   []string             // Oldest first, evicted when full
+}
+
+// One URL, stored once per combination of the headers it varies on
+type resource struct {
+	path     string
+	vary     []string
+	variants map[string]*stored
+}
+
+type stored struct {
+	status  int
+	header  http.Header
+	body    []byte
+	date    time.Time
+	expires time.Time
+}
+
+func NewCache(maxEntries int) *Cache {
+	return &Cache{maxEntries: max(maxEntries, 1), entries: make(map[string]*resource)}
+}
+
+type sharedCacheKey struct{}
+
+func fromSharedCache(r *http.Request) bool {
+	return r.Context().Value(sharedCacheKey{}) != nil
+}
+
+func (c *Cache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.Method + " " + r.URL.String()
+		forceRevalidate := strings.Contains(r.Header.Get("Cache-Control"), "no-cache")
+		if entry := c.lookup(key, r); entry != nil && !forceRevalidate {
+			sharedHits.Add(1)
+			header := entry.header.Clone()
+			header.Set("Age", strconv.Itoa(int(time.Since(entry.date).Seconds())))
+			header.Set("X-Cache", "HIT")
+			c.respond(w, r, entry.status, header, entry.body)
+			return
+		}
+		sharedMisses.Add(1)
+
+		// The cache wants the full response to store, whatever validators this particular client sent
+		origin := r.Clone(context.WithValue(r.Context(), sharedCacheKey{}, true))
+		origin.Header.Del("If-None-Match")
+		origin.Header.Del("If-Modified-Since")
+
+		rec := newRecorder()
+		next.ServeHTTP(rec, origin)
+
+		header := rec.Header().Clone()
+		c.store(key, r, rec.status, header, rec.body.Bytes())
+		header.Set("X-Cache", "MISS")
+		c.respond(w, r, rec.status, header, rec.body.Bytes())
+	})
+}
+
+func (c *Cache) respond(w http.ResponseWriter, r *http.Request, status int, header http.Header, body []byte) {
+	requests.Add(1)
+	if status == http.StatusOK && notModifiedFor(r, header) {
+		notModified.Add(1)
+		bytesSaved.Add(int64(len(body)))
+		writeNotModified(w, header)
+		return
+	}
+
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+		bytesSent.Add(int64(len(body)))
+	}
+}
+
+func (c *Cache) lookup(key string, r *http.Request) *stored {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry, ok := res.variants[variantKey(res.vary, r)]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+
+	return entry
+}
+
+func (c *Cache) store(key string, r *http.Request, status int, header http.Header, body []byte) {
+	if status != http.StatusOK {
+		return
+	}
+	ttl, ok := sharedTTL(header.Get("Cache-Control"))
+	if !ok {
+		return
+	}
+	vary := varyHeaders(header)
+	if vary == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res, ok := c.entries[key]
+	if !ok || !slices.Equal(res.vary, vary) { // The response changed what it varies on, the old variants mean nothing
+		if !ok {
+			c.order = append(c.order, key)
+			c.evict()
+		}
+		res = &resource{path: r.URL.Path, vary: vary, variants: make(map[string]*stored)}
+		c.entries[key] = res
+	}
+
+	now := time.Now()
+	res.variants[variantKey(vary, r)] = &stored{status: status, header: header, body: body, date: now, expires: now.Add(ttl)}
+}
+
+func (c *Cache) evict() {
+	for len(c.order) > c.maxEntries {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// Purge drops every stored response for the path, whatever the query string or variant - call it after a write
+func (c *Cache) Purge(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	kept := c.order[:0]
+	for _, key := range c.order {
+		if c.entries[key].path == path {
+			delete(c.entries, key)
+			continue
+		}
+		kept = append(kept, key)
+	}
+	c.order = kept
+}
+
+// How long a shared cache may keep the response: s-maxage over max-age, nothing at all for private, no-store and no-cache
+func sharedTTL(cacheControl string) (time.Duration, bool) {
+	maxAge, sMaxAge := -1, -1
+	for directive := range strings.SplitSeq(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		switch name {
+		case "private", "no-store", "no-cache":
+			return 0, false
+		case "max-age":
+			maxAge, _ = strconv.Atoi(value)
+		case "s-maxage":
+			sMaxAge, _ = strconv.Atoi(value)
+		}
+	}
+
+	seconds := maxAge
+	if sMaxAge >= 0 {
+		seconds = sMaxAge
+	}
+	if seconds <= 0 {
+		return 0, false
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
+
+// Canonical header names, nil for Vary: * which can't be cached
+func varyHeaders(header http.Header) []string {
+	vary := []string{}
+	for _, value := range header.Values("Vary") {
+		for name := range strings.SplitSeq(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	return vary
+}
+
+func variantKey(vary []string, r *http.Request) string {
+	var b strings.Builder
+	for _, name := range vary {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+		b.WriteByte('\n')
+	}
+
+	return b.String()
+}
@@ -0,0 +1,342 @@
+package job_queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A job queue in a plain table. A claim flips a pending row to running and gives the worker a lease on it - if the worker dies
+// the lease runs out and the row is claimable again. A failed job goes back to pending but stays invisible for a while (the
+// visibility timeout), and after MaxAttempts it's moved to dead_jobs instead of being retried forever.
+// Every write after the claim is fenced on (locked_by, attempts): a worker whose lease expired and got reclaimed can't ack
+// a job that now belongs to someone else
+
+type ClaimStrategy string
+
+const (
+	SkipLocked ClaimStrategy = "skip locked" // Locked rows are invisible to the claim, every worker gets a different job
+	NoWait     ClaimStrategy = "nowait"      // Fail straight away with 55P03 when the head of the queue is locked
+	Blocking   ClaimStrategy = "for update"  // Naive, every worker queues up behind the lock on the same head row
+	Atomic     ClaimStrategy = "atomic"      // SQLite, no row locks at all - one UPDATE ... RETURNING under the database write lock
+)
+
+var ErrLeaseLost = errors.New("lease expired, the job was claimed by another worker")
+
+type Config struct {
+	Lease            time.Duration // How long a claimed job is ours before another worker may take it over
+	RetryDelay       time.Duration // Visibility timeout after a failure, multiplied by the attempt count
+	MaxAttempts      int
+	LockTimeout      time.Duration // Postgres lock_timeout for the claim, 0 waits forever
+	StatementTimeout time.Duration // Postgres statement_timeout for the claim, 0 means no limit
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Lease:            2 * time.Second,
+		RetryDelay:       50 * time.Millisecond,
+		MaxAttempts:      3,
+		LockTimeout:      100 * time.Millisecond,
+		StatementTimeout: time.Second,
+	}
+}
+
+type Job struct {
+	ID       int64
+	Payload  string
+	Attempts int // Including this one, doubles as the fencing token
+	Worker   string
+}
+
+type Counts struct {
+	Pending int
+	Running int
+	Done    int
+	Dead    int
+}
+
+type Queue struct {
+	DB       *sql.DB
+	cfg      Config
+	strategy ClaimStrategy
+	postgres bool
+	queries  queueQueries
+}
+
+type queueQueries struct {
+	setup, enqueue, claim, complete, retry, bury, remove, counts, dead string
+}
+
+func NewPostgres(DB *sql.DB, cfg Config, strategy ClaimStrategy) *Queue {
+	lock := "FOR UPDATE SKIP LOCKED"
+	switch strategy {
+	case NoWait:
+		lock = "FOR UPDATE NOWAIT"
+	case Blocking:
+		lock = "FOR UPDATE"
+	}
+
+	return &Queue{DB: DB, cfg: cfg, strategy: strategy, postgres: true, queries: queueQueries{
+		setup: `
+			DROP TABLE IF EXISTS jobs, dead_jobs;
+			CREATE TABLE jobs (
+				id BIGSERIAL PRIMARY KEY,
+				payload TEXT NOT NULL,
+				status TEXT NOT NULL DEFAULT 'pending',
+				attempts INTEGER NOT NULL DEFAULT 0,
+				run_at BIGINT NOT NULL,
+				locked_by TEXT,
+				lease_until BIGINT,
+				last_error TEXT
+			);
+			CREATE INDEX jobs_claimable ON jobs (id) WHERE status IN ('pending', 'running');
+			CREATE TABLE dead_jobs (id BIGINT PRIMARY KEY, payload TEXT NOT NULL, attempts INTEGER NOT NULL, last_error TEXT, died_at BIGINT NOT NULL);
+		`,
+		enqueue: `INSERT INTO jobs (payload, run_at) VALUES ($1, $2)`,
+		// The subquery picks and locks the row, the outer update claims it - both in one statement
+		claim: `
+			UPDATE jobs SET status = 'running', attempts = attempts + 1, locked_by = $2, lease_until = $3
+			WHERE id = (
+				SELECT id FROM jobs
+				WHERE (status = 'pending' AND run_at <= $1) OR (status = 'running' AND lease_until < $1)
+				ORDER BY id LIMIT 1
+				` + lock + `
+			)
+			RETURNING id, payload, attempts`,
+		complete: `UPDATE jobs SET status = 'done', locked_by = NULL, lease_until = NULL WHERE id = $1 AND locked_by = $2 AND attempts = $3`,
+		retry:    `UPDATE jobs SET status = 'pending', run_at = $4, last_error = $5, locked_by = NULL, lease_until = NULL WHERE id = $1 AND locked_by = $2 AND attempts = $3`,
+		bury:     `INSERT INTO dead_jobs (id, payload, attempts, last_error, died_at) SELECT id, payload, attempts, $4, $5 FROM jobs WHERE id = $1 AND locked_by = $2 AND attempts = $3`,
+		remove:   `DELETE FROM jobs WHERE id = $1`,
+		counts:   `SELECT status, COUNT(*) FROM jobs GROUP BY status`,
+		dead:     `SELECT COUNT(*) FROM dead_jobs`,
+	}}
+}
+
+// The sqlite fallback. There's no SKIP LOCKED (or row locks at all), but there is only ever one writer - so a single
+// UPDATE ... RETURNING is already an atomic claim, the other workers just wait for the write lock (busy timeout) instead of a row
+func NewSQLite(DB *sql.DB, cfg Config) *Queue {
+	return &Queue{DB: DB, cfg: cfg, strategy: Atomic, queries: queueQueries{
+		setup: `
+			DROP TABLE IF EXISTS jobs;
+			DROP TABLE IF EXISTS dead_jobs;
+			CREATE TABLE jobs (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				payload TEXT NOT NULL,
+				status TEXT NOT NULL DEFAULT 'pending',
+				attempts INTEGER NOT NULL DEFAULT 0,
+				run_at INTEGER NOT NULL,
+				locked_by TEXT,
+				lease_until INTEGER,
+				last_error TEXT
+			);
+			CREATE INDEX jobs_claimable ON jobs (id) WHERE status IN ('pending', 'running');
+			CREATE TABLE dead_jobs (id INTEGER PRIMARY KEY, payload TEXT NOT NULL, attempts INTEGER NOT NULL, last_error TEXT, died_at INTEGER NOT NULL);
+		`,
+		enqueue: `INSERT INTO jobs (payload, run_at) VALUES (?, ?)`,
+		claim: `
+			UPDATE jobs SET status = 'running', attempts = attempts + 1, locked_by = ?2, lease_until = ?3
+			WHERE id = (
+				SELECT id FROM jobs
+				WHERE (status = 'pending' AND run_at <= ?1) OR (status = 'running' AND lease_until < ?1)
+				ORDER BY id LIMIT 1
+			)
+			RETURNING id, payload, attempts`,
+		complete: `UPDATE jobs SET status = 'done', locked_by = NULL, lease_until = NULL WHERE id = ? AND locked_by = ? AND attempts = ?`,
+		retry:    `UPDATE jobs SET status = 'pending', run_at = ?4, last_error = ?5, locked_by = NULL, lease_until = NULL WHERE id = ?1 AND locked_by = ?2 AND attempts = ?3`,
+		bury:     `INSERT INTO dead_jobs (id, payload, attempts, last_error, died_at) SELECT id, payload, attempts, ?4, ?5 FROM jobs WHERE id = ?1 AND locked_by = ?2 AND attempts = ?3`,
+		remove:   `DELETE FROM jobs WHERE id = ?`,
+		counts:   `SELECT status, COUNT(*) FROM jobs GROUP BY status`,
+		dead:     `SELECT COUNT(*) FROM dead_jobs`,
+	}}
+}
+
+func (q *Queue) Strategy() ClaimStrategy {
+	return q.strategy
+}
+
+func (q *Queue) Setup(ctx context.Context) error {
+	if _, err := q.DB.ExecContext(ctx, q.queries.setup); err != nil {
+		return fmt.Errorf("failed creating job tables: %w", err)
+	}
+
+	return nil
+}
+
+func (q *Queue) Enqueue(ctx context.Context, payloads ...string) error {
+	tx, err := q.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, q.queries.enqueue)
+	if err != nil {
+		return fmt.Errorf("failed preparing enqueue: %w", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now().UnixMilli()
+	for _, payload := range payloads {
+		if _, err = stmt.ExecContext(ctx, payload, now); err != nil {
+			return fmt.Errorf("failed enqueueing job: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed committing jobs: %w", err)
+	}
+
+	return nil
+}
+
+// Claim returns the next visible job, or nil when there's nothing to do right now.
+// A job that ran out of attempts while its worker was dead is dead-lettered on the spot and the claim moves on
+func (q *Queue) Claim(ctx context.Context, worker string) (*Job, error) {
+	for {
+		job, err := q.claimOnce(ctx, worker)
+		if err != nil || job == nil {
+			return nil, err
+		}
+		if job.Attempts <= q.cfg.MaxAttempts {
+			return job, nil
+		}
+
+		if err = q.bury(ctx, job, "lease expired on the last attempt"); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (q *Queue) claimOnce(ctx context.Context, worker string) (*Job, error) {
+	tx, err := q.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if q.postgres {
+		// set_config(..., true) is SET LOCAL, the timeouts only apply to this transaction and die with it
+		_, err = tx.ExecContext(ctx, `SELECT set_config('lock_timeout', $1, true), set_config('statement_timeout', $2, true)`,
+			fmt.Sprintf("%dms", q.cfg.LockTimeout.Milliseconds()), fmt.Sprintf("%dms", q.cfg.StatementTimeout.Milliseconds()))
+		if err != nil {
+			return nil, fmt.Errorf("failed setting timeouts: %w", err)
+		}
+	}
+
+	now := time.Now()
+	job := &Job{Worker: worker}
+	err = tx.QueryRowContext(ctx, q.queries.claim, now.UnixMilli(), worker, now.Add(q.cfg.Lease).UnixMilli()).Scan(&job.ID, &job.Payload, &job.Attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed claiming job: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed committing claim: %w", err)
+	}
+
+	return job, nil
+}
+
+func (q *Queue) Complete(ctx context.Context, job *Job) error {
+	res, err := q.DB.ExecContext(ctx, q.queries.complete, job.ID, job.Worker, job.Attempts)
+	if err != nil {
+		return fmt.Errorf("failed completing job %d: %w", job.ID, err)
+	}
+
+	return leaseHeld(res, job)
+}
+
+// Fail puts the job back for a later attempt, or dead-letters it when it's out of attempts. Returns whether it was dead-lettered
+func (q *Queue) Fail(ctx context.Context, job *Job, reason error) (bool, error) {
+	if job.Attempts >= q.cfg.MaxAttempts {
+		return true, q.bury(ctx, job, reason.Error())
+	}
+
+	runAt := time.Now().Add(q.cfg.RetryDelay * time.Duration(job.Attempts)).UnixMilli()
+	res, err := q.DB.ExecContext(ctx, q.queries.retry, job.ID, job.Worker, job.Attempts, runAt, reason.Error())
+	if err != nil {
+		return false, fmt.Errorf("failed rescheduling job %d: %w", job.ID, err)
+	}
+
+	return false, leaseHeld(res, job)
+}
+
+func (q *Queue) bury(ctx context.Context, job *Job, reason string) error {
+	tx, err := q.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, q.queries.bury, job.ID, job.Worker, job.Attempts, reason, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed dead-lettering job %d: %w", job.ID, err)
+	}
+	if err = leaseHeld(res, job); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, q.queries.remove, job.ID); err != nil {
+		return fmt.Errorf("failed removing dead job %d: %w", job.ID, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed committing dead job %d: %w", job.ID, err)
+	}
+
+	return nil
+}
+
+func (q *Queue) Counts(ctx context.Context) (Counts, error) {
+	var counts Counts
+	rows, err := q.DB.QueryContext(ctx, q.queries.counts)
+	if err != nil {
+		return counts, fmt.Errorf("failed counting jobs: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var n int
+		if err = rows.Scan(&status, &n); err != nil {
+			return counts, fmt.Errorf("failed counting jobs: %w", err)
+		}
+		switch status {
+		case "pending":
+			counts.Pending = n
+		case "running":
+			counts.Running = n
+		case "done":
+			counts.Done = n
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return counts, fmt.Errorf("failed counting jobs: %w", err)
+	}
+
+	if err = q.DB.QueryRowContext(ctx, q.queries.dead).Scan(&counts.Dead); err != nil {
+		return counts, fmt.Errorf("failed counting dead jobs: %w", err)
+	}
+
+	return counts, nil
+}
+
+func leaseHeld(res sql.Result, job *Job) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed checking job %d: %w", job.ID, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("job %d attempt %d: %w", job.ID, job.Attempts, ErrLeaseLost)
+	}
+
+	return nil
+}
+
+func (c Counts) String() string {
+	return fmt.Sprintf("pending %d, running %d, done %d, dead %d", c.Pending, c.Running, c.Done, c.Dead)
+}
@@ -0,0 +1,121 @@
+package job_queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	tx_retry "andreashoj/deeper-learnings/internal/tx-retry"
+)
+
+// Return ErrAbandoned from a handler to play a worker that died halfway through: nothing gets acked,
+// the job sits in running until its lease runs out and somebody else picks it up
+var ErrAbandoned = errors.New("worker walked away from the job")
+
+type Handler func(ctx context.Context, job *Job) error
+
+type WorkerStats struct {
+	Claimed      int
+	Completed    int
+	Retried      int
+	DeadLettered int
+	Abandoned    int
+	EmptyPolls   int // Claims that came back with nothing, the queue was empty or every visible job was taken
+	LockTimeouts int // 55P03 from NOWAIT or lock_timeout, or sqlite busy
+	LeaseLost    int // Acks rejected because the lease expired and the job moved on
+	ClaimErrors  int // Anything else, statement_timeout included
+	ClaimWait    time.Duration
+}
+
+func (s WorkerStats) String() string {
+	return fmt.Sprintf("claimed %d, completed %d, retried %d, dead %d, abandoned %d, empty polls %d, lock timeouts %d, lease lost %d, claim errors %d",
+		s.Claimed, s.Completed, s.Retried, s.DeadLettered, s.Abandoned, s.EmptyPolls, s.LockTimeouts, s.LeaseLost, s.ClaimErrors)
+}
+
+// Work runs the workers until ctx is done. A worker polls again after poll when it didn't get a job.
+// The handler and the ack aren't bound to ctx, a job that was claimed before shutdown gets to finish
+func Work(ctx context.Context, q *Queue, workers int, poll time.Duration, handle Handler) WorkerStats {
+	var mu sync.Mutex
+	var stats WorkerStats
+	count := func(f func(s *WorkerStats)) {
+		mu.Lock()
+		f(&stats)
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Go(func() {
+			name := fmt.Sprintf("worker-%d", i)
+			for ctx.Err() == nil {
+				began := time.Now()
+				job, err := q.Claim(ctx, name)
+				wait := time.Since(began)
+				count(func(s *WorkerStats) { s.ClaimWait += wait })
+
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					switch tx_retry.Classify(err) {
+					case tx_retry.ClassLockNotAvail, tx_retry.ClassBusy:
+						count(func(s *WorkerStats) { s.LockTimeouts++ })
+					default:
+						count(func(s *WorkerStats) { s.ClaimErrors++ })
+					}
+					time.Sleep(poll)
+					continue
+				}
+				if job == nil {
+					count(func(s *WorkerStats) { s.EmptyPolls++ })
+					time.Sleep(poll)
+					continue
+				}
+				count(func(s *WorkerStats) { s.Claimed++ })
+
+				process(q, job, handle, count)
+			}
+		})
+	}
+	wg.Wait()
+
+	return stats
+}
+
+func process(q *Queue, job *Job, handle Handler, count func(f func(s *WorkerStats))) {
+	ctx, cancel := context.WithTimeout(context.Background(), q.cfg.Lease) // No point working past the lease, the job isn't ours anymore
+	defer cancel()
+
+	handleErr := handle(ctx, job)
+	if errors.Is(handleErr, ErrAbandoned) {
+		count(func(s *WorkerStats) { s.Abandoned++ })
+		return
+	}
+
+	var err error
+	if handleErr == nil {
+		if err = q.Complete(context.Background(), job); err == nil {
+			count(func(s *WorkerStats) { s.Completed++ })
+		}
+	} else {
+		var dead bool
+		if dead, err = q.Fail(context.Background(), job, handleErr); err == nil {
+			count(func(s *WorkerStats) {
+				if dead {
+					s.DeadLettered++
+				} else {
+					s.Retried++
+				}
+			})
+		}
+	}
+
+	switch {
+	case errors.Is(err, ErrLeaseLost):
+		count(func(s *WorkerStats) { s.LeaseLost++ })
+	case err != nil:
+		count(func(s *WorkerStats) { s.ClaimErrors++ })
+	}
+}
@@ -0,0 +1,237 @@
+package leak_check
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A debug detector for the classic database/sql leaks: Rows that are never closed, Tx's that are never committed or rolled back,
+// and connections that are taken from the pool and never given back. Every acquire records where it happened,
+// so a leak report points at the line that forgot to clean up instead of just "the pool is exhausted"
+
+type Kind string
+
+const (
+	KindConn Kind = "conn"
+	KindRows Kind = "rows"
+	KindTx   Kind = "tx"
+)
+
+type Reason string
+
+const (
+	ReasonHeldTooLong Reason = "held longer than threshold"
+	ReasonCollected   Reason = "garbage collected while still open"
+	ReasonOpenAtCheck Reason = "still open"
+)
+
+type Leak struct {
+	Kind       Kind          `json:"kind"`
+	Reason     Reason        `json:"reason"`
+	Query      string        `json:"query,omitempty"`
+	Held       time.Duration `json:"held"`
+	AcquiredAt string        `json:"acquired_at"` // First frame outside database/sql and this package
+	Stack      string        `json:"stack"`
+}
+
+func (l Leak) String() string {
+	query := ""
+	if l.Query != "" {
+		query = fmt.Sprintf(" (%s)", l.Query)
+	}
+
+	return fmt.Sprintf("%s %s after %v%s, acquired at %s\n%s", l.Kind, l.Reason, l.Held.Round(time.Millisecond), query, l.AcquiredAt, l.Stack)
+}
+
+type Detector struct {
+	threshold time.Duration
+
+	mu        sync.Mutex
+	nextID    uint64
+	open      map[uint64]*tracked
+	reported  map[uint64]bool // Held too long is reported once per object
+	collected []Leak          // Collected since the last Check
+	history   []Leak          // Every collected leak, for VerifyNone
+}
+
+type tracked struct {
+	kind       Kind
+	query      string
+	acquiredAt time.Time
+	stack      []uintptr
+}
+
+func NewDetector(threshold time.Duration) *Detector {
+	return &Detector{
+		threshold: threshold,
+		open:      make(map[uint64]*tracked),
+		reported:  make(map[uint64]bool),
+	}
+}
+
+func (d *Detector) acquire(kind Kind, query string) uint64 {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(3, pcs)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.nextID++
+	d.open[d.nextID] = &tracked{kind: kind, query: query, acquiredAt: time.Now(), stack: pcs[:n]}
+	return d.nextID
+}
+
+func (d *Detector) release(id uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.open, id)
+	delete(d.reported, id)
+}
+
+// Called from runtime.AddCleanup - the wrapper was garbage collected, if it's still tracked nobody closed it
+func (d *Detector) collect(id uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.open[id]
+	if !ok {
+		return
+	}
+
+	delete(d.open, id)
+	delete(d.reported, id)
+	leak := t.leak(ReasonCollected)
+	d.collected = append(d.collected, leak)
+	d.history = append(d.history, leak)
+}
+
+// Check returns everything held longer than the threshold (once per object) and everything collected while open since the last check
+func (d *Detector) Check() []Leak {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	leaks := d.collected
+	d.collected = nil
+
+	for id, t := range d.open {
+		if d.reported[id] || time.Since(t.acquiredAt) < d.threshold {
+			continue
+		}
+
+		d.reported[id] = true
+		leaks = append(leaks, t.leak(ReasonHeldTooLong))
+	}
+
+	sort.Slice(leaks, func(i, j int) bool { return leaks[i].Held > leaks[j].Held })
+	return leaks
+}
+
+// Open lists every tracked object that hasn't been released yet, regardless of the threshold
+func (d *Detector) Open() []Leak {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var leaks []Leak
+	for _, t := range d.open {
+		leaks = append(leaks, t.leak(ReasonOpenAtCheck))
+	}
+
+	return leaks
+}
+
+// Watch checks on an interval and hands leaks to report, until ctx is done
+func (d *Detector) Watch(ctx context.Context, interval time.Duration, report func(Leak)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, leak := range d.Check() {
+					report(leak)
+				}
+			}
+		}
+	}()
+}
+
+// TestingT is the part of *testing.T we need, so this package doesn't pull the testing package into the binary
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// VerifyNone fails the test for every Rows, Tx or connection that is still open or was dropped without being closed.
+// Use it at the end of a test, after the code under test is done: defer detector.VerifyNone(t)
+func (d *Detector) VerifyNone(t TestingT) {
+	t.Helper()
+
+	// Give the cleanups a chance to run, they only fire after the wrapper is unreachable and a GC cycle has passed
+	for range 3 {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	d.mu.Lock()
+	leaks := append([]Leak(nil), d.history...)
+	d.mu.Unlock()
+	leaks = append(leaks, d.Open()...)
+
+	for _, leak := range leaks {
+		t.Errorf("leaked %s", leak)
+	}
+}
+
+func (t *tracked) leak(reason Reason) Leak {
+	acquiredAt, stack := formatStack(t.stack)
+	return Leak{
+		Kind:       t.kind,
+		Reason:     reason,
+		Query:      t.query,
+		Held:       time.Since(t.acquiredAt),
+		AcquiredAt: acquiredAt,
+		Stack:      stack,
+	}
+}
+
+// Drops the frames from database/sql, this package and the runtime - they're the same for every leak and hide the interesting line
+func formatStack(pcs []uintptr) (string, string) {
+	frames := runtime.CallersFrames(pcs)
+	var sb strings.Builder
+	acquiredAt := "unknown"
+
+	for {
+		frame, more := frames.Next()
+		if !isInternalFrame(frame.Function) {
+			if acquiredAt == "unknown" {
+				acquiredAt = fmt.Sprintf("%s:%d", frame.File, frame.Line)
+			}
+			fmt.Fprintf(&sb, "    %s\n        %s:%d\n", frame.Function, frame.File, frame.Line)
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	return acquiredAt, sb.String()
+}
+
+func isInternalFrame(function string) bool {
+	for _, prefix := range []string{"database/sql.", "runtime.", "andreashoj/deeper-learnings/internal/leak-check."} {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
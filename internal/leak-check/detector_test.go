@@ -0,0 +1,120 @@
+package leak_check_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	leak_check "andreashoj/deeper-learnings/internal/leak-check"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Stands in for the test VerifyNone is supposed to fail
+type recordingT struct {
+	errors []string
+}
+
+func (r *recordingT) Helper() {}
+
+func (r *recordingT) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingT) leaked(kind leak_check.Kind) int {
+	n := 0
+	for _, e := range r.errors {
+		if strings.HasPrefix(e, "leaked "+string(kind)+" ") {
+			n++
+		}
+	}
+
+	return n
+}
+
+func openTestDB(t *testing.T) (*leak_check.Detector, func(query string) error) {
+	t.Helper()
+
+	detector := leak_check.NewDetector(time.Hour)
+	DB, err := leak_check.Open("sqlite3", filepath.Join(t.TempDir(), "leak.db"), detector)
+	if err != nil {
+		t.Fatalf("failed opening db: %s", err)
+	}
+	t.Cleanup(func() { DB.Close() })
+
+	if _, err = DB.Exec(`CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT); INSERT INTO users (name) VALUES ('a'), ('b'), ('c')`); err != nil {
+		t.Fatalf("failed seeding db: %s", err)
+	}
+
+	// Runs the query and bails out after the first row, the way the leaky GetUsers did
+	leak := func(query string) error {
+		rows, err := DB.Query(query)
+		if err != nil {
+			return err
+		}
+		rows.Next()
+		return nil
+	}
+
+	return detector, leak
+}
+
+func TestVerifyNoneFailsOnLeakedRows(t *testing.T) {
+	detector, leak := openTestDB(t)
+
+	if err := leak(`SELECT id, name FROM users`); err != nil {
+		t.Fatalf("failed querying users: %s", err)
+	}
+
+	rec := &recordingT{}
+	detector.VerifyNone(rec)
+	if rec.leaked(leak_check.KindRows) == 0 {
+		t.Fatalf("VerifyNone didn't fail for leaked rows, errors: %v", rec.errors)
+	}
+	if !strings.Contains(strings.Join(rec.errors, "\n"), "detector_test.go") {
+		t.Fatalf("leak report doesn't point at the test that leaked: %v", rec.errors)
+	}
+}
+
+func TestVerifyNoneReportsCollectedRows(t *testing.T) {
+	detector, leak := openTestDB(t)
+
+	if err := leak(`SELECT id, name FROM users`); err != nil {
+		t.Fatalf("failed querying users: %s", err)
+	}
+	runtime.GC()
+
+	rec := &recordingT{}
+	detector.VerifyNone(rec)
+	if !strings.Contains(strings.Join(rec.errors, "\n"), string(leak_check.ReasonCollected)) {
+		t.Fatalf("VerifyNone didn't fail for rows dropped without Close, errors: %v", rec.errors)
+	}
+}
+
+func TestVerifyNonePassesWhenEverythingIsClosed(t *testing.T) {
+	detector := leak_check.NewDetector(time.Hour)
+	DB, err := leak_check.Open("sqlite3", filepath.Join(t.TempDir(), "clean.db"), detector)
+	if err != nil {
+		t.Fatalf("failed opening db: %s", err)
+	}
+	defer DB.Close()
+
+	rows, err := DB.Query(`SELECT 1`)
+	if err != nil {
+		t.Fatalf("failed querying: %s", err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+
+	tx, err := DB.Begin()
+	if err != nil {
+		t.Fatalf("failed starting transaction: %s", err)
+	}
+	tx.Rollback()
+
+	detector.VerifyNone(t)
+}
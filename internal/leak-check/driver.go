@@ -0,0 +1,273 @@
+package leak_check
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+)
+
+// Open gives a *sql.DB that tracks every connection, Rows and Tx it hands out. Meant for tests and local debugging,
+// capturing a stack per query is way too expensive for production
+func Open(driverName, dsn string, detector *Detector) (*sql.DB, error) {
+	// sql.Open doesn't connect, it's just the easiest way to get hold of the registered driver
+	base, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed looking up driver %s: %w", driverName, err)
+	}
+	d := base.Driver()
+	base.Close()
+
+	return sql.OpenDB(&connector{driver: d, dsn: dsn, detector: detector}), nil
+}
+
+type connector struct {
+	driver   driver.Driver
+	dsn      string
+	detector *Detector
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	raw, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &conn{Conn: raw, detector: c.detector}
+	cn.checkout() // A new connection goes straight to whoever asked for it
+	return cn, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// database/sql doesn't tell the driver when a connection is borrowed or returned, but it does call
+// ResetSession right before reusing a connection, and IsValid right as it's put back - so those are our acquire/release hooks
+type conn struct {
+	driver.Conn
+	detector *Detector
+	id       uint64 // 0 while the connection is idle in the pool
+}
+
+func (c *conn) checkout() {
+	c.id = c.detector.acquire(KindConn, "")
+}
+
+func (c *conn) checkin() {
+	if c.id != 0 {
+		c.detector.release(c.id)
+		c.id = 0
+	}
+}
+
+func (c *conn) ResetSession(ctx context.Context) error {
+	c.checkout()
+
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+func (c *conn) IsValid() bool {
+	c.checkin()
+
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+
+	return true
+}
+
+func (c *conn) Close() error {
+	c.checkin()
+	return c.Conn.Close()
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &stmtWrapper{Stmt: stmt, detector: c.detector, query: query}, nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var raw driver.Tx
+	var err error
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		raw, err = b.BeginTx(ctx, opts)
+	} else {
+		raw, err = c.Conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tx{Tx: raw, detector: c.detector}
+	t.id = c.detector.acquire(KindTx, "")
+	runtime.AddCleanup(t, c.detector.collect, t.id)
+	return t, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, query, args)
+	}
+
+	return nil, driver.ErrSkip
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	raw, err := q.QueryContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return trackRows(c.detector, raw, query), nil
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+
+	return nil
+}
+
+func (c *conn) CheckNamedValue(v *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(v)
+	}
+
+	return driver.ErrSkip
+}
+
+type tx struct {
+	driver.Tx
+	detector *Detector
+	id       uint64
+}
+
+func (t *tx) Commit() error {
+	t.detector.release(t.id)
+	return t.Tx.Commit()
+}
+
+func (t *tx) Rollback() error {
+	t.detector.release(t.id)
+	return t.Tx.Rollback()
+}
+
+type stmtWrapper struct {
+	driver.Stmt
+	detector *Detector
+	query    string
+}
+
+func (s *stmtWrapper) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	var raw driver.Rows
+	var err error
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		raw, err = q.QueryContext(ctx, args)
+	} else {
+		values := make([]driver.Value, len(args))
+		for i, arg := range args {
+			values[i] = arg.Value
+		}
+		raw, err = s.Stmt.Query(values)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return trackRows(s.detector, raw, s.query), nil
+}
+
+func (s *stmtWrapper) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return e.ExecContext(ctx, args)
+	}
+
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return s.Stmt.Exec(values)
+}
+
+type rows struct {
+	driver.Rows
+	detector *Detector
+	id       uint64
+}
+
+func trackRows(detector *Detector, raw driver.Rows, query string) *rows {
+	r := &rows{Rows: raw, detector: detector}
+	r.id = detector.acquire(KindRows, query)
+	runtime.AddCleanup(r, detector.collect, r.id)
+	return r
+}
+
+func (r *rows) Close() error {
+	r.detector.release(r.id)
+	return r.Rows.Close()
+}
+
+// Forwarded so rows.ColumnTypes() keeps working through the wrapper
+func (r *rows) ColumnTypeScanType(index int) reflect.Type {
+	if s, ok := r.Rows.(driver.RowsColumnTypeScanType); ok {
+		return s.ColumnTypeScanType(index)
+	}
+
+	return reflect.TypeFor[any]()
+}
+
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	if s, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return s.ColumnTypeDatabaseTypeName(index)
+	}
+
+	return ""
+}
+
+func (r *rows) HasNextResultSet() bool {
+	if n, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return n.HasNextResultSet()
+	}
+
+	return false
+}
+
+func (r *rows) NextResultSet() error {
+	if n, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return n.NextResultSet()
+	}
+
+	return io.EOF
+}
@@ -0,0 +1,196 @@
+package load_balancer
+
+import (
+	"math/rand"
+	"net/http"
+	"path"
+	"sync"
+	"sync/atomic"
+)
+
+// Algorithm picks one of the healthy backends for a request, it's never called with an empty slice
+type Algorithm interface {
+	Name() string
+	Pick(r *http.Request, healthy []*Backend) *Backend
+}
+
+// Algorithms that keep per-backend state hear about backends joining and leaving
+type membership interface {
+	added(b *Backend)
+	removed(b *Backend)
+}
+
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+// RoundRobin hands out the backends in turn. The counter only ever goes up, the modulo does the wrapping
+func RoundRobin() Algorithm {
+	return &roundRobin{}
+}
+
+func (rr *roundRobin) Name() string {
+	return "round robin"
+}
+
+func (rr *roundRobin) Pick(r *http.Request, healthy []*Backend) *Backend {
+	n := rr.next.Add(1) - 1
+	return healthy[n%uint64(len(healthy))]
+}
+
+type leastConnections struct{}
+
+// LeastConnections goes to whoever has the fewest requests in flight, slow backends naturally get less
+func LeastConnections() Algorithm {
+	return leastConnections{}
+}
+
+func (leastConnections) Name() string {
+	return "least connections"
+}
+
+func (leastConnections) Pick(r *http.Request, healthy []*Backend) *Backend {
+	best := healthy[0]
+	for _, b := range healthy[1:] {
+		if b.Active() < best.Active() {
+			best = b
+		}
+	}
+
+	return best
+}
+
+type weighted struct {
+	mu      sync.Mutex
+	current map[*Backend]int
+}
+
+// Weighted is nginx's smooth weighted round robin: weights 5, 1, 1 gives a a b a c a a instead of a a a a a b c
+func Weighted() Algorithm {
+	return &weighted{current: make(map[*Backend]int)}
+}
+
+func (w *weighted) Name() string {
+	return "weighted"
+}
+
+func (w *weighted) Pick(r *http.Request, healthy []*Backend) *Backend {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	total := 0
+	var best *Backend
+	for _, b := range healthy {
+		w.current[b] += b.Weight
+		total += b.Weight
+		if best == nil || w.current[b] > w.current[best] {
+			best = b
+		}
+	}
+	w.current[best] -= total
+
+	return best
+}
+
+func (w *weighted) added(b *Backend) {}
+
+func (w *weighted) removed(b *Backend) {
+	w.mu.Lock()
+	delete(w.current, b)
+	w.mu.Unlock()
+}
+
+type randomTwoChoices struct{}
+
+// RandomTwoChoices picks two backends at random and takes the less busy one. Almost as good as least connections
+// without having to look at every backend, and no herd of requests all piling onto the one that just looked idle
+func RandomTwoChoices() Algorithm {
+	return randomTwoChoices{}
+}
+
+func (randomTwoChoices) Name() string {
+	return "random two choices"
+}
+
+func (randomTwoChoices) Pick(r *http.Request, healthy []*Backend) *Backend {
+	if len(healthy) == 1 {
+		return healthy[0]
+	}
+
+	i := rand.Intn(len(healthy))
+	j := rand.Intn(len(healthy) - 1)
+	if j >= i {
+		j++
+	}
+	if healthy[j].Active() < healthy[i].Active() {
+		return healthy[j]
+	}
+
+	return healthy[i]
+}
+
+// KeyFunc decides what a request is about, requests with the same key go to the same backend
+type KeyFunc func(r *http.Request) string
+
+func ByHeader(name string) KeyFunc {
+	return func(r *http.Request) string { return r.Header.Get(name) }
+}
+
+func ByQuery(name string) KeyFunc {
+	return func(r *http.Request) string { return r.URL.Query().Get(name) }
+}
+
+// ByLastPathSegment keys /user/12 on "12"
+func ByLastPathSegment() KeyFunc {
+	return func(r *http.Request) string { return path.Base(r.URL.Path) }
+}
+
+type consistentHash struct {
+	key  KeyFunc
+	ring *Ring
+
+	mu       sync.RWMutex
+	backends map[string]*Backend
+}
+
+// ConsistentHash sends every key to the same backend for as long as that backend is around - that's what makes a
+// per-instance cache useful. When the owner is down the key walks on to the next node on the ring
+func ConsistentHash(key KeyFunc, replicas int) Algorithm {
+	return &consistentHash{key: key, ring: NewRing(replicas), backends: make(map[string]*Backend)}
+}
+
+func (c *consistentHash) Name() string {
+	return "consistent hash"
+}
+
+func (c *consistentHash) Pick(r *http.Request, healthy []*Backend) *Backend {
+	up := make(map[string]bool, len(healthy))
+	for _, b := range healthy {
+		up[b.Name()] = true
+	}
+
+	node := c.ring.GetFunc(c.key(r), func(node string) bool { return up[node] })
+
+	c.mu.RLock()
+	b, ok := c.backends[node]
+	c.mu.RUnlock()
+	if !ok {
+		return healthy[0] // Only when the backend was added behind the balancer's back
+	}
+
+	return b
+}
+
+func (c *consistentHash) added(b *Backend) {
+	c.mu.Lock()
+	c.backends[b.Name()] = b
+	c.mu.Unlock()
+	c.ring.Add(b.Name())
+}
+
+func (c *consistentHash) removed(b *Backend) {
+	c.ring.Remove(b.Name())
+	c.mu.Lock()
+	delete(c.backends, b.Name())
+	c.mu.Unlock()
+}
@@ -0,0 +1,64 @@
+package load_balancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+)
+
+type Backend struct {
+	URL    *url.URL
+	Weight int // Only used by the weighted algorithm
+
+	proxy   *httputil.ReverseProxy
+	active  atomic.Int64 // Requests in flight right now
+	served  atomic.Int64
+	failed  atomic.Int64
+	healthy atomic.Bool
+	streak  atomic.Int64 // Proxy errors in a row, reset by any response
+}
+
+func NewBackend(rawURL string, weight int) (*Backend, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing backend url %s: %w", rawURL, err)
+	}
+	if weight < 1 {
+		weight = 1
+	}
+
+	b := &Backend{URL: u, Weight: weight, proxy: httputil.NewSingleHostReverseProxy(u)}
+	b.healthy.Store(true) // Innocent until the first health check says otherwise
+
+	return b, nil
+}
+
+func (b *Backend) Name() string {
+	return b.URL.Host
+}
+
+func (b *Backend) Active() int {
+	return int(b.active.Load())
+}
+
+func (b *Backend) Served() int {
+	return int(b.served.Load())
+}
+
+func (b *Backend) Failed() int {
+	return int(b.failed.Load())
+}
+
+func (b *Backend) Healthy() bool {
+	return b.healthy.Load()
+}
+
+func (b *Backend) serve(w http.ResponseWriter, r *http.Request) {
+	b.active.Add(1)
+	defer b.active.Add(-1)
+	b.served.Add(1)
+
+	b.proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,181 @@
+package load_balancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A reverse proxy in front of a set of backends. The algorithm only decides where a request goes, the proxying, counting and
+// health checking is the same for all of them. A backend that fails a health check (or FailureThreshold proxied requests in a row)
+// is left out until a health check sees it come back
+
+const DefaultFailureThreshold = 3
+
+type Balancer struct {
+	algo Algorithm
+
+	// Proxy errors in a row before a backend is taken out without waiting for the health check. One failed request
+	// is as likely to be the client or a blip as a dead backend
+	FailureThreshold int
+
+	mu       sync.RWMutex
+	backends []*Backend
+}
+
+func New(algo Algorithm, backends ...*Backend) *Balancer {
+	lb := &Balancer{algo: algo, FailureThreshold: DefaultFailureThreshold}
+	for _, b := range backends {
+		lb.Add(b)
+	}
+
+	return lb
+}
+
+func (lb *Balancer) Algorithm() Algorithm {
+	return lb.algo
+}
+
+func (lb *Balancer) Add(b *Backend) {
+	b.proxy.ModifyResponse = func(res *http.Response) error {
+		b.streak.Store(0) // It answered, whatever the status
+		return nil
+	}
+	b.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if r.Context().Err() != nil {
+			return // The client went away, nothing wrong with the backend and nobody left to answer
+		}
+
+		b.failed.Add(1)
+		// Passive check, after enough failures in a row there's no point sending more traffic until the active check says it's back
+		if b.streak.Add(1) >= int64(max(lb.FailureThreshold, 1)) {
+			lb.setHealthy(b, false, fmt.Sprintf("%d proxy errors in a row, last: %s", b.streak.Load(), err))
+		}
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}
+
+	lb.mu.Lock()
+	lb.backends = append(lb.backends, b)
+	lb.mu.Unlock()
+
+	if m, ok := lb.algo.(membership); ok {
+		m.added(b)
+	}
+}
+
+func (lb *Balancer) Remove(b *Backend) {
+	lb.mu.Lock()
+	for i, other := range lb.backends {
+		if other == b {
+			lb.backends = append(lb.backends[:i:i], lb.backends[i+1:]...)
+			break
+		}
+	}
+	lb.mu.Unlock()
+
+	if m, ok := lb.algo.(membership); ok {
+		m.removed(b)
+	}
+}
+
+func (lb *Balancer) Backends() []*Backend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	return append([]*Backend(nil), lb.backends...)
+}
+
+func (lb *Balancer) healthy() []*Backend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	healthy := make([]*Backend, 0, len(lb.backends))
+	for _, b := range lb.backends {
+		if b.Healthy() {
+			healthy = append(healthy, b)
+		}
+	}
+
+	return healthy
+}
+
+func (lb *Balancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	healthy := lb.healthy()
+	if len(healthy) == 0 {
+		http.Error(w, "no healthy backends", http.StatusServiceUnavailable)
+		return
+	}
+
+	b := lb.algo.Pick(r, healthy)
+	w.Header().Set("X-Backend", b.Name()) // So the client can see where it ended up
+	if s, ok := lb.algo.(binder); ok {
+		s.bind(w, r, b)
+	}
+	b.serve(w, r)
+}
+
+type HealthConfig struct {
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// HealthCheck polls every backend until ctx is done. Anything but a 200 within the timeout counts as down
+func (lb *Balancer) HealthCheck(ctx context.Context, cfg HealthConfig) {
+	client := &http.Client{Timeout: cfg.Timeout}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, b := range lb.Backends() {
+			lb.check(ctx, client, b, cfg.Path)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (lb *Balancer) check(ctx context.Context, client *http.Client, b *Backend, path string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL.JoinPath(path).String(), nil)
+	if err != nil {
+		lb.setHealthy(b, false, err.Error())
+		return
+	}
+
+	res, err := client.Do(req)
+	if ctx.Err() != nil {
+		return // Shutting down, not the backend's fault
+	}
+	if err != nil {
+		lb.setHealthy(b, false, err.Error())
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		lb.setHealthy(b, false, fmt.Sprintf("health check returned %d", res.StatusCode))
+		return
+	}
+	lb.setHealthy(b, true, "")
+}
+
+func (lb *Balancer) setHealthy(b *Backend, healthy bool, reason string) {
+	if healthy {
+		b.streak.Store(0)
+	}
+	if b.healthy.Swap(healthy) == healthy {
+		return
+	}
+
+	if healthy {
+		fmt.Printf("backend %s is back up\n", b.Name())
+		return
+	}
+	fmt.Printf("backend %s is down: %s\n", b.Name(), reason)
+}
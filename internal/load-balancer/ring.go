@@ -0,0 +1,137 @@
+package load_balancer
+
+import (
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// A consistent hash ring. Every node is placed on the ring many times (virtual nodes) so the keys spread evenly,
+// and a key belongs to the first node clockwise from its hash. Adding or removing a node only moves the keys
+// between it and its neighbours, everything else stays where it was
+
+type Ring struct {
+	replicas int
+
+	mu     sync.RWMutex
+	points []uint32 // Sorted
+	owners map[uint32]string
+	nodes  map[string]bool
+}
+
+func NewRing(replicas int) *Ring {
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	return &Ring{replicas: replicas, owners: make(map[uint32]string), nodes: make(map[string]bool)}
+}
+
+// FNV alone clusters short keys like "1", "2", "3" next to each other on the ring, the murmur3 finalizer spreads them out
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+func (r *Ring) Add(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	for i := range r.replicas {
+		point := hashKey(node + "#" + strconv.Itoa(i))
+		if _, taken := r.owners[point]; taken {
+			continue // Collisions are rare enough that losing a virtual node doesn't matter
+		}
+		r.owners[point] = node
+		r.points = append(r.points, point)
+	}
+	slices.Sort(r.points)
+}
+
+func (r *Ring) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	r.points = slices.DeleteFunc(r.points, func(point uint32) bool {
+		if r.owners[point] == node {
+			delete(r.owners, point)
+			return true
+		}
+		return false
+	})
+}
+
+func (r *Ring) Get(key string) string {
+	return r.GetFunc(key, func(string) bool { return true })
+}
+
+// GetFunc returns the first node clockwise from key that accept agrees to - the balancer uses it to walk past unhealthy nodes
+func (r *Ring) GetFunc(key string, accept func(node string) bool) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	start, _ := slices.BinarySearch(r.points, hashKey(key))
+	for i := range len(r.points) {
+		node := r.owners[r.points[(start+i)%len(r.points)]]
+		if accept(node) {
+			return node
+		}
+	}
+
+	return ""
+}
+
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	slices.Sort(nodes)
+
+	return nodes
+}
+
+// Assign returns the owner of every key, compare two of them with Moved to see what a membership change cost
+func (r *Ring) Assign(keys []string) map[string]string {
+	owners := make(map[string]string, len(keys))
+	for _, key := range keys {
+		owners[key] = r.Get(key)
+	}
+
+	return owners
+}
+
+func Moved(before, after map[string]string) int {
+	moved := 0
+	for key, owner := range before {
+		if after[key] != owner {
+			moved++
+		}
+	}
+
+	return moved
+}
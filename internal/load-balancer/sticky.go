@@ -0,0 +1,115 @@
+package load_balancer
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Session affinity: once a client (or a key) has landed on a backend it keeps going there, so whatever that backend
+// cached for it is still around. Unlike consistent hashing the assignment is remembered, not computed - the first
+// request is placed by the fallback algorithm and only a backend going away moves it
+
+// Algorithms that want to leave something on the response, like a cookie, before it's proxied
+type binder interface {
+	bind(w http.ResponseWriter, r *http.Request, b *Backend)
+}
+
+type stickyCookie struct {
+	cookie   string
+	fallback Algorithm
+}
+
+// StickyCookie pins a client to a backend with a cookie naming it. Clients without the cookie, or whose backend is down,
+// get a new one from fallback
+func StickyCookie(cookie string, fallback Algorithm) Algorithm {
+	return &stickyCookie{cookie: cookie, fallback: fallback}
+}
+
+func (s *stickyCookie) Name() string {
+	return "sticky cookie"
+}
+
+func (s *stickyCookie) Pick(r *http.Request, healthy []*Backend) *Backend {
+	if c, err := r.Cookie(s.cookie); err == nil {
+		for _, b := range healthy {
+			if b.Name() == c.Value {
+				return b
+			}
+		}
+	}
+
+	return s.fallback.Pick(r, healthy)
+}
+
+func (s *stickyCookie) bind(w http.ResponseWriter, r *http.Request, b *Backend) {
+	if c, err := r.Cookie(s.cookie); err == nil && c.Value == b.Name() {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: s.cookie, Value: b.Name(), Path: "/", HttpOnly: true})
+}
+
+func (s *stickyCookie) added(b *Backend) {
+	if m, ok := s.fallback.(membership); ok {
+		m.added(b)
+	}
+}
+
+func (s *stickyCookie) removed(b *Backend) {
+	if m, ok := s.fallback.(membership); ok {
+		m.removed(b)
+	}
+}
+
+type stickyKey struct {
+	key      KeyFunc
+	fallback Algorithm
+
+	mu       sync.Mutex
+	assigned map[string]*Backend
+}
+
+// StickyKey remembers which backend every key went to - a routing table instead of a cookie, so it works for clients
+// that don't keep cookies. The table grows with the number of keys, that's the price compared to a hash ring
+func StickyKey(key KeyFunc, fallback Algorithm) Algorithm {
+	return &stickyKey{key: key, fallback: fallback, assigned: make(map[string]*Backend)}
+}
+
+func (s *stickyKey) Name() string {
+	return "sticky key"
+}
+
+func (s *stickyKey) Pick(r *http.Request, healthy []*Backend) *Backend {
+	key := s.key(r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if b, ok := s.assigned[key]; ok && b.Healthy() {
+		return b
+	}
+	b := s.fallback.Pick(r, healthy)
+	s.assigned[key] = b
+
+	return b
+}
+
+func (s *stickyKey) added(b *Backend) {
+	if m, ok := s.fallback.(membership); ok {
+		m.added(b)
+	}
+}
+
+// Keys on a removed backend are forgotten, they get placed again on their next request
+func (s *stickyKey) removed(b *Backend) {
+	s.mu.Lock()
+	for key, assigned := range s.assigned {
+		if assigned == b {
+			delete(s.assigned, key)
+		}
+	}
+	s.mu.Unlock()
+
+	if m, ok := s.fallback.(membership); ok {
+		m.removed(b)
+	}
+}
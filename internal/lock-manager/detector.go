@@ -0,0 +1,95 @@
+package lock_manager
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Policy picks which transaction of a cycle gets aborted. Whatever it picks, aborting it breaks the cycle -
+// the policies only differ in how much work gets thrown away and who keeps losing
+type Policy func(cycle []TxnState) uint64
+
+// Youngest aborts the transaction that started last, it has usually done the least and older ones don't starve
+func Youngest(cycle []TxnState) uint64 {
+	victim := cycle[0]
+	for _, t := range cycle[1:] {
+		if t.Started.After(victim.Started) || (t.Started.Equal(victim.Started) && t.ID > victim.ID) {
+			victim = t
+		}
+	}
+
+	return victim.ID
+}
+
+// LeastWork aborts the transaction with the fewest locks taken and work reported, the cheapest one to redo
+func LeastWork(cycle []TxnState) uint64 {
+	victim := cycle[0]
+	for _, t := range cycle[1:] {
+		if t.Work < victim.Work || (t.Work == victim.Work && t.ID > victim.ID) {
+			victim = t
+		}
+	}
+
+	return victim.ID
+}
+
+type DeadlockReport struct {
+	At     time.Time
+	Cycle  []TxnState
+	Victim uint64
+	Graph  Graph // The whole wait-for graph at detection time, with the cycle and victim marked
+}
+
+func (r DeadlockReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "deadlock at %s, victim T%d\n", r.At.Format("15:04:05.000"), r.Victim)
+	for _, t := range r.Cycle {
+		held := make([]string, len(t.Held))
+		for i, l := range t.Held {
+			held[i] = l.String()
+		}
+
+		awaiting := "nothing"
+		if t.Awaiting != nil {
+			awaiting = t.Awaiting.String()
+		}
+
+		marker := " "
+		if t.ID == r.Victim {
+			marker = "*"
+		}
+		fmt.Fprintf(&sb, " %s T%d %-20s work=%-3d holds [%s] waits for %s\n", marker, t.ID, t.Name, t.Work, strings.Join(held, ", "), awaiting)
+	}
+
+	return sb.String()
+}
+
+// Runs on a waiter's goroutine once it has waited DeadlockTimeout. Keeps breaking cycles until there are none left
+func (m *Manager) detect() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		g := m.graph()
+		cycle := g.FindCycle()
+		if cycle == nil {
+			return
+		}
+
+		states := make([]TxnState, len(cycle))
+		for i, id := range cycle {
+			states[i] = g.Nodes[id]
+		}
+
+		victim := m.cfg.Policy(states)
+		g.Cycle = cycle
+		g.Victim = victim
+		m.reports = append(m.reports, DeadlockReport{At: time.Now(), Cycle: states, Victim: victim, Graph: g})
+
+		t := m.txns[victim]
+		req, name := t.waiting, t.waitRes
+		m.cancel(m.resources[name], req)
+		req.granted <- fmt.Errorf("%w: T%d picked as victim while waiting for %s", ErrDeadlock, victim, name)
+	}
+}
@@ -0,0 +1,163 @@
+package lock_manager
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+type LockRef struct {
+	Resource string
+	Mode     Mode
+}
+
+func (l LockRef) String() string {
+	return fmt.Sprintf("%s %s", l.Resource, l.Mode)
+}
+
+type TxnState struct {
+	ID       uint64
+	Name     string
+	Started  time.Time
+	Work     int
+	Held     []LockRef
+	Awaiting *LockRef
+}
+
+// An edge means From can't continue until To lets go of Resource.
+// Soft edges point at a request queued ahead of us rather than a holder - we'd conflict with it once it's granted
+type Edge struct {
+	From, To uint64
+	Resource string
+	Mode     Mode
+	Soft     bool
+}
+
+type Graph struct {
+	Nodes  map[uint64]TxnState
+	Edges  []Edge
+	Cycle  []uint64 // Set on graphs attached to a deadlock report
+	Victim uint64
+}
+
+func (m *Manager) graph() Graph {
+	g := Graph{Nodes: make(map[uint64]TxnState)}
+	for id, t := range m.txns {
+		state := TxnState{ID: id, Name: t.Name, Started: t.Started, Work: t.work}
+		for _, name := range slices.Sorted(maps.Keys(t.held)) {
+			state.Held = append(state.Held, LockRef{Resource: name, Mode: t.held[name]})
+		}
+		if t.waiting != nil {
+			state.Awaiting = &LockRef{Resource: t.waitRes, Mode: t.waiting.mode}
+		}
+		g.Nodes[id] = state
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(m.resources)) {
+		res := m.resources[name]
+		for i, req := range res.queue {
+			for _, holder := range slices.Sorted(maps.Keys(res.holders)) {
+				if holder != req.txn.ID && req.mode.conflicts(res.holders[holder]) {
+					g.Edges = append(g.Edges, Edge{From: req.txn.ID, To: holder, Resource: name, Mode: req.mode})
+				}
+			}
+			// Only the nearest conflicting request ahead, the ones further up are reachable through it
+			for j := i - 1; j >= 0; j-- {
+				ahead := res.queue[j]
+				if ahead.txn.ID != req.txn.ID && req.mode.conflicts(ahead.mode) {
+					g.Edges = append(g.Edges, Edge{From: req.txn.ID, To: ahead.txn.ID, Resource: name, Mode: req.mode, Soft: true})
+					break
+				}
+			}
+		}
+	}
+
+	return g
+}
+
+// FindCycle returns the transactions of one cycle in wait order, or nil
+func (g Graph) FindCycle() []uint64 {
+	out := make(map[uint64][]uint64)
+	for _, e := range g.Edges {
+		out[e.From] = append(out[e.From], e.To)
+	}
+
+	const (
+		unvisited = iota
+		onPath
+		done
+	)
+	state := make(map[uint64]int)
+	var path []uint64
+
+	var visit func(id uint64) []uint64
+	visit = func(id uint64) []uint64 {
+		state[id] = onPath
+		path = append(path, id)
+		for _, next := range out[id] {
+			switch state[next] {
+			case onPath:
+				start := slices.Index(path, next)
+				return slices.Clone(path[start:])
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = done
+		return nil
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(g.Nodes)) {
+		if state[id] == unvisited {
+			if cycle := visit(id); cycle != nil {
+				return cycle
+			}
+		}
+	}
+
+	return nil
+}
+
+// DOT renders the graph for graphviz: dot -Tpng deadlock.dot -o deadlock.png
+// The cycle is drawn in red and the victim is filled
+func (g Graph) DOT() string {
+	inCycle := make(map[[2]uint64]bool)
+	for i, id := range g.Cycle {
+		inCycle[[2]uint64{id, g.Cycle[(i+1)%len(g.Cycle)]}] = true
+	}
+
+	var sb strings.Builder
+	sb.WriteString("digraph waitfor {\n\trankdir=LR;\n\tnode [shape=box, fontname=\"monospace\"];\n")
+	for _, id := range slices.Sorted(maps.Keys(g.Nodes)) {
+		n := g.Nodes[id]
+		label := fmt.Sprintf("T%d %s\\nwork %d", id, n.Name, n.Work)
+		for _, held := range n.Held {
+			label += fmt.Sprintf("\\nholds %s", held)
+		}
+
+		attrs := ""
+		if id == g.Victim {
+			attrs = ", style=filled, fillcolor=salmon"
+		}
+		fmt.Fprintf(&sb, "\tT%d [label=\"%s\"%s];\n", id, label, attrs)
+	}
+
+	for _, e := range g.Edges {
+		attrs := fmt.Sprintf("label=\"%s %s\"", e.Resource, e.Mode)
+		if e.Soft {
+			attrs += ", style=dashed"
+		}
+		if inCycle[[2]uint64{e.From, e.To}] {
+			attrs += ", color=red, penwidth=2"
+		}
+		fmt.Fprintf(&sb, "\tT%d -> T%d [%s];\n", e.From, e.To, attrs)
+	}
+	sb.WriteString("}\n")
+
+	return sb.String()
+}
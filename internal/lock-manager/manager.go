@@ -0,0 +1,229 @@
+package lock_manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A lock manager simulator, so we can see the deadlock postgres only tells us about after the fact.
+// Transactions take shared or exclusive locks on named resources and queue up when they conflict. Like postgres, nobody looks for
+// deadlocks until a waiter has waited DeadlockTimeout - then it builds the wait-for graph, and if there's a cycle it picks a victim
+
+type Mode int
+
+const (
+	Shared Mode = iota
+	Exclusive
+)
+
+func (m Mode) String() string {
+	if m == Exclusive {
+		return "X"
+	}
+
+	return "S"
+}
+
+func (m Mode) conflicts(other Mode) bool {
+	return m == Exclusive || other == Exclusive
+}
+
+var ErrDeadlock = errors.New("deadlock detected")
+
+type Config struct {
+	Policy          Policy
+	DeadlockTimeout time.Duration // How long a waiter waits before checking for a cycle, postgres defaults to 1s
+}
+
+type Manager struct {
+	cfg Config
+
+	mu        sync.Mutex
+	nextID    uint64
+	txns      map[uint64]*Txn
+	resources map[string]*resource
+	reports   []DeadlockReport
+}
+
+type resource struct {
+	name    string
+	holders map[uint64]Mode
+	queue   []*request // FIFO, a request is only granted when nothing ahead of it conflicts
+}
+
+type request struct {
+	txn     *Txn
+	mode    Mode
+	granted chan error // Buffered, gets nil when granted or ErrDeadlock when chosen as victim
+}
+
+func New(cfg Config) *Manager {
+	if cfg.Policy == nil {
+		cfg.Policy = Youngest
+	}
+	if cfg.DeadlockTimeout <= 0 {
+		cfg.DeadlockTimeout = time.Second
+	}
+
+	return &Manager{
+		cfg:       cfg,
+		txns:      make(map[uint64]*Txn),
+		resources: make(map[string]*resource),
+	}
+}
+
+type Txn struct {
+	manager *Manager
+	ID      uint64
+	Name    string
+	Started time.Time
+
+	// Guarded by the manager's mutex
+	work    int // Locks acquired plus whatever AddWork reported, used by the least work policy
+	held    map[string]Mode
+	waiting *request
+	waitRes string
+}
+
+func (m *Manager) Begin(name string) *Txn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	t := &Txn{manager: m, ID: m.nextID, Name: name, Started: time.Now(), held: make(map[string]Mode)}
+	m.txns[t.ID] = t
+	return t
+}
+
+// AddWork records work done outside of locking, like rows written - a transaction that did a lot is expensive to pick as victim
+func (t *Txn) AddWork(n int) {
+	t.manager.mu.Lock()
+	defer t.manager.mu.Unlock()
+	t.work += n
+}
+
+// Lock blocks until the lock is granted, ctx is done, or the transaction is picked as a deadlock victim.
+// After ErrDeadlock the caller must Release, exactly like a rollback after postgres' 40P01
+func (t *Txn) Lock(ctx context.Context, name string, mode Mode) error {
+	m := t.manager
+	m.mu.Lock()
+
+	res, ok := m.resources[name]
+	if !ok {
+		res = &resource{name: name, holders: make(map[uint64]Mode)}
+		m.resources[name] = res
+	}
+
+	if held, ok := res.holders[t.ID]; ok && (held == Exclusive || mode == Shared) {
+		m.mu.Unlock()
+		return nil // Already strong enough
+	}
+
+	req := &request{txn: t, mode: mode, granted: make(chan error, 1)}
+	res.queue = append(res.queue, req)
+	t.waiting = req
+	t.waitRes = name
+	m.grant(res)
+	m.mu.Unlock()
+
+	timer := time.NewTimer(m.cfg.DeadlockTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case err := <-req.granted:
+			return err
+		case <-ctx.Done():
+			m.mu.Lock()
+			m.cancel(res, req)
+			m.mu.Unlock()
+			// It might have been granted while we were taking the lock
+			select {
+			case err := <-req.granted:
+				if err == nil {
+					return nil
+				}
+			default:
+			}
+			return ctx.Err()
+		case <-timer.C:
+			m.detect()
+			timer.Reset(m.cfg.DeadlockTimeout)
+		}
+	}
+}
+
+// Release gives up every lock the transaction holds, and any request it's still waiting on
+func (t *Txn) Release() {
+	m := t.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t.waiting != nil {
+		m.cancel(m.resources[t.waitRes], t.waiting)
+	}
+
+	for name := range t.held {
+		res := m.resources[name]
+		delete(res.holders, t.ID)
+		m.grant(res)
+	}
+	t.held = make(map[string]Mode)
+	delete(m.txns, t.ID)
+}
+
+// Grants queued requests front to back, stopping at the first one that has to keep waiting
+func (m *Manager) grant(res *resource) {
+	for len(res.queue) > 0 {
+		req := res.queue[0]
+		for holder, mode := range res.holders {
+			if holder != req.txn.ID && req.mode.conflicts(mode) {
+				return
+			}
+		}
+
+		res.queue = res.queue[1:]
+		res.holders[req.txn.ID] = max(res.holders[req.txn.ID], req.mode)
+		req.txn.held[res.name] = res.holders[req.txn.ID]
+		req.txn.work++
+		req.txn.waiting = nil
+		req.txn.waitRes = ""
+		req.granted <- nil
+	}
+}
+
+func (m *Manager) cancel(res *resource, req *request) {
+	for i, queued := range res.queue {
+		if queued == req {
+			res.queue = append(res.queue[:i], res.queue[i+1:]...)
+			break
+		}
+	}
+
+	if req.txn.waiting == req {
+		req.txn.waiting = nil
+		req.txn.waitRes = ""
+	}
+	m.grant(res) // Whoever was behind us might be able to go now
+}
+
+func (m *Manager) Reports() []DeadlockReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]DeadlockReport(nil), m.reports...)
+}
+
+// Graph is the current wait-for graph
+func (m *Manager) Graph() Graph {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.graph()
+}
+
+func (t *Txn) String() string {
+	return fmt.Sprintf("T%d (%s)", t.ID, t.Name)
+}
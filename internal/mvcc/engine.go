@@ -0,0 +1,200 @@
+package mvcc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A tiny MVCC key-value store that works the way Postgres does, so we can watch the visibility rules instead of guessing at them.
+// Nothing is ever updated in place: an update marks the current version as deleted by us (xmax) and adds a new version created by us (xmin).
+// Which version a transaction sees is decided purely by its snapshot - which transactions had committed when the snapshot was taken.
+//
+//   - Read committed takes a new snapshot for every statement
+//   - Snapshot isolation (postgres' repeatable read) takes one snapshot at the first statement and keeps it
+//   - Serializable is snapshot isolation plus tracking of rw-antidependencies, aborting a transaction when two of them line up (SSI)
+
+type Level int
+
+const (
+	ReadCommitted Level = iota
+	SnapshotIsolation
+	Serializable
+)
+
+func (l Level) String() string {
+	switch l {
+	case SnapshotIsolation:
+		return "snapshot isolation"
+	case Serializable:
+		return "serializable"
+	default:
+		return "read committed"
+	}
+}
+
+var (
+	ErrSerialization = errors.New("could not serialize access")
+	ErrDuplicateKey  = errors.New("duplicate key")
+	ErrTxDone        = errors.New("transaction has already been committed or rolled back")
+)
+
+type status int
+
+const (
+	statusInProgress status = iota
+	statusCommitted
+	statusAborted
+)
+
+func (s status) String() string {
+	switch s {
+	case statusCommitted:
+		return "committed"
+	case statusAborted:
+		return "aborted"
+	default:
+		return "in progress"
+	}
+}
+
+type version[V any] struct {
+	key   int
+	value V
+	xmin  uint64 // Created by
+	xmax  uint64 // Deleted or replaced by, 0 while it's the live version
+}
+
+// Everything with an xid >= xmax started after the snapshot, everything in active was still running - both invisible
+type snapshot struct {
+	xmax   uint64
+	active map[uint64]bool
+}
+
+type txnMeta[V any] struct {
+	xid      uint64
+	level    Level
+	status   status
+	snapshot *snapshot
+
+	// SSI bookkeeping, kept after commit - a committed transaction can still be half of a dangerous structure
+	reads      map[int]bool
+	predicates []func(key int, value V) bool
+	in, out    map[uint64]bool // rw-antidependencies: in[x] means x read something we overwrote
+}
+
+type Engine[V any] struct {
+	mu      sync.Mutex
+	nextXID uint64
+	txns    map[uint64]*txnMeta[V]
+	rows    map[int][]*version[V] // Every version of a key, oldest first
+	changed chan struct{}         // Closed and replaced whenever a transaction ends, wakes up anyone waiting on a row
+	trace   io.Writer
+}
+
+func New[V any]() *Engine[V] {
+	return &Engine[V]{
+		nextXID: 1,
+		txns:    make(map[uint64]*txnMeta[V]),
+		rows:    make(map[int][]*version[V]),
+		changed: make(chan struct{}),
+	}
+}
+
+// SetTrace makes the engine explain every visibility decision, row wait and conflict to w
+func (e *Engine[V]) SetTrace(w io.Writer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.trace = w
+}
+
+func (e *Engine[V]) tracef(format string, args ...any) {
+	if e.trace != nil {
+		fmt.Fprintf(e.trace, format+"\n", args...)
+	}
+}
+
+func (e *Engine[V]) Begin(ctx context.Context, level Level) *Txn[V] {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	meta := &txnMeta[V]{
+		xid:   e.nextXID,
+		level: level,
+		reads: make(map[int]bool),
+		in:    make(map[uint64]bool),
+		out:   make(map[uint64]bool),
+	}
+	e.nextXID++
+	e.txns[meta.xid] = meta
+	e.tracef("T%d begin (%s)", meta.xid, level)
+
+	return &Txn[V]{engine: e, meta: meta, ctx: ctx}
+}
+
+func (e *Engine[V]) takeSnapshot() *snapshot {
+	s := &snapshot{xmax: e.nextXID, active: make(map[uint64]bool)}
+	for xid, t := range e.txns {
+		if t.status == statusInProgress {
+			s.active[xid] = true
+		}
+	}
+
+	return s
+}
+
+func (e *Engine[V]) committedIn(xid uint64, s *snapshot) bool {
+	return xid < s.xmax && !s.active[xid] && e.txns[xid].status == statusCommitted
+}
+
+// The heart of it - the same rules as postgres' HeapTupleSatisfiesMVCC, minus hint bits and subtransactions
+func (e *Engine[V]) visible(v *version[V], me uint64, s *snapshot) (bool, string) {
+	if v.xmin != me && !e.committedIn(v.xmin, s) {
+		return false, fmt.Sprintf("xmin T%d is %s", v.xmin, e.describe(v.xmin, s))
+	}
+
+	switch {
+	case v.xmax == 0:
+		return true, fmt.Sprintf("xmin T%d visible, never deleted", v.xmin)
+	case v.xmax == me:
+		return false, "replaced by ourselves"
+	case e.committedIn(v.xmax, s):
+		return false, fmt.Sprintf("replaced by T%d, committed before our snapshot", v.xmax)
+	default:
+		return true, fmt.Sprintf("xmin T%d visible, xmax T%d is %s", v.xmin, v.xmax, e.describe(v.xmax, s))
+	}
+}
+
+func (e *Engine[V]) describe(xid uint64, s *snapshot) string {
+	t := e.txns[xid]
+	switch {
+	case t.status == statusAborted:
+		return "aborted"
+	case t.status == statusInProgress:
+		return "in progress"
+	case xid >= s.xmax || s.active[xid]:
+		return "committed after our snapshot"
+	default:
+		return "committed"
+	}
+}
+
+// The newest version not created by an aborted transaction - the one an update or delete has to lock
+func (e *Engine[V]) latest(key int) *version[V] {
+	versions := e.rows[key]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if e.txns[versions[i].xmin].status != statusAborted {
+			return versions[i]
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine[V]) finish(meta *txnMeta[V], s status) {
+	meta.status = s
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
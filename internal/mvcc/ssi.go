@@ -0,0 +1,108 @@
+package mvcc
+
+import (
+	"fmt"
+)
+
+// Serializable snapshot isolation (Cahill et al, and what postgres ships since 9.1). Snapshot isolation only ever goes wrong through
+// rw-antidependencies: T1 reads something, a concurrent T2 writes a newer version of it, so T1 has to come before T2 in any serial order.
+// Every non-serializable history has a transaction with one of those coming in and one going out (the pivot),
+// where the outgoing one committed first. We track the edges and abort whoever would complete that structure
+
+// Called after a read: every version the reader couldn't see because a concurrent transaction wrote it is a reader -> writer edge
+func (e *Engine[V]) readConflicts(reader *txnMeta[V], key int, s *snapshot, pred func(key int, value V) bool) {
+	for _, v := range e.rows[key] {
+		if pred != nil && !pred(key, v.value) {
+			continue
+		}
+
+		for _, writer := range []uint64{v.xmin, v.xmax} {
+			if writer == 0 || writer == reader.xid || e.committedIn(writer, s) {
+				continue
+			}
+
+			if w := e.txns[writer]; w.level == Serializable && w.status != statusAborted {
+				e.addConflict(reader, w)
+			}
+		}
+	}
+}
+
+// Called before a write: every concurrent transaction that read the key, or scanned with a predicate the old or new value matches,
+// read something we're about to replace - reader -> writer
+func (e *Engine[V]) writeConflicts(writer *txnMeta[V], key int, old, new *V) {
+	for _, reader := range e.txns {
+		if reader == writer || reader.level != Serializable || reader.status == statusAborted {
+			continue
+		}
+		if !e.concurrent(reader, writer) || !reader.readsKey(key, old, new) {
+			continue
+		}
+
+		e.addConflict(reader, writer)
+	}
+}
+
+func (t *txnMeta[V]) readsKey(key int, old, new *V) bool {
+	if t.reads[key] {
+		return true
+	}
+
+	for _, pred := range t.predicates {
+		if (old != nil && pred(key, *old)) || (new != nil && pred(key, *new)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The reader overlaps the writer unless it committed before the writer's snapshot
+func (e *Engine[V]) concurrent(reader, writer *txnMeta[V]) bool {
+	if reader.status == statusInProgress {
+		return true
+	}
+
+	return !e.committedIn(reader.xid, writer.snapshot)
+}
+
+func (e *Engine[V]) addConflict(reader, writer *txnMeta[V]) {
+	if reader.out[writer.xid] {
+		return
+	}
+
+	reader.out[writer.xid] = true
+	writer.in[reader.xid] = true
+	e.tracef("rw-antidependency T%d -> T%d (T%d read what T%d overwrote)", reader.xid, writer.xid, reader.xid, writer.xid)
+}
+
+// Checked at commit. Either we're the pivot (something points in, and we point to a transaction that already committed),
+// or we point into a pivot that already committed and can't be aborted anymore - then it has to be us
+func (e *Engine[V]) checkDangerous(t *txnMeta[V]) error {
+	for in := range t.in {
+		if e.txns[in].status == statusAborted {
+			continue
+		}
+
+		for out := range t.out {
+			if e.txns[out].status == statusCommitted {
+				return fmt.Errorf("%w: T%d is a pivot, T%d -> T%d -> T%d", ErrSerialization, t.xid, in, t.xid, out)
+			}
+		}
+	}
+
+	for pivot := range t.out {
+		p := e.txns[pivot]
+		if p.status != statusCommitted {
+			continue
+		}
+
+		for out := range p.out {
+			if out != t.xid && e.txns[out].status == statusCommitted {
+				return fmt.Errorf("%w: T%d -> T%d -> T%d with T%d already committed", ErrSerialization, t.xid, pivot, out, pivot)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,285 @@
+package mvcc
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+type Txn[V any] struct {
+	engine *Engine[V]
+	meta   *txnMeta[V]
+	ctx    context.Context // Only used while waiting on a row lock
+}
+
+type KV[V any] struct {
+	Key   int
+	Value V
+}
+
+func (t *Txn[V]) ID() uint64 {
+	return t.meta.xid
+}
+
+func (t *Txn[V]) Get(key int) (V, bool, error) {
+	e := t.engine
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var zero V
+	if err := t.check(); err != nil {
+		return zero, false, err
+	}
+
+	s := t.statementSnapshot()
+	v := t.visibleVersion(key, s)
+	if t.meta.level == Serializable {
+		t.meta.reads[key] = true
+		e.readConflicts(t.meta, key, s, nil)
+	}
+
+	if v == nil {
+		return zero, false, nil
+	}
+	return v.value, true, nil
+}
+
+// Scan is a predicate read, like SELECT ... WHERE. Under serializable the predicate itself is remembered,
+// so a row inserted later that matches it still counts as a conflict - that's what catches phantoms
+func (t *Txn[V]) Scan(pred func(key int, value V) bool) ([]KV[V], error) {
+	e := t.engine
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+
+	s := t.statementSnapshot()
+	var result []KV[V]
+	for _, key := range slices.Sorted(maps.Keys(e.rows)) {
+		v := t.visibleVersion(key, s)
+		if v != nil && pred(key, v.value) {
+			result = append(result, KV[V]{Key: key, Value: v.value})
+			if t.meta.level == Serializable {
+				t.meta.reads[key] = true
+			}
+		}
+		if t.meta.level == Serializable {
+			e.readConflicts(t.meta, key, s, pred)
+		}
+	}
+	if t.meta.level == Serializable {
+		t.meta.predicates = append(t.meta.predicates, pred)
+	}
+	e.tracef("T%d scan: %d matching rows", t.meta.xid, len(result))
+
+	return result, nil
+}
+
+func (t *Txn[V]) Insert(key int, value V) error {
+	e := t.engine
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := t.check(); err != nil {
+		return err
+	}
+
+	cur, _, err := t.lockLatest(key)
+	if err != nil {
+		return err
+	}
+	if cur != nil && !e.deleted(cur, t.meta.xid) {
+		return fmt.Errorf("%w: key %d", ErrDuplicateKey, key)
+	}
+
+	if t.meta.level == Serializable {
+		e.writeConflicts(t.meta, key, nil, &value)
+	}
+	e.rows[key] = append(e.rows[key], &version[V]{key: key, value: value, xmin: t.meta.xid})
+	e.tracef("T%d insert(%d): new version xmin=T%d", t.meta.xid, key, t.meta.xid)
+
+	return nil
+}
+
+// Update replaces the live version of key, it returns false if there's no row to update
+func (t *Txn[V]) Update(key int, value V) (bool, error) {
+	return t.replace(key, &value)
+}
+
+func (t *Txn[V]) Delete(key int) (bool, error) {
+	return t.replace(key, nil)
+}
+
+func (t *Txn[V]) replace(key int, value *V) (bool, error) {
+	e := t.engine
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := t.check(); err != nil {
+		return false, err
+	}
+
+	cur, s, err := t.lockLatest(key)
+	if err != nil {
+		return false, err
+	}
+	if cur == nil {
+		return false, nil
+	}
+
+	me := t.meta.xid
+	// Under read committed the snapshot is fresh, so the newest version is always visible. Under snapshot isolation it might have been
+	// committed after our snapshot - we'd be overwriting a change we never saw, so this is where the first updater wins
+	if cur.xmin != me && !e.committedIn(cur.xmin, s) {
+		e.tracef("T%d write(%d): newest version was created by T%d after our snapshot", me, key, cur.xmin)
+		e.finish(t.meta, statusAborted)
+		return false, fmt.Errorf("%w due to concurrent update of key %d", ErrSerialization, key)
+	}
+	if e.deleted(cur, me) {
+		if cur.xmax != me && !e.committedIn(cur.xmax, s) {
+			e.finish(t.meta, statusAborted)
+			return false, fmt.Errorf("%w due to concurrent delete of key %d", ErrSerialization, key)
+		}
+		return false, nil
+	}
+
+	if t.meta.level == Serializable {
+		e.writeConflicts(t.meta, key, &cur.value, value)
+	}
+
+	cur.xmax = me
+	if value == nil {
+		e.tracef("T%d delete(%d): xmax=T%d on version xmin=T%d", me, key, me, cur.xmin)
+		return true, nil
+	}
+
+	e.rows[key] = append(e.rows[key], &version[V]{key: key, value: *value, xmin: me})
+	e.tracef("T%d update(%d): xmax=T%d on version xmin=T%d, new version xmin=T%d", me, key, me, cur.xmin, me)
+	return true, nil
+}
+
+func (t *Txn[V]) Commit() error {
+	e := t.engine
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := t.check(); err != nil {
+		return err
+	}
+
+	if t.meta.level == Serializable {
+		if err := e.checkDangerous(t.meta); err != nil {
+			e.finish(t.meta, statusAborted)
+			e.tracef("T%d commit failed: %s", t.meta.xid, err)
+			return err
+		}
+	}
+
+	e.finish(t.meta, statusCommitted)
+	e.tracef("T%d commit", t.meta.xid)
+	return nil
+}
+
+func (t *Txn[V]) Rollback() error {
+	e := t.engine
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := t.check(); err != nil {
+		return err
+	}
+
+	e.finish(t.meta, statusAborted)
+	e.tracef("T%d rollback", t.meta.xid)
+	return nil
+}
+
+func (t *Txn[V]) check() error {
+	if t.meta.status != statusInProgress {
+		return ErrTxDone
+	}
+
+	return nil
+}
+
+func (t *Txn[V]) statementSnapshot() *snapshot {
+	if t.meta.snapshot == nil || t.meta.level == ReadCommitted {
+		t.meta.snapshot = t.engine.takeSnapshot()
+	}
+
+	return t.meta.snapshot
+}
+
+func (t *Txn[V]) visibleVersion(key int, s *snapshot) *version[V] {
+	e := t.engine
+	versions := e.rows[key]
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		ok, why := e.visible(v, t.meta.xid, s)
+		e.tracef("T%d read(%d): version xmin=T%d xmax=%s %s: %s", t.meta.xid, key, v.xmin, xmaxString(v.xmax), visibleWord(ok), why)
+		if ok {
+			return v
+		}
+	}
+
+	return nil
+}
+
+func xmaxString(xmax uint64) string {
+	if xmax == 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("T%d", xmax)
+}
+
+func visibleWord(ok bool) string {
+	if ok {
+		return "visible"
+	}
+
+	return "invisible"
+}
+
+// Waits until nobody else is in the middle of changing key, then returns its newest version. Called with the lock held
+func (t *Txn[V]) lockLatest(key int) (*version[V], *snapshot, error) {
+	e := t.engine
+	me := t.meta.xid
+	for {
+		s := t.statementSnapshot()
+		cur := e.latest(key)
+		if cur == nil {
+			return nil, s, nil
+		}
+
+		var holder uint64
+		switch {
+		case cur.xmin != me && e.txns[cur.xmin].status == statusInProgress:
+			holder = cur.xmin
+		case cur.xmax != 0 && cur.xmax != me && e.txns[cur.xmax].status == statusInProgress:
+			holder = cur.xmax
+		}
+		if holder == 0 {
+			return cur, s, nil
+		}
+
+		e.tracef("T%d write(%d): waiting for T%d to commit or roll back", me, key, holder)
+		changed := e.changed
+		e.mu.Unlock()
+		select {
+		case <-changed:
+			e.mu.Lock()
+		case <-t.ctx.Done():
+			e.mu.Lock()
+			return nil, s, t.ctx.Err()
+		}
+	}
+}
+
+// Deleted or replaced by a committed transaction, or by ourselves
+func (e *Engine[V]) deleted(v *version[V], me uint64) bool {
+	return v.xmax == me || (v.xmax != 0 && e.txns[v.xmax].status == statusCommitted)
+}
@@ -0,0 +1,213 @@
+package near_cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A near cache: every instance keeps a small L1 in its own memory in front of the shared L2 (redis), and only goes to the
+// database when both miss. L1 is nanoseconds away but every instance has its own copy, so a write on one instance has to tell
+// the others to drop theirs - that's the bus. The L1 TTL is the safety net for an invalidation that never arrives, it bounds
+// how long an instance can serve a stale value, which is why it's much shorter than the L2 TTL.
+// A load that was running while its key got invalidated may have read the database before the write, so its value isn't cached.
+// Without a bus an instance can't tell when another one invalidated, and such a value can still land in L2
+
+type Loader func(ctx context.Context, key string) ([]byte, error)
+
+type Config struct {
+	L1TTL time.Duration
+	L2TTL time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{L1TTL: 5 * time.Second, L2TTL: 5 * time.Minute}
+}
+
+type Stats struct {
+	L1Hits        int64
+	L2Hits        int64
+	Loads         int64
+	Invalidations int64 // Received from other instances
+	DroppedLoads  int64 // Loads that weren't cached because the key was invalidated while they ran
+}
+
+type Cache struct {
+	instance string
+	cfg      Config
+	l2       L2 // nil for an L1-only cache
+	bus      Bus
+	load     Loader
+
+	mu     sync.RWMutex
+	l1     map[string]entry
+	gens   map[string]uint64 // Bumped by every invalidation of the key
+	filled map[string]bool   // Keys we wrote to L2 since their last invalidation
+
+	l1Hits, l2Hits, loads, invalidations, droppedLoads atomic.Int64
+}
+
+type entry struct {
+	value   []byte
+	expires time.Time
+}
+
+func (e entry) expired() bool {
+	return time.Now().After(e.expires)
+}
+
+// New starts listening for invalidations straight away. A nil l2 gives an L1 in front of the database, a nil bus means
+// other instances' writes are only noticed when the L1 entry expires. L1TTL 0 turns L1 off.
+// The instance name tags our own invalidations on the bus, it has to be unique and can't contain a newline
+func New(ctx context.Context, instance string, cfg Config, l2 L2, bus Bus, load Loader) (*Cache, error) {
+	c := &Cache{instance: instance, cfg: cfg, l2: l2, bus: bus, load: load,
+		l1: make(map[string]entry), gens: make(map[string]uint64), filled: make(map[string]bool)}
+	if bus == nil {
+		return c, nil
+	}
+
+	err := bus.Subscribe(ctx, func(msg string) {
+		origin, key, ok := strings.Cut(msg, "\n")
+		if !ok || origin == c.instance {
+			return // Our own invalidation, we dropped the key before publishing it
+		}
+		c.invalidations.Add(1)
+		if c.dropL1(key) && c.l2 != nil {
+			// Our load may have read the database before the write and set L2 after the writer deleted it
+			if err := c.l2.Del(ctx, key); err != nil {
+				fmt.Printf("L2 del %s failed: %s\n", key, err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed subscribing to invalidations: %w", err)
+	}
+
+	return c, nil
+}
+
+func (c *Cache) Get(ctx context.Context, key string) ([]byte, error) {
+	gen := c.generation(key)
+	if c.cfg.L1TTL > 0 {
+		c.mu.RLock()
+		e, ok := c.l1[key]
+		c.mu.RUnlock()
+		if ok && !e.expired() {
+			c.l1Hits.Add(1)
+			return e.value, nil
+		}
+	}
+
+	if c.l2 != nil {
+		value, err := c.l2.Get(ctx, key)
+		if err == nil {
+			c.l2Hits.Add(1)
+			c.setL1(key, value, gen)
+			return value, nil
+		}
+		if !errors.Is(err, ErrMiss) {
+			fmt.Printf("L2 get %s failed, falling through to the loader: %s\n", key, err) // A broken L2 makes us slow, not down
+		}
+	}
+
+	c.loads.Add(1)
+	value, err := c.load(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading %s: %w", key, err)
+	}
+	c.fill(ctx, key, value, gen)
+
+	return value, nil
+}
+
+// Caches a loaded value, unless the key was invalidated since the load started - the value may be from before the write,
+// and in L2 it would outlive the invalidation by up to L2TTL
+func (c *Cache) fill(ctx context.Context, key string, value []byte, gen uint64) {
+	if c.l2 != nil {
+		c.mu.Lock()
+		current := c.gens[key] == gen
+		if current {
+			c.filled[key] = true
+		}
+		c.mu.Unlock()
+		if !current {
+			c.droppedLoads.Add(1)
+			return
+		}
+
+		if err := c.l2.Set(ctx, key, value, c.cfg.L2TTL); err != nil {
+			fmt.Printf("L2 set %s failed: %s\n", key, err)
+		}
+		if c.generation(key) != gen {
+			// Invalidated while we were setting it, the invalidation's delete may have come first
+			c.droppedLoads.Add(1)
+			if err := c.l2.Del(ctx, key); err != nil {
+				fmt.Printf("L2 del %s failed: %s\n", key, err)
+			}
+			return
+		}
+	}
+
+	c.setL1(key, value, gen)
+}
+
+// Invalidate is called after the database write committed: L2 first, so the other instances refill from the new value,
+// then our own L1, then everybody else's
+func (c *Cache) Invalidate(ctx context.Context, key string) error {
+	if c.l2 != nil {
+		if err := c.l2.Del(ctx, key); err != nil {
+			return fmt.Errorf("failed deleting %s from L2: %w", key, err)
+		}
+	}
+	c.dropL1(key)
+
+	if c.bus != nil {
+		if err := c.bus.Publish(ctx, c.instance+"\n"+key); err != nil {
+			return fmt.Errorf("failed publishing invalidation of %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Cache) Stats() Stats {
+	return Stats{L1Hits: c.l1Hits.Load(), L2Hits: c.l2Hits.Load(), Loads: c.loads.Load(), Invalidations: c.invalidations.Load(),
+		DroppedLoads: c.droppedLoads.Load()}
+}
+
+func (c *Cache) generation(key string) uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.gens[key]
+}
+
+// Only while the key is still at the generation the value was read at
+func (c *Cache) setL1(key string, value []byte, gen uint64) {
+	if c.cfg.L1TTL <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	if c.gens[key] == gen {
+		c.l1[key] = entry{value: value, expires: time.Now().Add(c.cfg.L1TTL)}
+	}
+	c.mu.Unlock()
+}
+
+// Drops the key from L1 and bumps its generation, reports whether we wrote it to L2 since the last invalidation
+func (c *Cache) dropL1(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.l1, key)
+	c.gens[key]++
+	filled := c.filled[key]
+	delete(c.filled, key)
+
+	return filled
+}
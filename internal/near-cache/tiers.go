@@ -0,0 +1,174 @@
+package near_cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrMiss = errors.New("cache miss")
+
+// L2 is the shared tier every instance talks to, redis in real life
+type L2 interface {
+	Get(ctx context.Context, key string) ([]byte, error) // ErrMiss when it isn't there
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Del(ctx context.Context, key string) error
+}
+
+// Bus carries invalidations between instances. Messages are opaque to the bus and must arrive byte for byte as published:
+// Cache sends "<instance>\n<key>" so a subscriber can skip its own invalidations, and drops the key from its L1 otherwise
+type Bus interface {
+	Publish(ctx context.Context, msg string) error
+	Subscribe(ctx context.Context, handle func(msg string)) error // Returns once the subscription is live
+}
+
+type redisL2 struct {
+	client *redis.Client
+}
+
+func NewRedisL2(client *redis.Client) L2 {
+	return redisL2{client: client}
+}
+
+func (r redisL2) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := r.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrMiss
+	}
+
+	return value, err
+}
+
+func (r redisL2) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (r redisL2) Del(ctx context.Context, key string) error {
+	return r.client.Del(ctx, key).Err()
+}
+
+type redisBus struct {
+	client  *redis.Client
+	channel string
+}
+
+func NewRedisBus(client *redis.Client, channel string) Bus {
+	return redisBus{client: client, channel: channel}
+}
+
+func (b redisBus) Publish(ctx context.Context, msg string) error {
+	return b.client.Publish(ctx, b.channel, msg).Err()
+}
+
+func (b redisBus) Subscribe(ctx context.Context, handle func(msg string)) error {
+	sub := b.client.Subscribe(ctx, b.channel)
+	if _, err := sub.Receive(ctx); err != nil { // The subscribe confirmation, after this no message can slip past us
+		sub.Close()
+		return fmt.Errorf("failed subscribing to %s: %w", b.channel, err)
+	}
+
+	go func() {
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				handle(msg.Payload)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// The in-process fallbacks, for when there's no redis around. Delay plays the network round trip
+// so the tiers don't all look equally fast
+
+type memoryL2 struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+func NewMemoryL2(delay time.Duration) L2 {
+	return &memoryL2{delay: delay, entries: make(map[string]entry)}
+}
+
+func (m *memoryL2) Get(ctx context.Context, key string) ([]byte, error) {
+	time.Sleep(m.delay)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok || e.expired() {
+		return nil, ErrMiss
+	}
+
+	return e.value, nil
+}
+
+func (m *memoryL2) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	time.Sleep(m.delay)
+	m.mu.Lock()
+	m.entries[key] = entry{value: value, expires: time.Now().Add(ttl)}
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *memoryL2) Del(ctx context.Context, key string) error {
+	time.Sleep(m.delay)
+	m.mu.Lock()
+	delete(m.entries, key)
+	m.mu.Unlock()
+
+	return nil
+}
+
+type localBus struct {
+	mu     sync.RWMutex
+	nextID int
+	subs   map[int]func(msg string)
+}
+
+func NewLocalBus() Bus {
+	return &localBus{subs: make(map[int]func(msg string))}
+}
+
+func (b *localBus) Publish(ctx context.Context, msg string) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, handle := range b.subs {
+		handle(msg)
+	}
+
+	return nil
+}
+
+// The subscription ends with ctx, like the redis one
+func (b *localBus) Subscribe(ctx context.Context, handle func(msg string)) error {
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = handle
+	b.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		delete(b.subs, id)
+		b.mu.Unlock()
+	})
+
+	return nil
+}
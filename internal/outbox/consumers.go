@@ -0,0 +1,124 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+type Consumer interface {
+	Name() string
+	Handle(ctx context.Context, event Event) error
+}
+
+type consumerFunc struct {
+	name   string
+	handle func(ctx context.Context, event Event) error
+}
+
+func (c consumerFunc) Name() string {
+	return c.name
+}
+
+func (c consumerFunc) Handle(ctx context.Context, event Event) error {
+	return c.handle(ctx, event)
+}
+
+func ConsumerFunc(name string, handle func(ctx context.Context, event Event) error) Consumer {
+	return consumerFunc{name: name, handle: handle}
+}
+
+func Logger() Consumer {
+	return ConsumerFunc("logger", func(ctx context.Context, event Event) error {
+		fmt.Printf("event %d %s %s attempt %d: %s\n", event.ID, event.Type, event.Aggregate, event.Attempts+1, event.Payload)
+		return nil
+	})
+}
+
+// CacheInvalidator deletes the cache keys an event makes stale, e.g. "post.created" -> "posts"
+func CacheInvalidator(keys func(event Event) []string, invalidate func(ctx context.Context, key string) error) Consumer {
+	return ConsumerFunc("cache invalidation", func(ctx context.Context, event Event) error {
+		for _, key := range keys(event) {
+			if err := invalidate(ctx, key); err != nil {
+				return fmt.Errorf("failed invalidating %s: %w", key, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Dedup drops events the wrapped consumer already handled. The seen set lives in memory, which covers the relay retrying a batch
+// but not a restart - a consumer that has to survive restarts keeps the ids next to its own data, in the same transaction
+type Dedup struct {
+	Consumer
+
+	mu         sync.Mutex
+	seen       map[int64]bool
+	duplicates int
+}
+
+func Deduplicate(c Consumer) *Dedup {
+	return &Dedup{Consumer: c, seen: make(map[int64]bool)}
+}
+
+func (d *Dedup) Handle(ctx context.Context, event Event) error {
+	d.mu.Lock()
+	defer d.mu.Unlock() // Held through the handler, otherwise two relays could both pass the check with the same event
+
+	if d.seen[event.ID] {
+		d.duplicates++
+		return nil
+	}
+	if err := d.Consumer.Handle(ctx, event); err != nil {
+		return err
+	}
+	d.seen[event.ID] = true
+
+	return nil
+}
+
+func (d *Dedup) Duplicates() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.duplicates
+}
+
+// Bus is an in-memory pub/sub, subscribers get every event of the types they asked for.
+// A slow subscriber blocks the relay, which is the point - the event isn't published until everyone has it
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[string][]chan Event
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[string][]chan Event)}
+}
+
+func (b *Bus) Subscribe(eventType string, buffer int) <-chan Event {
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	b.subs[eventType] = append(b.subs[eventType], ch)
+	b.mu.Unlock()
+
+	return ch
+}
+
+func (b *Bus) Name() string {
+	return "bus"
+}
+
+func (b *Bus) Handle(ctx context.Context, event Event) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, ch := range b.subs[event.Type] {
+		select {
+		case ch <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
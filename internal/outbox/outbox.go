@@ -0,0 +1,98 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The transactional outbox. Writing a row and publishing "this row changed" are two different systems, so there's always a moment
+// where one has happened and the other hasn't - crash there and the event is gone. Instead the event is inserted into the outbox
+// table in the same transaction as the write: either both commit or neither does. A relay reads the outbox afterwards and does the
+// actual publishing, and only marks an event as published once every consumer took it.
+// That makes delivery at-least-once - a crash between publishing and marking publishes the event again - so consumers dedupe on the event id
+
+const Channel = "outbox" // NOTIFY channel, the relay LISTENs on it so it doesn't have to wait for the next poll
+
+type Event struct {
+	ID        int64
+	Type      string // E.g. "post.created"
+	Aggregate string // What it's about, e.g. "post:12" - events for the same aggregate are relayed in order
+	Payload   json.RawMessage
+	CreatedAt time.Time
+	Attempts  int
+}
+
+// Setup creates the outbox if it isn't there yet. It never touches existing rows:
+// events committed before a restart are exactly the ones the relay has to pick up after it
+func Setup(ctx context.Context, DB *sql.DB) error {
+	_, err := DB.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS outbox (
+			id BIGSERIAL PRIMARY KEY,
+			type TEXT NOT NULL,
+			aggregate TEXT NOT NULL,
+			payload JSONB NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			published_at TIMESTAMPTZ,
+			failed_at TIMESTAMPTZ,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT
+		);
+		CREATE INDEX IF NOT EXISTS outbox_unpublished ON outbox (id) WHERE published_at IS NULL AND failed_at IS NULL;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed creating outbox: %w", err)
+	}
+
+	return nil
+}
+
+// Reset drops every event and starts from an empty outbox, for demos and tests only
+func Reset(ctx context.Context, DB *sql.DB) error {
+	if _, err := DB.ExecContext(ctx, `DROP TABLE IF EXISTS outbox`); err != nil {
+		return fmt.Errorf("failed dropping outbox: %w", err)
+	}
+
+	return Setup(ctx, DB)
+}
+
+// Add records an event as part of tx. Nothing is published here, the event only exists if tx commits.
+// The NOTIFY is transactional too, listeners hear about it on commit and not a moment before
+func Add(ctx context.Context, tx *sql.Tx, eventType, aggregate string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed encoding %s payload: %w", eventType, err)
+	}
+
+	if _, err = tx.ExecContext(ctx, `INSERT INTO outbox (type, aggregate, payload) VALUES ($1, $2, $3)`, eventType, aggregate, data); err != nil {
+		return fmt.Errorf("failed adding %s to outbox: %w", eventType, err)
+	}
+	if _, err = tx.ExecContext(ctx, `SELECT pg_notify($1, '')`, Channel); err != nil {
+		return fmt.Errorf("failed notifying relay: %w", err)
+	}
+
+	return nil
+}
+
+type Counts struct {
+	Pending   int
+	Published int
+	Failed    int
+}
+
+func Count(ctx context.Context, DB *sql.DB) (Counts, error) {
+	var c Counts
+	err := DB.QueryRowContext(ctx, `
+		SELECT
+			COUNT(*) FILTER (WHERE published_at IS NULL AND failed_at IS NULL),
+			COUNT(*) FILTER (WHERE published_at IS NOT NULL),
+			COUNT(*) FILTER (WHERE failed_at IS NOT NULL)
+		FROM outbox`).Scan(&c.Pending, &c.Published, &c.Failed)
+	if err != nil {
+		return c, fmt.Errorf("failed counting outbox: %w", err)
+	}
+
+	return c, nil
+}
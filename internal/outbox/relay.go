@@ -0,0 +1,172 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type RelayConfig struct {
+	BatchSize    int
+	PollInterval time.Duration // Fallback when nothing is LISTENing, or a notification got lost
+	MaxAttempts  int           // After this many failed deliveries the event is parked as failed instead of blocking the outbox
+	ListenDSN    string        // Set it to wake up on NOTIFY instead of only polling
+
+	// BeforeMark runs after the batch was handed to the consumers but before it's marked as published.
+	// Returning an error plays a crash right there: the transaction rolls back and the whole batch gets delivered again
+	BeforeMark func(delivered []Event) error
+}
+
+func DefaultRelayConfig() RelayConfig {
+	return RelayConfig{BatchSize: 100, PollInterval: time.Second, MaxAttempts: 5}
+}
+
+type Relay struct {
+	DB        *sql.DB
+	cfg       RelayConfig
+	consumers []Consumer
+}
+
+func NewRelay(DB *sql.DB, cfg RelayConfig, consumers ...Consumer) *Relay {
+	return &Relay{DB: DB, cfg: cfg, consumers: consumers}
+}
+
+// Run relays until ctx is done
+func (r *Relay) Run(ctx context.Context) error {
+	var notify <-chan *pq.Notification
+	if r.cfg.ListenDSN != "" {
+		listener := pq.NewListener(r.cfg.ListenDSN, 10*time.Millisecond, time.Second, nil)
+		defer listener.Close()
+		if err := listener.Listen(Channel); err != nil {
+			return fmt.Errorf("failed listening on %s: %w", Channel, err)
+		}
+		notify = listener.Notify
+	}
+
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Drain(ctx); err != nil && ctx.Err() == nil {
+			fmt.Printf("outbox relay: %s\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Drain relays batches until the outbox is empty
+func (r *Relay) Drain(ctx context.Context) error {
+	for {
+		n, err := r.RunOnce(ctx)
+		if err != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+// RunOnce relays one batch and returns how many events were published.
+// SKIP LOCKED lets several relays run side by side without handing out the same event twice at the same time
+func (r *Relay) RunOnce(ctx context.Context) (int, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	events, err := r.batch(ctx, tx)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+
+	var delivered []Event
+	for _, event := range events {
+		if err = r.deliver(ctx, event); err != nil {
+			// Stop at the first failure, the events behind it may be about the same aggregate and must not overtake it
+			if err = r.recordFailure(ctx, tx, event, err); err != nil {
+				return 0, err
+			}
+			break
+		}
+		delivered = append(delivered, event)
+	}
+
+	if r.cfg.BeforeMark != nil {
+		if err = r.cfg.BeforeMark(delivered); err != nil {
+			return 0, fmt.Errorf("relay stopped before marking %d events: %w", len(delivered), err)
+		}
+	}
+
+	ids := make([]int64, len(delivered))
+	for i, event := range delivered {
+		ids[i] = event.ID
+	}
+	if _, err = tx.ExecContext(ctx, `UPDATE outbox SET published_at = now() WHERE id = ANY($1)`, pq.Array(ids)); err != nil {
+		return 0, fmt.Errorf("failed marking events as published: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed committing relay batch: %w", err)
+	}
+
+	return len(delivered), nil
+}
+
+func (r *Relay) batch(ctx context.Context, tx *sql.Tx) ([]Event, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, type, aggregate, payload, created_at, attempts FROM outbox
+		WHERE published_at IS NULL AND failed_at IS NULL
+		ORDER BY id LIMIT $1
+		FOR UPDATE SKIP LOCKED`, r.cfg.BatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading outbox: %w", err)
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if err = rows.Scan(&e.ID, &e.Type, &e.Aggregate, &e.Payload, &e.CreatedAt, &e.Attempts); err != nil {
+			return nil, fmt.Errorf("failed mapping outbox row: %w", err)
+		}
+		events = append(events, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading outbox: %w", err)
+	}
+
+	return events, nil
+}
+
+// Every consumer gets the event, even when an earlier one failed - whoever succeeded will see it again on the retry and dedupe it
+func (r *Relay) deliver(ctx context.Context, event Event) error {
+	var errs []error
+	for _, c := range r.consumers {
+		if err := c.Handle(ctx, event); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (r *Relay) recordFailure(ctx context.Context, tx *sql.Tx, event Event, cause error) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE outbox SET attempts = attempts + 1, last_error = $2,
+			failed_at = CASE WHEN attempts + 1 >= $3 THEN now() END
+		WHERE id = $1`, event.ID, cause.Error(), r.cfg.MaxAttempts)
+	if err != nil {
+		return fmt.Errorf("failed recording delivery failure for event %d: %w", event.ID, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package outbox_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"andreashoj/deeper-learnings/internal/db"
+	"andreashoj/deeper-learnings/internal/outbox"
+)
+
+// Needs postgres, the outbox leans on JSONB, SKIP LOCKED and pg_notify. TEST_DATABASE_DSN overrides the docker compose one.
+// Starts from an empty outbox every time, don't point this at anything you care about
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		dsn = db.DSN
+	}
+	DB, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("failed opening db: %s", err)
+	}
+	t.Cleanup(func() { DB.Close() })
+
+	if err = DB.Ping(); err != nil {
+		t.Skipf("postgres not reachable: %s", err)
+	}
+	if err = outbox.Reset(context.Background(), DB); err != nil {
+		t.Fatalf("failed resetting outbox: %s", err)
+	}
+
+	return DB
+}
+
+// Commits n events the way a write would, the events are in the outbox and nothing has published them yet
+func addEvents(t *testing.T, DB *sql.DB, n int) {
+	t.Helper()
+
+	tx, err := DB.Begin()
+	if err != nil {
+		t.Fatalf("failed starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	for i := range n {
+		if err = outbox.Add(context.Background(), tx, "post.created", "post:1", map[string]int{"id": i}); err != nil {
+			t.Fatalf("failed adding event: %s", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatalf("failed committing events: %s", err)
+	}
+}
+
+// Counts how often the consumer behind the dedup actually ran, per event
+type recorder struct {
+	mu      sync.Mutex
+	handled map[int64]int
+}
+
+func (r *recorder) Name() string { return "recorder" }
+
+func (r *recorder) Handle(ctx context.Context, event outbox.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.handled[event.ID]++
+	return nil
+}
+
+func pending(t *testing.T, DB *sql.DB) outbox.Counts {
+	t.Helper()
+
+	counts, err := outbox.Count(context.Background(), DB)
+	if err != nil {
+		t.Fatalf("failed counting outbox: %s", err)
+	}
+
+	return counts
+}
+
+func TestRelayRedeliversAfterCrashBeforeMark(t *testing.T) {
+	DB := openTestDB(t)
+	ctx := context.Background()
+	addEvents(t, DB, 5)
+
+	rec := &recorder{handled: make(map[int64]int)}
+	dedup := outbox.Deduplicate(rec)
+
+	crashes := 0
+	cfg := outbox.DefaultRelayConfig()
+	cfg.BeforeMark = func(delivered []outbox.Event) error {
+		if crashes == 0 {
+			crashes++
+			return errors.New("crash between publish and mark")
+		}
+		return nil
+	}
+	relay := outbox.NewRelay(DB, cfg, dedup)
+
+	if _, err := relay.RunOnce(ctx); err == nil {
+		t.Fatalf("relay didn't report the crash")
+	}
+	if c := pending(t, DB); c.Pending != 5 || c.Published != 0 {
+		t.Fatalf("after the crash want 5 pending and 0 published, got %+v", c)
+	}
+
+	if err := relay.Drain(ctx); err != nil {
+		t.Fatalf("failed draining after the crash: %s", err)
+	}
+	if c := pending(t, DB); c.Pending != 0 || c.Published != 5 {
+		t.Fatalf("after draining want 0 pending and 5 published, got %+v", c)
+	}
+	if d := dedup.Duplicates(); d != 5 {
+		t.Fatalf("want all 5 events replayed and deduped, got %d duplicates", d)
+	}
+	for id, n := range rec.handled {
+		if n != 1 {
+			t.Fatalf("event %d reached the consumer %d times, dedup should let it through once", id, n)
+		}
+	}
+	if len(rec.handled) != 5 {
+		t.Fatalf("want 5 events handled, got %d", len(rec.handled))
+	}
+}
+
+func TestRelayDeliversEventsCommittedBeforeACrash(t *testing.T) {
+	DB := openTestDB(t)
+	ctx := context.Background()
+
+	// The write committed and the process died before any relay ran, a relay after the restart still has them
+	addEvents(t, DB, 3)
+
+	rec := &recorder{handled: make(map[int64]int)}
+	if err := outbox.NewRelay(DB, outbox.DefaultRelayConfig(), rec).Drain(ctx); err != nil {
+		t.Fatalf("failed draining: %s", err)
+	}
+	if c := pending(t, DB); c.Pending != 0 || c.Published != 3 {
+		t.Fatalf("want 0 pending and 3 published, got %+v", c)
+	}
+	if len(rec.handled) != 3 {
+		t.Fatalf("want 3 events handled, got %d", len(rec.handled))
+	}
+}
+
+func TestSetupAfterRestartKeepsCommittedEvents(t *testing.T) {
+	DB := openTestDB(t)
+	ctx := context.Background()
+	addEvents(t, DB, 3)
+
+	// The restarted process sets the outbox up again before its relay starts, like startPostsOutboxRelay does
+	if err := outbox.Setup(ctx, DB); err != nil {
+		t.Fatalf("failed setting up outbox after the restart: %s", err)
+	}
+	if c := pending(t, DB); c.Pending != 3 {
+		t.Fatalf("setup after the restart lost events, want 3 pending, got %+v", c)
+	}
+
+	rec := &recorder{handled: make(map[int64]int)}
+	if err := outbox.NewRelay(DB, outbox.DefaultRelayConfig(), rec).Drain(ctx); err != nil {
+		t.Fatalf("failed draining: %s", err)
+	}
+	if c := pending(t, DB); c.Pending != 0 || c.Published != 3 {
+		t.Fatalf("want the 3 events from before the restart published, got %+v", c)
+	}
+	if len(rec.handled) != 3 {
+		t.Fatalf("want 3 events handled, got %d", len(rec.handled))
+	}
+}
+
+func TestRelayParksEventsAfterMaxAttempts(t *testing.T) {
+	DB := openTestDB(t)
+	ctx := context.Background()
+	addEvents(t, DB, 1)
+
+	cfg := outbox.DefaultRelayConfig()
+	cfg.MaxAttempts = 2
+	failing := outbox.ConsumerFunc("failing", func(ctx context.Context, event outbox.Event) error {
+		return errors.New("consumer down")
+	})
+	relay := outbox.NewRelay(DB, cfg, failing)
+
+	for range cfg.MaxAttempts {
+		if _, err := relay.RunOnce(ctx); err != nil {
+			t.Fatalf("failed relaying: %s", err)
+		}
+	}
+	if c := pending(t, DB); c.Pending != 0 || c.Failed != 1 {
+		t.Fatalf("want the event parked as failed, got %+v", c)
+	}
+}
@@ -0,0 +1,278 @@
+package pool_monitor
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Samples sql.DBStats for every registered pool on an interval, and turns the raw counters into something we can act on:
+// rates instead of totals, and warnings when a pool is saturated or looks like it's leaking connections.
+// A one-off check (like the old poolHealth) only tells you how the pool looks right now, the interesting stuff is the trend
+
+type Config struct {
+	Interval time.Duration
+	History  int // Samples kept per pool
+
+	SaturationWarn float64       // Warn when InUse / MaxOpen is above this, 0.9 = 90%
+	MeanWaitWarn   time.Duration // Warn when the mean wait for a connection in the last interval is above this
+
+	// Leak detection: the pool has been saturated for LeakWindow samples in a row,
+	// while request throughput dropped below LeakThroughputDrop of what it was before
+	LeakWindow         int
+	LeakThroughputDrop float64
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Interval:           time.Second,
+		History:            60,
+		SaturationWarn:     0.9,
+		MeanWaitWarn:       50 * time.Millisecond,
+		LeakWindow:         5,
+		LeakThroughputDrop: 0.5,
+	}
+}
+
+type Monitor struct {
+	cfg   Config
+	sinks []Sink
+
+	mu    sync.Mutex
+	pools map[string]*pool
+	order []string
+}
+
+type pool struct {
+	name     string
+	stats    func() sql.DBStats
+	requests atomic.Int64
+
+	samples  []Sample
+	leaking  bool    // So we warn once per leak, not every interval
+	baseline float64 // Throughput before the leak started, recovery is measured against it
+	previous sql.DBStats
+	lastReqs int64
+	lastTime time.Time
+}
+
+// Sample is one interval worth of derived numbers, the raw stats are kept alongside for the dashboard
+type Sample struct {
+	Time           time.Time   `json:"time"`
+	Stats          sql.DBStats `json:"stats"`
+	WaitsPerSec    float64     `json:"waits_per_sec"`
+	MeanWaitMs     float64     `json:"mean_wait_ms"`
+	Saturation     float64     `json:"saturation"` // InUse / MaxOpen, 0 when the pool is unlimited
+	RequestsPerSec float64     `json:"requests_per_sec"`
+}
+
+func New(cfg Config, sinks ...Sink) *Monitor {
+	return &Monitor{
+		cfg:   cfg,
+		sinks: sinks,
+		pools: make(map[string]*pool),
+	}
+}
+
+// Register adds a pool to watch, stats is usually DB.Stats
+func (m *Monitor) Register(name string, stats func() sql.DBStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.pools[name]; !exists {
+		m.order = append(m.order, name)
+	}
+
+	m.pools[name] = &pool{name: name, stats: stats, previous: stats(), lastTime: time.Now()}
+}
+
+// RecordRequest counts a unit of work done against the pool - it's how we tell "busy" apart from "stuck"
+func (m *Monitor) RecordRequest(name string) {
+	m.mu.Lock()
+	p, ok := m.pools[name]
+	m.mu.Unlock()
+
+	if ok {
+		p.requests.Add(1)
+	}
+}
+
+// Middleware counts every request through the route as work done against the named pool
+func (m *Monitor) Middleware(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r)
+			m.RecordRequest(name)
+		})
+	}
+}
+
+// Start samples until ctx is cancelled
+func (m *Monitor) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(m.cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.SampleAll()
+			}
+		}
+	}()
+}
+
+func (m *Monitor) SampleAll() {
+	m.mu.Lock()
+	var events []Event
+	for _, name := range m.order {
+		events = append(events, m.sample(m.pools[name])...)
+	}
+	m.mu.Unlock()
+
+	// Emit outside the lock, a slow sink shouldn't block RecordRequest
+	for _, e := range events {
+		for _, sink := range m.sinks {
+			sink.Emit(e)
+		}
+	}
+}
+
+// Must be called with mu held
+func (m *Monitor) sample(p *pool) []Event {
+	now := time.Now()
+	stats := p.stats()
+	reqs := p.requests.Load()
+	elapsed := now.Sub(p.lastTime).Seconds()
+
+	s := Sample{Time: now, Stats: stats}
+	if elapsed > 0 {
+		s.WaitsPerSec = float64(stats.WaitCount-p.previous.WaitCount) / elapsed
+		s.RequestsPerSec = float64(reqs-p.lastReqs) / elapsed
+	}
+
+	if waits := stats.WaitCount - p.previous.WaitCount; waits > 0 {
+		s.MeanWaitMs = float64(stats.WaitDuration-p.previous.WaitDuration) / float64(waits) / float64(time.Millisecond)
+	}
+
+	if stats.MaxOpenConnections > 0 {
+		s.Saturation = float64(stats.InUse) / float64(stats.MaxOpenConnections)
+	}
+
+	p.previous = stats
+	p.lastReqs = reqs
+	p.lastTime = now
+	p.samples = append(p.samples, s)
+	if len(p.samples) > m.cfg.History {
+		p.samples = p.samples[len(p.samples)-m.cfg.History:]
+	}
+
+	return m.evaluate(p, s)
+}
+
+func (m *Monitor) evaluate(p *pool, s Sample) []Event {
+	var events []Event
+
+	if m.cfg.SaturationWarn > 0 && s.Saturation >= m.cfg.SaturationWarn {
+		events = append(events, newEvent(p.name, LevelWarning, KindSaturated, s,
+			"pool is %.0f%% in use (%d/%d)", s.Saturation*100, s.Stats.InUse, s.Stats.MaxOpenConnections))
+	}
+
+	if m.cfg.MeanWaitWarn > 0 && s.MeanWaitMs >= float64(m.cfg.MeanWaitWarn)/float64(time.Millisecond) {
+		events = append(events, newEvent(p.name, LevelWarning, KindSlowWait, s,
+			"mean wait for a connection is %.1fms (%.1f waits/sec)", s.MeanWaitMs, s.WaitsPerSec))
+	}
+
+	leaking := m.looksLikeLeak(p)
+	if leaking && !p.leaking {
+		events = append(events, newEvent(p.name, LevelCritical, KindLeakSuspected, s,
+			"pool saturated for %d samples while throughput dropped to %.1f req/s - connections are likely not being released", m.cfg.LeakWindow, s.RequestsPerSec))
+	}
+	if !leaking && p.leaking {
+		events = append(events, newEvent(p.name, LevelInfo, KindRecovered, s, "pool recovered"))
+	}
+	p.leaking = leaking
+
+	return events
+}
+
+// A busy pool is saturated and doing a lot of work. A leaking pool is saturated and doing nothing, because the connections are held by code that's done with them
+func (m *Monitor) looksLikeLeak(p *pool) bool {
+	window := m.cfg.LeakWindow
+	if window == 0 || len(p.samples) < window*2 {
+		return false // Need a baseline before the window to compare against
+	}
+
+	recent := p.samples[len(p.samples)-window:]
+	for _, s := range recent {
+		if s.Saturation < m.cfg.SaturationWarn {
+			return false
+		}
+	}
+
+	// Once leaking, the window before is just as dead as the current one - keep comparing against the throughput from before the leak
+	if !p.leaking {
+		p.baseline = meanThroughput(p.samples[len(p.samples)-window*2 : len(p.samples)-window])
+	}
+
+	return meanThroughput(recent) < p.baseline*m.cfg.LeakThroughputDrop
+}
+
+func meanThroughput(samples []Sample) float64 {
+	total := 0.0
+	for _, s := range samples {
+		total += s.RequestsPerSec
+	}
+
+	return total / float64(len(samples))
+}
+
+type PoolReport struct {
+	Name    string   `json:"name"`
+	Latest  *Sample  `json:"latest"`
+	Leaking bool     `json:"leaking"`
+	History []Sample `json:"history"`
+}
+
+func (m *Monitor) Report() []PoolReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var reports []PoolReport
+	for _, name := range m.order {
+		p := m.pools[name]
+		report := PoolReport{Name: name, Leaking: p.leaking, History: append([]Sample(nil), p.samples...)}
+		if len(p.samples) > 0 {
+			latest := p.samples[len(p.samples)-1]
+			report.Latest = &latest
+		}
+		reports = append(reports, report)
+	}
+
+	return reports
+}
+
+// Handler serves every pool's latest sample and history, plus the recent events if a MemorySink is given
+func (m *Monitor) Handler(events *MemorySink) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := struct {
+			Pools  []PoolReport `json:"pools"`
+			Events []Event      `json:"events"`
+		}{
+			Pools: m.Report(),
+		}
+
+		if events != nil {
+			res.Events = events.Events()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
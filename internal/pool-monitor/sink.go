@@ -0,0 +1,91 @@
+package pool_monitor
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type Level string
+
+const (
+	LevelInfo     Level = "info"
+	LevelWarning  Level = "warning"
+	LevelCritical Level = "critical"
+)
+
+type Kind string
+
+const (
+	KindSaturated     Kind = "saturated"
+	KindSlowWait      Kind = "slow_wait"
+	KindLeakSuspected Kind = "leak_suspected"
+	KindRecovered     Kind = "recovered"
+)
+
+type Event struct {
+	Time    time.Time `json:"time"`
+	Pool    string    `json:"pool"`
+	Level   Level     `json:"level"`
+	Kind    Kind      `json:"kind"`
+	Message string    `json:"message"`
+	Sample  Sample    `json:"sample"`
+}
+
+func newEvent(pool string, level Level, kind Kind, s Sample, format string, args ...any) Event {
+	return Event{
+		Time:    s.Time,
+		Pool:    pool,
+		Level:   level,
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+		Sample:  s,
+	}
+}
+
+// Sink is where events go - logs, metrics, alerting, a channel in a test
+type Sink interface {
+	Emit(e Event)
+}
+
+type SinkFunc func(e Event)
+
+func (f SinkFunc) Emit(e Event) {
+	f(e)
+}
+
+// LogSink prints events the same way the old poolHealth did
+type LogSink struct{}
+
+func (LogSink) Emit(e Event) {
+	log.Printf("%s: [%s] %s: %s", e.Level, e.Pool, e.Kind, e.Message)
+}
+
+// MemorySink keeps the last N events around for the JSON endpoint
+type MemorySink struct {
+	mu     sync.Mutex
+	size   int
+	events []Event
+}
+
+func NewMemorySink(size int) *MemorySink {
+	return &MemorySink{size: size}
+}
+
+func (s *MemorySink) Emit(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, e)
+	if len(s.events) > s.size {
+		s.events = s.events[len(s.events)-s.size:]
+	}
+}
+
+func (s *MemorySink) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Event(nil), s.events...)
+}
@@ -0,0 +1,378 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A from scratch connection pool, to see what database/sql is actually doing for us.
+// It's generic so it can pool anything that is expensive to open - db connections, redis clients, tcp sockets
+
+var ErrClosed = errors.New("pool: closed")
+
+type Config[T any] struct {
+	MaxOpen     int           // Max resources open at once, 0 = unlimited
+	MinIdle     int           // The maintainer keeps at least this many idle resources warm
+	MaxLifetime time.Duration // Resources older than this are closed instead of reused, 0 = forever
+	IdleTimeout time.Duration // Idle resources unused for longer than this are closed, 0 = forever
+
+	New   func(ctx context.Context) (T, error)
+	Close func(T) error
+	Check func(ctx context.Context, value T) error // Health check on borrow, optional
+
+	MaintainInterval time.Duration // How often idle resources are pruned / refilled, defaults to 1s
+}
+
+type Pool[T any] struct {
+	cfg Config[T]
+
+	mu      sync.Mutex
+	idle    []*entry[T] // LIFO - the most recently used resource is the most likely to still be healthy
+	open    int
+	waiters []*waiter[T] // FIFO - first to wait is first to get served, so nobody starves
+	closed  bool
+	stats   Stats
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type entry[T any] struct {
+	value     T
+	createdAt time.Time
+	idleSince time.Time
+}
+
+// A waiter receives either a resource handed off from Release, or nil, meaning a slot opened up and it may create its own
+type waiter[T any] struct {
+	ch chan *entry[T]
+}
+
+func New[T any](cfg Config[T]) (*Pool[T], error) {
+	if cfg.New == nil {
+		return nil, errors.New("pool: Config.New is required")
+	}
+
+	if cfg.MaxOpen > 0 && cfg.MinIdle > cfg.MaxOpen {
+		return nil, fmt.Errorf("pool: MinIdle (%d) can't be larger than MaxOpen (%d)", cfg.MinIdle, cfg.MaxOpen)
+	}
+
+	if cfg.MaintainInterval == 0 {
+		cfg.MaintainInterval = time.Second
+	}
+
+	p := &Pool[T]{
+		cfg:  cfg,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go p.maintain()
+
+	return p, nil
+}
+
+// Acquire hands out an idle resource, opens a new one if we're below MaxOpen, or waits in line until one is released or ctx is done
+func (p *Pool[T]) Acquire(ctx context.Context) (*Resource[T], error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrClosed
+		}
+
+		if n := len(p.idle); n > 0 {
+			e := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.mu.Unlock()
+
+			if !p.healthy(ctx, e) {
+				continue // Unhealthy one has been closed, try the next
+			}
+
+			p.mu.Lock()
+			p.stats.Acquired++
+			p.mu.Unlock()
+			return &Resource[T]{pool: p, entry: e}, nil
+		}
+
+		if p.cfg.MaxOpen == 0 || p.open < p.cfg.MaxOpen {
+			p.open++ // Reserve the slot before unlocking, otherwise concurrent acquires overshoot MaxOpen
+			p.mu.Unlock()
+			return p.create(ctx)
+		}
+
+		// Pool is exhausted, get in line
+		w := &waiter[T]{ch: make(chan *entry[T], 1)}
+		p.waiters = append(p.waiters, w)
+		p.stats.WaitCount++
+		p.mu.Unlock()
+
+		start := time.Now()
+		select {
+		case e, ok := <-w.ch:
+			p.mu.Lock()
+			p.stats.WaitDuration += time.Since(start)
+			p.mu.Unlock()
+
+			if !ok {
+				return nil, ErrClosed
+			}
+
+			if e == nil { // Slot was handed to us, not a resource
+				return p.create(ctx)
+			}
+
+			if !p.healthy(ctx, e) {
+				continue
+			}
+
+			p.mu.Lock()
+			p.stats.Acquired++
+			p.mu.Unlock()
+			return &Resource[T]{pool: p, entry: e}, nil
+
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.stats.WaitDuration += time.Since(start)
+			p.stats.WaitTimeouts++
+			removed := p.removeWaiter(w)
+			p.mu.Unlock()
+
+			if !removed {
+				// We lost the race - something was already handed to us, pass it on so it isn't leaked
+				if e, ok := <-w.ch; e != nil {
+					p.release(e)
+				} else if ok {
+					p.releaseSlot()
+				}
+			}
+
+			return nil, fmt.Errorf("pool: acquire: %w", ctx.Err())
+		}
+	}
+}
+
+func (p *Pool[T]) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.stats
+	s.MaxOpen = p.cfg.MaxOpen
+	s.Open = p.open
+	s.Idle = len(p.idle)
+	s.InUse = p.open - len(p.idle)
+	s.Waiting = len(p.waiters)
+	return s
+}
+
+// Close closes all idle resources, and resources that are in use are closed when released
+func (p *Pool[T]) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
+	waiters := p.waiters
+	p.waiters = nil
+	p.mu.Unlock()
+
+	close(p.stop)
+	<-p.done
+
+	for _, w := range waiters {
+		close(w.ch) // Waiters see the closed chan and return ErrClosed
+	}
+
+	var errs []error
+	for _, e := range idle {
+		errs = append(errs, p.closeEntry(e))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *Pool[T]) create(ctx context.Context) (*Resource[T], error) {
+	value, err := p.cfg.New(ctx)
+	if err != nil {
+		p.releaseSlot()
+		return nil, fmt.Errorf("pool: failed creating resource: %w", err)
+	}
+
+	now := time.Now()
+	p.mu.Lock()
+	p.stats.Created++
+	p.stats.Acquired++
+	p.mu.Unlock()
+
+	return &Resource[T]{pool: p, entry: &entry[T]{value: value, createdAt: now, idleSince: now}}, nil
+}
+
+func (p *Pool[T]) healthy(ctx context.Context, e *entry[T]) bool {
+	now := time.Now()
+	if p.cfg.MaxLifetime > 0 && now.Sub(e.createdAt) > p.cfg.MaxLifetime {
+		p.discard(e, func(s *Stats) { s.LifetimeClosed++ })
+		return false
+	}
+
+	if p.cfg.IdleTimeout > 0 && now.Sub(e.idleSince) > p.cfg.IdleTimeout {
+		p.discard(e, func(s *Stats) { s.IdleClosed++ })
+		return false
+	}
+
+	if p.cfg.Check != nil {
+		if err := p.cfg.Check(ctx, e.value); err != nil {
+			p.discard(e, func(s *Stats) { s.HealthCheckFailed++ })
+			return false
+		}
+	}
+
+	return true
+}
+
+// release puts the resource back - straight into the hands of the first waiter if there is one
+func (p *Pool[T]) release(e *entry[T]) {
+	p.mu.Lock()
+	if p.closed {
+		p.open--
+		p.mu.Unlock()
+		p.closeEntry(e)
+		return
+	}
+
+	e.idleSince = time.Now()
+	if len(p.waiters) > 0 {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.mu.Unlock()
+		w.ch <- e
+		return
+	}
+
+	p.idle = append(p.idle, e)
+	p.mu.Unlock()
+}
+
+// discard closes the resource and frees its slot for the next waiter
+func (p *Pool[T]) discard(e *entry[T], count func(s *Stats)) {
+	p.closeEntry(e)
+
+	p.mu.Lock()
+	count(&p.stats)
+	p.mu.Unlock()
+
+	p.releaseSlot()
+}
+
+// releaseSlot gives up a reserved slot - if someone is waiting, they get the slot instead of it being freed
+func (p *Pool[T]) releaseSlot() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.waiters) > 0 && !p.closed {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		w.ch <- nil
+		return
+	}
+
+	p.open--
+}
+
+func (p *Pool[T]) closeEntry(e *entry[T]) error {
+	p.mu.Lock()
+	p.stats.Closed++
+	p.mu.Unlock()
+
+	if p.cfg.Close == nil {
+		return nil
+	}
+
+	return p.cfg.Close(e.value)
+}
+
+// Must be called with mu held
+func (p *Pool[T]) removeWaiter(w *waiter[T]) bool {
+	for i, other := range p.waiters {
+		if other == w {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Background loop closing expired idle resources and keeping MinIdle warm, like database/sql's connectionCleaner
+func (p *Pool[T]) maintain() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.cfg.MaintainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.pruneIdle()
+			p.fillIdle()
+		}
+	}
+}
+
+func (p *Pool[T]) pruneIdle() {
+	now := time.Now()
+
+	p.mu.Lock()
+	var keep, expired []*entry[T]
+	for _, e := range p.idle {
+		lifetimeDone := p.cfg.MaxLifetime > 0 && now.Sub(e.createdAt) > p.cfg.MaxLifetime
+		idleDone := p.cfg.IdleTimeout > 0 && now.Sub(e.idleSince) > p.cfg.IdleTimeout
+		if lifetimeDone || idleDone {
+			expired = append(expired, e)
+			continue
+		}
+		keep = append(keep, e)
+	}
+	p.idle = keep
+	p.open -= len(expired)
+	p.stats.IdleClosed += len(expired)
+	p.mu.Unlock()
+
+	for _, e := range expired {
+		p.closeEntry(e)
+	}
+}
+
+func (p *Pool[T]) fillIdle() {
+	for {
+		p.mu.Lock()
+		full := p.cfg.MaxOpen > 0 && p.open >= p.cfg.MaxOpen
+		if p.closed || len(p.idle) >= p.cfg.MinIdle || full {
+			p.mu.Unlock()
+			return
+		}
+		p.open++
+		p.mu.Unlock()
+
+		value, err := p.cfg.New(context.Background())
+		if err != nil {
+			p.releaseSlot()
+			return
+		}
+
+		now := time.Now()
+		p.mu.Lock()
+		p.stats.Created++
+		p.mu.Unlock()
+		p.release(&entry[T]{value: value, createdAt: now, idleSince: now})
+	}
+}
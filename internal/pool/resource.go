@@ -0,0 +1,35 @@
+package pool
+
+import "time"
+
+// Resource is a borrowed value, it must be given back with Release, or Discard if it turned out to be broken
+type Resource[T any] struct {
+	pool     *Pool[T]
+	entry    *entry[T]
+	returned bool
+}
+
+func (r *Resource[T]) Value() T {
+	return r.entry.value
+}
+
+func (r *Resource[T]) CreatedAt() time.Time {
+	return r.entry.createdAt
+}
+
+// Release is safe to call more than once, so it can be deferred even when Discard is called on an error path
+func (r *Resource[T]) Release() {
+	if r.returned {
+		return
+	}
+	r.returned = true
+	r.pool.release(r.entry)
+}
+
+func (r *Resource[T]) Discard() {
+	if r.returned {
+		return
+	}
+	r.returned = true
+	r.pool.discard(r.entry, func(s *Stats) { s.Discarded++ })
+}
@@ -0,0 +1,35 @@
+package pool
+
+import (
+	"fmt"
+	"time"
+)
+
+// Mirrors sql.DBStats where it makes sense, so the two are easy to compare side by side
+type Stats struct {
+	MaxOpen int
+	Open    int
+	Idle    int
+	InUse   int
+	Waiting int
+
+	Acquired     int
+	Created      int
+	Closed       int
+	WaitCount    int
+	WaitDuration time.Duration
+	WaitTimeouts int
+
+	LifetimeClosed    int
+	IdleClosed        int
+	HealthCheckFailed int
+	Discarded         int
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf(
+		"open=%d/%d idle=%d in_use=%d waiting=%d acquired=%d created=%d closed=%d waits=%d wait_duration=%v timeouts=%d lifetime_closed=%d idle_closed=%d health_failed=%d discarded=%d",
+		s.Open, s.MaxOpen, s.Idle, s.InUse, s.Waiting, s.Acquired, s.Created, s.Closed, s.WaitCount, s.WaitDuration, s.WaitTimeouts,
+		s.LifetimeClosed, s.IdleClosed, s.HealthCheckFailed, s.Discarded,
+	)
+}
@@ -1,10 +1,12 @@
 package query_profiling
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"andreashoj/deeper-learnings/internal/db"
+	"andreashoj/deeper-learnings/internal/outbox"
 )
 
 type Post struct {
@@ -155,6 +157,7 @@ func GetPostsAndUsersWithoutNPlus() ([]Post, []User, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed getting posts: %w", err)
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		post := Post{}
@@ -199,6 +202,7 @@ func GetPosts() ([]Post, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed getting posts: %w", err)
 	}
+	defer rows.Close()
 
 	posts := []Post{}
 	for rows.Next() {
@@ -233,6 +237,32 @@ func CreatePost(name string, userID int) (*Post, error) {
 	return post, nil
 }
 
+// Same as CreatePost, but the post.created event is written to the outbox in the same transaction.
+// If the process dies right after the commit the event is still there, the relay publishes it whenever it gets to it
+func CreatePostWithOutbox(ctx context.Context, name string, userID int) (*Post, error) {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	post := &Post{Name: name, UserID: userID}
+	err = tx.QueryRowContext(ctx, "INSERT INTO posts (name, user_id) VALUES ($1, $2) RETURNING id", name, userID).Scan(&post.Id)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating post: %w", err)
+	}
+
+	if err = outbox.Add(ctx, tx, "post.created", fmt.Sprintf("post:%d", post.Id), post); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed committing post: %w", err)
+	}
+
+	return post, nil
+}
+
 func GetUser(id int) (*User, error) {
 	user := User{Id: id}
 	err := db.DB.QueryRow("SELECT name FROM users WHERE id = $1", user.Id).Scan(&user.Name)
@@ -244,10 +274,11 @@ func GetUser(id int) (*User, error) {
 }
 
 func GetUsers() ([]User, error) {
-	rows, err := db.DB.Query("SELECT name FROM users")
+	rows, err := db.DB.Query("SELECT id, name FROM users")
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	var users []User
 	for rows.Next() {
@@ -262,15 +293,35 @@ func GetUsers() ([]User, error) {
 	return users, nil
 }
 
+func GetUserIDs() ([]int, error) {
+	rows, err := db.DB.Query("SELECT id FROM users")
+	if err != nil {
+		return nil, fmt.Errorf("failed getting user ids: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed mapping user id: %w", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
 func explainQuery(query string) {
 	rows, err := db.DB.Query("EXPLAIN ANALYZE " + query)
 	if err != nil {
-		fmt.Print("failed analyzing query: %s", err)
+		fmt.Printf("failed analyzing query: %s", err)
 		return
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		defer rows.Close()
 		var plan string
 		if err = rows.Scan(&plan); err != nil {
 			fmt.Printf("failed getting query plan: %s", err)
@@ -0,0 +1,91 @@
+package redis_server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RESP2, the wire format go-redis speaks when the server says no to HELLO 3.
+// Clients send commands as arrays of bulk strings: *2\r\n$3\r\nGET\r\n$3\r\nkey\r\n. redis-cli and telnet can also send
+// plain "inline" lines, so those are accepted too
+
+var errProtocol = errors.New("protocol error")
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%w: bad array length %q", errProtocol, line)
+	}
+
+	args := make([]string, 0, n)
+	for range n {
+		header, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if header == "" || header[0] != '$' {
+			return nil, fmt.Errorf("%w: expected bulk string, got %q", errProtocol, header)
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("%w: bad bulk length %q", errProtocol, header)
+		}
+
+		buf := make([]byte, size+2) // The payload and its \r\n
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func appendSimple(b []byte, s string) []byte {
+	return append(append(append(b, '+'), s...), "\r\n"...)
+}
+
+func appendError(b []byte, s string) []byte {
+	return append(append(append(b, '-'), s...), "\r\n"...)
+}
+
+func appendInt(b []byte, n int64) []byte {
+	return append(strconv.AppendInt(append(b, ':'), n, 10), "\r\n"...)
+}
+
+func appendBulk(b []byte, s string) []byte {
+	b = strconv.AppendInt(append(b, '$'), int64(len(s)), 10)
+	return append(append(append(b, "\r\n"...), s...), "\r\n"...)
+}
+
+func appendNil(b []byte) []byte {
+	return append(b, "$-1\r\n"...)
+}
+
+func appendArrayHeader(b []byte, n int) []byte {
+	return append(strconv.AppendInt(append(b, '*'), int64(n), 10), "\r\n"...)
+}
@@ -0,0 +1,516 @@
+package redis_server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A tiny redis that runs inside the process, so the caching experiments don't need the docker compose redis.
+// It only knows the commands this project uses: PING, GET, SET (EX/PX/NX/XX), SETNX, INCR, DEL, EXISTS, TTL, PTTL, EXPIRE, FLUSHALL
+// and PUBLISH/SUBSCRIBE/UNSUBSCRIBE - one keyspace, no persistence, expired keys are dropped when they're touched
+// and by a sweep every 100ms
+
+type Server struct {
+	ln net.Listener
+
+	mu   sync.Mutex
+	data map[string]item
+	subs map[string]map[*conn]bool // channel -> subscribers
+
+	conns  map[*conn]bool
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+type item struct {
+	value   string
+	expires time.Time // Zero means no expiry
+}
+
+func (i item) expired(now time.Time) bool {
+	return !i.expires.IsZero() && !now.Before(i.expires)
+}
+
+type conn struct {
+	net.Conn
+
+	writeMu  sync.Mutex // PUBLISH from another connection writes to this one too
+	channels map[string]bool
+}
+
+func (c *conn) write(b []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+// Start listens on addr, "127.0.0.1:0" picks a free port - Addr tells which
+func Start(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed listening on %s: %w", addr, err)
+	}
+
+	s := &Server{
+		ln:     ln,
+		data:   make(map[string]item),
+		subs:   make(map[string]map[*conn]bool),
+		conns:  make(map[*conn]bool),
+		closed: make(chan struct{}),
+	}
+	s.wg.Go(s.accept)
+	s.wg.Go(s.sweep)
+
+	return s, nil
+}
+
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	close(s.closed)
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return // Closed
+		}
+
+		c := &conn{Conn: nc, channels: make(map[string]bool)}
+		s.mu.Lock()
+		select {
+		case <-s.closed: // Accepted while Close was closing the others
+			s.mu.Unlock()
+			nc.Close()
+			return
+		default:
+		}
+		s.conns[c] = true
+		s.mu.Unlock()
+
+		s.wg.Go(func() { s.serve(c) })
+	}
+}
+
+func (s *Server) sweep() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, it := range s.data {
+				if it.expired(now) {
+					delete(s.data, key)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Server) serve(c *conn) {
+	defer func() {
+		s.mu.Lock()
+		for channel := range c.channels {
+			s.unsubscribeLocked(c, channel)
+		}
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				c.write(appendError(nil, "ERR "+err.Error()))
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		reply, quit := s.exec(c, args)
+		if err = c.write(reply); err != nil || quit {
+			return
+		}
+	}
+}
+
+func (s *Server) exec(c *conn, args []string) ([]byte, bool) {
+	cmd := strings.ToUpper(args[0])
+
+	if len(c.channels) > 0 {
+		switch cmd {
+		case "SUBSCRIBE", "UNSUBSCRIBE", "PING", "QUIT":
+		default:
+			return appendError(nil, fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(cmd))), false
+		}
+	}
+
+	switch cmd {
+	case "PING":
+		if len(c.channels) > 0 { // Subscribed connections answer PING with a push, go-redis uses it as a health check
+			msg := ""
+			if len(args) > 1 {
+				msg = args[1]
+			}
+			return appendBulk(appendBulk(appendArrayHeader(nil, 2), "pong"), msg), false
+		}
+		if len(args) > 1 {
+			return appendBulk(nil, args[1]), false
+		}
+		return appendSimple(nil, "PONG"), false
+	case "QUIT":
+		return appendSimple(nil, "OK"), true
+	case "SELECT":
+		if len(args) != 2 || args[1] != "0" {
+			return appendError(nil, "ERR DB index is out of range"), false
+		}
+		return appendSimple(nil, "OK"), false
+	case "CLIENT":
+		return appendSimple(nil, "OK"), false // SETNAME, SETINFO... nothing to remember
+	case "GET":
+		return s.get(args), false
+	case "SET":
+		return s.set(args), false
+	case "SETNX": // What go-redis sends for SetNX without an expiry
+		if len(args) != 3 {
+			return wrongArgs(args[0]), false
+		}
+		if reply := s.set([]string{"SET", args[1], args[2], "NX"}); reply[0] == '$' {
+			return appendInt(nil, 0), false
+		}
+		return appendInt(nil, 1), false
+	case "INCR":
+		return s.incr(args), false
+	case "DEL":
+		return s.del(args), false
+	case "EXISTS":
+		return s.exists(args), false
+	case "TTL", "PTTL":
+		return s.ttl(args, cmd == "PTTL"), false
+	case "EXPIRE":
+		return s.expire(args), false
+	case "FLUSHALL", "FLUSHDB":
+		s.mu.Lock()
+		s.data = make(map[string]item)
+		s.mu.Unlock()
+		return appendSimple(nil, "OK"), false
+	case "PUBLISH":
+		return s.publish(args), false
+	case "SUBSCRIBE":
+		return s.subscribe(c, args), false
+	case "UNSUBSCRIBE":
+		return s.unsubscribe(c, args), false
+	default:
+		// HELLO lands here too, which is what makes go-redis fall back to RESP2
+		return appendError(nil, fmt.Sprintf("ERR unknown command '%s'", args[0])), false
+	}
+}
+
+func wrongArgs(cmd string) []byte {
+	return appendError(nil, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
+
+// Returns the live item, dropping it if it expired. s.mu must be held
+func (s *Server) lookupLocked(key string) (item, bool) {
+	it, ok := s.data[key]
+	if ok && it.expired(time.Now()) {
+		delete(s.data, key)
+		return item{}, false
+	}
+
+	return it, ok
+}
+
+func (s *Server) get(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs(args[0])
+	}
+
+	s.mu.Lock()
+	it, ok := s.lookupLocked(args[1])
+	s.mu.Unlock()
+	if !ok {
+		return appendNil(nil)
+	}
+
+	return appendBulk(nil, it.value)
+}
+
+// SET key value [EX seconds | PX milliseconds] [NX | XX]
+func (s *Server) set(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs(args[0])
+	}
+
+	var ttl time.Duration
+	nx, xx := false, false
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "EX", "PX":
+			if i+1 >= len(args) || ttl != 0 {
+				return appendError(nil, "ERR syntax error")
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return appendError(nil, "ERR invalid expire time in 'set' command")
+			}
+			unit := time.Second
+			if strings.EqualFold(args[i], "PX") {
+				unit = time.Millisecond
+			}
+			ttl = time.Duration(n) * unit
+			i++
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			return appendError(nil, "ERR syntax error")
+		}
+	}
+	if nx && xx {
+		return appendError(nil, "ERR syntax error")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.lookupLocked(args[1])
+	if (nx && exists) || (xx && !exists) {
+		return appendNil(nil)
+	}
+
+	it := item{value: args[2]}
+	if ttl > 0 {
+		it.expires = time.Now().Add(ttl)
+	}
+	s.data[args[1]] = it
+
+	return appendSimple(nil, "OK")
+}
+
+func (s *Server) del(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs(args[0])
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for _, key := range args[1:] {
+		if _, ok := s.lookupLocked(key); ok {
+			delete(s.data, key)
+			deleted++
+		}
+	}
+
+	return appendInt(nil, int64(deleted))
+}
+
+func (s *Server) exists(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs(args[0])
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := 0
+	for _, key := range args[1:] {
+		if _, ok := s.lookupLocked(key); ok {
+			found++
+		}
+	}
+
+	return appendInt(nil, int64(found))
+}
+
+// -2 when the key doesn't exist, -1 when it never expires
+func (s *Server) ttl(args []string, millis bool) []byte {
+	if len(args) != 2 {
+		return wrongArgs(args[0])
+	}
+
+	s.mu.Lock()
+	it, ok := s.lookupLocked(args[1])
+	s.mu.Unlock()
+
+	switch {
+	case !ok:
+		return appendInt(nil, -2)
+	case it.expires.IsZero():
+		return appendInt(nil, -1)
+	}
+
+	left := time.Until(it.expires)
+	if millis {
+		return appendInt(nil, left.Milliseconds())
+	}
+	return appendInt(nil, int64((left+time.Second-1)/time.Second)) // Rounded up like redis, 1500ms left is 2
+}
+
+// INCR key, a missing key counts as 0 and the expiry is kept
+func (s *Server) incr(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs(args[0])
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it, _ := s.lookupLocked(args[1])
+	n := int64(0)
+	if it.value != "" {
+		var err error
+		if n, err = strconv.ParseInt(it.value, 10, 64); err != nil {
+			return appendError(nil, "ERR value is not an integer or out of range")
+		}
+	}
+	n++
+	it.value = strconv.FormatInt(n, 10)
+	s.data[args[1]] = it
+
+	return appendInt(nil, n)
+}
+
+func (s *Server) expire(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs(args[0])
+	}
+	seconds, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return appendError(nil, "ERR value is not an integer or out of range")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it, ok := s.lookupLocked(args[1])
+	if !ok {
+		return appendInt(nil, 0)
+	}
+	if seconds <= 0 {
+		delete(s.data, args[1])
+		return appendInt(nil, 1)
+	}
+	it.expires = time.Now().Add(time.Duration(seconds) * time.Second)
+	s.data[args[1]] = it
+
+	return appendInt(nil, 1)
+}
+
+func (s *Server) publish(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs(args[0])
+	}
+
+	s.mu.Lock()
+	receivers := make([]*conn, 0, len(s.subs[args[1]]))
+	for c := range s.subs[args[1]] {
+		receivers = append(receivers, c)
+	}
+	s.mu.Unlock()
+
+	msg := appendArrayHeader(nil, 3)
+	msg = appendBulk(msg, "message")
+	msg = appendBulk(msg, args[1])
+	msg = appendBulk(msg, args[2])
+	for _, c := range receivers {
+		c.write(msg)
+	}
+
+	return appendInt(nil, int64(len(receivers)))
+}
+
+// Every channel gets its own confirmation, all of them in one reply
+func (s *Server) subscribe(c *conn, args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs(args[0])
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reply []byte
+	for _, channel := range args[1:] {
+		if s.subs[channel] == nil {
+			s.subs[channel] = make(map[*conn]bool)
+		}
+		s.subs[channel][c] = true
+		c.channels[channel] = true
+
+		reply = appendArrayHeader(reply, 3)
+		reply = appendBulk(reply, "subscribe")
+		reply = appendBulk(reply, channel)
+		reply = appendInt(reply, int64(len(c.channels)))
+	}
+
+	return reply
+}
+
+func (s *Server) unsubscribe(c *conn, args []string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := args[1:]
+	if len(channels) == 0 {
+		for channel := range c.channels {
+			channels = append(channels, channel)
+		}
+	}
+
+	var reply []byte
+	for _, channel := range channels {
+		s.unsubscribeLocked(c, channel)
+		reply = appendArrayHeader(reply, 3)
+		reply = appendBulk(reply, "unsubscribe")
+		reply = appendBulk(reply, channel)
+		reply = appendInt(reply, int64(len(c.channels)))
+	}
+	if len(channels) == 0 { // Not subscribed to anything, redis still answers
+		reply = appendArrayHeader(reply, 3)
+		reply = appendBulk(reply, "unsubscribe")
+		reply = appendNil(reply)
+		reply = appendInt(reply, 0)
+	}
+
+	return reply
+}
+
+func (s *Server) unsubscribeLocked(c *conn, channel string) {
+	delete(c.channels, channel)
+	delete(s.subs[channel], c)
+	if len(s.subs[channel]) == 0 {
+		delete(s.subs, channel)
+	}
+}
@@ -0,0 +1,152 @@
+package redis_server_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	redis_server "andreashoj/deeper-learnings/internal/redis-server"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Drives the server with go-redis, the client the caching experiments use, so the tests break where the experiments would
+
+func startServer(t *testing.T) *redis.Client {
+	t.Helper()
+
+	server, err := redis_server.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed starting server: %s", err)
+	}
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client
+}
+
+func TestSetGet(t *testing.T) {
+	client := startServer(t)
+	ctx := context.Background()
+
+	if err := client.Set(ctx, "k", "v", 0).Err(); err != nil {
+		t.Fatalf("failed setting: %s", err)
+	}
+	if got, err := client.Get(ctx, "k").Result(); err != nil || got != "v" {
+		t.Fatalf("want v, got %q (%v)", got, err)
+	}
+	if err := client.Get(ctx, "missing").Err(); !errors.Is(err, redis.Nil) {
+		t.Fatalf("want redis.Nil for a missing key, got %v", err)
+	}
+}
+
+func TestSetExpiry(t *testing.T) {
+	client := startServer(t)
+	ctx := context.Background()
+
+	client.Set(ctx, "ex", "v", 10*time.Second) // go-redis sends EX for whole seconds
+	client.Set(ctx, "px", "v", 50*time.Millisecond)
+	client.Set(ctx, "forever", "v", 0)
+
+	if ttl := client.TTL(ctx, "ex").Val(); ttl <= 9*time.Second || ttl > 10*time.Second {
+		t.Fatalf("want a TTL of about 10s, got %v", ttl)
+	}
+	if pttl := client.PTTL(ctx, "px").Val(); pttl <= 0 || pttl > 50*time.Millisecond {
+		t.Fatalf("want a PTTL of at most 50ms, got %v", pttl)
+	}
+	if ttl := client.TTL(ctx, "forever").Val(); ttl != -1 {
+		t.Fatalf("want -1 for a key without expiry, got %v", ttl)
+	}
+	if ttl := client.TTL(ctx, "missing").Val(); ttl != -2 {
+		t.Fatalf("want -2 for a missing key, got %v", ttl)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	if err := client.Get(ctx, "px").Err(); !errors.Is(err, redis.Nil) {
+		t.Fatalf("want px expired, got %v", err)
+	}
+}
+
+func TestSetNXAndXX(t *testing.T) {
+	client := startServer(t)
+	ctx := context.Background()
+
+	if ok := client.SetNX(ctx, "nx", "first", 0).Val(); !ok {
+		t.Fatalf("SETNX on a missing key should set it")
+	}
+	if ok := client.SetNX(ctx, "nx", "second", time.Minute).Val(); ok {
+		t.Fatalf("SET NX on an existing key should not set it")
+	}
+	if got := client.Get(ctx, "nx").Val(); got != "first" {
+		t.Fatalf("want first, got %q", got)
+	}
+
+	if ok := client.SetXX(ctx, "xx", "v", 0).Val(); ok {
+		t.Fatalf("SET XX on a missing key should not set it")
+	}
+	if ok := client.SetXX(ctx, "nx", "replaced", 0).Val(); !ok {
+		t.Fatalf("SET XX on an existing key should set it")
+	}
+	if got := client.Get(ctx, "nx").Val(); got != "replaced" {
+		t.Fatalf("want replaced, got %q", got)
+	}
+}
+
+func TestExpireAndDel(t *testing.T) {
+	client := startServer(t)
+	ctx := context.Background()
+
+	client.Set(ctx, "a", "1", 0)
+	client.Set(ctx, "b", "2", 0)
+
+	if ok := client.Expire(ctx, "a", 5*time.Second).Val(); !ok {
+		t.Fatalf("EXPIRE on an existing key should return true")
+	}
+	if ttl := client.TTL(ctx, "a").Val(); ttl <= 4*time.Second || ttl > 5*time.Second {
+		t.Fatalf("want a TTL of about 5s after EXPIRE, got %v", ttl)
+	}
+	if ok := client.Expire(ctx, "missing", time.Second).Val(); ok {
+		t.Fatalf("EXPIRE on a missing key should return false")
+	}
+
+	if n := client.Exists(ctx, "a", "b", "missing").Val(); n != 2 {
+		t.Fatalf("want 2 existing keys, got %d", n)
+	}
+	if n := client.Del(ctx, "a", "b", "missing").Val(); n != 2 {
+		t.Fatalf("want 2 deleted keys, got %d", n)
+	}
+	if n := client.Exists(ctx, "a", "b").Val(); n != 0 {
+		t.Fatalf("want no keys left, got %d", n)
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	client := startServer(t)
+	ctx := context.Background()
+
+	sub := client.Subscribe(ctx, "invalidations")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil { // The subscribe confirmation
+		t.Fatalf("failed subscribing: %s", err)
+	}
+
+	if n := client.Publish(ctx, "invalidations", "users:1").Val(); n != 1 {
+		t.Fatalf("want 1 receiver, got %d", n)
+	}
+	if n := client.Publish(ctx, "nobody-listens", "x").Val(); n != 0 {
+		t.Fatalf("want 0 receivers, got %d", n)
+	}
+
+	select {
+	case msg := <-sub.Channel():
+		if msg.Channel != "invalidations" || msg.Payload != "users:1" {
+			t.Fatalf("got %s on %s", msg.Payload, msg.Channel)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no message within a second")
+	}
+}
@@ -0,0 +1,71 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const CookieName = "session"
+
+type contextKey struct{}
+
+// FromContext is the session Require let through
+func FromContext(ctx context.Context) (Session, bool) {
+	s, ok := ctx.Value(contextKey{}).(Session)
+	return s, ok
+}
+
+// Token is the bearer token, or the session cookie when there's no Authorization header
+func Token(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if c, err := r.Cookie(CookieName); err == nil {
+		return c.Value
+	}
+
+	return ""
+}
+
+// SetCookie hands the token to a browser, the API clients use the token from the response body
+func (m *Manager) SetCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{Name: CookieName, Value: token, Path: "/", MaxAge: int(m.ttl.Seconds()), HttpOnly: true, SameSite: http.SameSiteLaxMode})
+}
+
+// Require lets a request through when its session is live and the user has the permission at their current generation:
+// 401 without a usable session, revoked ones included, 403 with one that lacks the permission.
+// When redis or the database fails we say 503, never fall back to letting the request in
+func (m *Manager) Require(permission int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s, err := m.Verify(r.Context(), Token(r))
+			if errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrRevoked) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				fmt.Printf("failed verifying session: %s\n", err)
+				http.Error(w, "failed verifying session", http.StatusServiceUnavailable)
+				return
+			}
+
+			permissions, err := m.Permissions(r.Context(), s)
+			if err != nil {
+				fmt.Printf("failed getting permissions: %s\n", err)
+				http.Error(w, "failed getting permissions", http.StatusServiceUnavailable)
+				return
+			}
+			if !slices.Contains(permissions, permission) {
+				http.Error(w, fmt.Sprintf("missing permission %d", permission), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, s)))
+		})
+	}
+}
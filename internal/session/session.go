@@ -0,0 +1,188 @@
+package session
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Login hands out a signed token naming a session in redis. Every user has a generation, a counter bumped whenever their
+// permissions change, and the session remembers the generation it was created at. A session behind its user's generation is revoked,
+// so one INCR logs the user out everywhere - no list of their sessions to find and delete.
+// Permissions are cached per user and generation: a bump makes the old set unreachable instead of having to delete it,
+// and a slow read that loaded the old set can only ever store it under the old generation, never the new one.
+// The one rule for writers: bump after the permissions are committed, not before
+
+var (
+	ErrInvalidToken = errors.New("invalid session token")
+	ErrRevoked      = errors.New("session revoked or expired") // Redis expiring the session and a revocation look the same to us
+)
+
+const (
+	keySession     = "sessions:%s"
+	keyGeneration  = "users:%d:gen"
+	keyPermissions = "users:%d:permissions:%d" // User id, generation
+)
+
+// Loads the user's permissions from the source of truth
+type PermissionLoader func(ctx context.Context, userID int) ([]int, error)
+
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	Generation int64     `json:"generation"`
+	Expires    time.Time `json:"expires"`
+}
+
+type Manager struct {
+	redis  *redis.Client
+	secret []byte
+	ttl    time.Duration // Of sessions and of cached permissions
+	load   PermissionLoader
+}
+
+func New(client *redis.Client, secret []byte, ttl time.Duration, load PermissionLoader) *Manager {
+	return &Manager{redis: client, secret: secret, ttl: ttl, load: load}
+}
+
+// The token is the session id and an HMAC of it, a forged or mangled token is turned away before redis is asked
+func (m *Manager) sign(id string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(id))
+
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (m *Manager) verify(token string) (string, error) {
+	id, _, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(m.sign(id)), []byte(token)) {
+		return "", ErrInvalidToken
+	}
+
+	return id, nil
+}
+
+// Issue creates a session for the user at their current generation
+func (m *Manager) Issue(ctx context.Context, userID int) (string, Session, error) {
+	gen, err := m.Generation(ctx, userID)
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	s := Session{ID: hex.EncodeToString(id), UserID: userID, Generation: gen, Expires: time.Now().Add(m.ttl)}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", Session{}, fmt.Errorf("failed encoding session: %w", err)
+	}
+	if err = m.redis.Set(ctx, fmt.Sprintf(keySession, s.ID), data, m.ttl).Err(); err != nil {
+		return "", Session{}, fmt.Errorf("failed storing session: %w", err)
+	}
+
+	return m.sign(s.ID), s, nil
+}
+
+// Verify returns the session behind the token, ErrInvalidToken or ErrRevoked when there is none to use
+func (m *Manager) Verify(ctx context.Context, token string) (Session, error) {
+	id, err := m.verify(token)
+	if err != nil {
+		return Session{}, err
+	}
+
+	data, err := m.redis.Get(ctx, fmt.Sprintf(keySession, id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Session{}, ErrRevoked
+	}
+	if err != nil {
+		return Session{}, fmt.Errorf("failed getting session: %w", err)
+	}
+
+	var s Session
+	if err = json.Unmarshal(data, &s); err != nil {
+		return Session{}, fmt.Errorf("failed decoding session: %w", err)
+	}
+
+	gen, err := m.Generation(ctx, s.UserID)
+	if err != nil {
+		return Session{}, err
+	}
+	if s.Generation < gen {
+		m.redis.Del(ctx, fmt.Sprintf(keySession, id)) // Revoked for good, no need to compare generations next time
+		return Session{}, ErrRevoked
+	}
+
+	return s, nil
+}
+
+// Logout deletes the one session behind the token
+func (m *Manager) Logout(ctx context.Context, token string) error {
+	id, err := m.verify(token)
+	if err != nil {
+		return err
+	}
+	if err = m.redis.Del(ctx, fmt.Sprintf(keySession, id)).Err(); err != nil {
+		return fmt.Errorf("failed deleting session: %w", err)
+	}
+
+	return nil
+}
+
+// Generation is the user's current generation, 0 until their permissions change for the first time
+func (m *Manager) Generation(ctx context.Context, userID int) (int64, error) {
+	gen, err := m.redis.Get(ctx, fmt.Sprintf(keyGeneration, userID)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed getting generation of user %d: %w", userID, err)
+	}
+
+	return gen, nil
+}
+
+// Revoke bumps the user's generation: every session they have is revoked and their cached permissions are never read again.
+// Call it after the change to their permissions is committed
+func (m *Manager) Revoke(ctx context.Context, userID int) (int64, error) {
+	gen, err := m.redis.Incr(ctx, fmt.Sprintf(keyGeneration, userID)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed bumping generation of user %d: %w", userID, err)
+	}
+
+	return gen, nil
+}
+
+// Permissions of the session's user at the session's generation, read through the cache
+func (m *Manager) Permissions(ctx context.Context, s Session) ([]int, error) {
+	key := fmt.Sprintf(keyPermissions, s.UserID, s.Generation)
+	data, err := m.redis.Get(ctx, key).Bytes()
+	if err == nil {
+		var permissions []int
+		if err = json.Unmarshal(data, &permissions); err == nil {
+			return permissions, nil
+		}
+	}
+	if err != nil && !errors.Is(err, redis.Nil) {
+		fmt.Printf("failed reading cached permissions of user %d, loading them: %s\n", s.UserID, err)
+	}
+
+	permissions, err := m.load(ctx, s.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading permissions of user %d: %w", s.UserID, err)
+	}
+	if data, err = json.Marshal(permissions); err == nil {
+		m.redis.Set(ctx, key, data, m.ttl)
+	}
+
+	return permissions, nil
+}
@@ -0,0 +1,250 @@
+package stale_cache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	near_cache "andreashoj/deeper-learnings/internal/near-cache"
+)
+
+// Every value has two ages that matter. Until the soft TTL it's fresh and served as is. Between the soft and the hard TTL
+// it's stale: served straight away while one background load replaces it, so nobody waits on the database and
+// an expiring key never turns into a stampede. Past the hard TTL the caller waits for the load - but if that load fails
+// and the value is younger than hard TTL + StaleIfError, the old value beats an error page (RFC 5861 for HTTP caches).
+// Concurrent loads of the same key are collapsed into one, and after a failed load the key isn't loaded again for RetryBackoff -
+// a database that's down gets one load per key per backoff, not one per request
+
+type Freshness string
+
+const (
+	Fresh        Freshness = "fresh"
+	Stale        Freshness = "stale"          // Served while a background load revalidates it
+	StaleIfError Freshness = "stale-if-error" // Served because loading a newer one failed
+	Miss         Freshness = "miss"           // Loaded for this request
+)
+
+type Loader func(ctx context.Context, key string) ([]byte, error)
+
+type Config struct {
+	SoftTTL      time.Duration
+	HardTTL      time.Duration
+	StaleIfError time.Duration // How long past the hard TTL a value may still cover for a failing loader
+	LoadTimeout  time.Duration // For background loads, which don't have a request context to inherit
+	RetryBackoff time.Duration // After a failed load, how long before the next one. 0 means a second
+}
+
+func DefaultConfig() Config {
+	return Config{SoftTTL: time.Minute, HardTTL: 5 * time.Minute, StaleIfError: time.Hour, LoadTimeout: 10 * time.Second, RetryBackoff: 5 * time.Second}
+}
+
+type Result struct {
+	Value     []byte
+	Freshness Freshness
+	Age       time.Duration
+	LoadErr   error // Why a stale-if-error value was served
+}
+
+type Stats struct {
+	Fresh, Stale, StaleIfError, Misses, Loads, LoadErrors int64
+	BackedOff                                             int64 // Requests that didn't start a load because the last one failed too recently
+}
+
+type Cache struct {
+	store near_cache.L2
+	cfg   Config
+	load  Loader
+
+	mu       sync.Mutex
+	inflight map[string]*call
+	failing  map[string]failure // Keys whose last load failed
+
+	fresh, stale, staleIfError, misses, loads, loadErrors, backedOff atomic.Int64
+}
+
+type failure struct {
+	err error
+	at  time.Time
+}
+
+type call struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+func New(store near_cache.L2, cfg Config, load Loader) *Cache {
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = time.Second
+	}
+
+	return &Cache{store: store, cfg: cfg, load: load, inflight: make(map[string]*call), failing: make(map[string]failure)}
+}
+
+// Stored as written-at in unix ms, then the value. The store's own TTL is the hard TTL plus the stale-if-error window
+type entry struct {
+	written time.Time
+	value   []byte
+}
+
+func encode(value []byte, written time.Time) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(written.UnixMilli())), value...)
+}
+
+func decode(data []byte) (entry, error) {
+	if len(data) < 8 {
+		return entry{}, fmt.Errorf("stale cache entry of %d bytes is too short", len(data))
+	}
+
+	return entry{written: time.UnixMilli(int64(binary.BigEndian.Uint64(data))), value: data[8:]}, nil
+}
+
+func (c *Cache) Get(ctx context.Context, key string) (Result, error) {
+	data, err := c.store.Get(ctx, key)
+	if err != nil && !errors.Is(err, near_cache.ErrMiss) {
+		// The cache itself is down, the database is all we have
+		fmt.Printf("failed reading %s from the cache, loading it: %s\n", key, err)
+	}
+
+	var cached *entry
+	if err == nil {
+		if e, err := decode(data); err == nil {
+			cached = &e
+		}
+	}
+
+	if cached != nil {
+		age := time.Since(cached.written)
+		switch {
+		case age < c.cfg.SoftTTL:
+			c.fresh.Add(1)
+			return Result{Value: cached.value, Freshness: Fresh, Age: age}, nil
+		case age < c.cfg.HardTTL:
+			f, failed := c.lastFailure(key)
+			if failed && c.backingOff(f) {
+				c.backedOff.Add(1)
+			} else {
+				c.revalidate(key)
+			}
+			if failed {
+				c.staleIfError.Add(1)
+				return Result{Value: cached.value, Freshness: StaleIfError, Age: age, LoadErr: f.err}, nil
+			}
+			c.stale.Add(1)
+			return Result{Value: cached.value, Freshness: Stale, Age: age}, nil
+		}
+	}
+
+	if f, failed := c.lastFailure(key); failed && c.backingOff(f) {
+		c.backedOff.Add(1)
+		err = f.err // Same answer as a moment ago, without asking the database again
+	} else {
+		var value []byte
+		if value, err = c.loadOnce(ctx, key); err == nil {
+			c.misses.Add(1)
+			return Result{Value: value, Freshness: Miss}, nil
+		}
+	}
+	if cached != nil && time.Since(cached.written) < c.cfg.HardTTL+c.cfg.StaleIfError {
+		c.staleIfError.Add(1)
+		return Result{Value: cached.value, Freshness: StaleIfError, Age: time.Since(cached.written), LoadErr: err}, nil
+	}
+
+	return Result{}, err
+}
+
+func (c *Cache) lastFailure(key string) (failure, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.failing[key]
+	return f, ok
+}
+
+func (c *Cache) backingOff(f failure) bool {
+	return time.Since(f.at) < c.cfg.RetryBackoff
+}
+
+// Starts a background load unless one is already running for the key
+func (c *Cache) revalidate(key string) {
+	c.join(key)
+}
+
+// Every caller for the key while a load runs waits for that load instead of starting its own
+func (c *Cache) loadOnce(ctx context.Context, key string) ([]byte, error) {
+	cl := c.join(key)
+	select {
+	case <-cl.done:
+		return cl.value, cl.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// The running load for the key, or a new one. Loads run on their own context, a request that gives up
+// doesn't cancel the load everyone else is waiting for
+func (c *Cache) join(key string) *call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, ok := c.inflight[key]; ok {
+		return existing
+	}
+	cl := &call{done: make(chan struct{})}
+	c.inflight[key] = cl
+	go c.run(key, cl)
+
+	return cl
+}
+
+func (c *Cache) run(key string, cl *call) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.LoadTimeout)
+	defer cancel()
+
+	c.loads.Add(1)
+	cl.value, cl.err = c.load(ctx, key)
+	if cl.err == nil {
+		ttl := c.cfg.HardTTL + c.cfg.StaleIfError
+		if err := c.store.Set(ctx, key, encode(cl.value, time.Now()), ttl); err != nil {
+			fmt.Printf("failed storing %s: %s\n", key, err)
+		}
+	} else {
+		c.loadErrors.Add(1)
+	}
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if cl.err != nil {
+		c.failing[key] = failure{err: cl.err, at: time.Now()}
+	} else {
+		delete(c.failing, key)
+	}
+	c.mu.Unlock()
+	close(cl.done)
+}
+
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Fresh:        c.fresh.Load(),
+		Stale:        c.stale.Load(),
+		StaleIfError: c.staleIfError.Load(),
+		Misses:       c.misses.Load(),
+		Loads:        c.loads.Load(),
+		LoadErrors:   c.loadErrors.Load(),
+		BackedOff:    c.backedOff.Load(),
+	}
+}
+
+// SetHeaders tells the client how fresh the response is: X-Cache-Freshness and Age for us,
+// Cache-Control with the same windows for any HTTP cache in between
+func (c *Cache) SetHeaders(h http.Header, res Result) {
+	h.Set("X-Cache-Freshness", string(res.Freshness))
+	h.Set("Age", fmt.Sprint(int(res.Age.Seconds())))
+	h.Set("Cache-Control", fmt.Sprintf("max-age=%d, stale-while-revalidate=%d, stale-if-error=%d",
+		int(c.cfg.SoftTTL.Seconds()), int((c.cfg.HardTTL-c.cfg.SoftTTL).Seconds()), int(c.cfg.StaleIfError.Seconds())))
+}
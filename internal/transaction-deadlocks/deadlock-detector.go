@@ -0,0 +1,90 @@
+package transaction_deadlocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	lock_manager "andreashoj/deeper-learnings/internal/lock-manager"
+)
+
+// The transfers from this package replayed against the lock manager simulator instead of postgres. Same shape: lock one account,
+// do some work, lock the other. In the deadlock introducing order two transfers in opposite directions end up waiting on each other,
+// and this time we get to see the cycle, who was picked as victim and why. Ordered (safe) transfers should never produce a report
+func StartDeadlockDetectorDemo(policy lock_manager.Policy, safe bool) {
+	manager := lock_manager.New(lock_manager.Config{Policy: policy, DeadlockTimeout: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	transfer := func(from, to int) error {
+		t := manager.Begin(fmt.Sprintf("transfer %d->%d", from, to))
+		defer t.Release() // Commit or rollback, both let go of every lock
+
+		first, second := from, to
+		if safe {
+			first, second = min(from, to), max(from, to)
+		}
+
+		if err := t.Lock(ctx, fmt.Sprintf("accounts:%d", first), lock_manager.Exclusive); err != nil {
+			return err
+		}
+		t.AddWork(rand.Intn(3)) // Some transfers did more before getting stuck, that's what the least work policy looks at
+		time.Sleep(20 * time.Millisecond)
+
+		if err := t.Lock(ctx, fmt.Sprintf("accounts:%d", second), lock_manager.Exclusive); err != nil {
+			return err
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		return nil
+	}
+
+	transfers := 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded, victims := 0, 0
+	for range transfers {
+		wg.Go(func() {
+			from := rand.Intn(3) + 1
+			to := from%3 + 1
+			if rand.Intn(2) == 0 {
+				from, to = to, from
+			}
+
+			for range 5 { // A victim retries, just like it would after postgres' 40P01
+				err := transfer(from, to)
+				mu.Lock()
+				if errors.Is(err, lock_manager.ErrDeadlock) {
+					victims++
+					mu.Unlock()
+					time.Sleep(time.Duration(rand.Intn(50)) * time.Millisecond) // Retrying straight away walks right back into the same cycle
+					continue
+				}
+				if err == nil {
+					succeeded++
+				}
+				mu.Unlock()
+				return
+			}
+		})
+	}
+	wg.Wait()
+
+	reports := manager.Reports()
+	fmt.Printf("%d transfers succeeded, %d gave up, %d deadlock victims, %d deadlocks detected\n", succeeded, transfers-succeeded, victims, len(reports))
+	if len(reports) == 0 {
+		return
+	}
+
+	fmt.Printf("\nfirst deadlock:\n%s", reports[0])
+	path := filepath.Join(os.TempDir(), "deadlock.dot") // Not the working directory, that's the repo root under go run ./cmd
+	if err := os.WriteFile(path, []byte(reports[0].Graph.DOT()), 0644); err != nil {
+		fmt.Printf("failed writing %s: %s\n", path, err)
+		return
+	}
+	fmt.Printf("\nwait-for graph written to %s, render it with: dot -Tpng %s -o deadlock.png\n", path, path)
+}
@@ -0,0 +1,98 @@
+package transaction_deadlocks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+
+	"andreashoj/deeper-learnings/internal/chaos"
+	"andreashoj/deeper-learnings/internal/db"
+	tx_retry "andreashoj/deeper-learnings/internal/tx-retry"
+)
+
+// Same transfers as StartTransactionDeadlock, but through a chaos wrapped connection.
+// The extra latency widens the window between the two FOR UPDATE's, which is exactly where the deadlock happens
+func StartTransactionDeadlockDrill(scenarioPath string, safe bool) {
+	faults, err := chaos.NewInjectorFromFile(scenarioPath)
+	if err != nil {
+		log.Fatalf("failed loading chaos scenario: %s", err)
+		return
+	}
+
+	chaosDB, err := chaos.Open("postgres", db.DSN, faults)
+	if err != nil {
+		log.Fatalf("failed opening chaos db: %s", err)
+		return
+	}
+	defer chaosDB.Close()
+
+	db.SeedDB(`
+		DROP TABLE IF EXISTS accounts;
+		CREATE TABLE accounts (
+			id SERIAL PRIMARY KEY,
+			balance INTEGER NOT NULL
+		);
+		INSERT INTO accounts (balance) VALUES (1000), (1000);
+	`)
+
+	transfer := deadlockIntroducingTransfer
+	if safe {
+		transfer = safeTransfer
+	}
+
+	// Deadlock victims and serialization failures are retried, so the failures left over are the ones retrying couldn't fix.
+	// The retry stats show how many deadlocks actually happened
+	ctx := context.Background()
+	runner := tx_retry.New(chaosDB, tx_retry.DefaultConfig())
+
+	// Directions come from the scenario's seed too, drawn up front since a *rand.Rand isn't safe for the workers to share
+	rng := rand.New(rand.NewSource(faults.Seed()))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failures := make(map[string]int)
+	for range 50 {
+		from, to := 1, 2
+		if rng.Intn(2) == 0 {
+			from, to = 2, 1
+		}
+		wg.Go(func() {
+			err := runner.RunInTx(ctx, nil, func(tx *sql.Tx) error {
+				return transfer(ctx, tx, nil, from, to, 10)
+			})
+			if err != nil {
+				mu.Lock()
+				failures[classifyDrillError(err)]++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	total := 0
+	if err = db.DB.QueryRow(`SELECT SUM(balance) FROM accounts`).Scan(&total); err != nil {
+		log.Fatalf("failed summing balances: %s", err)
+		return
+	}
+
+	fmt.Printf("\nTransfers failed by cause: %v\n", failures)
+	fmt.Printf("Retry stats: %s\n", runner.Stats())
+	fmt.Printf("Total balance after drill: %d (should still be 2000)\n", total)
+	faults.Report()
+}
+
+func classifyDrillError(err error) string {
+	switch {
+	case errors.Is(err, chaos.ErrPartitioned):
+		return "partition"
+	case errors.Is(err, chaos.ErrInjected):
+		return "injected"
+	case errors.Is(err, tx_retry.ErrBudgetExhausted):
+		return "retry budget exhausted"
+	default:
+		return string(tx_retry.Classify(err))
+	}
+}
@@ -0,0 +1,80 @@
+package transaction_deadlocks
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+
+	"andreashoj/deeper-learnings/internal/db"
+	"andreashoj/deeper-learnings/internal/history"
+	tx_retry "andreashoj/deeper-learnings/internal/tx-retry"
+)
+
+// Runs concurrent transfers while recording every read and write, then checks the history: no lost updates, no cycles,
+// every transfer saw a total of 2000 and the final balances add up to what the committed transfers did.
+// Random amounts keep the balances from repeating, the checker can only tie a read to its writer when the value is unique
+func StartTransferHistoryCheck(safe bool) {
+	db.SeedDB(`
+		DROP TABLE IF EXISTS accounts;
+		CREATE TABLE accounts (
+			id SERIAL PRIMARY KEY,
+			balance INTEGER NOT NULL
+		);
+		INSERT INTO accounts (balance) VALUES (1000), (1000);
+	`)
+
+	transfer := deadlockIntroducingTransfer
+	if safe {
+		transfer = safeTransfer
+	}
+
+	recorder := history.NewRecorder()
+	runner := tx_retry.New(db.DB, tx_retry.DefaultConfig())
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for worker := range 20 {
+		wg.Go(func() {
+			from, to := 1, 2
+			if rand.Intn(2) == 0 {
+				from, to = 2, 1
+			}
+			amount := rand.Intn(97) + 1
+
+			name := fmt.Sprintf("transfer %d from %d to %d", amount, from, to)
+			recorder.Run(worker, name, func(attempt func() *history.Txn) error {
+				return runner.RunInTx(ctx, nil, func(tx *sql.Tx) error {
+					return transfer(ctx, tx, attempt(), from, to, amount)
+				})
+			})
+		})
+	}
+	wg.Wait()
+
+	final := make(map[int]int)
+	rows, err := db.DB.Query(`SELECT id, balance FROM accounts`)
+	if err != nil {
+		log.Fatalf("failed reading balances: %s", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, balance int
+		if err = rows.Scan(&id, &balance); err != nil {
+			log.Fatalf("failed scanning balance: %s", err)
+			return
+		}
+		final[id] = balance
+	}
+
+	report := history.Check(recorder.History(), history.CheckOptions{
+		Initial:       map[int]int{1: 1000, 2: 1000},
+		Final:         final,
+		ConstantTotal: true,
+	})
+	fmt.Printf("\n%s\nRetry stats: %s\n", report, runner.Stats())
+}
@@ -0,0 +1,152 @@
+package transaction_deadlocks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"andreashoj/deeper-learnings/internal/db"
+	job_queue "andreashoj/deeper-learnings/internal/job-queue"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The FOR UPDATE locking from the transfers, used for something real: workers claiming jobs from a table.
+// With plain FOR UPDATE every worker goes for the same head row and waits in line behind whoever got it first, NOWAIT turns
+// that wait into an error, and SKIP LOCKED just hands each worker the next row nobody has - that's the one queues actually use.
+// The handler is a bit hostile: some jobs fail once in a while, every 50th job always fails (and ends up dead-lettered)
+// and now and then a worker "dies" mid-job, leaving the job to be reclaimed once its lease runs out
+func StartJobQueueDemo() {
+	jobs, workers := 500, 16
+
+	cfg := job_queue.DefaultConfig()
+	cfg.Lease = 300 * time.Millisecond // Short so the abandoned jobs come back within the run
+
+	type run struct {
+		queue *job_queue.Queue
+		stats job_queue.WorkerStats
+		final job_queue.Counts
+		took  time.Duration
+	}
+	var runs []run
+
+	pg, err := sql.Open("postgres", db.DSN)
+	if err != nil {
+		log.Fatalf("failed opening postgres: %s", err)
+		return
+	}
+	defer pg.Close()
+
+	if err = pg.Ping(); err != nil {
+		fmt.Printf("skipping postgres, not reachable: %s\n", err)
+	} else {
+		pg.SetMaxOpenConns(workers + 2)
+		for _, strategy := range []job_queue.ClaimStrategy{job_queue.SkipLocked, job_queue.NoWait, job_queue.Blocking} {
+			runs = append(runs, run{queue: job_queue.NewPostgres(pg, cfg, strategy)})
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "jobs")
+	if err != nil {
+		log.Fatalf("failed creating temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// _txlock=immediate takes the write lock at BEGIN, a deferred transaction upgrading later can fail with busy without waiting
+	lite, err := sql.Open("sqlite3", filepath.Join(dir, "jobs.db")+"?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		log.Fatalf("failed opening sqlite: %s", err)
+		return
+	}
+	defer lite.Close()
+	runs = append(runs, run{queue: job_queue.NewSQLite(lite, cfg)})
+
+	for i := range runs {
+		r := &runs[i]
+		r.stats, r.final, r.took, err = runJobQueue(r.queue, jobs, workers)
+		if err != nil {
+			log.Fatalf("failed running %s queue: %s", r.queue.Strategy(), err)
+			return
+		}
+	}
+
+	fmt.Printf("\n%d jobs, %d workers, lease %v, max %d attempts\n", jobs, workers, cfg.Lease, cfg.MaxAttempts)
+	fmt.Printf("%-12s %6s %6s %9s %8s %12s %14s %15s\n", "claim", "done", "dead", "jobs/sec", "retried", "empty polls", "lock timeouts", "avg claim wait")
+	for _, r := range runs {
+		avgWait := time.Duration(0)
+		if attempts := r.stats.Claimed + r.stats.EmptyPolls + r.stats.LockTimeouts; attempts > 0 {
+			avgWait = r.stats.ClaimWait / time.Duration(attempts)
+		}
+		fmt.Printf("%-12s %6d %6d %9.0f %8d %12d %14d %15v\n", r.queue.Strategy(), r.final.Done, r.final.Dead,
+			float64(r.final.Done)/r.took.Seconds(), r.stats.Retried, r.stats.EmptyPolls, r.stats.LockTimeouts, avgWait.Round(time.Microsecond))
+	}
+	for _, r := range runs {
+		fmt.Printf("%s: %s\n", r.queue.Strategy(), r.stats)
+	}
+}
+
+func runJobQueue(queue *job_queue.Queue, jobs, workers int) (job_queue.WorkerStats, job_queue.Counts, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := queue.Setup(ctx); err != nil {
+		return job_queue.WorkerStats{}, job_queue.Counts{}, 0, err
+	}
+	payloads := make([]string, jobs)
+	for i := range payloads {
+		payloads[i] = strconv.Itoa(i + 1)
+	}
+	if err := queue.Enqueue(ctx, payloads...); err != nil {
+		return job_queue.WorkerStats{}, job_queue.Counts{}, 0, err
+	}
+
+	handle := func(ctx context.Context, job *job_queue.Job) error {
+		n, _ := strconv.Atoi(job.Payload)
+		time.Sleep(time.Duration(1+rand.Intn(4)) * time.Millisecond)
+
+		switch {
+		case n%50 == 0:
+			return errors.New("poison job, fails every time")
+		case job.Attempts == 1 && rand.Intn(100) < 2:
+			return job_queue.ErrAbandoned
+		case rand.Intn(100) < 5:
+			return errors.New("flaky downstream")
+		}
+		return nil
+	}
+
+	// Stop the workers once every job is either done or dead
+	workCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go func() {
+		for workCtx.Err() == nil {
+			time.Sleep(20 * time.Millisecond)
+			counts, err := queue.Counts(workCtx)
+			if err == nil && counts.Pending == 0 && counts.Running == 0 {
+				stop()
+			}
+		}
+	}()
+
+	began := time.Now()
+	stats := job_queue.Work(workCtx, queue, workers, 5*time.Millisecond, handle)
+	took := time.Since(began)
+
+	final, err := queue.Counts(context.Background())
+	if err != nil {
+		return stats, final, took, err
+	}
+	if final.Done+final.Dead != jobs {
+		return stats, final, took, fmt.Errorf("jobs went missing, %d enqueued but %s", jobs, final)
+	}
+
+	return stats, final, took, nil
+}
@@ -2,12 +2,15 @@ package transaction_deadlocks
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"math/rand"
 	"sync"
 	"time"
 
 	"andreashoj/deeper-learnings/internal/db"
+	"andreashoj/deeper-learnings/internal/history"
+	tx_retry "andreashoj/deeper-learnings/internal/tx-retry"
 )
 
 type Account struct {
@@ -29,6 +32,9 @@ func StartTransactionDeadlock() {
 	userA := 1
 	userB := 2
 
+	ctx := context.Background()
+	runner := tx_retry.New(db.DB, tx_retry.DefaultConfig())
+
 	var wg sync.WaitGroup
 	errsChan := make(chan error, 20)
 
@@ -38,8 +44,10 @@ func StartTransactionDeadlock() {
 			if rand.Intn(2) == 0 {
 				from, to = userB, userA
 			}
-			// if err := deadlockIntroducingTransfer(userA, userB, 40); err != nil {
-			if err := safeTransfer(from, to, 10); err != nil {
+			// The deadlock victim is retried by the runner, so even the deadlock introducing version ends up moving the money - just slower
+			// transfer := func(tx *sql.Tx) error { return deadlockIntroducingTransfer(ctx, tx, nil, from, to, 40) }
+			transfer := func(tx *sql.Tx) error { return safeTransfer(ctx, tx, nil, from, to, 10) }
+			if err := runner.RunInTx(ctx, nil, transfer); err != nil {
 				errsChan <- err
 			}
 		})
@@ -53,23 +61,19 @@ func StartTransactionDeadlock() {
 	for err := range errsChan {
 		fmt.Printf("something went wrong in the goroutine: %s", err)
 	}
-}
 
-func deadlockIntroducingTransfer(fromID, toID int, amount int) error {
-	ctx := context.Background()
-	tx, err := db.DB.BeginTx(ctx, nil)
-	if err != nil {
-		return fmt.Errorf("failed starting transaction: %w", err)
-	}
-	defer tx.Rollback()
+	fmt.Printf("Retry stats: %s\n", runner.Stats())
+}
 
+func deadlockIntroducingTransfer(ctx context.Context, tx *sql.Tx, h *history.Txn, fromID, toID int, amount int) error {
 	toAccount := Account{ID: toID}
 	fromAccount := Account{ID: fromID}
 	// Cause deadlock by locking from in first job - that row is being used to in the other query causing a circular dependency
-	err = tx.QueryRowContext(ctx, `SELECT balance FROM accounts WHERE id = $1  FOR UPDATE`, fromID).Scan(&fromAccount.Balance)
+	err := tx.QueryRowContext(ctx, `SELECT balance FROM accounts WHERE id = $1  FOR UPDATE`, fromID).Scan(&fromAccount.Balance)
 	if err != nil {
 		return fmt.Errorf("failed getting fromAccount: %w", err)
 	}
+	h.Read(fromID, fromAccount.Balance)
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -77,6 +81,7 @@ func deadlockIntroducingTransfer(fromID, toID int, amount int) error {
 	if err != nil {
 		return fmt.Errorf("failed getting toAccount: %w", err)
 	}
+	h.Read(toID, toAccount.Balance)
 
 	fromAccount.Balance -= amount
 	toAccount.Balance += amount
@@ -85,40 +90,32 @@ func deadlockIntroducingTransfer(fromID, toID int, amount int) error {
 	if err != nil {
 		return fmt.Errorf("failed updating from accounts balance: %w", err)
 	}
+	h.Write(fromAccount.ID, fromAccount.Balance)
 
 	_, err = tx.ExecContext(ctx, `UPDATE accounts SET balance = $1 WHERE id = $2`, toAccount.Balance, toAccount.ID)
 	if err != nil {
 		return fmt.Errorf("failed updating to accounts balance: %w", err)
 	}
-
-	err = tx.Commit()
-	if err != nil {
-		fmt.Printf("failed commit transfer")
-	}
+	h.Write(toAccount.ID, toAccount.Balance)
 
 	return nil
 }
 
 // Safe deadlock pattern implemented here, that ensures userID 1 cant end up waiting on user 2, while user waits on user 1
 // Done by sorting the ID's here. Which means both queries tries to use row with userID 1 first, which is fine, because that row is released after first query is done
-func safeTransfer(fromID, toID int, amount int) error {
-	ctx := context.Background()
-	tx, err := db.DB.BeginTx(ctx, nil)
-	if err != nil {
-		return fmt.Errorf("failed starting transaction: %w", err)
-	}
-	defer tx.Rollback()
-
+// Committing is left to RunInTx, which returns a failed commit instead of printing it like the transfers used to
+func safeTransfer(ctx context.Context, tx *sql.Tx, h *history.Txn, fromID, toID int, amount int) error {
 	firstID := min(fromID, toID)
 	secondID := max(fromID, toID)
 
 	toAccount := Account{ID: toID}
 	fromAccount := Account{ID: fromID}
 	// Cause deadlock by locking from in first job - that row is being used to in the other query causing a circular dependency
-	err = tx.QueryRowContext(ctx, `SELECT balance FROM accounts WHERE id = $1  FOR UPDATE`, firstID).Scan(&fromAccount.Balance)
+	err := tx.QueryRowContext(ctx, `SELECT balance FROM accounts WHERE id = $1  FOR UPDATE`, firstID).Scan(&fromAccount.Balance)
 	if err != nil {
 		return fmt.Errorf("failed getting fromAccount: %w", err)
 	}
+	h.Read(firstID, fromAccount.Balance)
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -126,6 +123,7 @@ func safeTransfer(fromID, toID int, amount int) error {
 	if err != nil {
 		return fmt.Errorf("failed getting toAccount: %w", err)
 	}
+	h.Read(secondID, toAccount.Balance)
 
 	fromBalance := fromAccount.Balance
 	toBalance := toAccount.Balance
@@ -141,16 +139,13 @@ func safeTransfer(fromID, toID int, amount int) error {
 	if err != nil {
 		return fmt.Errorf("failed updating from accounts balance: %w", err)
 	}
+	h.Write(fromAccount.ID, fromBalance)
 
 	_, err = tx.ExecContext(ctx, `UPDATE accounts SET balance = $1 WHERE id = $2`, toBalance, toAccount.ID)
 	if err != nil {
 		return fmt.Errorf("failed updating to accounts balance: %w", err)
 	}
-
-	err = tx.Commit()
-	if err != nil {
-		fmt.Printf("failed commit transfer")
-	}
+	h.Write(toAccount.ID, toBalance)
 
 	return nil
 }
@@ -0,0 +1,284 @@
+package transaction_deadlocks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"andreashoj/deeper-learnings/internal/db"
+	tx_retry "andreashoj/deeper-learnings/internal/tx-retry"
+)
+
+// A configurable transfer workload: M accounts, N workers moving random amounts between them for a while.
+// Zipf skew makes a few accounts hot, like real data - that's where the locking strategies start to differ.
+// The locking modes write the new balances computed from what they read under the lock, not balance = balance + x,
+// so a mode whose locks don't actually protect the read loses money and the conserved check at the end catches it
+
+type WorkloadMode string
+
+const (
+	ModeDeadlockProne   WorkloadMode = "deadlock-prone"   // Lock from, then to - opposite transfers wait on each other
+	ModeOrdered         WorkloadMode = "ordered"          // Lock the lowest id first, no cycles possible
+	ModeSingleStatement WorkloadMode = "single-statement" // One UPDATE for both rows, postgres locks them in scan order
+	ModeNoWait          WorkloadMode = "nowait"           // FOR UPDATE NOWAIT, fail instead of waiting and retry later
+	ModeSkipLocked      WorkloadMode = "skip-locked"      // FOR UPDATE SKIP LOCKED, if a row is busy skip the transfer and do another one
+)
+
+var WorkloadModes = []WorkloadMode{ModeDeadlockProne, ModeOrdered, ModeSingleStatement, ModeNoWait, ModeSkipLocked}
+
+type WorkloadConfig struct {
+	Accounts       int
+	Workers        int
+	Duration       time.Duration
+	ZipfS          float64 // Skew, must be > 1 - 0 picks accounts uniformly
+	MaxAmount      int
+	InitialBalance int
+	Think          time.Duration // Between locking the first and second account, widens the deadlock window
+}
+
+func DefaultWorkloadConfig() WorkloadConfig {
+	return WorkloadConfig{
+		Accounts:       20,
+		Workers:        16,
+		Duration:       5 * time.Second,
+		ZipfS:          1.2,
+		MaxAmount:      100,
+		InitialBalance: 1000,
+		Think:          2 * time.Millisecond,
+	}
+}
+
+type WorkloadResult struct {
+	Mode         WorkloadMode
+	Committed    int
+	Failed       int // Gave up after retrying
+	Skipped      int // Skip locked found a row taken
+	Deadlocks    int
+	Retries      int
+	Duration     time.Duration
+	Throughput   float64 // Committed transfers per second
+	InitialTotal int
+	FinalTotal   int
+	Conserved    bool
+}
+
+var errRowsTaken = errors.New("account locked by another transfer, skipped")
+
+func StartTransferWorkload() {
+	cfg := DefaultWorkloadConfig()
+
+	var results []WorkloadResult
+	for _, mode := range WorkloadModes {
+		result, err := RunTransferWorkload(db.DB, mode, cfg)
+		if err != nil {
+			log.Fatalf("failed running %s workload: %s", mode, err)
+			return
+		}
+		results = append(results, result)
+	}
+
+	fmt.Printf("\n%d accounts, %d workers, %v per mode, zipf s=%.1f\n", cfg.Accounts, cfg.Workers, cfg.Duration, cfg.ZipfS)
+	fmt.Printf("%-18s %10s %8s %8s %10s %8s %10s %10s\n", "mode", "committed", "failed", "skipped", "deadlocks", "retries", "ops/sec", "conserved")
+	for _, r := range results {
+		fmt.Printf("%-18s %10d %8d %8d %10d %8d %10.0f %10v\n", r.Mode, r.Committed, r.Failed, r.Skipped, r.Deadlocks, r.Retries, r.Throughput, r.Conserved)
+	}
+}
+
+func (c WorkloadConfig) validate() error {
+	if c.Accounts < 2 {
+		return fmt.Errorf("a transfer needs two accounts, got %d", c.Accounts)
+	}
+	if c.Workers < 1 {
+		return fmt.Errorf("workload needs at least one worker, got %d", c.Workers)
+	}
+	if c.MaxAmount < 1 {
+		return fmt.Errorf("max amount must be at least 1, got %d", c.MaxAmount)
+	}
+
+	return nil
+}
+
+func RunTransferWorkload(DB *sql.DB, mode WorkloadMode, cfg WorkloadConfig) (WorkloadResult, error) {
+	result := WorkloadResult{Mode: mode}
+	if err := cfg.validate(); err != nil {
+		return result, err
+	}
+
+	_, err := DB.Exec(`
+		DROP TABLE IF EXISTS accounts;
+		CREATE TABLE accounts (
+			id SERIAL PRIMARY KEY,
+			balance INTEGER NOT NULL
+		);
+	`)
+	if err != nil {
+		return result, fmt.Errorf("failed creating accounts: %w", err)
+	}
+	if _, err = DB.Exec(`INSERT INTO accounts (balance) SELECT $1 FROM generate_series(1, $2)`, cfg.InitialBalance, cfg.Accounts); err != nil {
+		return result, fmt.Errorf("failed seeding accounts: %w", err)
+	}
+	if result.InitialTotal, err = totalBalance(DB); err != nil {
+		return result, err
+	}
+
+	// Every mode gets a full budget of its own, otherwise a mode's numbers depend on how much the modes before it retried
+	retryCfg := tx_retry.DefaultConfig()
+	retryCfg.Budget = tx_retry.NewBudget(50, 0.2)
+	runner := tx_retry.New(DB, retryCfg)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Duration)
+	defer cancel()
+
+	var committed, failed, skipped atomic.Int64
+	began := time.Now()
+
+	var wg sync.WaitGroup
+	for worker := range cfg.Workers {
+		wg.Go(func() {
+			r := rand.New(rand.NewSource(time.Now().UnixNano() + int64(worker)))
+			pick := accountPicker(r, cfg)
+
+			for ctx.Err() == nil {
+				from := pick()
+				to := pick()
+				for to == from {
+					to = pick()
+				}
+				amount := r.Intn(cfg.MaxAmount) + 1
+
+				// The transfer itself isn't bound to ctx, a transfer that started before the deadline gets to finish
+				err := runner.RunInTx(context.Background(), nil, func(tx *sql.Tx) error {
+					return workloadTransfer(tx, mode, from, to, amount, cfg.Think)
+				})
+				switch {
+				case err == nil:
+					committed.Add(1)
+				case errors.Is(err, errRowsTaken):
+					skipped.Add(1)
+				default:
+					failed.Add(1)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if result.FinalTotal, err = totalBalance(DB); err != nil {
+		return result, err
+	}
+
+	stats := runner.Stats()
+	result.Committed = int(committed.Load())
+	result.Failed = int(failed.Load())
+	result.Skipped = int(skipped.Load())
+	// Every deadlock ends in exactly one of these: retried, given up on, or refused a retry by the budget
+	result.Deadlocks = stats.Retries[tx_retry.ClassDeadlock] + stats.GaveUp[tx_retry.ClassDeadlock] + stats.BudgetExhaustedBy[tx_retry.ClassDeadlock]
+	for _, n := range stats.Retries {
+		result.Retries += n
+	}
+	result.Duration = time.Since(began)
+	result.Throughput = float64(result.Committed) / result.Duration.Seconds()
+	result.Conserved = result.InitialTotal == result.FinalTotal
+
+	return result, nil
+}
+
+// Returns account ids from 1 to Accounts, with low ids picked far more often when skewed
+func accountPicker(r *rand.Rand, cfg WorkloadConfig) func() int {
+	if cfg.ZipfS <= 1 {
+		return func() int { return r.Intn(cfg.Accounts) + 1 }
+	}
+
+	zipf := rand.NewZipf(r, cfg.ZipfS, 1, uint64(cfg.Accounts-1))
+	return func() int { return int(zipf.Uint64()) + 1 }
+}
+
+func workloadTransfer(tx *sql.Tx, mode WorkloadMode, from, to, amount int, think time.Duration) error {
+	ctx := context.Background()
+
+	switch mode {
+	case ModeSingleStatement:
+		_, err := tx.ExecContext(ctx, `
+			UPDATE accounts SET balance = balance + CASE WHEN id = $1 THEN -$3::int ELSE $3::int END
+			WHERE id IN ($1, $2)`, from, to, amount)
+		if err != nil {
+			return fmt.Errorf("failed transferring: %w", err)
+		}
+		return nil
+
+	case ModeSkipLocked:
+		rows, err := tx.QueryContext(ctx, `SELECT id, balance FROM accounts WHERE id IN ($1, $2) ORDER BY id FOR UPDATE SKIP LOCKED`, from, to)
+		if err != nil {
+			return fmt.Errorf("failed locking accounts: %w", err)
+		}
+		balances := make(map[int]int, 2)
+		for rows.Next() {
+			var id, balance int
+			if err = rows.Scan(&id, &balance); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed reading locked account: %w", err)
+			}
+			balances[id] = balance
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("failed locking accounts: %w", err)
+		}
+		if len(balances) < 2 {
+			return errRowsTaken
+		}
+		time.Sleep(think)
+
+		return writeBalances(ctx, tx, from, balances[from]-amount, to, balances[to]+amount)
+	}
+
+	first, second := from, to
+	if mode == ModeOrdered {
+		first, second = min(from, to), max(from, to)
+	}
+
+	lockQuery := `SELECT balance FROM accounts WHERE id = $1 FOR UPDATE`
+	if mode == ModeNoWait {
+		lockQuery = `SELECT balance FROM accounts WHERE id = $1 FOR UPDATE NOWAIT`
+	}
+
+	balances := make(map[int]int, 2)
+	for _, id := range []int{first, second} {
+		var balance int
+		if err := tx.QueryRowContext(ctx, lockQuery, id).Scan(&balance); err != nil {
+			return fmt.Errorf("failed locking account %d: %w", id, err)
+		}
+		balances[id] = balance
+		if id == first {
+			time.Sleep(think)
+		}
+	}
+
+	return writeBalances(ctx, tx, from, balances[from]-amount, to, balances[to]+amount)
+}
+
+// Absolute writes of what was computed from the locked reads. Correct only while the locks hold, which is the point
+func writeBalances(ctx context.Context, tx *sql.Tx, from, fromBalance, to, toBalance int) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE accounts SET balance = $1 WHERE id = $2`, fromBalance, from); err != nil {
+		return fmt.Errorf("failed debiting account %d: %w", from, err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE accounts SET balance = $1 WHERE id = $2`, toBalance, to); err != nil {
+		return fmt.Errorf("failed crediting account %d: %w", to, err)
+	}
+
+	return nil
+}
+
+func totalBalance(DB *sql.DB) (int, error) {
+	var total int
+	if err := DB.QueryRow(`SELECT COALESCE(SUM(balance), 0) FROM accounts`).Scan(&total); err != nil {
+		return 0, fmt.Errorf("failed summing balances: %w", err)
+	}
+
+	return total, nil
+}
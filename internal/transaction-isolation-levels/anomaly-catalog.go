@@ -0,0 +1,180 @@
+package transaction_isolation_levels
+
+// Catalog of isolation anomalies, each one scripted as an exact interleaving of steps across transactions.
+// The steps are plain operations on an items table (id, kind, value) instead of raw SQL, so the same script can run
+// against Postgres, SQLite, or anything else that implements Engine
+
+type OpKind int
+
+const (
+	OpRead OpKind = iota
+	OpWrite
+	OpInsert
+	OpCount // Predicate read - rows WHERE kind = Kind
+	OpSum
+	OpCommit
+	OpRollback
+)
+
+type Step struct {
+	Tx    int
+	Op    OpKind
+	ID    int
+	Kind  string
+	Value func(reads map[string]int) int // Computed when the step runs, so a write can depend on what the transaction read earlier
+	Into  string                         // Name the result of a read is stored under
+}
+
+type Row struct {
+	ID    int
+	Kind  string
+	Value int
+}
+
+type Anomaly struct {
+	Name        string
+	Description string
+	Rows        []Row
+	Steps       []Step
+	Occurred    func(o Outcome) bool
+}
+
+func read(tx, id int, into string) Step {
+	return Step{Tx: tx, Op: OpRead, ID: id, Into: into}
+}
+
+func write(tx, id int, value func(reads map[string]int) int) Step {
+	return Step{Tx: tx, Op: OpWrite, ID: id, Value: value}
+}
+
+func insert(tx, id int, kind string, value int) Step {
+	return Step{Tx: tx, Op: OpInsert, ID: id, Kind: kind, Value: func(map[string]int) int { return value }}
+}
+
+func count(tx int, kind string, into string) Step {
+	return Step{Tx: tx, Op: OpCount, Kind: kind, Into: into}
+}
+
+func sum(tx int, kind string, into string) Step {
+	return Step{Tx: tx, Op: OpSum, Kind: kind, Into: into}
+}
+
+func commit(tx int) Step {
+	return Step{Tx: tx, Op: OpCommit}
+}
+
+func rollback(tx int) Step {
+	return Step{Tx: tx, Op: OpRollback}
+}
+
+func constant(value int) func(map[string]int) int {
+	return func(map[string]int) int { return value }
+}
+
+var AnomalyCatalog = []Anomaly{
+	{
+		Name:        "dirty read",
+		Description: "T2 reads a value T1 wrote but never committed",
+		Rows:        []Row{{ID: 1, Kind: "a", Value: 0}},
+		Steps: []Step{
+			write(1, 1, constant(100)),
+			read(2, 1, "t2_value"),
+			rollback(1),
+			commit(2),
+		},
+		Occurred: func(o Outcome) bool {
+			return o.Reads["t2_value"] == 100
+		},
+	},
+	{
+		Name:        "non-repeatable read",
+		Description: "T1 reads the same row twice and gets two different values, because T2 committed in between",
+		Rows:        []Row{{ID: 1, Kind: "a", Value: 0}},
+		Steps: []Step{
+			read(1, 1, "t1_first"),
+			write(2, 1, constant(100)),
+			commit(2),
+			read(1, 1, "t1_second"),
+			commit(1),
+		},
+		Occurred: func(o Outcome) bool {
+			return o.Committed[1] && o.Reads["t1_first"] != o.Reads["t1_second"]
+		},
+	},
+	{
+		Name:        "phantom",
+		Description: "T1 runs the same predicate query twice and a new row shows up, inserted and committed by T2",
+		Rows:        []Row{{ID: 1, Kind: "a", Value: 1}, {ID: 2, Kind: "a", Value: 1}},
+		Steps: []Step{
+			count(1, "a", "t1_first"),
+			insert(2, 3, "a", 1),
+			commit(2),
+			count(1, "a", "t1_second"),
+			commit(1),
+		},
+		Occurred: func(o Outcome) bool {
+			return o.Committed[1] && o.Reads["t1_first"] != o.Reads["t1_second"]
+		},
+	},
+	{
+		Name:        "lost update",
+		Description: "T1 and T2 both read, add 10 and write back - both commit, but the balance only went up by 10",
+		Rows:        []Row{{ID: 1, Kind: "a", Value: 0}},
+		Steps: []Step{
+			read(1, 1, "t1_value"),
+			read(2, 1, "t2_value"),
+			write(1, 1, func(r map[string]int) int { return r["t1_value"] + 10 }),
+			write(2, 1, func(r map[string]int) int { return r["t2_value"] + 10 }), // Blocks on T1's row lock in postgres
+			commit(1),
+			commit(2),
+		},
+		Occurred: func(o Outcome) bool {
+			return o.Committed[1] && o.Committed[2] && o.Final[1] != 20
+		},
+	},
+	{
+		Name:        "write skew",
+		Description: "Two doctors on call, each checks that someone else is on call and goes off call - both commit and nobody is left",
+		Rows:        []Row{{ID: 1, Kind: "oncall", Value: 1}, {ID: 2, Kind: "oncall", Value: 1}},
+		Steps: []Step{
+			sum(1, "oncall", "t1_on_call"),
+			sum(2, "oncall", "t2_on_call"),
+			write(1, 1, constant(0)), // Fine, t1_on_call is 2
+			write(2, 2, constant(0)), // Also fine from T2's point of view - different row, so no lock conflict
+			commit(1),
+			commit(2),
+		},
+		Occurred: func(o Outcome) bool {
+			return o.Committed[1] && o.Committed[2] && o.Final[1]+o.Final[2] == 0
+		},
+	},
+	{
+		// Fekete et al: a read only transaction sees a state that can't exist in any serial order
+		Name:        "read-only anomaly",
+		Description: "T2 withdraws from checking (1) with a penalty, T1 deposits to savings (2), read only T3 sees the deposit but not the withdrawal",
+		Rows:        []Row{{ID: 1, Kind: "checking", Value: 0}, {ID: 2, Kind: "savings", Value: 0}},
+		Steps: []Step{
+			read(2, 1, "t2_checking"),
+			read(2, 2, "t2_savings"),
+			read(1, 2, "t1_savings"),
+			write(1, 2, func(r map[string]int) int { return r["t1_savings"] + 20 }),
+			commit(1),
+			read(3, 1, "t3_checking"),
+			read(3, 2, "t3_savings"),
+			commit(3),
+			write(2, 1, func(r map[string]int) int {
+				// Withdraw 10, overdrawing costs a penalty of 1
+				if r["t2_checking"]+r["t2_savings"] < 10 {
+					return r["t2_checking"] - 11
+				}
+				return r["t2_checking"] - 10
+			}),
+			commit(2),
+		},
+		Occurred: func(o Outcome) bool {
+			// T3 saw the deposit, so T1 came before T3 - then T2 must come after T1 too and shouldn't have paid the penalty
+			allCommitted := o.Committed[1] && o.Committed[2] && o.Committed[3]
+			return allCommitted && o.Reads["t3_savings"] == 20 && o.Reads["t3_checking"] == 0 && o.Final[1] == -11
+		},
+	},
+}
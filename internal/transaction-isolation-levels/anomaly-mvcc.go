@@ -0,0 +1,183 @@
+package transaction_isolation_levels
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"andreashoj/deeper-learnings/internal/db"
+	"andreashoj/deeper-learnings/internal/mvcc"
+)
+
+// Runs the anomaly catalog against the in-process MVCC engine, and against postgres when it's up, and compares the two matrices.
+// If they match, the engine's visibility rules explain what postgres does - the trace of one scenario shows how
+func StartMVCCAnomalyCatalog() {
+	stepTimeout := 100 * time.Millisecond
+
+	engine := NewMVCCEngine(nil)
+	matrix, err := RunCatalog(engine, AnomalyCatalog, stepTimeout)
+	if err != nil {
+		log.Fatalf("failed running catalog on mvcc engine: %s", err)
+		return
+	}
+	matrix.Print("mvcc engine", AnomalyCatalog)
+
+	pg, err := sql.Open("postgres", db.DSN)
+	if err != nil {
+		log.Fatalf("failed opening postgres: %s", err)
+		return
+	}
+	defer pg.Close()
+
+	if err = pg.Ping(); err != nil {
+		fmt.Printf("\nskipping the postgres comparison, not reachable: %s\n", err)
+	} else {
+		pgMatrix, err := RunCatalog(NewSQLEngine("postgres", pg), AnomalyCatalog, 300*time.Millisecond)
+		if err != nil {
+			log.Fatalf("failed running catalog on postgres: %s", err)
+			return
+		}
+		pgMatrix.Print("postgres", AnomalyCatalog)
+
+		differences := 0
+		for _, a := range AnomalyCatalog {
+			for _, level := range MatrixLevels {
+				if matrix[a.Name][level] != pgMatrix[a.Name][level] {
+					differences++
+					fmt.Printf("MISMATCH %s at %s: mvcc %s, postgres %s\n", a.Name, level, matrix[a.Name][level], pgMatrix[a.Name][level])
+				}
+			}
+		}
+		fmt.Printf("\n%d differences between the mvcc engine and postgres\n", differences)
+	}
+
+	// Replay one scenario with the trace on, to see every visibility decision behind its cell in the matrix
+	writeSkew := AnomalyCatalog[slices.IndexFunc(AnomalyCatalog, func(a Anomaly) bool { return a.Name == "write skew" })]
+	for _, level := range []sql.IsolationLevel{sql.LevelRepeatableRead, sql.LevelSerializable} {
+		fmt.Printf("\nwrite skew at %s:\n", level)
+		if _, err = RunAnomaly(NewMVCCEngine(os.Stdout), level, writeSkew, stepTimeout); err != nil {
+			log.Fatalf("failed tracing write skew: %s", err)
+			return
+		}
+	}
+}
+
+type mvccEngine struct {
+	engine *mvcc.Engine[Row]
+	trace  io.Writer
+}
+
+// NewMVCCEngine adapts the mvcc engine to the catalog, trace is nil unless you want to see the visibility decisions
+func NewMVCCEngine(trace io.Writer) Engine {
+	return &mvccEngine{trace: trace}
+}
+
+func (e *mvccEngine) Name() string {
+	return "mvcc"
+}
+
+func (e *mvccEngine) Reset(rows []Row) error {
+	e.engine = mvcc.New[Row]()
+
+	tx := e.engine.Begin(context.Background(), mvcc.ReadCommitted)
+	for _, row := range rows {
+		if err := tx.Insert(row.ID, row); err != nil {
+			return fmt.Errorf("failed inserting row %d: %w", row.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	e.engine.SetTrace(e.trace) // Only trace the scenario itself, not the setup
+	return nil
+}
+
+// Same mapping as postgres: read uncommitted behaves like read committed, repeatable read is snapshot isolation
+func (e *mvccEngine) Begin(ctx context.Context, level sql.IsolationLevel) (Txn, error) {
+	mvccLevel := mvcc.ReadCommitted
+	switch level {
+	case sql.LevelRepeatableRead, sql.LevelSnapshot:
+		mvccLevel = mvcc.SnapshotIsolation
+	case sql.LevelSerializable, sql.LevelLinearizable:
+		mvccLevel = mvcc.Serializable
+	}
+
+	return &mvccTxn{tx: e.engine.Begin(ctx, mvccLevel)}, nil
+}
+
+func (e *mvccEngine) Final() (map[int]int, error) {
+	tx := e.engine.Begin(context.Background(), mvcc.ReadCommitted)
+	defer tx.Rollback()
+
+	rows, err := tx.Scan(func(int, Row) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+
+	final := make(map[int]int)
+	for _, row := range rows {
+		final[row.Key] = row.Value.Value
+	}
+
+	return final, nil
+}
+
+type mvccTxn struct {
+	tx *mvcc.Txn[Row]
+}
+
+func (t *mvccTxn) Read(id int) (int, error) {
+	row, ok, err := t.tx.Get(id)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+
+	return row.Value, nil
+}
+
+func (t *mvccTxn) Write(id, value int) error {
+	row, ok, err := t.tx.Get(id)
+	if err != nil || !ok {
+		return err
+	}
+
+	row.Value = value
+	_, err = t.tx.Update(id, row)
+	return err
+}
+
+func (t *mvccTxn) Insert(row Row) error {
+	return t.tx.Insert(row.ID, row)
+}
+
+func (t *mvccTxn) Count(kind string) (int, error) {
+	rows, err := t.tx.Scan(func(_ int, row Row) bool { return row.Kind == kind })
+	return len(rows), err
+}
+
+func (t *mvccTxn) Sum(kind string) (int, error) {
+	rows, err := t.tx.Scan(func(_ int, row Row) bool { return row.Kind == kind })
+	sum := 0
+	for _, row := range rows {
+		sum += row.Value.Value
+	}
+
+	return sum, err
+}
+
+func (t *mvccTxn) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *mvccTxn) Rollback() error {
+	return t.tx.Rollback()
+}
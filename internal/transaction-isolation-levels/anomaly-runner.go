@@ -0,0 +1,279 @@
+package transaction_isolation_levels
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Runs the anomaly scripts step by step. Every transaction gets its own goroutine, and the coordinator hands out one step at a
+// time and waits for it to finish before sending the next one - that's the barrier that makes the interleaving exact.
+// A step that doesn't finish within StepTimeout is waiting on a lock, so the coordinator notes it as blocked and moves on,
+// the step finishes (or fails) once whatever it's waiting for is committed or rolled back
+
+// Engine is anything the catalog can run against - the sql engine below, or an in-process one
+type Engine interface {
+	Name() string
+	Reset(rows []Row) error
+	Begin(ctx context.Context, level sql.IsolationLevel) (Txn, error)
+	Final() (map[int]int, error) // Committed value per id, read after all transactions are done
+}
+
+type Txn interface {
+	Read(id int) (int, error)
+	Write(id, value int) error
+	Insert(row Row) error
+	Count(kind string) (int, error)
+	Sum(kind string) (int, error)
+	Commit() error
+	Rollback() error
+}
+
+type Outcome struct {
+	Reads     map[string]int
+	Final     map[int]int
+	Committed map[int]bool
+	Errors    map[int]error // Why a transaction was aborted
+	Blocked   []int         // Steps that had to wait on another transaction
+}
+
+type Result string
+
+const (
+	ResultOccurred  Result = "ANOMALY"
+	ResultPrevented Result = "prevented"
+	ResultAborted   Result = "aborted" // Prevented, by failing one of the transactions
+)
+
+func (o Outcome) Result(a Anomaly) Result {
+	if a.Occurred(o) {
+		return ResultOccurred
+	}
+	if len(o.Errors) > 0 {
+		return ResultAborted
+	}
+
+	return ResultPrevented
+}
+
+var ErrStuck = errors.New("step never finished")
+
+type job struct {
+	step  Step
+	reads map[string]int
+	done  chan jobResult
+}
+
+type jobResult struct {
+	value int
+	err   error
+}
+
+type txState struct {
+	txn      Txn
+	jobs     chan job
+	pending  *job // Blocked step we haven't seen finish yet
+	finished bool
+	cancel   context.CancelFunc
+}
+
+func RunAnomaly(engine Engine, level sql.IsolationLevel, a Anomaly, stepTimeout time.Duration) (Outcome, error) {
+	o := Outcome{
+		Reads:     make(map[string]int),
+		Committed: make(map[int]bool),
+		Errors:    make(map[int]error),
+	}
+
+	if err := engine.Reset(a.Rows); err != nil {
+		return o, fmt.Errorf("failed resetting %s: %w", engine.Name(), err)
+	}
+
+	txs := make(map[int]*txState)
+	var wg sync.WaitGroup
+	defer func() {
+		for _, t := range txs {
+			close(t.jobs)
+			t.cancel()
+		}
+		wg.Wait()
+	}()
+
+	for _, step := range a.Steps {
+		if _, ok := txs[step.Tx]; ok {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		txn, err := engine.Begin(ctx, level)
+		if err != nil {
+			cancel()
+			return o, fmt.Errorf("failed starting T%d: %w", step.Tx, err)
+		}
+
+		t := &txState{txn: txn, jobs: make(chan job), cancel: cancel}
+		txs[step.Tx] = t
+		wg.Go(func() {
+			for j := range t.jobs {
+				value, err := runStep(t.txn, j.step, j.reads)
+				j.done <- jobResult{value: value, err: err}
+			}
+		})
+	}
+
+	apply := func(id int, t *txState, j *job, res jobResult) {
+		t.pending = nil
+		if res.err != nil {
+			o.Errors[id] = res.err
+			t.finished = true
+			t.txn.Rollback() // Postgres needs it after a failed statement, and sqlite doesn't roll back on its own
+			return
+		}
+
+		switch j.step.Op {
+		case OpCommit:
+			o.Committed[id] = true
+			t.finished = true
+		case OpRollback:
+			t.finished = true
+		case OpRead, OpCount, OpSum:
+			o.Reads[j.step.Into] = res.value
+		}
+	}
+
+	// Picks up blocked steps that finished in the meantime, without waiting for the ones that didn't
+	poll := func() {
+		for _, id := range slices.Sorted(maps.Keys(txs)) {
+			t := txs[id]
+			if t.pending == nil {
+				continue
+			}
+
+			select {
+			case res := <-t.pending.done:
+				apply(id, t, t.pending, res)
+			default:
+			}
+		}
+	}
+
+	wait := func(id int, t *txState, timeout time.Duration) bool {
+		select {
+		case res := <-t.pending.done:
+			apply(id, t, t.pending, res)
+			return true
+		case <-time.After(timeout):
+			return false
+		}
+	}
+
+	for i, step := range a.Steps {
+		poll()
+
+		t := txs[step.Tx]
+		if t.pending != nil && !wait(step.Tx, t, 5*time.Second) {
+			// Blocked on something later in the script - the script itself deadlocks, cancel the transaction
+			t.cancel()
+			wait(step.Tx, t, 5*time.Second)
+			o.Errors[step.Tx] = fmt.Errorf("T%d step %d: %w", step.Tx, i, ErrStuck)
+			t.finished = true
+		}
+		if t.finished {
+			continue // Aborted earlier, the rest of its steps never happen
+		}
+
+		t.pending = &job{step: step, reads: maps.Clone(o.Reads), done: make(chan jobResult, 1)}
+		t.jobs <- *t.pending
+		if !wait(step.Tx, t, stepTimeout) {
+			o.Blocked = append(o.Blocked, i)
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(txs)) {
+		t := txs[id]
+		if t.pending != nil && !wait(id, t, 5*time.Second) {
+			t.cancel()
+			o.Errors[id] = fmt.Errorf("T%d: %w", id, ErrStuck)
+		}
+		if !t.finished {
+			t.txn.Rollback()
+		}
+	}
+
+	final, err := engine.Final()
+	if err != nil {
+		return o, fmt.Errorf("failed reading final state: %w", err)
+	}
+	o.Final = final
+
+	return o, nil
+}
+
+func runStep(txn Txn, step Step, reads map[string]int) (int, error) {
+	switch step.Op {
+	case OpRead:
+		return txn.Read(step.ID)
+	case OpWrite:
+		return 0, txn.Write(step.ID, step.Value(reads))
+	case OpInsert:
+		return 0, txn.Insert(Row{ID: step.ID, Kind: step.Kind, Value: step.Value(reads)})
+	case OpCount:
+		return txn.Count(step.Kind)
+	case OpSum:
+		return txn.Sum(step.Kind)
+	case OpCommit:
+		return 0, txn.Commit()
+	case OpRollback:
+		return 0, txn.Rollback()
+	}
+
+	return 0, fmt.Errorf("unknown op %d", step.Op)
+}
+
+// Matrix is anomaly name -> isolation level -> result
+type Matrix map[string]map[sql.IsolationLevel]Result
+
+var MatrixLevels = []sql.IsolationLevel{sql.LevelReadUncommitted, sql.LevelReadCommitted, sql.LevelRepeatableRead, sql.LevelSerializable}
+
+func RunCatalog(engine Engine, catalog []Anomaly, stepTimeout time.Duration) (Matrix, error) {
+	matrix := make(Matrix)
+	for _, a := range catalog {
+		matrix[a.Name] = make(map[sql.IsolationLevel]Result)
+		for _, level := range MatrixLevels {
+			o, err := RunAnomaly(engine, level, a, stepTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("failed running %s at %s: %w", a.Name, level, err)
+			}
+
+			matrix[a.Name][level] = o.Result(a)
+			for id, err := range o.Errors {
+				fmt.Printf("  %s, %s, %s: T%d aborted: %s\n", engine.Name(), a.Name, level, id, err)
+			}
+		}
+	}
+
+	return matrix, nil
+}
+
+func (m Matrix) Print(title string, catalog []Anomaly) {
+	fmt.Printf("\n%s\n", title)
+	fmt.Printf("%-22s", "")
+	for _, level := range MatrixLevels {
+		fmt.Printf("%-18s", level)
+	}
+	fmt.Println()
+	fmt.Println(strings.Repeat("-", 22+18*len(MatrixLevels)))
+
+	for _, a := range catalog {
+		fmt.Printf("%-22s", a.Name)
+		for _, level := range MatrixLevels {
+			fmt.Printf("%-18s", m[a.Name][level])
+		}
+		fmt.Println()
+	}
+}
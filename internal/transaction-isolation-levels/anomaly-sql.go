@@ -0,0 +1,183 @@
+package transaction_isolation_levels
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"andreashoj/deeper-learnings/internal/db"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Runs the anomaly catalog at every isolation level on postgres and sqlite and prints which anomalies actually happened.
+// Worth knowing before reading the sqlite matrix: go-sqlite3 ignores the isolation level completely, every transaction is
+// serializable because sqlite only allows one writer at a time - the conflicts show up as "database is locked" instead
+func StartAnomalyCatalog() {
+	stepTimeout := 300 * time.Millisecond
+
+	pg, err := sql.Open("postgres", db.DSN)
+	if err != nil {
+		log.Fatalf("failed opening postgres: %s", err)
+		return
+	}
+	defer pg.Close()
+
+	if err = pg.Ping(); err != nil {
+		fmt.Printf("skipping postgres, not reachable: %s\n", err)
+	} else {
+		matrix, err := RunCatalog(NewSQLEngine("postgres", pg), AnomalyCatalog, stepTimeout)
+		if err != nil {
+			log.Fatalf("failed running catalog on postgres: %s", err)
+			return
+		}
+		matrix.Print("postgres", AnomalyCatalog)
+	}
+
+	dir, err := os.MkdirTemp("", "anomalies")
+	if err != nil {
+		log.Fatalf("failed creating temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// WAL so readers don't block on the writer, and a short busy timeout so a lock conflict fails fast instead of waiting 5s
+	lite, err := sql.Open("sqlite3", filepath.Join(dir, "anomalies.db")+"?_journal_mode=WAL&_busy_timeout=100")
+	if err != nil {
+		log.Fatalf("failed opening sqlite: %s", err)
+		return
+	}
+	defer lite.Close()
+
+	matrix, err := RunCatalog(NewSQLEngine("sqlite3", lite), AnomalyCatalog, stepTimeout)
+	if err != nil {
+		log.Fatalf("failed running catalog on sqlite: %s", err)
+		return
+	}
+	matrix.Print("sqlite (isolation level is ignored by the driver)", AnomalyCatalog)
+}
+
+type sqlEngine struct {
+	driverName string
+	DB         *sql.DB
+	queries    anomalyQueries
+}
+
+type anomalyQueries struct {
+	read, write, insert, count, sum string
+}
+
+func NewSQLEngine(driverName string, DB *sql.DB) Engine {
+	queries := anomalyQueries{
+		read:   `SELECT value FROM anomaly_items WHERE id = ?`,
+		write:  `UPDATE anomaly_items SET value = ? WHERE id = ?`,
+		insert: `INSERT INTO anomaly_items (id, kind, value) VALUES (?, ?, ?)`,
+		count:  `SELECT COUNT(*) FROM anomaly_items WHERE kind = ?`,
+		sum:    `SELECT COALESCE(SUM(value), 0) FROM anomaly_items WHERE kind = ?`,
+	}
+	if driverName == "postgres" {
+		queries = anomalyQueries{
+			read:   `SELECT value FROM anomaly_items WHERE id = $1`,
+			write:  `UPDATE anomaly_items SET value = $1 WHERE id = $2`,
+			insert: `INSERT INTO anomaly_items (id, kind, value) VALUES ($1, $2, $3)`,
+			count:  `SELECT COUNT(*) FROM anomaly_items WHERE kind = $1`,
+			sum:    `SELECT COALESCE(SUM(value), 0) FROM anomaly_items WHERE kind = $1`,
+		}
+	}
+
+	return &sqlEngine{driverName: driverName, DB: DB, queries: queries}
+}
+
+func (e *sqlEngine) Name() string {
+	return e.driverName
+}
+
+func (e *sqlEngine) Reset(rows []Row) error {
+	_, err := e.DB.Exec(`DROP TABLE IF EXISTS anomaly_items;
+		CREATE TABLE anomaly_items (id INTEGER PRIMARY KEY, kind VARCHAR(20) NOT NULL, value INTEGER NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("failed creating anomaly_items: %w", err)
+	}
+
+	for _, row := range rows {
+		if _, err = e.DB.Exec(e.queries.insert, row.ID, row.Kind, row.Value); err != nil {
+			return fmt.Errorf("failed inserting row %d: %w", row.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (e *sqlEngine) Begin(ctx context.Context, level sql.IsolationLevel) (Txn, error) {
+	tx, err := e.DB.BeginTx(ctx, &sql.TxOptions{Isolation: level})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlTxn{tx: tx, ctx: ctx, queries: e.queries}, nil
+}
+
+func (e *sqlEngine) Final() (map[int]int, error) {
+	rows, err := e.DB.Query(`SELECT id, value FROM anomaly_items`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	final := make(map[int]int)
+	for rows.Next() {
+		var id, value int
+		if err = rows.Scan(&id, &value); err != nil {
+			return nil, err
+		}
+		final[id] = value
+	}
+
+	return final, rows.Err()
+}
+
+type sqlTxn struct {
+	tx      *sql.Tx
+	ctx     context.Context
+	queries anomalyQueries
+}
+
+func (t *sqlTxn) Read(id int) (int, error) {
+	var value int
+	err := t.tx.QueryRowContext(t.ctx, t.queries.read, id).Scan(&value)
+	return value, err
+}
+
+func (t *sqlTxn) Write(id, value int) error {
+	_, err := t.tx.ExecContext(t.ctx, t.queries.write, value, id)
+	return err
+}
+
+func (t *sqlTxn) Insert(row Row) error {
+	_, err := t.tx.ExecContext(t.ctx, t.queries.insert, row.ID, row.Kind, row.Value)
+	return err
+}
+
+func (t *sqlTxn) Count(kind string) (int, error) {
+	var count int
+	err := t.tx.QueryRowContext(t.ctx, t.queries.count, kind).Scan(&count)
+	return count, err
+}
+
+func (t *sqlTxn) Sum(kind string) (int, error) {
+	var sum int
+	err := t.tx.QueryRowContext(t.ctx, t.queries.sum, kind).Scan(&sum)
+	return sum, err
+}
+
+func (t *sqlTxn) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *sqlTxn) Rollback() error {
+	return t.tx.Rollback()
+}
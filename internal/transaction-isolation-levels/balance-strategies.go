@@ -0,0 +1,237 @@
+package transaction_isolation_levels
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The same "add amount to a balance" operation done five ways, so the fixes for the lost update can be compared side by side.
+// Think is the business logic between reading the balance and writing it back - the longer it is, the wider the race window,
+// and the longer the pessimistic strategies hold their lock
+
+type BalanceStrategy struct {
+	Name      string
+	Increment func(ctx context.Context, DB *sql.DB, id, amount int, think time.Duration) (retries int, err error)
+}
+
+var BalanceStrategies = []BalanceStrategy{
+	{Name: "naive read-modify-write", Increment: naiveIncrement},
+	{Name: "atomic update", Increment: atomicIncrement},
+	{Name: "select for update", Increment: forUpdateIncrement},
+	{Name: "optimistic version", Increment: optimisticIncrement},
+	{Name: "advisory lock", Increment: advisoryLockIncrement},
+}
+
+var errVersionConflict = errors.New("balance was changed by someone else")
+
+// What incrementBalance does, minus the printing: read, think, write back the computed value
+func naiveIncrement(ctx context.Context, DB *sql.DB, id, amount int, think time.Duration) (int, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current int
+	if err = tx.QueryRowContext(ctx, `SELECT amount FROM balances WHERE id = $1`, id).Scan(&current); err != nil {
+		return 0, fmt.Errorf("failed getting balance: %w", err)
+	}
+
+	time.Sleep(think)
+
+	if _, err = tx.ExecContext(ctx, `UPDATE balances SET amount = $1 WHERE id = $2`, current+amount, id); err != nil {
+		return 0, fmt.Errorf("failed updating balance: %w", err)
+	}
+
+	return 0, tx.Commit()
+}
+
+// Let the db do the read-modify-write in one statement. The row lock is only held for the update itself,
+// the thinking happens before, outside any transaction - only works when the new value doesn't depend on logic we run in Go
+func atomicIncrement(ctx context.Context, DB *sql.DB, id, amount int, think time.Duration) (int, error) {
+	time.Sleep(think)
+
+	if _, err := DB.ExecContext(ctx, `UPDATE balances SET amount = amount + $1 WHERE id = $2`, amount, id); err != nil {
+		return 0, fmt.Errorf("failed updating balance: %w", err)
+	}
+
+	return 0, nil
+}
+
+// Pessimistic: lock the row when reading it, everyone else queues up on the lock until we commit
+func forUpdateIncrement(ctx context.Context, DB *sql.DB, id, amount int, think time.Duration) (int, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current int
+	if err = tx.QueryRowContext(ctx, `SELECT amount FROM balances WHERE id = $1 FOR UPDATE`, id).Scan(&current); err != nil {
+		return 0, fmt.Errorf("failed locking balance: %w", err)
+	}
+
+	time.Sleep(think)
+
+	if _, err = tx.ExecContext(ctx, `UPDATE balances SET amount = $1 WHERE id = $2`, current+amount, id); err != nil {
+		return 0, fmt.Errorf("failed updating balance: %w", err)
+	}
+
+	return 0, tx.Commit()
+}
+
+// Optimistic: no locks and no transaction while thinking, the write only succeeds if the version is still the one we read.
+// If someone got there first we read again and redo the work
+func optimisticIncrement(ctx context.Context, DB *sql.DB, id, amount int, think time.Duration) (int, error) {
+	maxAttempts := 100
+	for attempt := range maxAttempts {
+		var current, version int
+		err := DB.QueryRowContext(ctx, `SELECT amount, version FROM balances WHERE id = $1`, id).Scan(&current, &version)
+		if err != nil {
+			return attempt, fmt.Errorf("failed getting balance: %w", err)
+		}
+
+		time.Sleep(think)
+
+		res, err := DB.ExecContext(ctx, `UPDATE balances SET amount = $1, version = version + 1 WHERE id = $2 AND version = $3`, current+amount, id, version)
+		if err != nil {
+			return attempt, fmt.Errorf("failed updating balance: %w", err)
+		}
+
+		updated, err := res.RowsAffected()
+		if err != nil {
+			return attempt, fmt.Errorf("failed getting affected rows: %w", err)
+		}
+		if updated == 1 {
+			return attempt, nil
+		}
+
+		time.Sleep(time.Duration(attempt+1) * time.Millisecond) // Small backoff, everyone who lost the race would otherwise retry in lockstep
+	}
+
+	return maxAttempts, fmt.Errorf("gave up after %d attempts: %w", maxAttempts, errVersionConflict)
+}
+
+// Pessimistic, but the lock is an application level one keyed on the balance id instead of the row itself.
+// The xact variant is released on commit/rollback, so a crash can't leave it behind
+func advisoryLockIncrement(ctx context.Context, DB *sql.DB, id, amount int, think time.Duration) (int, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, id); err != nil {
+		return 0, fmt.Errorf("failed taking advisory lock: %w", err)
+	}
+
+	var current int
+	if err = tx.QueryRowContext(ctx, `SELECT amount FROM balances WHERE id = $1`, id).Scan(&current); err != nil {
+		return 0, fmt.Errorf("failed getting balance: %w", err)
+	}
+
+	time.Sleep(think)
+
+	if _, err = tx.ExecContext(ctx, `UPDATE balances SET amount = $1 WHERE id = $2`, current+amount, id); err != nil {
+		return 0, fmt.Errorf("failed updating balance: %w", err)
+	}
+
+	return 0, tx.Commit()
+}
+
+type StrategyConfig struct {
+	Workers    int
+	Increments int // Per worker
+	Amount     int
+	Think      time.Duration
+}
+
+type StrategyResult struct {
+	Name       string
+	Expected   int // What the balance should have gained from the successful increments
+	Actual     int
+	Lost       int // Increments that reported success but aren't in the balance
+	Failed     int
+	Retries    int
+	Duration   time.Duration
+	Throughput float64 // Successful increments per second
+}
+
+func StartBalanceStrategies(DB *sql.DB) {
+	cfg := StrategyConfig{Workers: 20, Increments: 10, Amount: 10, Think: 5 * time.Millisecond}
+
+	results, err := RunBalanceStrategies(DB, BalanceStrategies, cfg)
+	if err != nil {
+		log.Fatalf("failed running balance strategies: %s", err)
+		return
+	}
+
+	fmt.Printf("\n%d workers x %d increments, %v think time\n", cfg.Workers, cfg.Increments, cfg.Think)
+	fmt.Printf("%-26s %10s %10s %6s %7s %8s %10s %10s\n", "strategy", "expected", "actual", "lost", "failed", "retries", "duration", "ops/sec")
+	for _, r := range results {
+		fmt.Printf("%-26s %10d %10d %6d %7d %8d %10v %10.0f\n",
+			r.Name, r.Expected, r.Actual, r.Lost, r.Failed, r.Retries, r.Duration.Round(time.Millisecond), r.Throughput)
+	}
+}
+
+func RunBalanceStrategies(DB *sql.DB, strategies []BalanceStrategy, cfg StrategyConfig) ([]StrategyResult, error) {
+	balanceToUpdate := 2
+	ctx := context.Background()
+
+	var results []StrategyResult
+	for _, strategy := range strategies {
+		if err := StartSeed(DB); err != nil {
+			return nil, fmt.Errorf("failed seeding db: %w", err)
+		}
+
+		var start int
+		if err := DB.QueryRow(`SELECT amount FROM balances WHERE id = $1`, balanceToUpdate).Scan(&start); err != nil {
+			return nil, fmt.Errorf("failed reading start balance: %w", err)
+		}
+
+		var succeeded, failed, retries atomic.Int64
+		began := time.Now()
+
+		var wg sync.WaitGroup
+		for range cfg.Workers {
+			wg.Go(func() {
+				for range cfg.Increments {
+					r, err := strategy.Increment(ctx, DB, balanceToUpdate, cfg.Amount, cfg.Think)
+					retries.Add(int64(r))
+					if err != nil {
+						failed.Add(1)
+						continue
+					}
+					succeeded.Add(1)
+				}
+			})
+		}
+		wg.Wait()
+		elapsed := time.Since(began)
+
+		var end int
+		if err := DB.QueryRow(`SELECT amount FROM balances WHERE id = $1`, balanceToUpdate).Scan(&end); err != nil {
+			return nil, fmt.Errorf("failed reading end balance: %w", err)
+		}
+
+		expected := int(succeeded.Load()) * cfg.Amount
+		results = append(results, StrategyResult{
+			Name:       strategy.Name,
+			Expected:   expected,
+			Actual:     end - start,
+			Lost:       (expected - (end - start)) / cfg.Amount,
+			Failed:     int(failed.Load()),
+			Retries:    int(retries.Load()),
+			Duration:   elapsed,
+			Throughput: float64(succeeded.Load()) / elapsed.Seconds(),
+		})
+	}
+
+	return results, nil
+}
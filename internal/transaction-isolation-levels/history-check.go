@@ -0,0 +1,63 @@
+package transaction_isolation_levels
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+
+	"andreashoj/deeper-learnings/internal/history"
+	tx_retry "andreashoj/deeper-learnings/internal/tx-retry"
+)
+
+// Runs the concurrent increments at each isolation level while recording every read and write, then lets the history checker
+// decide whether the run was correct. At read committed it should point out the exact transactions whose updates got lost,
+// at repeatable read and serializable the conflicting ones are aborted and retried, so the history should come out clean
+func StartIncrementHistoryCheck(DB *sql.DB) {
+	balanceToUpdate := 2
+	workers := 10
+	amount := 10
+
+	for _, level := range []sql.IsolationLevel{sql.LevelReadCommitted, sql.LevelRepeatableRead, sql.LevelSerializable} {
+		if err := StartSeed(DB); err != nil {
+			log.Fatalf("failed seeding db: %s", err)
+			return
+		}
+
+		var startAmount int
+		if err := DB.QueryRow(`SELECT amount FROM balances WHERE id = $1`, balanceToUpdate).Scan(&startAmount); err != nil {
+			log.Fatalf("failed reading start balance: %s", err)
+			return
+		}
+
+		recorder := history.NewRecorder()
+		runner := tx_retry.New(DB, tx_retry.DefaultConfig())
+		ctx := context.Background()
+
+		var wg sync.WaitGroup
+		for worker := range workers {
+			wg.Go(func() {
+				name := fmt.Sprintf("increment %d by %d", balanceToUpdate, amount)
+				recorder.Run(worker, name, func(attempt func() *history.Txn) error {
+					return runner.RunInTx(ctx, &sql.TxOptions{Isolation: level}, func(tx *sql.Tx) error {
+						return incrementBalanceInTx(ctx, tx, attempt(), balanceToUpdate, amount)
+					})
+				})
+			})
+		}
+		wg.Wait()
+
+		var endAmount int
+		if err := DB.QueryRow(`SELECT amount FROM balances WHERE id = $1`, balanceToUpdate).Scan(&endAmount); err != nil {
+			log.Fatalf("failed reading end balance: %s", err)
+			return
+		}
+
+		report := history.Check(recorder.History(), history.CheckOptions{
+			Initial: map[int]int{balanceToUpdate: startAmount},
+			Final:   map[int]int{balanceToUpdate: endAmount},
+		})
+		fmt.Printf("\n%s:\n%s", level, report)
+	}
+}
@@ -0,0 +1,83 @@
+package transaction_isolation_levels
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+
+	"andreashoj/deeper-learnings/internal/chaos"
+	"andreashoj/deeper-learnings/internal/db"
+	tx_retry "andreashoj/deeper-learnings/internal/tx-retry"
+)
+
+// Runs the concurrent increments through a chaos wrapped connection, so we can see how each isolation level (and the retry)
+// behaves when the db is slow, drops connections or throws serialization failures - and replay it with the same seed
+func StartIsolationDrill(scenarioPath string) {
+	faults, err := chaos.NewInjectorFromFile(scenarioPath)
+	if err != nil {
+		log.Fatalf("failed loading chaos scenario: %s", err)
+		return
+	}
+
+	chaosDB, err := chaos.Open("postgres", db.DSN, faults)
+	if err != nil {
+		log.Fatalf("failed opening chaos db: %s", err)
+		return
+	}
+	defer chaosDB.Close()
+
+	// Seeding and verifying goes through a clean connection, we only want faults in the experiment itself
+	cleanDB, err := sql.Open("postgres", db.DSN)
+	if err != nil {
+		log.Fatalf("failed opening clean db: %s", err)
+		return
+	}
+	defer cleanDB.Close()
+
+	balanceToUpdate := 2
+	increments := 10
+	amount := 10
+
+	for _, level := range []sql.IsolationLevel{sql.LevelReadCommitted, sql.LevelRepeatableRead, sql.LevelSerializable} {
+		if err = StartSeed(cleanDB); err != nil {
+			log.Fatalf("failed seeding db: %s", err)
+			return
+		}
+
+		var startAmount int
+		if err = cleanDB.QueryRow(`SELECT amount FROM balances WHERE id = $1`, balanceToUpdate).Scan(&startAmount); err != nil {
+			log.Fatalf("failed reading start balance: %s", err)
+			return
+		}
+
+		runner := tx_retry.New(chaosDB, tx_retry.DefaultConfig())
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		failed := 0
+		for range increments {
+			wg.Go(func() {
+				if err := incrementBalanceWithRetry(runner, level, balanceToUpdate, amount); err != nil {
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			})
+		}
+		wg.Wait()
+
+		var endAmount int
+		if err = cleanDB.QueryRow(`SELECT amount FROM balances WHERE id = $1`, balanceToUpdate).Scan(&endAmount); err != nil {
+			log.Fatalf("failed reading end balance: %s", err)
+			return
+		}
+
+		// Every successful increment should be visible, anything missing is a lost update
+		expected := startAmount + (increments-failed)*amount
+		fmt.Printf("\n%s: %d/%d increments succeeded, balance %d (expected %d, lost %d updates)\n",
+			level, increments-failed, increments, endAmount, expected, (expected-endAmount)/amount)
+		fmt.Printf("%s\n", runner.Stats())
+	}
+
+	faults.Report()
+}
@@ -2,7 +2,8 @@ DROP TABLE balances;
 
 CREATE TABLE balances (
     id SERIAL PRIMARY KEY,
-    amount INTEGER NOT NULL
+    amount INTEGER NOT NULL,
+    version INTEGER NOT NULL DEFAULT 0 -- Bumped on every write by the optimistic locking strategy
 );
 
 INSERT INTO balances (amount) VALUES (10), (50), (200), (12), (220)
\ No newline at end of file
@@ -5,7 +5,11 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"sync"
 	"time"
+
+	"andreashoj/deeper-learnings/internal/history"
+	tx_retry "andreashoj/deeper-learnings/internal/tx-retry"
 )
 
 func StartTransactionIsolationLevels(DB *sql.DB) {
@@ -27,12 +31,17 @@ func StartTransactionIsolationLevels(DB *sql.DB) {
 	time.Sleep(1000 * time.Millisecond)
 	// High isolation levels here, brings awareness to the row, and sees another concurrent operation is affecting it and then locks it.
 	// By default, in postgres these operations will fail, if they try to operate on a locked row
-	go incrementBalance(DB, sql.LevelRepeatableRead, balanceToUpdate, 10) // Fails, because the row is locked from previous routine
-	go incrementBalance(DB, sql.LevelSerializable, balanceToUpdate, 10)   // Fails, because the row is locked from previous routine
+	var wg sync.WaitGroup
+	wg.Go(func() { incrementBalance(DB, sql.LevelRepeatableRead, balanceToUpdate, 10) }) // Fails, because the row is locked from previous routine
+	wg.Go(func() { incrementBalance(DB, sql.LevelSerializable, balanceToUpdate, 10) })   // Fails, because the row is locked from previous routine
 
 	// To avoid locked rows and failures on updates, implement retry logic to ensure correct data and isolation locked protected rows
-	go incrementBalanceWithRetry(DB, sql.LevelRepeatableRead, balanceToUpdate, 10, 5) // Fails, because the row is locked from previous routine
-	go incrementBalanceWithRetry(DB, sql.LevelSerializable, balanceToUpdate, 10, 5)   // Fails, because the row is locked from previous routine
+	runner := tx_retry.New(DB, tx_retry.DefaultConfig())
+	wg.Go(func() { incrementBalanceWithRetry(runner, sql.LevelRepeatableRead, balanceToUpdate, 10) })
+	wg.Go(func() { incrementBalanceWithRetry(runner, sql.LevelSerializable, balanceToUpdate, 10) })
+
+	wg.Wait()
+	fmt.Printf("Retry stats: %s\n", runner.Stats())
 }
 
 type balance struct {
@@ -42,22 +51,40 @@ type balance struct {
 
 func incrementBalance(DB *sql.DB, isolationLevel sql.IsolationLevel, id int, amount int) error {
 	ctx := context.Background()
-	newBalance := balance{Id: id}
 	tx, err := DB.BeginTx(ctx, &sql.TxOptions{
 		Isolation: isolationLevel,
 	})
-	defer tx.Rollback()
 	if err != nil {
 		fmt.Printf("failed starting transaction: %s\n", err)
 		return fmt.Errorf("failed starting transaction: %w", err)
 	}
+	defer tx.Rollback()
+
+	if err = incrementBalanceInTx(ctx, tx, nil, id, amount); err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("failed commiting transaction: %s\n", err)
+		return fmt.Errorf("failed committing comitting transaction: %w", err)
+	}
+
+	return nil
+}
+
+// The read-modify-write itself, without owning the transaction - so the retry runner can rerun it in a fresh one.
+// Reads and writes are recorded to h for the history checker, h is nil when nobody is recording
+func incrementBalanceInTx(ctx context.Context, tx *sql.Tx, h *history.Txn, id int, amount int) error {
+	newBalance := balance{Id: id}
 
 	currentBalance := 0
-	err = tx.QueryRow(`SELECT amount FROM balances WHERE id = $1`, newBalance.Id).Scan(&currentBalance)
+	err := tx.QueryRowContext(ctx, `SELECT amount FROM balances WHERE id = $1`, newBalance.Id).Scan(&currentBalance)
 	if err != nil {
 		log.Printf("failed getting updated balance: %s\n", err)
 		return fmt.Errorf("failed updating balance: %w", err)
 	}
+	h.Read(id, currentBalance)
 
 	newBalance.Amount = currentBalance + amount
 	time.Sleep(100 * time.Millisecond)
@@ -67,9 +94,10 @@ func incrementBalance(DB *sql.DB, isolationLevel sql.IsolationLevel, id int, amo
 		log.Printf("failed creating new balance: %s\n", err)
 		return fmt.Errorf("failed creating new balance: %w", err)
 	}
+	h.Write(id, newBalance.Amount)
 
 	updatedBalance := balance{}
-	err = tx.QueryRow(`SELECT id, amount FROM balances WHERE id = $1`, newBalance.Id).Scan(&updatedBalance.Id, &updatedBalance.Amount)
+	err = tx.QueryRowContext(ctx, `SELECT id, amount FROM balances WHERE id = $1`, newBalance.Id).Scan(&updatedBalance.Id, &updatedBalance.Amount)
 	if err != nil {
 		log.Printf("failed creating new balance: %s\n", err)
 		return fmt.Errorf("failed getting updated balance: %w", err)
@@ -88,25 +116,12 @@ func incrementBalance(DB *sql.DB, isolationLevel sql.IsolationLevel, id int, amo
 		fmt.Printf("DAMN, you balling! Retire now. You have %v$! \n", updatedBalance.Amount)
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		log.Printf("failed commiting transaction: %s\n", err)
-		return fmt.Errorf("failed committing comitting transaction: %w", err)
-	}
-
 	return nil
 }
 
-func incrementBalanceWithRetry(DB *sql.DB, isolationLevel sql.IsolationLevel, id int, amount int, maxRetries int) error {
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		err := incrementBalance(DB, isolationLevel, id, amount)
-		if err == nil {
-			return nil
-		}
-
-		fmt.Printf("Attempt %d failed, retrying...\n", attempt)
-		time.Sleep(time.Duration(attempt*100) * time.Millisecond) // Backoff
-	}
-
-	return fmt.Errorf("failed after %d attempts", maxRetries)
+// Retries only when postgres says the transaction lost a race (serialization failure, deadlock) - anything else won't get better by retrying
+func incrementBalanceWithRetry(runner *tx_retry.Runner, isolationLevel sql.IsolationLevel, id int, amount int) error {
+	return runner.RunInTx(context.Background(), &sql.TxOptions{Isolation: isolationLevel}, func(tx *sql.Tx) error {
+		return incrementBalanceInTx(context.Background(), tx, nil, id, amount)
+	})
 }
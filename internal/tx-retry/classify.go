@@ -0,0 +1,62 @@
+package tx_retry
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Only some errors mean "the same transaction would probably work if you ran it again".
+// A serialization failure or a deadlock victim is the db telling us exactly that, a constraint violation is the opposite -
+// running it again gives the same violation, just slower
+
+type Class string
+
+const (
+	ClassSerialization Class = "serialization"      // Postgres 40001
+	ClassDeadlock      Class = "deadlock"           // Postgres 40P01
+	ClassBusy          Class = "busy"               // SQLite BUSY/LOCKED, another connection holds the write lock
+	ClassLockNotAvail  Class = "lock not available" // Postgres 55P03, a NOWAIT lock found the row taken
+	ClassConstraint    Class = "constraint"         // Unique, foreign key, check... never retried
+	ClassCanceled      Class = "canceled"
+	ClassOther         Class = "other"
+)
+
+func (c Class) Retryable() bool {
+	return c == ClassSerialization || c == ClassDeadlock || c == ClassBusy || c == ClassLockNotAvail
+}
+
+func Classify(err error) Class {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ClassCanceled
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code == "40001":
+			return ClassSerialization
+		case pqErr.Code == "40P01":
+			return ClassDeadlock
+		case pqErr.Code == "55P03":
+			return ClassLockNotAvail
+		case pqErr.Code.Class() == "23": // integrity_constraint_violation
+			return ClassConstraint
+		}
+		return ClassOther
+	}
+
+	var liteErr sqlite3.Error
+	if errors.As(err, &liteErr) {
+		switch liteErr.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked:
+			return ClassBusy
+		case sqlite3.ErrConstraint:
+			return ClassConstraint
+		}
+	}
+
+	return ClassOther
+}
@@ -0,0 +1,229 @@
+package tx_retry
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunInTx runs fn inside a transaction and reruns the whole thing when the db says the transaction lost a race.
+// The whole transaction has to be rerun, not just the failed statement - after a serialization failure or deadlock everything
+// fn read is stale, so fn must be safe to call more than once (no side effects outside the tx)
+
+var ErrBudgetExhausted = errors.New("retry budget exhausted")
+
+type Config struct {
+	MaxAttempts int           // Including the first one
+	BaseDelay   time.Duration // Backoff before the first retry, doubled for every retry after that
+	MaxDelay    time.Duration
+	Budget      *Budget // Shared between calls, nil means only MaxAttempts limits retries
+}
+
+// Every call gets its own budget, shared by all calls of the runner made from it - one experiment's retries
+// don't drain another's. Runners that should dry up together get the same *Budget set explicitly
+func DefaultConfig() Config {
+	return Config{
+		MaxAttempts: 5,
+		BaseDelay:   10 * time.Millisecond,
+		MaxDelay:    500 * time.Millisecond,
+		Budget:      NewBudget(50, 0.2),
+	}
+}
+
+type Runner struct {
+	DB  *sql.DB
+	cfg Config
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+type Stats struct {
+	Calls             int
+	Succeeded         int
+	Failed            int
+	Attempts          map[int]int   // Attempts a call took -> number of calls
+	Retries           map[Class]int // Why we retried
+	GaveUp            map[Class]int // Why a call failed in the end
+	BudgetExhausted   int
+	BudgetExhaustedBy map[Class]int // What the retry the budget refused was for - these calls aren't in GaveUp
+}
+
+func New(DB *sql.DB, cfg Config) *Runner {
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+
+	return &Runner{
+		DB:  DB,
+		cfg: cfg,
+		stats: Stats{
+			Attempts:          make(map[int]int),
+			Retries:           make(map[Class]int),
+			GaveUp:            make(map[Class]int),
+			BudgetExhaustedBy: make(map[Class]int),
+		},
+	}
+}
+
+func (r *Runner) RunInTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	attempt := 0
+	for {
+		attempt++
+		err := r.runOnce(ctx, opts, fn)
+		if err == nil {
+			r.record(attempt, nil, "")
+			r.cfg.Budget.deposit()
+			return nil
+		}
+
+		class := Classify(err)
+		if !class.Retryable() || attempt >= r.cfg.MaxAttempts {
+			r.record(attempt, err, class)
+			return fmt.Errorf("transaction failed after %d attempts (%s): %w", attempt, class, err)
+		}
+
+		if !r.cfg.Budget.withdraw() {
+			r.record(attempt, ErrBudgetExhausted, class)
+			return fmt.Errorf("transaction failed after %d attempts (%s): %w: %w", attempt, class, ErrBudgetExhausted, err)
+		}
+
+		r.mu.Lock()
+		r.stats.Retries[class]++
+		r.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			r.record(attempt, ctx.Err(), ClassCanceled)
+			return fmt.Errorf("transaction failed after %d attempts: %w", attempt, ctx.Err())
+		case <-time.After(r.backoff(attempt)):
+		}
+	}
+}
+
+func (r *Runner) runOnce(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	tx, err := r.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// Exponential backoff with full jitter - sleeping a random time up to the cap spreads the retries out,
+// otherwise the transactions that just collided wake up together and collide again
+func (r *Runner) backoff(attempt int) time.Duration {
+	ceiling := r.cfg.BaseDelay << (attempt - 1)
+	if ceiling > r.cfg.MaxDelay || ceiling <= 0 {
+		ceiling = r.cfg.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return rand.N(ceiling)
+}
+
+func (r *Runner) record(attempts int, err error, class Class) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stats.Calls++
+	r.stats.Attempts[attempts]++
+	switch {
+	case err == nil:
+		r.stats.Succeeded++
+	case errors.Is(err, ErrBudgetExhausted):
+		r.stats.Failed++
+		r.stats.BudgetExhausted++
+		r.stats.BudgetExhaustedBy[class]++
+	default:
+		r.stats.Failed++
+		r.stats.GaveUp[class]++
+	}
+}
+
+func (r *Runner) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.stats
+	s.Attempts = maps.Clone(r.stats.Attempts)
+	s.Retries = maps.Clone(r.stats.Retries)
+	s.GaveUp = maps.Clone(r.stats.GaveUp)
+	s.BudgetExhaustedBy = maps.Clone(r.stats.BudgetExhaustedBy)
+
+	return s
+}
+
+func (s Stats) String() string {
+	var attempts []int
+	for n := range s.Attempts {
+		attempts = append(attempts, n)
+	}
+	sort.Ints(attempts)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "calls=%d succeeded=%d failed=%d budget_exhausted=%d\n", s.Calls, s.Succeeded, s.Failed, s.BudgetExhausted)
+	for _, n := range attempts {
+		fmt.Fprintf(&sb, "  %d attempt(s): %d calls\n", n, s.Attempts[n])
+	}
+	fmt.Fprintf(&sb, "  retried: %v\n  gave up: %v\n  budget exhausted by: %v", s.Retries, s.GaveUp, s.BudgetExhaustedBy)
+
+	return sb.String()
+}
+
+// Budget caps retries across all calls sharing it. Every retry spends a token and every success earns back a fraction of one,
+// so when the db is struggling and most calls fail the retries dry up, instead of multiplying the load exactly when it hurts most
+type Budget struct {
+	mu     sync.Mutex
+	tokens float64
+	max    float64
+	refill float64
+}
+
+func NewBudget(max int, refillPerSuccess float64) *Budget {
+	return &Budget{tokens: float64(max), max: float64(max), refill: refillPerSuccess}
+}
+
+func (b *Budget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *Budget) deposit() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.max, b.tokens+b.refill)
+}